@@ -0,0 +1,119 @@
+package check
+
+import (
+	"fmt"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/nas"
+	"m3u8-downloader/pkg/processing"
+)
+
+// Result is the outcome of a single preflight check
+type Result struct {
+	Name    string
+	Passed  bool
+	Skipped bool
+	Detail  string
+}
+
+// RunChecks validates the resolved configuration without starting any
+// services. NAS and FFmpeg checks are skipped when their feature is disabled.
+func RunChecks(cfg *config.Config) []Result {
+	var results []Result
+
+	if cfg.NAS.EnableTransfer {
+		results = append(results, checkNAS(cfg))
+	} else {
+		results = append(results, Result{Name: "NAS connection", Skipped: true, Detail: "transfer disabled"})
+	}
+
+	if cfg.Processing.Enabled {
+		results = append(results, checkFFmpeg(cfg))
+	} else {
+		results = append(results, Result{Name: "FFmpeg", Skipped: true, Detail: "processing disabled"})
+	}
+
+	return results
+}
+
+func checkNAS(cfg *config.Config) Result {
+	// Built directly rather than via NewNASService, which exits on failure
+	nasService := &nas.NASService{
+		Config: nas.NASConfig{
+			Path:       cfg.NAS.OutputPath,
+			Username:   cfg.NAS.Username,
+			Password:   cfg.NAS.Password,
+			Timeout:    cfg.NAS.Timeout,
+			MountPoint: cfg.NAS.MountPoint,
+		},
+	}
+
+	if err := nasService.EstablishConnection(); err != nil {
+		return Result{Name: "NAS connection", Detail: err.Error()}
+	}
+	defer nasService.Disconnect()
+	if err := nasService.TestConnection(); err != nil {
+		return Result{Name: "NAS connection", Detail: err.Error()}
+	}
+	return Result{Name: "NAS connection", Passed: true, Detail: cfg.NAS.OutputPath}
+}
+
+func checkFFmpeg(cfg *config.Config) Result {
+	path, err := processing.FindFFmpeg(cfg.Processing.FFmpegPath)
+	if err != nil {
+		return Result{Name: "FFmpeg", Detail: err.Error()}
+	}
+	if err := processing.ValidateFFmpegExtraArgs(cfg.Processing.FFmpegExtraArgs); err != nil {
+		return Result{Name: "FFmpeg", Detail: err.Error()}
+	}
+	return Result{Name: "FFmpeg", Passed: true, Detail: path}
+}
+
+// AllPassed reports whether no check failed
+func AllPassed(results []Result) bool {
+	for _, r := range results {
+		if !r.Passed && !r.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// Run loads the configuration, runs every check, prints a report, and returns
+// the process exit code.
+func Run() int {
+	fmt.Println("Configuration check")
+	fmt.Println("===================")
+
+	cfg, err := constants.GetConfig()
+	if err != nil {
+		fmt.Printf("✗ Configuration: %v\n", err)
+		return 1
+	}
+	fmt.Println("✓ Configuration loaded")
+	fmt.Printf("  Local output:     %s\n", cfg.Paths.LocalOutput)
+	fmt.Printf("  Process output:   %s\n", cfg.Paths.ProcessOutput)
+	fmt.Printf("  Manifest dir:     %s\n", cfg.Paths.ManifestDir)
+	fmt.Printf("  Persistence file: %s\n", cfg.Paths.PersistenceFile)
+	fmt.Printf("  NAS transfer:     %v (%s)\n", cfg.NAS.EnableTransfer, cfg.NAS.OutputPath)
+	fmt.Printf("  Processing:       %v (%s)\n", cfg.Processing.Enabled, cfg.Processing.FFmpegPath)
+
+	results := RunChecks(cfg)
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			fmt.Printf("- %s: skipped (%s)\n", r.Name, r.Detail)
+		case r.Passed:
+			fmt.Printf("✓ %s: %s\n", r.Name, r.Detail)
+		default:
+			fmt.Printf("✗ %s: %s\n", r.Name, r.Detail)
+		}
+	}
+
+	if !AllPassed(results) {
+		fmt.Println("Check FAILED")
+		return 1
+	}
+	fmt.Println("All checks passed")
+	return 0
+}
@@ -0,0 +1,75 @@
+package check
+
+import (
+	"m3u8-downloader/pkg/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunChecks_MissingFFmpegAndBadNAS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "check_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := &config.Config{
+		NAS: config.NASConfig{
+			EnableTransfer: true,
+			OutputPath:     filepath.Join(tempDir, "does", "not", "exist"),
+		},
+		Processing: config.ProcessingConfig{
+			Enabled:    true,
+			FFmpegPath: "definitely-not-a-real-ffmpeg-binary",
+		},
+	}
+
+	results := RunChecks(cfg)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Passed || r.Skipped {
+			t.Errorf("Expected %s check to fail, got passed=%v skipped=%v", r.Name, r.Passed, r.Skipped)
+		}
+	}
+	if AllPassed(results) {
+		t.Error("AllPassed() should be false when checks fail")
+	}
+}
+
+func TestRunChecks_DisabledFeaturesSkipped(t *testing.T) {
+	cfg := &config.Config{
+		NAS:        config.NASConfig{EnableTransfer: false},
+		Processing: config.ProcessingConfig{Enabled: false},
+	}
+
+	results := RunChecks(cfg)
+	for _, r := range results {
+		if !r.Skipped {
+			t.Errorf("Expected %s check to be skipped", r.Name)
+		}
+	}
+	if !AllPassed(results) {
+		t.Error("AllPassed() should be true when every check is skipped")
+	}
+}
+
+func TestRunChecks_ReachableNAS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "check_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := &config.Config{
+		NAS:        config.NASConfig{EnableTransfer: true, OutputPath: tempDir},
+		Processing: config.ProcessingConfig{Enabled: false},
+	}
+
+	results := RunChecks(cfg)
+	if !results[0].Passed {
+		t.Errorf("Expected NAS check to pass for writable directory: %s", results[0].Detail)
+	}
+}
@@ -2,46 +2,352 @@ package downloader
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"m3u8-downloader/pkg/config"
 	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/httpClient"
 	"m3u8-downloader/pkg/media"
 	"m3u8-downloader/pkg/transfer"
 	"m3u8-downloader/pkg/utils"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 )
 
-func Download(masterURL string, eventName string, debug bool) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Options holds per-invocation settings from the command line
+type Options struct {
+	// Debug only downloads one variant for easier testing, the tallest no
+	// taller than DebugResolution
+	Debug           bool
+	DebugResolution int
+	// DownloadOnly forces NAS transfer and processing off for this run
+	DownloadOnly bool
+	// MaxVariants caps how many variants are downloaded, highest bandwidth
+	// first; 0 means all
+	MaxVariants int
+	// MaxResolution skips variants taller than this height (e.g. 720); 0
+	// means no limit
+	MaxResolution int
+	// StartOffset and Duration capture only part of the event, from the
+	// segment covering StartOffset for Duration; 0 means from the start and
+	// to the end
+	StartOffset time.Duration
+	Duration    time.Duration
+}
+
+func (o Options) transferEnabled(cfg *config.Config) bool {
+	return cfg.NAS.EnableTransfer && !o.DownloadOnly
+}
+
+// newTransferService creates the run's transfer service; tests replace it
+var newTransferService = transfer.NewTrasferService
+
+// handleShutdownSignals runs the two-phase stop. The first signal stops
+// polling for new segments so in-flight downloads and queued transfers can
+// finish; a second signal, or drainTimeout elapsing, forces an immediate stop.
+// It returns early if done is closed first.
+func handleShutdownSignals(signals <-chan os.Signal, done <-chan struct{}, stopPolling, force context.CancelFunc, drainTimeout time.Duration) {
+	select {
+	case <-done:
+		return
+	case <-signals:
+	}
+	log.Printf("Shutting down: finishing in-flight downloads and transfers (up to %v, interrupt again to stop now)...", drainTimeout)
+	stopPolling()
+
+	deadline := time.NewTimer(drainTimeout)
+	defer deadline.Stop()
+	select {
+	case <-done:
+		return
+	case <-signals:
+		log.Println("Second interrupt, stopping immediately...")
+	case <-deadline.C:
+		log.Println("Drain deadline reached, stopping immediately...")
+	}
+	force()
+}
+
+// variantGroup runs variant downloaders. A fatal error stops only the variant
+// that hit it, such as one whose playlist is gone, unless it was the last
+// video variant running; then the whole group stops with that error. Subtitle
+// renditions never stop the group. Transient errors are the downloader's to
+// retry. Downloaders can be added while Wait is blocking, as the master
+// playlist refresher does, until the last one returns; after that the group
+// is finished and Go starts nothing.
+type variantGroup struct {
+	stop context.CancelFunc
+
+	mu       sync.Mutex
+	idle     *sync.Cond // signalled when running drops to zero
+	running  int
+	videos   int                    // video variants running that haven't been removed
+	runs     map[string]*variantRun // by variant URL, for Remove
+	finished bool
+	err      error
+}
+
+// variantRun is one downloader started by variantGroup.Go
+type variantRun struct {
+	cancel    context.CancelFunc
+	subtitles bool
+	removed   bool // left the master playlist
+}
+
+// Go starts run for variant in its own goroutine and reports whether it did,
+// which it doesn't once the group has finished. run is given a context from
+// ctx that Remove cancels. Starting a video variant stops any removed one
+// that Remove kept polling.
+func (g *variantGroup) Go(ctx context.Context, variant *media.StreamVariant, run func(ctx context.Context) error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.finished {
+		return false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if g.runs == nil {
+		g.runs = make(map[string]*variantRun)
+	}
+	r := &variantRun{cancel: cancel, subtitles: variant.Subtitles}
+	g.running++
+	if !r.subtitles {
+		for _, other := range g.runs {
+			if other.removed && !other.subtitles {
+				other.cancel()
+			}
+		}
+		g.videos++
+	}
+	// A variant that comes back may still be finishing its old segments
+	g.runs[variant.URL] = r
 
-	// Goroutine to listen for shutdown signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-sigChan
-		log.Println("Shutting down...")
+		err := run(ctx)
 		cancel()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.runs[variant.URL] == r {
+			delete(g.runs, variant.URL)
+		}
+		if !r.subtitles && !r.removed {
+			g.videos--
+		}
+		if media.IsFatal(err) {
+			switch {
+			case variant.Subtitles:
+				log.Printf("Subtitle rendition stopped, video variants continue: %v", err)
+			case g.videos > 0:
+				log.Printf("Variant stopped, %d other variants continue: %v", g.videos, err)
+			case g.err == nil:
+				log.Printf("Fatal error on the last variant, stopping: %v", err)
+				g.err = err
+				g.stop()
+			}
+		}
+		g.running--
+		if g.running == 0 && g.idle != nil {
+			g.idle.Broadcast()
+		}
 	}()
+	return true
+}
 
+// Remove stops polling variant, which left the master playlist, letting its
+// in-flight segments finish, and reports whether it was running. The last
+// video variant is kept polling until Go starts another, so a master
+// playlist that briefly lists none of the variants being downloaded doesn't
+// leave only subtitles running.
+func (g *variantGroup) Remove(variant *media.StreamVariant) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, ok := g.runs[variant.URL]
+	if !ok || r.removed {
+		return false
+	}
+	r.removed = true
+	if !r.subtitles {
+		g.videos--
+		if g.videos == 0 {
+			log.Printf("%s variant left the master playlist, still polling it until another video variant starts", variant.Resolution)
+			return true
+		}
+	}
+	log.Printf("Stopping %s variant, it left the master playlist", variant.Resolution)
+	r.cancel()
+	return true
+}
+
+// Videos returns how many video variants are being downloaded, not counting
+// ones that left the master playlist
+func (g *variantGroup) Videos() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.videos
+}
+
+// Wait blocks until every downloader, including any added while it waits,
+// has returned, then finishes the group. It reports the fatal error that
+// stopped the group, if any.
+func (g *variantGroup) Wait() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.idle == nil {
+		g.idle = sync.NewCond(&g.mu)
+	}
+	for g.running > 0 {
+		g.idle.Wait()
+	}
+	g.finished = true
+	return g.err
+}
+
+// prepareEventDir applies the existing-data policy to the event directory and
+// makes sure it exists. append keeps what is there, clean empties it, and
+// abort refuses to start if it has anything in it.
+func prepareEventDir(eventPath string, policy string) error {
+	entries, err := os.ReadDir(eventPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read event directory: %w", err)
+	}
+
+	if len(entries) > 0 {
+		switch policy {
+		case config.ExistingDataAbort:
+			return fmt.Errorf("event directory %s already has %d entries (existing data policy is %q)", eventPath, len(entries), policy)
+		case config.ExistingDataClean:
+			log.Printf("Removing %d existing entries from %s", len(entries), eventPath)
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(eventPath, entry.Name())); err != nil {
+					return fmt.Errorf("failed to clean event directory: %w", err)
+				}
+			}
+		default:
+			log.Printf("Event directory %s has existing data, new segments will be added alongside it", eventPath)
+		}
+	}
+
+	return utils.EnsureDir(eventPath)
+}
+
+// Download records the event from masterURL until every variant finishes or
+// the run is interrupted. A variant that fails fatally, or disappears from
+// the master playlist, stops on its own while the others continue, and one
+// that reappears in the master playlist is started again. If the
+// last video variant fails fatally the run shuts down as usual and that
+// error is returned.
+func Download(masterURL string, eventName string, opts Options) error {
 	cfg := constants.MustGetConfig()
+	started := time.Now()
+
+	if eventName == "" {
+		eventName = DefaultEventName(masterURL, cfg.Core.EventNamePattern, started)
+		log.Printf("No -event given, using event name %q from the playlist URL", eventName)
+	}
+
+	// forceCtx ends everything; ctx only ends polling for new segments
+	forceCtx, force := context.WithCancel(context.Background())
+	defer force()
+	ctx, stopPolling := context.WithCancel(forceCtx)
+	defer stopPolling()
+
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go handleShutdownSignals(sigChan, forceCtx.Done(), stopPolling, force, cfg.Core.DrainTimeout)
+
+	lock, err := utils.AcquireLock(cfg.GetEventLockPath(eventName))
+	if err != nil {
+		return fmt.Errorf("cannot start download for event %q: %w", eventName, err)
+	}
+	defer lock.Release()
+
+	eventPath := cfg.GetEventPath(eventName)
+	if err := prepareEventDir(eventPath, cfg.Core.ExistingData); err != nil {
+		return fmt.Errorf("cannot start download for event %q: %w", eventName, err)
+	}
+
+	client, err := httpClient.NewClient(httpClient.ClientOptions{
+		ProxyURL:           cfg.HTTP.ProxyURL,
+		InsecureSkipVerify: cfg.HTTP.InsecureSkipVerify,
+		CABundlePath:       cfg.HTTP.CABundlePath,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP client: %w", err)
+	}
+	httpClient.SetDefault(client)
+	if cfg.HTTP.ProxyURL != "" {
+		log.Printf("Routing HTTP requests through proxy %s", cfg.HTTP.ProxyURL)
+	}
+
+	// Variants are chosen before any service starts, so a bad URL or
+	// selection returns without anything to shut down
+	manifestWriter := media.NewManifestWriter(eventName)
+
+	refresher := media.NewMasterRefresher(masterURL, eventPath, manifestWriter, cfg.Core.MasterRefreshDelay)
+	variants, _, err := refresher.Refresh()
+	if err != nil {
+		return fmt.Errorf("failed to get variants: %w", err)
+	}
+	log.Printf("Found %d variants", len(variants))
+
+	if opts.MaxVariants > 0 || opts.MaxResolution > 0 {
+		variants = media.SelectVariants(variants, opts.MaxVariants, opts.MaxResolution)
+		log.Printf("Selected %d variants (max variants: %d, max resolution: %d)", len(variants), opts.MaxVariants, opts.MaxResolution)
+	}
+
+	debugResolution := ""
+	if opts.Debug {
+		v := media.SelectVariant(variants, opts.DebugResolution)
+		if v == nil {
+			return fmt.Errorf("no variant at or below %dp for debug mode", opts.DebugResolution)
+		}
+		debugResolution = v.Resolution
+		log.Printf("Debug mode: downloading only the %s variant", debugResolution)
+	}
+
+	downloadOpts := media.DownloadOptions{
+		SegmentLimiter: utils.NewRateLimiter(cfg.Core.SegmentsPerSecond, 1),
+		CaptureRange:   media.CaptureRange{Start: opts.StartOffset, Duration: opts.Duration},
+	}
+	if cfg.Core.SegmentsPerSecond > 0 {
+		log.Printf("Limiting segment downloads to %.2f per second", cfg.Core.SegmentsPerSecond)
+	}
+	if !downloadOpts.CaptureRange.IsZero() {
+		log.Printf("Capturing from %v for %v", opts.StartOffset, opts.Duration)
+	}
+	if cfg.Core.MinFreeInodes > 0 {
+		downloadOpts.InodeGuard = media.NewInodeGuard(eventPath, cfg.Core.MinFreeInodes)
+		log.Printf("Pausing segment downloads below %d free inodes", cfg.Core.MinFreeInodes)
+	}
+	if cfg.HTTP.CacheWarmerURL != "" {
+		downloadOpts.CacheWarmer = media.NewCacheWarmer(cfg.HTTP.CacheWarmerURL, cfg.HTTP.CacheWarmerMethod, client)
+		log.Printf("Warming cache at %s for each downloaded segment", cfg.HTTP.CacheWarmerURL)
+	}
 
 	var wg sync.WaitGroup
+	group := &variantGroup{stop: stopPolling}
 	var transferService *transfer.TransferService
-	if cfg.NAS.EnableTransfer {
-		ts, err := transfer.NewTrasferService(cfg.NAS.OutputPath, eventName)
+	if opts.DownloadOnly {
+		log.Println("Download-only mode: NAS transfer and processing disabled for this run")
+	}
+
+	if opts.transferEnabled(cfg) {
+		ts, err := newTransferService(cfg.NAS.OutputPath, eventName)
 		if err != nil {
 			log.Printf("Failed to create transfer service: %v", err)
 			log.Println("Continuing without transfer service...")
 		} else {
 			transferService = ts
+			transferService.SetCaptureStart(started)
+			go transferService.HandlePauseSignal(forceCtx)
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if err := transferService.Start(ctx); err != nil && err != context.Canceled {
+				if err := transferService.Start(forceCtx); err != nil && err != context.Canceled {
 					log.Printf("Transfer service error: %v", err)
 				}
 			}()
@@ -49,39 +355,101 @@ func Download(masterURL string, eventName string, debug bool) {
 		}
 	}
 
-	manifestWriter := media.NewManifestWriter(eventName)
-
-	eventPath := cfg.GetEventPath(eventName)
-	if err := utils.EnsureDir(eventPath); err != nil {
-		log.Fatalf("Failed to create event directory: %v", err)
+	if cfg.Core.RollingSegments > 0 {
+		// Segments headed for the NAS stay until they are on it
+		var canEvict func(path string) bool
+		if transferService != nil {
+			canEvict = func(path string) bool {
+				status, ok := transferService.Status(path)
+				return ok && status == transfer.StatusCompleted
+			}
+		}
+		downloadOpts.RollingWindow = media.NewRollingWindow(cfg.Core.RollingSegments, canEvict)
+		log.Printf("Keeping the newest %d segments per resolution on disk", cfg.Core.RollingSegments)
 	}
 
-	variants, err := media.GetAllVariants(masterURL, eventPath, manifestWriter)
-	if err != nil {
-		log.Fatalf("Failed to get variants: %v", err)
+	sem := make(chan struct{}, constants.WorkerCount*len(variants))
+
+	stats := media.NewDownloadStats()
+
+	statsCtx, stopStats := context.WithCancel(ctx)
+	defer stopStats()
+	go stats.ReportStats(statsCtx, 30*time.Second)
+	if cfg.Core.AdaptiveErrorRate > 0 {
+		downloadOpts.Adaptive = media.NewAdaptiveConcurrency(sem, cfg.Core.AdaptiveErrorRate)
+		go downloadOpts.Adaptive.Run(statsCtx)
+	}
+	if cfg.Core.HealthInterval > 0 {
+		go stats.ReportHealth(statsCtx, cfg.Core.HealthInterval)
 	}
-	log.Printf("Found %d variants", len(variants))
 
-	sem := make(chan struct{}, constants.WorkerCount*len(variants))
+	var segmentIndex *media.SegmentIndex
+	if cfg.Core.WriteIndex {
+		segmentIndex = media.NewSegmentIndex(cfg.GetIndexPath(eventName))
+		downloadOpts.SegmentIndex = segmentIndex
+		go segmentIndex.Run(statsCtx)
+	}
 
-	manifest := media.NewManifestWriter(eventName)
+	startVariant := func(variant *media.StreamVariant) {
+		// Debug mode only tracks one variant for easier debugging, plus any
+		// subtitle renditions
+		if opts.Debug && !variant.Subtitles && variant.Resolution != debugResolution {
+			return
+		}
+		// Variants found by the refresher are held to the same limits
+		if opts.MaxResolution > 0 && media.ResolutionHeight(variant.Resolution) > opts.MaxResolution {
+			log.Printf("Skipping %s variant above max resolution %d", variant.Resolution, opts.MaxResolution)
+			return
+		}
+		// Subtitle renditions don't count toward MaxVariants
+		if running := group.Videos(); !variant.Subtitles && opts.MaxVariants > 0 && running >= opts.MaxVariants {
+			log.Printf("Skipping %s variant, already downloading %d variants", variant.Resolution, running)
+			return
+		}
+		started := group.Go(ctx, variant, func(pollCtx context.Context) error {
+			return media.VariantDownloader(pollCtx, forceCtx, variant, sem, manifestWriter, stats, downloadOpts)
+		})
+		if !started {
+			log.Printf("Not starting %s variant, every other variant has finished", variant.Resolution)
+		}
+	}
 
 	for _, variant := range variants {
-		// Debug mode only tracks one variant for easier debugging
-		if debug {
-			if variant.Resolution != "1080p" {
-				continue
-			}
-		}
-		wg.Add(1)
-		go func(v *media.StreamVariant) {
-			defer wg.Done()
-			media.VariantDownloader(ctx, v, sem, manifest)
-		}(variant)
+		startVariant(variant)
 	}
 
+	// Keep watching the master playlist for variants that appear or go away
+	// mid-event until every variant downloader has finished. A variant found
+	// after that is turned away by the group, so nothing writes to the
+	// manifest once it is closed.
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	refreshDone := make(chan struct{})
+	go func() {
+		defer close(refreshDone)
+		refresher.Run(refreshCtx, startVariant, func(variant *media.StreamVariant) {
+			group.Remove(variant)
+		})
+	}()
+
+	fatalErr := group.Wait()
+	stopRefresh()
+	<-refreshDone
+
+	// Let the watcher and queue hand off the last segments before stopping
+	if transferService != nil {
+		log.Println("Waiting for queued transfers to finish...")
+		if err := transferService.WaitIdle(forceCtx); err != nil {
+			log.Printf("Stopped before all transfers finished: %v", err)
+		}
+	}
+	force()
 	wg.Wait()
 	log.Println("All variant downloaders finished.")
+	stopStats()
+	log.Printf("Download Stats: %s", stats.Summary())
+	if captured := stats.CapturedSummary(); captured != "" {
+		log.Printf("Captured Duration: %s", captured)
+	}
 
 	if transferService != nil {
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -91,6 +459,37 @@ func Download(masterURL string, eventName string, debug bool) {
 
 	log.Println("All Services shut down.")
 
-	manifestWriter.WriteManifest()
-	log.Println("Manifest written.")
+	if err := manifestWriter.Close(); err != nil {
+		log.Printf("Failed to write manifest: %v", err)
+	} else {
+		log.Println("Manifest written.")
+	}
+
+	if segmentIndex != nil {
+		if err := segmentIndex.Flush(); err != nil {
+			log.Printf("Failed to write segment index: %v", err)
+		} else {
+			log.Println("Segment index written.")
+		}
+	}
+
+	if cfg.Core.WriteReport {
+		report := stats.Report(eventName, masterURL, started, time.Now())
+		report.Outputs["segments"] = eventPath
+		report.Outputs["manifest"] = cfg.GetManifestPath(eventName)
+		if segmentIndex != nil {
+			report.Outputs["index"] = cfg.GetIndexPath(eventName)
+		}
+		if transferService != nil {
+			report.Outputs["nas"] = filepath.Join(cfg.NAS.OutputPath, cfg.GetNASEventDir(eventName, started))
+		}
+		reportPath := cfg.GetReportPath(eventName)
+		if err := report.Write(reportPath); err != nil {
+			log.Printf("Failed to write capture report: %v", err)
+		} else {
+			log.Printf("Capture report written to %s", reportPath)
+		}
+	}
+
+	return fatalErr
 }
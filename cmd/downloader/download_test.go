@@ -0,0 +1,695 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/media"
+	"m3u8-downloader/pkg/transfer"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOptions_TransferEnabled(t *testing.T) {
+	tests := []struct {
+		name         string
+		nasEnabled   bool
+		downloadOnly bool
+		want         bool
+	}{
+		{name: "transfer enabled in config", nasEnabled: true, downloadOnly: false, want: true},
+		{name: "download-only overrides config", nasEnabled: true, downloadOnly: true, want: false},
+		{name: "transfer disabled in config", nasEnabled: false, downloadOnly: false, want: false},
+		{name: "both disabled", nasEnabled: false, downloadOnly: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{NAS: config.NASConfig{EnableTransfer: tt.nasEnabled}}
+			opts := Options{DownloadOnly: tt.downloadOnly}
+			if got := opts.transferEnabled(cfg); got != tt.want {
+				t.Errorf("transferEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownload_DownloadOnlyWiring(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "download_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldPaths, oldTransfer, oldDelay := cfg.Paths, cfg.NAS.EnableTransfer, cfg.Core.RefreshDelay
+	cfg.Paths.BaseDir = tempDir
+	cfg.Paths.LocalOutput = filepath.Join(tempDir, "data")
+	cfg.Paths.ManifestDir = filepath.Join(tempDir, "manifests")
+	cfg.Paths.ProcessOutput = filepath.Join(tempDir, "out")
+	cfg.NAS.EnableTransfer = true
+	cfg.Core.RefreshDelay = 50 * time.Millisecond
+	oldConstructor := newTransferService
+	t.Cleanup(func() {
+		cfg.Paths, cfg.NAS.EnableTransfer, cfg.Core.RefreshDelay = oldPaths, oldTransfer, oldDelay
+		newTransferService = oldConstructor
+	})
+
+	var created int32
+	newTransferService = func(outputDir, eventName string) (*transfer.TransferService, error) {
+		atomic.AddInt32(&created, 1)
+		return nil, errors.New("transfer disabled in test")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720\n720/chunklist.m3u8\n")
+	})
+	mux.HandleFunc("/720/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:6.0,\nmedia_0001.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/720/media_0001.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		downloadOnly bool
+		wantCreated  int32
+	}{
+		{name: "transfer enabled", downloadOnly: false, wantCreated: 1},
+		{name: "download-only", downloadOnly: true, wantCreated: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&created, 0)
+			eventName := "wiring-" + filepath.Base(t.Name())
+			if err := Download(server.URL+"/master.m3u8", eventName, Options{DownloadOnly: tt.downloadOnly}); err != nil {
+				t.Fatalf("Download() failed: %v", err)
+			}
+
+			if got := atomic.LoadInt32(&created); got != tt.wantCreated {
+				t.Errorf("Expected %d transfer services created, got %d", tt.wantCreated, got)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.GetEventPath(eventName), "720p", "media_0001.ts")); err != nil {
+				t.Errorf("Expected the segment to be downloaded: %v", err)
+			}
+			// Processing only runs in -process mode, never from a download
+			if entries, _ := os.ReadDir(cfg.Paths.ProcessOutput); len(entries) != 0 {
+				t.Errorf("Expected no processing output, got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestDownload_VariantLeavesAndComesBack(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "download_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldPaths, oldDelay, oldMasterDelay := cfg.Paths, cfg.Core.RefreshDelay, cfg.Core.MasterRefreshDelay
+	cfg.Paths.BaseDir = tempDir
+	cfg.Paths.LocalOutput = filepath.Join(tempDir, "data")
+	cfg.Paths.ManifestDir = filepath.Join(tempDir, "manifests")
+	cfg.Paths.ProcessOutput = filepath.Join(tempDir, "out")
+	cfg.Core.RefreshDelay = 20 * time.Millisecond
+	cfg.Core.MasterRefreshDelay = 50 * time.Millisecond
+	t.Cleanup(func() {
+		cfg.Paths, cfg.Core.RefreshDelay, cfg.Core.MasterRefreshDelay = oldPaths, oldDelay, oldMasterDelay
+	})
+
+	// The second master fetch drops 720p; later ones list it again, and
+	// only then does its playlist gain a second segment and end
+	var masterFetches, backfilled atomic.Int32
+	const variant1080 = "#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1920x1080\n1080/chunklist.m3u8\n"
+	const variant720 = "#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720\n720/chunklist.m3u8\n"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		if masterFetches.Add(1) == 2 {
+			fmt.Fprint(w, "#EXTM3U\n"+variant1080)
+			return
+		}
+		fmt.Fprint(w, "#EXTM3U\n"+variant1080+variant720)
+	})
+	mux.HandleFunc("/720/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:6.0,\nmedia_0001.ts\n"
+		if masterFetches.Load() >= 3 {
+			playlist += "#EXTINF:6.0,\nmedia_0002.ts\n#EXT-X-ENDLIST\n"
+		}
+		fmt.Fprint(w, playlist)
+	})
+	mux.HandleFunc("/720/media_0002.ts", func(w http.ResponseWriter, r *http.Request) {
+		backfilled.Store(1)
+		w.Write([]byte("segment"))
+	})
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:6.0,\nmedia_0001.ts\n"
+		if backfilled.Load() == 1 {
+			playlist += "#EXT-X-ENDLIST\n"
+		}
+		fmt.Fprint(w, playlist)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Download(server.URL+"/master.m3u8", "comeback", Options{DownloadOnly: true})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download() failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download did not finish; the variant that came back was never restarted")
+	}
+
+	if _, err := os.Stat(filepath.Join(cfg.GetEventPath("comeback"), "720p", "media_0002.ts")); err != nil {
+		t.Errorf("Expected the 720p variant to resume after coming back: %v", err)
+	}
+}
+
+func TestDownload_ReturnsStartupErrors(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "download_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldPaths := cfg.Paths
+	cfg.Paths.BaseDir = tempDir
+	cfg.Paths.LocalOutput = filepath.Join(tempDir, "data")
+	cfg.Paths.ManifestDir = filepath.Join(tempDir, "manifests")
+	t.Cleanup(func() { cfg.Paths = oldPaths })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720\n720/chunklist.m3u8\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		opts Options
+	}{
+		{name: "missing master playlist", url: server.URL + "/gone.m3u8", opts: Options{DownloadOnly: true}},
+		{name: "no debug variant", url: server.URL + "/master.m3u8", opts: Options{DownloadOnly: true, Debug: true, DebugResolution: 480}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Returned rather than exiting, and the event lock is released
+			// for the next attempt
+			eventName := "startup-" + filepath.Base(t.Name())
+			for i := 0; i < 2; i++ {
+				if err := Download(tt.url, eventName, tt.opts); err == nil {
+					t.Fatal("Expected Download() to return an error")
+				}
+			}
+		})
+	}
+}
+
+// shutdownHarness runs handleShutdownSignals against a fake signal channel
+type shutdownHarness struct {
+	signals chan os.Signal
+	pollCtx context.Context
+	force   context.Context
+	done    chan struct{}
+}
+
+func newShutdownHarness(t *testing.T, drainTimeout time.Duration) *shutdownHarness {
+	t.Helper()
+	forceCtx, force := context.WithCancel(context.Background())
+	pollCtx, stopPolling := context.WithCancel(forceCtx)
+	t.Cleanup(force)
+
+	h := &shutdownHarness{
+		signals: make(chan os.Signal, 2),
+		pollCtx: pollCtx,
+		force:   forceCtx,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(h.done)
+		handleShutdownSignals(h.signals, forceCtx.Done(), stopPolling, force, drainTimeout)
+	}()
+	return h
+}
+
+func isDone(ctx context.Context, within time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	case <-time.After(within):
+		return false
+	}
+}
+
+func TestHandleShutdownSignals_TwoPhase(t *testing.T) {
+	h := newShutdownHarness(t, time.Minute)
+
+	h.signals <- syscall.SIGINT
+	if !isDone(h.pollCtx, time.Second) {
+		t.Fatal("Expected first interrupt to stop polling")
+	}
+	if isDone(h.force, 50*time.Millisecond) {
+		t.Fatal("First interrupt should not force an immediate stop")
+	}
+
+	h.signals <- syscall.SIGINT
+	if !isDone(h.force, time.Second) {
+		t.Fatal("Expected second interrupt to force an immediate stop")
+	}
+	<-h.done
+}
+
+func TestHandleShutdownSignals_DrainDeadline(t *testing.T) {
+	h := newShutdownHarness(t, 20*time.Millisecond)
+
+	h.signals <- syscall.SIGTERM
+	if !isDone(h.force, time.Second) {
+		t.Fatal("Expected drain deadline to force a stop without a second interrupt")
+	}
+	<-h.done
+}
+
+func TestHandleShutdownSignals_ReturnsWhenDone(t *testing.T) {
+	forceCtx, force := context.WithCancel(context.Background())
+	pollCtx, stopPolling := context.WithCancel(forceCtx)
+	defer stopPolling()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleShutdownSignals(make(chan os.Signal), forceCtx.Done(), stopPolling, force, time.Minute)
+	}()
+
+	// A run that finishes on its own cancels forceCtx itself
+	force()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected signal handler to return once the run is done")
+	}
+	if pollCtx.Err() == nil {
+		t.Error("Expected polling context to be cancelled along with the run")
+	}
+}
+
+func newTempDir(t *testing.T) string {
+	t.Helper()
+	tempDir, err := os.MkdirTemp("", "download_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	return tempDir
+}
+
+// populateEventDir creates an event directory holding a segment from an
+// earlier run
+func populateEventDir(t *testing.T) string {
+	t.Helper()
+	eventPath := filepath.Join(newTempDir(t), "event")
+	if err := os.MkdirAll(filepath.Join(eventPath, "1080p"), 0755); err != nil {
+		t.Fatalf("Failed to create event dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(eventPath, "1080p", "media_0001.ts"), []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+	return eventPath
+}
+
+func TestPrepareEventDir_Policies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantErr  bool
+		wantKept bool
+	}{
+		{policy: config.ExistingDataAppend, wantErr: false, wantKept: true},
+		{policy: config.ExistingDataClean, wantErr: false, wantKept: false},
+		{policy: config.ExistingDataAbort, wantErr: true, wantKept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			eventPath := populateEventDir(t)
+
+			err := prepareEventDir(eventPath, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareEventDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			_, statErr := os.Stat(filepath.Join(eventPath, "1080p", "media_0001.ts"))
+			if kept := statErr == nil; kept != tt.wantKept {
+				t.Errorf("Expected existing segment kept=%v, got %v", tt.wantKept, kept)
+			}
+			if info, err := os.Stat(eventPath); err != nil || !info.IsDir() {
+				t.Errorf("Event directory should still exist: %v", err)
+			}
+		})
+	}
+}
+
+func TestPrepareEventDir_EmptyOrMissing(t *testing.T) {
+	for _, policy := range []string{config.ExistingDataAppend, config.ExistingDataClean, config.ExistingDataAbort} {
+		eventPath := filepath.Join(newTempDir(t), "event")
+		if err := prepareEventDir(eventPath, policy); err != nil {
+			t.Errorf("Policy %s should accept a missing directory, got %v", policy, err)
+		}
+		if err := prepareEventDir(eventPath, policy); err != nil {
+			t.Errorf("Policy %s should accept an empty directory, got %v", policy, err)
+		}
+	}
+}
+
+// testVariant is a variant for variantGroup tests, told apart by name
+func testVariant(name string, subtitles bool) *media.StreamVariant {
+	return &media.StreamVariant{URL: "http://example.com/" + name + ".m3u8", Resolution: name, Subtitles: subtitles}
+}
+
+func TestVariantGroup_FatalErrorStopsOnlyThatVariant(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	// A healthy variant polls until released; the other's playlist is gone
+	release := make(chan struct{})
+	group.Go(ctx, testVariant("1080p", false), func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	fatal := &media.FatalError{Variant: "720p", Err: errors.New("playlist unavailable")}
+	stopped := make(chan struct{})
+	group.Go(ctx, testVariant("720p", false), func(context.Context) error {
+		defer close(stopped)
+		return fatal
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- group.Wait() }()
+
+	<-stopped
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returned while a healthy variant was running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ctx.Err() != nil {
+		t.Error("A fatal error on one variant should not stop the run")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error while another variant was left, got %v", err)
+	}
+}
+
+func TestVariantGroup_LastVariantFatalStopsRun(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	// A subtitle rendition doesn't keep the run going on its own
+	group.Go(ctx, testVariant("subtitles_en", true), func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	fatal := &media.FatalError{Variant: "720p", Err: errors.New("playlist unavailable")}
+	group.Go(ctx, testVariant("720p", false), func(context.Context) error { return fatal })
+
+	done := make(chan error, 1)
+	go func() { done <- group.Wait() }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, fatal) {
+			t.Errorf("Expected the fatal variant error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("A fatal error on the last variant did not stop the run")
+	}
+	if ctx.Err() == nil {
+		t.Error("Expected the shared context to be cancelled")
+	}
+}
+
+func TestVariantGroup_SubtitleFatalKeepsRunning(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	fatal := &media.FatalError{Variant: "subtitles_en", Err: errors.New("playlist unavailable")}
+	group.Go(ctx, testVariant("subtitles_en", true), func(context.Context) error { return fatal })
+	group.Go(ctx, testVariant("1080p", false), func(context.Context) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	if err := group.Wait(); err != nil {
+		t.Errorf("Expected a subtitle rendition's error to be ignored, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("A subtitle rendition's fatal error should not stop the run")
+	}
+}
+
+func TestVariantGroup_RemoveStopsOnlyThatVariant(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	removed, kept := testVariant("720p", false), testVariant("1080p", false)
+	removedStopped := make(chan struct{})
+	group.Go(ctx, removed, func(ctx context.Context) error {
+		defer close(removedStopped)
+		<-ctx.Done()
+		return nil
+	})
+	var keptStopped atomic.Bool
+	group.Go(ctx, kept, func(ctx context.Context) error {
+		<-ctx.Done()
+		keptStopped.Store(true)
+		return nil
+	})
+
+	if !group.Remove(removed) {
+		t.Fatal("Expected Remove to find the running variant")
+	}
+	select {
+	case <-removedStopped:
+	case <-time.After(time.Second):
+		t.Fatal("Remove did not stop the variant")
+	}
+	if keptStopped.Load() || ctx.Err() != nil {
+		t.Error("Remove should not stop the other variants")
+	}
+	if group.Remove(removed) {
+		t.Error("Expected Remove to report a variant that already stopped")
+	}
+
+	stop()
+	group.Wait()
+}
+
+func TestVariantGroup_RemoveKeepsLastVideoVariant(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	// A refresh drops the only video variant being downloaded
+	last := testVariant("720p", false)
+	lastStopped := make(chan struct{})
+	group.Go(ctx, last, func(ctx context.Context) error {
+		defer close(lastStopped)
+		<-ctx.Done()
+		return nil
+	})
+	if !group.Remove(last) {
+		t.Fatal("Expected Remove to find the running variant")
+	}
+	select {
+	case <-lastStopped:
+		t.Fatal("Remove stopped the last video variant")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// It comes back, possibly under the same URL, and replaces the old one
+	group.Go(ctx, last, func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	select {
+	case <-lastStopped:
+	case <-time.After(time.Second):
+		t.Fatal("Starting another video variant did not stop the removed one")
+	}
+	if ctx.Err() != nil {
+		t.Error("Replacing the last video variant should not stop the run")
+	}
+	// The old downloader returning doesn't forget the new one
+	if !group.Remove(last) {
+		t.Error("Expected Remove to find the variant that came back")
+	}
+
+	stop()
+	group.Wait()
+}
+
+func TestVariantGroup_VideosCountsRunningVariants(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	release := make(chan struct{})
+	poll := func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+		case <-release:
+		}
+		return nil
+	}
+	removed, kept := testVariant("720p", false), testVariant("1080p", false)
+	group.Go(ctx, removed, poll)
+	group.Go(ctx, kept, poll)
+	group.Go(ctx, testVariant("subtitles_en", true), poll)
+	if got := group.Videos(); got != 2 {
+		t.Errorf("Expected 2 video variants, got %d", got)
+	}
+
+	// A variant that left, or failed, frees its place for a replacement
+	group.Remove(removed)
+	if got := group.Videos(); got != 1 {
+		t.Errorf("Expected 1 video variant after Remove, got %d", got)
+	}
+	failed := make(chan struct{})
+	group.Go(ctx, testVariant("480p", false), func(context.Context) error {
+		defer close(failed)
+		return &media.FatalError{Variant: "480p", Err: errors.New("playlist unavailable")}
+	})
+	<-failed
+	deadline := time.Now().Add(time.Second)
+	for group.Videos() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := group.Videos(); got != 1 {
+		t.Errorf("Expected 1 video variant after a fatal error, got %d", got)
+	}
+
+	close(release)
+	group.Wait()
+}
+
+func TestVariantGroup_TransientErrorKeepsRunning(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	group.Go(ctx, testVariant("1080p", false), func(context.Context) error { return errors.New("connection reset") })
+	group.Go(ctx, testVariant("720p", false), func(context.Context) error { return nil })
+
+	if err := group.Wait(); err != nil {
+		t.Errorf("Expected no error from non-fatal variants, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("A non-fatal error should not stop the run")
+	}
+}
+
+func TestVariantGroup_RefreshAddsVariantWhileWaiting(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	group := &variantGroup{stop: stop}
+
+	release := make(chan struct{})
+	group.Go(ctx, testVariant("1080p", false), func(context.Context) error {
+		<-release
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- group.Wait() }()
+
+	// The refresher finds a new variant while the first is still running
+	added := make(chan struct{})
+	releaseAdded := make(chan struct{})
+	if !group.Go(ctx, testVariant("720p", false), func(context.Context) error {
+		close(added)
+		<-releaseAdded
+		return nil
+	}) {
+		t.Fatal("Expected a variant added while others run to start")
+	}
+	<-added
+
+	// Every initial variant finishes, but Wait still covers the added one
+	close(release)
+	select {
+	case <-done:
+		t.Fatal("Wait returned while an added variant was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(releaseAdded)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return once every variant finished")
+	}
+
+	if group.Go(ctx, testVariant("480p", false), func(context.Context) error {
+		t.Error("A variant started after the group finished")
+		return nil
+	}) {
+		t.Error("Expected Go to refuse a variant once the group finished")
+	}
+}
+
+func TestVariantGroup_RefreshRacesLastVariant(t *testing.T) {
+	// A refresh landing just as the last variant returns either runs to
+	// completion before Wait returns or doesn't start at all
+	for i := 0; i < 200; i++ {
+		ctx, stop := context.WithCancel(context.Background())
+		group := &variantGroup{stop: stop}
+		group.Go(ctx, testVariant("1080p", false), func(context.Context) error { return nil })
+
+		var completed atomic.Bool
+		started := make(chan bool, 1)
+		go func() {
+			started <- group.Go(ctx, testVariant("720p", false), func(context.Context) error {
+				time.Sleep(time.Millisecond)
+				completed.Store(true)
+				return nil
+			})
+		}()
+
+		group.Wait()
+		doneBeforeWaitReturned := completed.Load()
+		if <-started && !doneBeforeWaitReturned {
+			t.Fatal("A variant added by a refresh outlived Wait")
+		}
+		stop()
+	}
+}
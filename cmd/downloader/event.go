@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"m3u8-downloader/pkg/utils"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// eventQueryParams are query parameters that name the event outright,
+// checked in order before the path
+var eventQueryParams = []string{"event", "eventId", "event_id", "slug"}
+
+// genericPathSegments are path segments common to HLS URLs that say nothing
+// about the event
+var genericPathSegments = map[string]bool{
+	"hls": true, "live": true, "vod": true, "stream": true, "streams": true,
+	"master": true, "playlist": true, "index": true, "chunklist": true,
+	"manifest": true, "media": true, "video": true, "videos": true,
+}
+
+// DefaultEventName derives an event name from masterURL for runs without
+// -event. A non-empty pattern is matched against the whole URL and its first
+// capture group is used; otherwise an event query parameter is used, then
+// the last path segment that isn't a playlist file or generic HLS directory.
+// Names are reduced to a lowercase slug, and a timestamp is used when
+// nothing usable is found.
+func DefaultEventName(masterURL string, pattern string, now time.Time) string {
+	for _, candidate := range eventNameCandidates(masterURL, pattern) {
+		if name := slugify(candidate); name != "" && utils.IsValidPath(name) {
+			return name
+		}
+	}
+	return "event-" + now.Format("20060102-150405")
+}
+
+func eventNameCandidates(masterURL string, pattern string) []string {
+	if pattern != "" {
+		// An explicit pattern replaces the built-in guesses
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil
+		}
+		if match := re.FindStringSubmatch(masterURL); len(match) > 1 {
+			return []string{match[1]}
+		}
+		return nil
+	}
+
+	u, err := url.Parse(masterURL)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []string
+	query := u.Query()
+	for _, param := range eventQueryParams {
+		if val := query.Get(param); val != "" {
+			candidates = append(candidates, val)
+		}
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment, err := url.PathUnescape(segments[i])
+		if err != nil || segment == "" {
+			continue
+		}
+		if path.Ext(segment) == ".m3u8" || genericPathSegments[strings.ToLower(segment)] || !hasLetter(segment) {
+			continue
+		}
+		candidates = append(candidates, segment)
+	}
+	return candidates
+}
+
+// slugify lowercases name and replaces every run of characters other than
+// letters, digits, '-' and '_' with a single '-'
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(b.String(), "-")
+}
+
+func hasLetter(s string) bool {
+	return strings.IndexFunc(s, unicode.IsLetter) >= 0
+}
@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultEventName(t *testing.T) {
+	now := time.Date(2026, 10, 15, 14, 30, 5, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		url      string
+		pattern  string
+		expected string
+	}{
+		{
+			name:     "event slug in path",
+			url:      "https://live.flomarching.com/hls/2026-dci-finals/master.m3u8",
+			expected: "2026-dci-finals",
+		},
+		{
+			name:     "generic directories skipped",
+			url:      "https://cdn.example.com/events/Boston%20Crusaders%20Show/live/hls/playlist.m3u8?token=abc",
+			expected: "boston-crusaders-show",
+		},
+		{
+			name:     "query parameter wins over path",
+			url:      "https://cdn.example.com/streams/12345/master.m3u8?event=Bands%20of%20America",
+			expected: "bands-of-america",
+		},
+		{
+			name:     "numeric ids only falls back to timestamp",
+			url:      "https://cdn.example.com/12345/67890/index.m3u8",
+			expected: "event-20261015-143005",
+		},
+		{
+			name:     "local playlist file",
+			url:      "/tmp/captures/regional_finals/master.m3u8",
+			expected: "regional_finals",
+		},
+		{
+			name:     "pattern overrides path",
+			url:      "https://cdn.example.com/hls/2026-dci-finals/master.m3u8?show=finale",
+			pattern:  `show=(\w+)`,
+			expected: "finale",
+		},
+		{
+			name:     "pattern without match falls back to timestamp",
+			url:      "https://cdn.example.com/hls/2026-dci-finals/master.m3u8",
+			pattern:  `show=(\w+)`,
+			expected: "event-20261015-143005",
+		},
+		{
+			name:     "unparseable URL",
+			url:      "://bad url",
+			expected: "event-20261015-143005",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DefaultEventName(tt.url, tt.pattern, now)
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -4,40 +4,111 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"log"
+	"m3u8-downloader/cmd/check"
 	"m3u8-downloader/cmd/downloader"
+	"m3u8-downloader/cmd/manifest"
 	"m3u8-downloader/cmd/processor"
 	"m3u8-downloader/cmd/transfer"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/constants"
 	"os"
 	"strings"
 )
 
 func main() {
 	url := flag.String("url", "", "M3U8 playlist URL")
-	eventName := flag.String("event", "", "Event name")
+	eventName := flag.String("event", "", "Event name (downloads derive one from -url if omitted)")
 	debug := flag.Bool("debug", false, "Enable debug mode")
+	debugResolution := flag.Int("debug-resolution", 1080, "Height of the single variant debug mode downloads, or the closest below it")
 	transferOnly := flag.Bool("transfer", false, "Transfer-only mode: transfer existing files without downloading")
 	processOnly := flag.Bool("process", false, "Process-only mode: process existing files without downloading")
+	checkOnly := flag.Bool("check", false, "Validate configuration, NAS access, and FFmpeg, then exit")
+	downloadOnly := flag.Bool("download-only", false, "Download-only mode: skip NAS transfer and processing regardless of config")
+	rebuildManifest := flag.Bool("rebuild-manifest", false, "Rebuild the event's manifest from its downloaded segments, then exit")
+	mergeEvents := flag.String("merge-events", "", "Comma-separated events whose manifests to merge into -event, then exit")
+	mergeSegments := flag.Bool("merge-segments", false, "With -merge-events, also copy the events' segment files into -event")
+	resumeQueue := flag.Bool("resume-transfer-queue", false, "Transfer items left in the persisted queue, then exit")
+	maxVariants := flag.Int("max-variants", 0, "Download at most this many variants, highest bandwidth first (0 = all)")
+	maxResolution := flag.Int("max-resolution", 0, "Skip variants taller than this height, e.g. 720 (0 = no limit); with -max-variants 1, take the closest height")
+	startOffset := flag.Duration("start-offset", 0, "Start downloading at the segment covering this offset into the event, e.g. 1h30m")
+	duration := flag.Duration("duration", 0, "Stop downloading after this much of the event, e.g. 45m (0 = to the end)")
+	outputDir := flag.String("output-dir", "", "Local download directory for this run (overrides LOCAL_OUTPUT_DIR)")
+	processOutputDir := flag.String("process-output-dir", "", "Processed video directory for this run (overrides PROCESS_OUTPUT_DIR)")
+	resolutionOrder := flag.String("resolution-order", "", "Resolutions to prefer when merging, most preferred first, e.g. 720p,1080p (overrides PROCESS_RESOLUTION_ORDER)")
+	baseURL := flag.String("base-url", "", "Base URL for relative variant URIs when -url is a local playlist file (overrides MASTER_BASE_URL)")
 
 	flag.Parse()
 
-	if *transferOnly {
-		transfer.RunTransferOnly(*eventName)
+	constants.SetOverrides(config.Overrides{
+		LocalOutput:     *outputDir,
+		ProcessOutput:   *processOutputDir,
+		MasterBaseURL:   *baseURL,
+		ResolutionOrder: config.ParseResolutionOrder(*resolutionOrder),
+	})
+
+	if *checkOnly {
+		os.Exit(check.Run())
+	}
+
+	if *rebuildManifest {
+		manifest.Rebuild(*eventName)
 		return
 	}
 
+	if *mergeEvents != "" {
+		manifest.Merge(*eventName, splitEvents(*mergeEvents), *mergeSegments)
+		return
+	}
+
+	if *resumeQueue {
+		transfer.RunResumeQueue()
+		return
+	}
+
+	if *transferOnly {
+		os.Exit(transfer.RunTransferOnly(*eventName))
+	}
+
 	if *processOnly {
 		processor.Process(*eventName)
 		return
 	}
 
+	opts := downloader.Options{
+		Debug:           *debug,
+		DebugResolution: *debugResolution,
+		DownloadOnly:    *downloadOnly,
+		MaxVariants:     *maxVariants,
+		MaxResolution:   *maxResolution,
+		StartOffset:     *startOffset,
+		Duration:        *duration,
+	}
+
+	if *startOffset < 0 || *duration < 0 {
+		log.Fatalf("-start-offset and -duration cannot be negative")
+	}
+
 	if *url == "" {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("Enter M3U8 playlist URL: ")
 		inputUrl, _ := reader.ReadString('\n')
 		inputUrl = strings.TrimSpace(inputUrl)
-		downloader.Download(inputUrl, *eventName, *debug)
-		return
+		*url = inputUrl
 	}
 
-	downloader.Download(*url, *eventName, *debug)
+	if err := downloader.Download(*url, *eventName, opts); err != nil {
+		log.Fatalf("Download failed: %v", err)
+	}
+}
+
+// splitEvents parses a comma-separated list of event names, ignoring blanks
+func splitEvents(list string) []string {
+	var events []string
+	for _, event := range strings.Split(list, ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			events = append(events, event)
+		}
+	}
+	return events
 }
@@ -0,0 +1,151 @@
+package manifest
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/media"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Merge combines the manifests of several runs of the same event into the
+// target event's manifest. With copySegments, the sources' segment files are
+// also copied into the target event directory so one processing run covers
+// every capture.
+func Merge(target string, sources []string, copySegments bool) {
+	if target == "" {
+		log.Fatal("-merge-events requires -event")
+	}
+	if len(sources) == 0 {
+		log.Fatal("-merge-events requires at least one source event")
+	}
+
+	cfg := constants.MustGetConfig()
+	count, err := merge(cfg, target, sources, copySegments)
+	if err != nil {
+		log.Fatalf("Failed to merge events into %q: %v", target, err)
+	}
+	log.Printf("Merged %d events into manifest %s with %d segments", len(sources), cfg.GetManifestPath(target), count)
+}
+
+func merge(cfg *config.Config, target string, sources []string, copySegments bool) (int, error) {
+	// A running download would overwrite the merged manifest
+	lock, err := utils.AcquireLock(cfg.GetEventLockPath(target))
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+
+	manifests := make([][]media.ManifestItem, 0, len(sources)+1)
+	targetManifest := cfg.GetManifestPath(target)
+	if utils.PathExists(targetManifest) {
+		items, err := media.ReadManifest(targetManifest, true)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read target manifest: %w", err)
+		}
+		manifests = append(manifests, items)
+	}
+
+	for _, source := range sources {
+		if source == target {
+			continue
+		}
+		items, err := media.ReadManifest(cfg.GetManifestPath(source), true)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read manifest for event %q: %w", source, err)
+		}
+		log.Printf("Read %d segments from event %s", len(items), source)
+		manifests = append(manifests, items)
+
+		if copySegments {
+			copied, err := copyEventSegments(cfg.GetEventPath(source), cfg.GetEventPath(target))
+			if err != nil {
+				return 0, fmt.Errorf("failed to copy segments from event %q: %w", source, err)
+			}
+			log.Printf("Copied %d segment files from event %s", copied, source)
+		}
+	}
+
+	writer := &media.ManifestWriter{ManifestPath: targetManifest}
+	count := media.MergeManifests(writer, manifests...)
+	if count == 0 {
+		return 0, fmt.Errorf("no segments found in the manifests of %s", strings.Join(sources, ", "))
+	}
+	return count, writer.Close()
+}
+
+// copyEventSegments copies each resolution's segment files from srcEvent to
+// dstEvent, keeping any file dstEvent already has. It returns how many files
+// were copied.
+func copyEventSegments(srcEvent, dstEvent string) (int, error) {
+	dirs, err := os.ReadDir(srcEvent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read event directory: %w", err)
+	}
+
+	copied := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		resolution := dir.Name()
+
+		files, err := os.ReadDir(filepath.Join(srcEvent, resolution))
+		if err != nil {
+			return copied, fmt.Errorf("failed to read resolution directory %s: %w", resolution, err)
+		}
+		if err := utils.EnsureDir(filepath.Join(dstEvent, resolution)); err != nil {
+			return copied, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || !utils.IsSegmentFile(file.Name()) {
+				continue
+			}
+			dst := filepath.Join(dstEvent, resolution, file.Name())
+			if utils.PathExists(dst) {
+				continue
+			}
+			if err := copySegment(filepath.Join(srcEvent, resolution, file.Name()), dst); err != nil {
+				return copied, err
+			}
+			copied++
+		}
+	}
+	return copied, nil
+}
+
+// copySegment hard links src to dst where the filesystem allows it and
+// copies the file otherwise
+func copySegment(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to copy segment: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to copy segment: %w", err)
+	}
+	return os.Rename(tmpPath, dst)
+}
@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"encoding/json"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/media"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestManifest(t *testing.T, cfg *config.Config, event string, items []media.ManifestItem) {
+	t.Helper()
+	if err := os.MkdirAll(cfg.Paths.ManifestDir, 0755); err != nil {
+		t.Fatalf("Failed to create manifest dir: %v", err)
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	if err := os.WriteFile(cfg.GetManifestPath(event), data, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+}
+
+func TestMerge_OverlappingManifests(t *testing.T) {
+	cfg := newRebuildConfig(t)
+	writeTestManifest(t, cfg, "run1", []media.ManifestItem{
+		{SeqNo: "1", Resolution: "720p", Available: []string{"720p"}},
+		{SeqNo: "2", Resolution: "720p", Available: []string{"720p"}, Missing: []string{"1080p"}},
+		{SeqNo: "3", Resolution: "720p", Available: []string{"720p"}},
+	})
+	writeTestManifest(t, cfg, "run2", []media.ManifestItem{
+		{SeqNo: "2", Resolution: "1080p", Available: []string{"1080p"}},
+		{SeqNo: "3", Resolution: "480p", Available: []string{"480p"}},
+		{SeqNo: "4", Resolution: "1080p", Available: []string{"1080p"}},
+	})
+
+	count, err := merge(cfg, "merged", []string{"run1", "run2"}, false)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 segments, got %d", count)
+	}
+
+	items, err := media.ReadManifest(cfg.GetManifestPath("merged"), false)
+	if err != nil {
+		t.Fatalf("Merged manifest is not readable: %v", err)
+	}
+	expected := map[string]string{"1": "720p", "2": "1080p", "3": "720p", "4": "1080p"}
+	if len(items) != len(expected) {
+		t.Fatalf("Expected %d items, got %+v", len(expected), items)
+	}
+	for _, item := range items {
+		if item.Resolution != expected[item.SeqNo] {
+			t.Errorf("Expected sequence %s at %s, got %s", item.SeqNo, expected[item.SeqNo], item.Resolution)
+		}
+		if item.SeqNo == "2" && len(item.Missing) != 0 {
+			t.Errorf("Expected sequence 2 to have no missing resolutions, got %v", item.Missing)
+		}
+	}
+}
+
+func TestMerge_CopiesSegments(t *testing.T) {
+	cfg := newRebuildConfig(t)
+	writeTestManifest(t, cfg, "run1", []media.ManifestItem{
+		{SeqNo: "1", Resolution: "720p", Available: []string{"720p"}},
+		{SeqNo: "2", Resolution: "720p", Available: []string{"720p"}},
+	})
+	writeTestManifest(t, cfg, "run2", []media.ManifestItem{
+		{SeqNo: "2", Resolution: "720p", Available: []string{"720p"}},
+		{SeqNo: "3", Resolution: "720p", Available: []string{"720p"}},
+	})
+	segments := map[string][]string{
+		"run1": {"media_0001.ts", "media_0002.ts"},
+		"run2": {"media_0002.ts", "media_0003.ts"},
+	}
+	for event, names := range segments {
+		dir := filepath.Join(cfg.GetEventPath(event), "720p")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create segment dir: %v", err)
+		}
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(event), 0644); err != nil {
+				t.Fatalf("Failed to write segment: %v", err)
+			}
+		}
+	}
+
+	if _, err := merge(cfg, "merged", []string{"run1", "run2"}, true); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	dir := filepath.Join(cfg.GetEventPath("merged"), "720p")
+	for name, want := range map[string]string{
+		"media_0001.ts": "run1",
+		"media_0002.ts": "run1",
+		"media_0003.ts": "run2",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Expected %s in merged event: %v", name, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("Expected %s from %s, got %s", name, want, data)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package manifest
+
+import (
+	"fmt"
+	"log"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/media"
+	"m3u8-downloader/pkg/utils"
+)
+
+// Rebuild replaces the event's manifest with one built from the segments in
+// its local event directory
+func Rebuild(eventName string) {
+	if eventName == "" {
+		log.Fatal("-rebuild-manifest requires -event")
+	}
+
+	cfg := constants.MustGetConfig()
+	count, err := rebuild(cfg, eventName)
+	if err != nil {
+		log.Fatalf("Failed to rebuild manifest for event %q: %v", eventName, err)
+	}
+	log.Printf("Rebuilt manifest %s from %d segment files", cfg.GetManifestPath(eventName), count)
+}
+
+func rebuild(cfg *config.Config, eventName string) (int, error) {
+	// A running download would overwrite the rebuilt manifest
+	lock, err := utils.AcquireLock(cfg.GetEventLockPath(eventName))
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+
+	eventPath := cfg.GetEventPath(eventName)
+	if !utils.PathExists(eventPath) {
+		return 0, fmt.Errorf("local event directory does not exist: %s", eventPath)
+	}
+
+	writer := &media.ManifestWriter{ManifestPath: cfg.GetManifestPath(eventName)}
+	count, err := media.RebuildManifest(eventPath, writer)
+	if err != nil {
+		return count, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no segments found in %s", eventPath)
+	}
+	return count, writer.Close()
+}
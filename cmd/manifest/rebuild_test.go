@@ -0,0 +1,94 @@
+package manifest
+
+import (
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/media"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newRebuildConfig(t *testing.T) *config.Config {
+	t.Helper()
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	return &config.Config{Paths: config.PathsConfig{
+		BaseDir:     tempDir,
+		LocalOutput: filepath.Join(tempDir, "data"),
+		ManifestDir: filepath.Join(tempDir, "manifests"),
+	}}
+}
+
+func TestRebuild_ReplacesManifest(t *testing.T) {
+	cfg := newRebuildConfig(t)
+	segDir := filepath.Join(cfg.GetEventPath("event"), "720p")
+	if err := os.MkdirAll(segDir, 0755); err != nil {
+		t.Fatalf("Failed to create segment dir: %v", err)
+	}
+	for _, name := range []string{"media_0001.ts", "media_0002.ts"} {
+		if err := os.WriteFile(filepath.Join(segDir, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to write segment: %v", err)
+		}
+	}
+	if err := os.MkdirAll(cfg.Paths.ManifestDir, 0755); err != nil {
+		t.Fatalf("Failed to create manifest dir: %v", err)
+	}
+	if err := os.WriteFile(cfg.GetManifestPath("event"), []byte("[{\"seqNo\":"), 0644); err != nil {
+		t.Fatalf("Failed to write corrupt manifest: %v", err)
+	}
+
+	count, err := rebuild(cfg, "event")
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 segments, got %d", count)
+	}
+
+	items, err := media.ReadManifest(cfg.GetManifestPath("event"), false)
+	if err != nil {
+		t.Fatalf("Rebuilt manifest is not readable: %v", err)
+	}
+	if len(items) != 2 || items[0].Resolution != "720p" {
+		t.Errorf("Expected 2 items at 720p, got %+v", items)
+	}
+}
+
+func TestRebuild_Errors(t *testing.T) {
+	t.Run("missing event directory", func(t *testing.T) {
+		cfg := newRebuildConfig(t)
+		if _, err := rebuild(cfg, "event"); err == nil {
+			t.Error("Expected error for missing event directory")
+		}
+	})
+
+	t.Run("no segments", func(t *testing.T) {
+		cfg := newRebuildConfig(t)
+		if err := os.MkdirAll(filepath.Join(cfg.GetEventPath("event"), "720p"), 0755); err != nil {
+			t.Fatalf("Failed to create segment dir: %v", err)
+		}
+		if _, err := rebuild(cfg, "event"); err == nil {
+			t.Error("Expected error when no segments are found")
+		}
+		if utils.PathExists(cfg.GetManifestPath("event")) {
+			t.Error("No manifest should be written when no segments are found")
+		}
+	})
+
+	t.Run("event locked", func(t *testing.T) {
+		cfg := newRebuildConfig(t)
+		lock, err := utils.AcquireLock(cfg.GetEventLockPath("event"))
+		if err != nil {
+			t.Fatalf("Failed to acquire lock: %v", err)
+		}
+		defer lock.Release()
+		if _, err := rebuild(cfg, "event"); err == nil {
+			t.Error("Expected error while the event is locked")
+		}
+	})
+}
@@ -31,7 +31,47 @@ func getEventDirs(cfg *config.Config) ([]string, error) {
 	return eventDirs, nil
 }
 
-func RunTransferOnly(eventName string) {
+// RunResumeQueue transfers whatever was left in the persisted queue, e.g.
+// after a crash, and exits once it is empty. No new files are scanned.
+func RunResumeQueue() {
+	cfg := constants.MustGetConfig()
+
+	if !cfg.NAS.EnableTransfer {
+		log.Fatal("NAS transfer is disabled in configuration. Please enable it to resume the transfer queue.")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Println("Shutting down transfer service...")
+		cancel()
+	}()
+
+	transferService, err := transfer.NewResumeService(cfg.NAS.OutputPath)
+	if err != nil {
+		log.Fatalf("Failed to create transfer service: %v", err)
+	}
+
+	restored, err := transferService.ResumePersisted(ctx)
+	if err != nil && err != context.Canceled {
+		log.Printf("Transfer service error: %v", err)
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	transferService.Shutdown(shutdownCtx)
+
+	log.Printf("Resume completed. Restored %d pending and %d failed items.", restored.Pending, restored.Failed)
+}
+
+// RunTransferOnly transfers an event's downloaded files to the NAS until
+// interrupted, then confirms every queued file reached the NAS with the
+// right size. It returns the process exit code, nonzero if any did not.
+func RunTransferOnly(eventName string) int {
 	cfg := constants.MustGetConfig()
 
 	// Check if NAS transfer is enabled
@@ -70,6 +110,12 @@ func RunTransferOnly(eventName string) {
 
 	log.Printf("Starting transfer-only mode for event: %s", eventName)
 
+	lock, err := utils.AcquireLock(cfg.GetEventLockPath(eventName))
+	if err != nil {
+		log.Fatalf("Cannot start transfer for event %q: %v", eventName, err)
+	}
+	defer lock.Release()
+
 	// Setup context and signal handling
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -94,21 +140,50 @@ func RunTransferOnly(eventName string) {
 		log.Fatalf("Failed to create transfer service: %v", err)
 	}
 
+	// The capture happened before this run, so date it by its first segment
+	if start, ok := transfer.CaptureStart(localEventPath); ok {
+		transferService.SetCaptureStart(start)
+	}
+
 	// Find and queue existing files
 	if err := transferService.QueueExistingFiles(localEventPath); err != nil {
 		log.Fatalf("Failed to queue existing files: %v", err)
 	}
 
+	go transferService.HandlePauseSignal(ctx)
+
 	// Start transfer service
 	log.Println("Starting transfer service...")
 	if err := transferService.Start(ctx); err != nil && err != context.Canceled {
 		log.Printf("Transfer service error: %v", err)
 	}
 
+	// Confirm before Shutdown disconnects from the NAS
+	missing, confirmErr := transferService.ConfirmTransferred()
+
 	// Graceful shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 	transferService.Shutdown(shutdownCtx)
 
+	return reportConfirmation(missing, confirmErr)
+}
+
+// reportConfirmation logs the result of ConfirmTransferred and returns the
+// exit code for transfer-only mode
+func reportConfirmation(missing []string, err error) int {
+	if err != nil {
+		log.Printf("Could not confirm transfers: %v", err)
+		return 1
+	}
+	if len(missing) > 0 {
+		for _, destPath := range missing {
+			log.Printf("✗ Not on NAS: %s", destPath)
+		}
+		log.Printf("Transfer-only mode finished with %d files missing from the NAS; they stay queued for the next run", len(missing))
+		return 1
+	}
+
 	log.Println("Transfer-only mode completed.")
+	return 0
 }
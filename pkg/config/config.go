@@ -1,11 +1,19 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"m3u8-downloader/pkg/utils"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type Config struct {
@@ -19,31 +27,155 @@ type Config struct {
 }
 
 type CoreConfig struct {
-	WorkerCount  int
-	RefreshDelay time.Duration
+	WorkerCount        int
+	RefreshDelay       time.Duration
+	MasterRefreshDelay time.Duration
+	DrainTimeout       time.Duration
+	HealthInterval     time.Duration
+	WriteReport        bool
+	WriteIndex         bool
+	PlaylistTimeout    time.Duration
+	SegmentTimeout     time.Duration
+	// MasterBaseURL resolves relative variant URIs when the master playlist
+	// is read from a local file
+	MasterBaseURL string
+	// VariantWorkers caps how many segment downloads one variant runs at
+	// once, whatever capacity the shared pool has
+	VariantWorkers int
+	// SegmentsPerSecond caps segment downloads across all variants; 0 means
+	// unlimited
+	SegmentsPerSecond float64
+	// AdaptiveErrorRate halves the usable download slots whenever more than
+	// this fraction of recent segment downloads fail, adding them back one at
+	// a time while failures stay below it; 0 disables adaptive concurrency
+	AdaptiveErrorRate float64
+	// MinFreeInodes pauses segment downloads while the download volume has
+	// fewer free inodes than this; 0 disables the check
+	MinFreeInodes uint64
+	// RollingSegments keeps only the newest this many segments of each
+	// resolution on disk, deleting older ones as new ones arrive; 0 keeps all
+	RollingSegments int
+	// ExistingData decides what a download does with an event directory
+	// that already has files in it
+	ExistingData string
+	// SegmentChecksum is the hash recorded in the manifest for each
+	// downloaded segment; empty records none
+	SegmentChecksum string
+	// EventNamePattern, when set, is matched against the playlist URL of a
+	// download without -event, and its first capture group names the event
+	EventNamePattern string
+	// EmptySegment decides what happens to a segment whose response has an
+	// empty body
+	EmptySegment string
+	// Subtitles also downloads the WebVTT subtitle renditions of the master
+	// playlist, each into its own subtitles_<language> directory
+	Subtitles bool
 }
 
+// Policies for CoreConfig.ExistingData
+const (
+	ExistingDataAppend = "append"
+	ExistingDataClean  = "clean"
+	ExistingDataAbort  = "abort"
+)
+
+// Policies for CoreConfig.EmptySegment
+const (
+	EmptySegmentRetry = "retry"
+	EmptySegmentSkip  = "skip"
+	EmptySegmentFail  = "fail"
+)
+
+// Hashes for CoreConfig.SegmentChecksum
+const (
+	ChecksumNone   = ""
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32  = "crc32"
+)
+
 type HTTPConfig struct {
-	UserAgent string
-	Referer   string
+	UserAgent          string
+	Referer            string
+	ProxyURL           string
+	InsecureSkipVerify bool
+	CABundlePath       string
+	// CacheWarmerURL, when set, is requested for every downloaded segment
+	// so a caching proxy holds a copy; {url} is replaced with the segment URL
+	CacheWarmerURL    string
+	CacheWarmerMethod string
 }
 
 type NASConfig struct {
-	EnableTransfer bool
-	OutputPath     string
-	Username       string
-	Password       string
-	Timeout        time.Duration
-	RetryLimit     int
+	EnableTransfer  bool
+	OutputPath      string
+	Username        string
+	Password        string
+	Timeout         time.Duration
+	RetryLimit      int
+	MaxConnections  int
+	ListingCacheTTL time.Duration
+	// PathStyle is the separator style for NAS paths (utils.PathStyle*)
+	PathStyle string
+	// PathTemplate is the event directory under OutputPath, built from the
+	// NASTemplate* placeholders
+	PathTemplate string
+	// Subpath is a fixed directory between OutputPath and the event
+	// directory, e.g. regionals or finals; empty puts events at the root
+	Subpath string
+	// MountPoint is where a //server/share OutputPath is mounted outside
+	// Windows; unused on Windows and for local paths
+	MountPoint string
 }
 
+// Placeholders for NASConfig.PathTemplate. The date is the capture start.
+const (
+	NASTemplateEvent = "{event}"
+	NASTemplateDate  = "{date}"
+	nasDateLayout    = "2006-01-02"
+)
+
 type ProcessingConfig struct {
 	Enabled     bool
 	AutoProcess bool
 	WorkerCount int
 	FFmpegPath  string
+	ConcatSort  string
+	// FastStart moves the MP4 index to the front for web playback, at the
+	// cost of FFmpeg rewriting the whole file once muxing finishes
+	FastStart bool
+	// FFmpegExtraArgs are appended after the concat and copy flags, before
+	// the output path
+	FFmpegExtraArgs []string
+	// FillGaps lets a sequence missing from the best resolution be taken
+	// from a lower one; when off, only the best resolution is used
+	FillGaps bool
+	// ResolutionOrder lists resolutions from most to least preferred when
+	// merging; unlisted ones follow, tallest first. Empty means tallest first.
+	ResolutionOrder []string
+	// RemoveConcatFile deletes the FFmpeg concat list once processing
+	// finishes. Without Paths.ConcatDir the list is then written to the
+	// system temp directory instead of next to the video.
+	RemoveConcatFile bool
+	// MinOutputRatio fails processing when the MP4 is smaller than this
+	// fraction of the input segments' total size; empty output always fails
+	MinOutputRatio float64
+	// AggregateShards splits choosing each sequence's segment across this
+	// many goroutines, by sequence number; 0 or 1 uses one
+	AggregateShards int
+	// PerResolution also writes <event>_<resolution>.mp4 from each
+	// resolution's own segments, alongside the merged video
+	PerResolution bool
+	// MuxSubtitles adds the captured subtitles to the merged video as
+	// mov_text tracks; they are always written as .vtt sidecars
+	MuxSubtitles bool
 }
 
+// Concat sort modes for ProcessingConfig.ConcatSort
+const (
+	ConcatSortSequence = "sequence"
+	ConcatSortModTime  = "mtime"
+)
+
 type TransferConfig struct {
 	WorkerCount       int
 	RetryLimit        int
@@ -51,30 +183,87 @@ type TransferConfig struct {
 	FileSettlingDelay time.Duration
 	QueueSize         int
 	BatchSize         int
+	VerifySegments    bool
+	VerifySize        bool
+	VerifyChecksum    bool
+	VerifyWorkers     int
+	// QueueOrder picks which pending file is transferred next
+	QueueOrder string
+	// StateInterval is how often the queue state file is rewritten
+	StateInterval time.Duration
+	// CompressState gzips the queue state file
+	CompressState bool
+	// StateBackend is where the queue state is kept: a JSON snapshot, or a
+	// SQLite database updated as each item changes
+	StateBackend string
+	// WatchMode is how new segments are found: fsnotify events, or
+	// scanning every WatchPollInterval where events aren't delivered
+	WatchMode string
+	// WatchPollInterval is how often polled directories are scanned
+	WatchPollInterval time.Duration
 }
 
+// Transfer queue orders for TransferConfig.QueueOrder
+const (
+	TransferOrderNewest   = "newest"
+	TransferOrderSmallest = "smallest"
+)
+
+// Queue state stores for TransferConfig.StateBackend
+const (
+	StateBackendJSON   = "json"
+	StateBackendSQLite = "sqlite"
+)
+
+// File watcher modes for TransferConfig.WatchMode
+const (
+	WatchModeNotify = "notify"
+	WatchModePoll   = "poll"
+)
+
 type CleanupConfig struct {
-	AfterTransfer bool
-	BatchSize     int
-	RetainHours   int
+	AfterTransfer         bool
+	BatchSize             int
+	RetainHours           int
+	RequireTransferRecord bool
+	// FileTimeout bounds each file's stat and delete
+	FileTimeout time.Duration
 }
 
 type PathsConfig struct {
-	BaseDir         string
-	LocalOutput     string
-	ProcessOutput   string
-	ManifestDir     string
-	PersistenceFile string
+	BaseDir           string
+	LocalOutput       string
+	ProcessOutput     string
+	ManifestDir       string
+	PersistenceFile   string
+	SegmentNamePolicy string
+	TempDir           string
+	// ConcatDir is where the FFmpeg concat list is written; empty means the
+	// event's process output directory
+	ConcatDir string
+	// StageDir, when set, is fast local storage that processing copies the
+	// selected segments into from the NAS before running FFmpeg; the copies
+	// are removed afterwards. Empty means FFmpeg reads the NAS directly.
+	StageDir string
 }
 
 var defaultConfig = Config{
 	Core: CoreConfig{
-		WorkerCount:  4,
-		RefreshDelay: 3 * time.Second,
+		WorkerCount:        4,
+		VariantWorkers:     4,
+		RefreshDelay:       3 * time.Second,
+		MasterRefreshDelay: 60 * time.Second,
+		DrainTimeout:       60 * time.Second,
+		HealthInterval:     60 * time.Second,
+		PlaylistTimeout:    5 * time.Second,
+		SegmentTimeout:     10 * time.Second,
+		ExistingData:       ExistingDataAppend,
+		EmptySegment:       EmptySegmentRetry,
 	},
 	HTTP: HTTPConfig{
-		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/138.0.0.0 Safari/537.36",
-		Referer:   "https://www.flomarching.com",
+		UserAgent:         "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/138.0.0.0 Safari/537.36",
+		Referer:           "https://www.flomarching.com",
+		CacheWarmerMethod: http.MethodHead,
 	},
 	NAS: NASConfig{
 		EnableTransfer: true,
@@ -83,12 +272,18 @@ var defaultConfig = Config{
 		Password:       "",
 		Timeout:        30 * time.Second,
 		RetryLimit:     3,
+		PathStyle:      utils.PathStyleAuto,
+		PathTemplate:   NASTemplateEvent,
 	},
 	Processing: ProcessingConfig{
-		Enabled:     true,
-		AutoProcess: true,
-		WorkerCount: 2,
-		FFmpegPath:  "ffmpeg",
+		Enabled:         true,
+		AutoProcess:     true,
+		WorkerCount:     2,
+		FFmpegPath:      "ffmpeg",
+		ConcatSort:      ConcatSortSequence,
+		FillGaps:        true,
+		MinOutputRatio:  0.5,
+		AggregateShards: 1,
 	},
 	Transfer: TransferConfig{
 		WorkerCount:       2,
@@ -97,27 +292,70 @@ var defaultConfig = Config{
 		FileSettlingDelay: 5 * time.Second,
 		QueueSize:         100000,
 		BatchSize:         1000,
+		VerifySize:        true,
+		VerifyWorkers:     4,
+		QueueOrder:        TransferOrderNewest,
+		StateInterval:     30 * time.Second,
+		StateBackend:      StateBackendJSON,
+		WatchMode:         WatchModeNotify,
+		WatchPollInterval: 10 * time.Second,
 	},
 	Cleanup: CleanupConfig{
 		AfterTransfer: true,
 		BatchSize:     1000,
 		RetainHours:   0,
+		FileTimeout:   30 * time.Second,
 	},
 	Paths: PathsConfig{
-		BaseDir:         "data",
-		LocalOutput:     "data",
-		ProcessOutput:   "out",
-		ManifestDir:     "data",
-		PersistenceFile: "transfer_queue.json",
+		BaseDir:           "data",
+		LocalOutput:       "data",
+		ProcessOutput:     "out",
+		ManifestDir:       "data",
+		PersistenceFile:   "transfer_queue.json",
+		SegmentNamePolicy: utils.NamePolicyAuto,
 	},
 }
 
+// Overrides are per-invocation settings, typically from command line flags,
+// that take precedence over the environment. Empty fields are ignored.
+type Overrides struct {
+	LocalOutput     string
+	ProcessOutput   string
+	MasterBaseURL   string
+	ResolutionOrder []string
+}
+
+func (o Overrides) apply(c *Config) {
+	if o.MasterBaseURL != "" {
+		c.Core.MasterBaseURL = o.MasterBaseURL
+	}
+	if o.LocalOutput != "" {
+		c.Paths.LocalOutput = o.LocalOutput
+	}
+	if o.ProcessOutput != "" {
+		c.Paths.ProcessOutput = o.ProcessOutput
+	}
+	if len(o.ResolutionOrder) > 0 {
+		c.Processing.ResolutionOrder = o.ResolutionOrder
+	}
+}
+
 func Load() (*Config, error) {
+	return LoadWithOverrides(Overrides{})
+}
+
+// LoadWithOverrides loads the configuration like Load, applying overrides
+// after the environment and before paths are resolved and created.
+func LoadWithOverrides(overrides Overrides) (*Config, error) {
 	cfg := defaultConfig
 
+	if err := cfg.loadFromFile(configFilePath()); err != nil {
+		return nil, err
+	}
 	if err := cfg.loadFromEnvironment(); err != nil {
 		return nil, fmt.Errorf("failed to load environment config: %w", err)
 	}
+	overrides.apply(&cfg)
 
 	if err := cfg.resolveAndValidatePaths(); err != nil {
 		return nil, fmt.Errorf("path validation failed: %w", err)
@@ -126,6 +364,49 @@ func Load() (*Config, error) {
 	return &cfg, nil
 }
 
+// defaultConfigFile is looked for next to the executable when CONFIG_FILE is
+// not set
+const defaultConfigFile = "config.yaml"
+
+// configFilePath returns CONFIG_FILE, or config.yaml in the executable's
+// directory
+func configFilePath() string {
+	if val := os.Getenv("CONFIG_FILE"); val != "" {
+		return val
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(exe), defaultConfigFile)
+}
+
+// loadFromFile overlays the YAML or JSON config file at path onto c. Keys are
+// the struct field names in lower case, e.g. transfer: {workercount: 4}, and
+// durations are strings such as "30s". A missing file leaves c unchanged;
+// unknown keys are an error so a misspelled setting isn't silently ignored.
+func (c *Config) loadFromFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open config file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
 func (c *Config) loadFromEnvironment() error {
 	if val := os.Getenv("WORKER_COUNT"); val != "" {
 		if parsed, err := strconv.Atoi(val); err == nil {
@@ -133,12 +414,124 @@ func (c *Config) loadFromEnvironment() error {
 		}
 	}
 
+	if val := os.Getenv("VARIANT_WORKERS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			c.Core.VariantWorkers = parsed
+		}
+	}
+
 	if val := os.Getenv("REFRESH_DELAY_SECONDS"); val != "" {
 		if parsed, err := strconv.Atoi(val); err == nil {
 			c.Core.RefreshDelay = time.Duration(parsed) * time.Second
 		}
 	}
 
+	if val := os.Getenv("MASTER_REFRESH_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Core.MasterRefreshDelay = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("SHUTDOWN_DRAIN_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Core.DrainTimeout = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("HEALTH_REPORT_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Core.HealthInterval = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("PLAYLIST_TIMEOUT_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Core.PlaylistTimeout = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("SEGMENT_TIMEOUT_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Core.SegmentTimeout = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("SEGMENTS_PER_SECOND"); val != "" {
+		if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+			c.Core.SegmentsPerSecond = parsed
+		}
+	}
+
+	if val := os.Getenv("ADAPTIVE_ERROR_RATE"); val != "" {
+		if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+			c.Core.AdaptiveErrorRate = parsed
+		}
+	}
+
+	if val := os.Getenv("MIN_FREE_INODES"); val != "" {
+		if parsed, err := strconv.ParseUint(val, 10, 64); err == nil {
+			c.Core.MinFreeInodes = parsed
+		}
+	}
+
+	if val := os.Getenv("ROLLING_WINDOW_SEGMENTS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Core.RollingSegments = parsed
+		}
+	}
+
+	if val := os.Getenv("EXISTING_DATA_POLICY"); val != "" {
+		c.Core.ExistingData = val
+	}
+
+	if val := os.Getenv("EMPTY_SEGMENT_POLICY"); val != "" {
+		c.Core.EmptySegment = val
+	}
+
+	if val := os.Getenv("SEGMENT_CHECKSUM"); val != "" {
+		c.Core.SegmentChecksum = val
+	}
+
+	if val := os.Getenv("EVENT_NAME_PATTERN"); val != "" {
+		c.Core.EventNamePattern = val
+	}
+
+	if val := os.Getenv("MASTER_BASE_URL"); val != "" {
+		c.Core.MasterBaseURL = val
+	}
+
+	if val := os.Getenv("WRITE_CAPTURE_REPORT"); val != "" {
+		c.Core.WriteReport = val == "true"
+	}
+
+	if val := os.Getenv("WRITE_SEGMENT_INDEX"); val != "" {
+		c.Core.WriteIndex = val == "true"
+	}
+
+	if val := os.Getenv("CAPTURE_SUBTITLES"); val != "" {
+		c.Core.Subtitles = val == "true"
+	}
+
+	if val := os.Getenv("HTTP_PROXY_URL"); val != "" {
+		c.HTTP.ProxyURL = val
+	}
+
+	if val := os.Getenv("HTTP_INSECURE_SKIP_VERIFY"); val != "" {
+		c.HTTP.InsecureSkipVerify = val == "true"
+	}
+
+	if val := os.Getenv("HTTP_CA_BUNDLE"); val != "" {
+		c.HTTP.CABundlePath = val
+	}
+
+	if val := os.Getenv("CACHE_WARMER_URL"); val != "" {
+		c.HTTP.CacheWarmerURL = val
+	}
+
+	if val := os.Getenv("CACHE_WARMER_METHOD"); val != "" {
+		c.HTTP.CacheWarmerMethod = strings.ToUpper(val)
+	}
+
 	if val := os.Getenv("NAS_OUTPUT_PATH"); val != "" {
 		c.NAS.OutputPath = val
 	}
@@ -151,10 +544,136 @@ func (c *Config) loadFromEnvironment() error {
 		c.NAS.Password = val
 	}
 
+	if val := os.Getenv("NAS_MAX_CONNECTIONS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.NAS.MaxConnections = parsed
+		}
+	}
+
+	if val := os.Getenv("NAS_LISTING_CACHE_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.NAS.ListingCacheTTL = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("NAS_PATH_STYLE"); val != "" {
+		c.NAS.PathStyle = val
+	}
+
+	if val := os.Getenv("NAS_PATH_TEMPLATE"); val != "" {
+		c.NAS.PathTemplate = val
+	}
+
+	if val := os.Getenv("NAS_SUBPATH"); val != "" {
+		c.NAS.Subpath = val
+	}
+
+	if val := os.Getenv("NAS_MOUNT_POINT"); val != "" {
+		c.NAS.MountPoint = val
+	}
+
+	if val := os.Getenv("NAS_RETRY_LIMIT"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed >= 0 {
+			c.NAS.RetryLimit = parsed
+		}
+	}
+
+	if val := os.Getenv("NAS_TIMEOUT_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			c.NAS.Timeout = time.Duration(parsed) * time.Second
+		}
+	}
+
 	if val := os.Getenv("ENABLE_NAS_TRANSFER"); val != "" {
 		c.NAS.EnableTransfer = val == "true"
 	}
 
+	if val := os.Getenv("TRANSFER_WORKER_COUNT"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			c.Transfer.WorkerCount = parsed
+		}
+	}
+
+	if val := os.Getenv("TRANSFER_QUEUE_SIZE"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			c.Transfer.QueueSize = parsed
+		}
+	}
+
+	if val := os.Getenv("TRANSFER_BATCH_SIZE"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			c.Transfer.BatchSize = parsed
+		}
+	}
+
+	if val := os.Getenv("FILE_SETTLING_DELAY_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed >= 0 {
+			c.Transfer.FileSettlingDelay = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("TRANSFER_VERIFY_SEGMENTS"); val != "" {
+		c.Transfer.VerifySegments = val == "true"
+	}
+
+	if val := os.Getenv("TRANSFER_VERIFY_SIZE"); val != "" {
+		c.Transfer.VerifySize = val == "true"
+	}
+
+	if val := os.Getenv("TRANSFER_VERIFY_CHECKSUM"); val != "" {
+		c.Transfer.VerifyChecksum = val == "true"
+	}
+
+	if val := os.Getenv("TRANSFER_VERIFY_WORKERS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Transfer.VerifyWorkers = parsed
+		}
+	}
+
+	if val := os.Getenv("TRANSFER_QUEUE_ORDER"); val != "" {
+		c.Transfer.QueueOrder = val
+	}
+
+	if val := os.Getenv("WATCH_MODE"); val != "" {
+		c.Transfer.WatchMode = val
+	}
+
+	if val := os.Getenv("WATCH_POLL_INTERVAL_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Transfer.WatchPollInterval = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("TRANSFER_STATE_INTERVAL_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Transfer.StateInterval = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if val := os.Getenv("TRANSFER_STATE_GZIP"); val != "" {
+		c.Transfer.CompressState = val == "true"
+	}
+
+	if val := os.Getenv("TRANSFER_STATE_BACKEND"); val != "" {
+		c.Transfer.StateBackend = val
+	}
+
+	if val := os.Getenv("RETAIN_LOCAL_HOURS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed >= 0 {
+			c.Cleanup.RetainHours = parsed
+		}
+	}
+
+	if val := os.Getenv("CLEANUP_REQUIRE_TRANSFER_RECORD"); val != "" {
+		c.Cleanup.RequireTransferRecord = val == "true"
+	}
+
+	if val := os.Getenv("CLEANUP_FILE_TIMEOUT_SECONDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Cleanup.FileTimeout = time.Duration(parsed) * time.Second
+		}
+	}
+
 	if val := os.Getenv("LOCAL_OUTPUT_DIR"); val != "" {
 		c.Paths.LocalOutput = val
 	}
@@ -167,6 +686,74 @@ func (c *Config) loadFromEnvironment() error {
 		c.Processing.FFmpegPath = val
 	}
 
+	if val := os.Getenv("PROCESSING_WORKER_COUNT"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			c.Processing.WorkerCount = parsed
+		}
+	}
+
+	if val := os.Getenv("PROCESS_FILL_GAPS"); val != "" {
+		c.Processing.FillGaps = val == "true"
+	}
+
+	if val := os.Getenv("PROCESS_FASTSTART"); val != "" {
+		c.Processing.FastStart = val == "true"
+	}
+
+	if val := os.Getenv("FFMPEG_EXTRA_ARGS"); val != "" {
+		c.Processing.FFmpegExtraArgs = strings.FieldsFunc(val, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+	}
+
+	if val := os.Getenv("PROCESS_RESOLUTION_ORDER"); val != "" {
+		c.Processing.ResolutionOrder = ParseResolutionOrder(val)
+	}
+
+	if val := os.Getenv("PROCESS_CONCAT_SORT"); val != "" {
+		c.Processing.ConcatSort = val
+	}
+
+	if val := os.Getenv("PROCESS_MIN_OUTPUT_RATIO"); val != "" {
+		if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+			c.Processing.MinOutputRatio = parsed
+		}
+	}
+
+	if val := os.Getenv("PROCESS_PER_RESOLUTION"); val != "" {
+		c.Processing.PerResolution = val == "true"
+	}
+
+	if val := os.Getenv("PROCESS_MUX_SUBTITLES"); val != "" {
+		c.Processing.MuxSubtitles = val == "true"
+	}
+
+	if val := os.Getenv("PROCESS_AGGREGATE_SHARDS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			c.Processing.AggregateShards = parsed
+		}
+	}
+
+	if val := os.Getenv("PROCESS_STAGE_DIR"); val != "" {
+		c.Paths.StageDir = val
+	}
+
+	if val := os.Getenv("PROCESS_CONCAT_DIR"); val != "" {
+		c.Paths.ConcatDir = val
+	}
+
+	if val := os.Getenv("PROCESS_REMOVE_CONCAT"); val != "" {
+		c.Processing.RemoveConcatFile = val == "true"
+	}
+
+	if val := os.Getenv("SEGMENT_TEMP_DIR"); val != "" {
+		c.Paths.TempDir = val
+	}
+
+	if val := os.Getenv("SEGMENT_NAME_POLICY"); val != "" {
+		c.Paths.SegmentNamePolicy = val
+	}
+
 	return nil
 }
 
@@ -199,6 +786,24 @@ func (c *Config) resolveAndValidatePaths() error {
 		c.Paths.ProcessOutput,
 		c.Paths.ManifestDir,
 	}
+	if c.Paths.TempDir != "" {
+		if !filepath.IsAbs(c.Paths.TempDir) {
+			c.Paths.TempDir = filepath.Join(cwd, c.Paths.TempDir)
+		}
+		requiredDirs = append(requiredDirs, c.Paths.TempDir)
+	}
+	if c.Paths.ConcatDir != "" {
+		if !filepath.IsAbs(c.Paths.ConcatDir) {
+			c.Paths.ConcatDir = filepath.Join(cwd, c.Paths.ConcatDir)
+		}
+		requiredDirs = append(requiredDirs, c.Paths.ConcatDir)
+	}
+	if c.Paths.StageDir != "" {
+		if !filepath.IsAbs(c.Paths.StageDir) {
+			c.Paths.StageDir = filepath.Join(cwd, c.Paths.StageDir)
+		}
+		requiredDirs = append(requiredDirs, c.Paths.StageDir)
+	}
 
 	for _, dir := range requiredDirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
@@ -214,6 +819,89 @@ func (c *Config) resolveAndValidatePaths() error {
 		return fmt.Errorf("FFmpeg path is required when processing is enabled")
 	}
 
+	if c.Processing.ConcatSort != ConcatSortSequence && c.Processing.ConcatSort != ConcatSortModTime {
+		return fmt.Errorf("invalid concat sort: %s", c.Processing.ConcatSort)
+	}
+
+	if c.Processing.AggregateShards < 0 {
+		return fmt.Errorf("aggregate shards cannot be negative")
+	}
+
+	if c.Processing.MinOutputRatio < 0 || c.Processing.MinOutputRatio > 1 {
+		return fmt.Errorf("minimum output ratio must be between 0 and 1: %v", c.Processing.MinOutputRatio)
+	}
+
+	if c.Core.AdaptiveErrorRate < 0 || c.Core.AdaptiveErrorRate >= 1 {
+		return fmt.Errorf("adaptive error rate must be at least 0 and below 1: %v", c.Core.AdaptiveErrorRate)
+	}
+
+	if c.HTTP.CacheWarmerMethod != http.MethodHead && c.HTTP.CacheWarmerMethod != http.MethodGet {
+		return fmt.Errorf("invalid cache warmer method: %s", c.HTTP.CacheWarmerMethod)
+	}
+
+	switch c.Core.ExistingData {
+	case ExistingDataAppend, ExistingDataClean, ExistingDataAbort:
+	default:
+		return fmt.Errorf("invalid existing data policy: %s", c.Core.ExistingData)
+	}
+
+	switch c.Core.EmptySegment {
+	case EmptySegmentRetry, EmptySegmentSkip, EmptySegmentFail:
+	default:
+		return fmt.Errorf("invalid empty segment policy: %s", c.Core.EmptySegment)
+	}
+
+	switch c.Core.SegmentChecksum {
+	case ChecksumNone, ChecksumSHA256, ChecksumCRC32:
+	default:
+		return fmt.Errorf("invalid segment checksum: %s", c.Core.SegmentChecksum)
+	}
+
+	if c.Core.EventNamePattern != "" {
+		re, err := regexp.Compile(c.Core.EventNamePattern)
+		if err != nil {
+			return fmt.Errorf("invalid event name pattern: %w", err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("event name pattern needs a capture group: %s", c.Core.EventNamePattern)
+		}
+	}
+
+	if c.Transfer.QueueOrder != TransferOrderNewest && c.Transfer.QueueOrder != TransferOrderSmallest {
+		return fmt.Errorf("invalid transfer queue order: %s", c.Transfer.QueueOrder)
+	}
+
+	if c.Transfer.StateBackend != StateBackendJSON && c.Transfer.StateBackend != StateBackendSQLite {
+		return fmt.Errorf("invalid transfer state backend: %s", c.Transfer.StateBackend)
+	}
+
+	if c.Core.RollingSegments < 0 {
+		return fmt.Errorf("rolling window segments cannot be negative")
+	}
+
+	if c.Transfer.WatchMode != WatchModeNotify && c.Transfer.WatchMode != WatchModePoll {
+		return fmt.Errorf("invalid watch mode: %s", c.Transfer.WatchMode)
+	}
+	if c.Transfer.WatchPollInterval <= 0 {
+		return fmt.Errorf("watch poll interval must be positive")
+	}
+
+	if !utils.IsValidPathStyle(c.NAS.PathStyle) {
+		return fmt.Errorf("invalid NAS path style: %s", c.NAS.PathStyle)
+	}
+
+	if err := validateNASPathTemplate(c.NAS.PathTemplate); err != nil {
+		return err
+	}
+
+	if escapesNASRoot(c.NAS.Subpath) {
+		return fmt.Errorf("invalid NAS subpath %q: must be relative to the NAS output path", c.NAS.Subpath)
+	}
+
+	if !utils.IsValidNamePolicy(c.Paths.SegmentNamePolicy) {
+		return fmt.Errorf("invalid segment name policy: %s", c.Paths.SegmentNamePolicy)
+	}
+
 	return nil
 }
 
@@ -225,8 +913,94 @@ func (c *Config) GetManifestPath(eventName string) string {
 	return filepath.Join(c.Paths.ManifestDir, eventName+".json")
 }
 
+// GetIndexPath is where the download writes its segment index
+func (c *Config) GetIndexPath(eventName string) string {
+	return filepath.Join(c.Paths.ManifestDir, eventName+"_index.json")
+}
+
+// GetReportPath is where the download writes its capture report
+func (c *Config) GetReportPath(eventName string) string {
+	return filepath.Join(c.Paths.ManifestDir, eventName+"_report.json")
+}
+
+// GetEventLockPath is the lock file guarding an event against concurrent runs
+func (c *Config) GetEventLockPath(eventName string) string {
+	return filepath.Join(c.Paths.BaseDir, eventName+".lock")
+}
+
+// ParseResolutionOrder splits a comma or space separated resolution list
+func ParseResolutionOrder(val string) []string {
+	return strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// GetNASEventPath is the NAS directory of an event whose capture starts now
 func (c *Config) GetNASEventPath(eventName string) string {
-	return filepath.Join(c.NAS.OutputPath, eventName)
+	return filepath.Join(c.NAS.OutputPath, c.GetNASEventDir(eventName, time.Now()))
+}
+
+// GetNASEventDir renders NAS.PathTemplate for eventName under NAS.Subpath,
+// relative to the NAS output path, dated by captureStart
+func (c *Config) GetNASEventDir(eventName string, captureStart time.Time) string {
+	return c.renderNASTemplate(eventName, captureStart.Format(nasDateLayout))
+}
+
+// GetNASEventGlob is a filepath.Glob pattern matching the NAS directories of
+// eventName for any capture date
+func (c *Config) GetNASEventGlob(eventName string) string {
+	return filepath.Join(c.NAS.OutputPath, c.renderNASTemplate(eventName, "[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]"))
+}
+
+// GetNASEventsRoot is the NAS directory holding event directories:
+// NAS.OutputPath, or NAS.Subpath under it when set
+func (c *Config) GetNASEventsRoot() string {
+	return filepath.Join(c.NAS.OutputPath, filepath.FromSlash(strings.ReplaceAll(c.NAS.Subpath, `\`, "/")))
+}
+
+// renderNASTemplate fills in the template placeholders and prefixes
+// NAS.Subpath. Either separator may be used in both; the result uses the
+// host's. An empty template is just the event.
+func (c *Config) renderNASTemplate(eventName, date string) string {
+	template := c.NAS.PathTemplate
+	if template == "" {
+		template = NASTemplateEvent
+	}
+	dir := strings.NewReplacer(
+		NASTemplateEvent, eventName,
+		NASTemplateDate, date,
+		`\`, "/",
+	).Replace(template)
+	if c.NAS.Subpath != "" {
+		dir = strings.ReplaceAll(c.NAS.Subpath, `\`, "/") + "/" + dir
+	}
+	return filepath.Clean(filepath.FromSlash(dir))
+}
+
+// validateNASPathTemplate requires the event placeholder, so events stay
+// apart, and a relative path using only known placeholders
+func validateNASPathTemplate(template string) error {
+	if !strings.Contains(template, NASTemplateEvent) {
+		return fmt.Errorf("invalid NAS path template %q: must contain %s", template, NASTemplateEvent)
+	}
+	rest := strings.NewReplacer(NASTemplateEvent, "", NASTemplateDate, "").Replace(template)
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("invalid NAS path template %q: only %s and %s are supported", template, NASTemplateEvent, NASTemplateDate)
+	}
+	if escapesNASRoot(template) {
+		return fmt.Errorf("invalid NAS path template %q: must be relative to the NAS output path", template)
+	}
+	return nil
+}
+
+// escapesNASRoot reports whether path is absolute or climbs out of the NAS
+// output path with ..
+func escapesNASRoot(path string) bool {
+	escapes := filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		escapes = escapes || part == ".."
+	}
+	return escapes
 }
 
 func (c *Config) GetProcessOutputPath(eventName string) string {
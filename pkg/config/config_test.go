@@ -93,6 +93,12 @@ func TestConfig_PathMethods(t *testing.T) {
 		t.Errorf("GetManifestPath should end with .json, got %s", manifestPath)
 	}
 
+	// Test GetEventLockPath
+	lockPath := cfg.GetEventLockPath(testEvent)
+	if !strings.HasSuffix(lockPath, testEvent+".lock") {
+		t.Errorf("GetEventLockPath should end with event name and .lock, got %s", lockPath)
+	}
+
 	// Test GetNASEventPath
 	nasPath := cfg.GetNASEventPath(testEvent)
 	if !strings.Contains(nasPath, testEvent) {
@@ -179,3 +185,318 @@ func TestConfig_ValidationErrors(t *testing.T) {
 		t.Error("Config should not be nil")
 	}
 }
+
+func TestConfig_LoadWithOverrides(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envOutput := filepath.Join(tempDir, "env-data")
+	os.Setenv("LOCAL_OUTPUT_DIR", envOutput)
+	defer os.Unsetenv("LOCAL_OUTPUT_DIR")
+
+	flagOutput := filepath.Join(tempDir, "flag-data")
+	flagProcess := filepath.Join(tempDir, "flag-out")
+	cfg, err := LoadWithOverrides(Overrides{
+		LocalOutput:   flagOutput,
+		ProcessOutput: flagProcess,
+	})
+	if err != nil {
+		t.Fatalf("LoadWithOverrides() failed: %v", err)
+	}
+
+	if cfg.Paths.LocalOutput != flagOutput {
+		t.Errorf("Expected LocalOutput=%s from override, got %s", flagOutput, cfg.Paths.LocalOutput)
+	}
+	if cfg.Paths.ProcessOutput != flagProcess {
+		t.Errorf("Expected ProcessOutput=%s from override, got %s", flagProcess, cfg.Paths.ProcessOutput)
+	}
+	if _, err := os.Stat(flagOutput); err != nil {
+		t.Errorf("Override directory should have been created: %v", err)
+	}
+	if _, err := os.Stat(envOutput); !os.IsNotExist(err) {
+		t.Errorf("Environment directory should not be created when overridden")
+	}
+
+	// Empty overrides fall back to the environment
+	cfg, err = LoadWithOverrides(Overrides{})
+	if err != nil {
+		t.Fatalf("LoadWithOverrides() failed: %v", err)
+	}
+	if cfg.Paths.LocalOutput != envOutput {
+		t.Errorf("Expected LocalOutput=%s from environment, got %s", envOutput, cfg.Paths.LocalOutput)
+	}
+}
+
+func TestConfig_GetNASEventDir(t *testing.T) {
+	captureStart := time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{NASTemplateEvent, "finals"},
+		{"{event}/{date}", filepath.Join("finals", "2024-06-01")},
+		{"{date}/{event}", filepath.Join("2024-06-01", "finals")},
+		{`captures\{event}\{date}`, filepath.Join("captures", "finals", "2024-06-01")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			cfg := &Config{NAS: NASConfig{OutputPath: "/nas", PathTemplate: tt.template}}
+			if got := cfg.GetNASEventDir("finals", captureStart); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfig_GetNASEventGlob(t *testing.T) {
+	nasRoot, err := os.MkdirTemp("", "config_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(nasRoot)
+
+	for _, dir := range []string{"2024-06-01", "2024-06-02", "notes"} {
+		os.MkdirAll(filepath.Join(nasRoot, "finals", dir), 0755)
+	}
+	os.MkdirAll(filepath.Join(nasRoot, "prelims", "2024-06-01"), 0755)
+
+	cfg := &Config{NAS: NASConfig{OutputPath: nasRoot, PathTemplate: "{event}/{date}"}}
+	matches, err := filepath.Glob(cfg.GetNASEventGlob("finals"))
+	if err != nil {
+		t.Fatalf("Glob failed: %v", err)
+	}
+	want := []string{
+		filepath.Join(nasRoot, "finals", "2024-06-01"),
+		filepath.Join(nasRoot, "finals", "2024-06-02"),
+	}
+	if strings.Join(matches, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v, got %v", want, matches)
+	}
+}
+
+func TestConfig_NASSubpath(t *testing.T) {
+	captureStart := time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		subpath  string
+		template string
+		wantDir  string
+		wantRoot string
+	}{
+		{"", NASTemplateEvent, "finals", "/nas"},
+		{"regionals", NASTemplateEvent, filepath.Join("regionals", "finals"), filepath.Join("/nas", "regionals")},
+		{"dci/2024", "{event}/{date}", filepath.Join("dci", "2024", "finals", "2024-06-01"), filepath.Join("/nas", "dci", "2024")},
+		{`boa\regionals`, NASTemplateEvent, filepath.Join("boa", "regionals", "finals"), filepath.Join("/nas", "boa", "regionals")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.subpath, func(t *testing.T) {
+			cfg := &Config{NAS: NASConfig{OutputPath: "/nas", PathTemplate: tt.template, Subpath: tt.subpath}}
+			if got := cfg.GetNASEventDir("finals", captureStart); got != tt.wantDir {
+				t.Errorf("GetNASEventDir: expected %s, got %s", tt.wantDir, got)
+			}
+			if got := cfg.GetNASEventsRoot(); got != tt.wantRoot {
+				t.Errorf("GetNASEventsRoot: expected %s, got %s", tt.wantRoot, got)
+			}
+			if tt.template == NASTemplateEvent {
+				want := filepath.Join("/nas", tt.wantDir)
+				if got := cfg.GetNASEventPath("finals"); got != want {
+					t.Errorf("GetNASEventPath: expected %s, got %s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestEscapesNASRoot(t *testing.T) {
+	tests := []struct {
+		path    string
+		escapes bool
+	}{
+		{"", false},
+		{"regionals", false},
+		{`dci\2024`, false},
+		{"/srv/captures", true},
+		{`\captures`, true},
+		{"regionals/../..", true},
+	}
+
+	for _, tt := range tests {
+		if got := escapesNASRoot(tt.path); got != tt.escapes {
+			t.Errorf("escapesNASRoot(%q): expected %v, got %v", tt.path, tt.escapes, got)
+		}
+	}
+}
+
+func TestValidateNASPathTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{"{event}", true},
+		{"{event}/{date}", true},
+		{`archive\{date}\{event}`, true},
+		{"{date}", false},
+		{"{event}/{time}", false},
+		{"/srv/{event}", false},
+		{"{event}/../{date}", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			err := validateNASPathTemplate(tt.template)
+			if tt.valid && err != nil {
+				t.Errorf("Expected %q to be valid, got %v", tt.template, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Expected %q to be rejected", tt.template)
+			}
+		})
+	}
+}
+
+func TestConfig_LoadFromFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.Setenv("LOCAL_OUTPUT_DIR", filepath.Join(tempDir, "data"))
+	defer os.Unsetenv("LOCAL_OUTPUT_DIR")
+
+	configPath := filepath.Join(tempDir, "config.yaml")
+	content := `core:
+  workercount: 6
+  refreshdelay: 5s
+nas:
+  username: fileuser
+transfer:
+  workercount: 7
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	os.Setenv("CONFIG_FILE", configPath)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if cfg.NAS.Username != "fileuser" {
+		t.Errorf("Expected NAS.Username=fileuser from file, got %s", cfg.NAS.Username)
+	}
+	if cfg.Transfer.WorkerCount != 7 {
+		t.Errorf("Expected Transfer.WorkerCount=7 from file, got %d", cfg.Transfer.WorkerCount)
+	}
+	if cfg.Core.RefreshDelay != 5*time.Second {
+		t.Errorf("Expected Core.RefreshDelay=5s from file, got %v", cfg.Core.RefreshDelay)
+	}
+	if cfg.HTTP.Referer != defaultConfig.HTTP.Referer {
+		t.Errorf("Expected settings missing from the file to keep their default, got Referer=%s", cfg.HTTP.Referer)
+	}
+
+	// The environment takes precedence over the file
+	os.Setenv("WORKER_COUNT", "9")
+	defer os.Unsetenv("WORKER_COUNT")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if cfg.Core.WorkerCount != 9 {
+		t.Errorf("Expected Core.WorkerCount=9 from environment, got %d", cfg.Core.WorkerCount)
+	}
+}
+
+func TestConfig_LoadFromFileErrors(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"json", `{"nas": {"username": "jsonuser"}}`, false},
+		{"empty", "", false},
+		{"malformed", "nas: [username", true},
+		{"unknown key", "nas:\n  usrname: typo\n", true},
+		{"wrong type", "transfer:\n  workercount: many\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tempDir, strings.ReplaceAll(tt.name, " ", "_")+".yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg := defaultConfig
+			err := cfg.loadFromFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error=%v, got %v", tt.wantErr, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), path) {
+				t.Errorf("Expected error to name the config file, got %v", err)
+			}
+		})
+	}
+
+	// A missing file leaves the defaults in place
+	cfg := defaultConfig
+	if err := cfg.loadFromFile(filepath.Join(tempDir, "missing.yaml")); err != nil {
+		t.Errorf("Expected a missing config file to be ignored, got %v", err)
+	}
+	if cfg.Transfer.WorkerCount != defaultConfig.Transfer.WorkerCount {
+		t.Errorf("Expected default Transfer.WorkerCount, got %d", cfg.Transfer.WorkerCount)
+	}
+}
+
+func TestConfig_TunablesFromEnvironment(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+		get   func(c *Config) interface{}
+		want  interface{}
+	}{
+		{"TRANSFER_WORKER_COUNT", "6", func(c *Config) interface{} { return c.Transfer.WorkerCount }, 6},
+		{"TRANSFER_QUEUE_SIZE", "5000", func(c *Config) interface{} { return c.Transfer.QueueSize }, 5000},
+		{"TRANSFER_BATCH_SIZE", "250", func(c *Config) interface{} { return c.Transfer.BatchSize }, 250},
+		{"FILE_SETTLING_DELAY_SECONDS", "12", func(c *Config) interface{} { return c.Transfer.FileSettlingDelay }, 12 * time.Second},
+		{"PROCESSING_WORKER_COUNT", "3", func(c *Config) interface{} { return c.Processing.WorkerCount }, 3},
+		{"RETAIN_LOCAL_HOURS", "48", func(c *Config) interface{} { return c.Cleanup.RetainHours }, 48},
+		{"NAS_RETRY_LIMIT", "5", func(c *Config) interface{} { return c.NAS.RetryLimit }, 5},
+		{"NAS_TIMEOUT_SECONDS", "90", func(c *Config) interface{} { return c.NAS.Timeout }, 90 * time.Second},
+
+		// Unparseable or out of range values keep the default
+		{"TRANSFER_WORKER_COUNT", "many", func(c *Config) interface{} { return c.Transfer.WorkerCount }, defaultConfig.Transfer.WorkerCount},
+		{"TRANSFER_QUEUE_SIZE", "0", func(c *Config) interface{} { return c.Transfer.QueueSize }, defaultConfig.Transfer.QueueSize},
+		{"FILE_SETTLING_DELAY_SECONDS", "5s", func(c *Config) interface{} { return c.Transfer.FileSettlingDelay }, defaultConfig.Transfer.FileSettlingDelay},
+		{"RETAIN_LOCAL_HOURS", "-1", func(c *Config) interface{} { return c.Cleanup.RetainHours }, defaultConfig.Cleanup.RetainHours},
+		{"NAS_TIMEOUT_SECONDS", "0", func(c *Config) interface{} { return c.NAS.Timeout }, defaultConfig.NAS.Timeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env+"="+tt.value, func(t *testing.T) {
+			os.Setenv(tt.env, tt.value)
+			defer os.Unsetenv(tt.env)
+
+			cfg := defaultConfig
+			if err := cfg.loadFromEnvironment(); err != nil {
+				t.Fatalf("loadFromEnvironment() failed: %v", err)
+			}
+			if got := tt.get(&cfg); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
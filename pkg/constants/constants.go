@@ -6,14 +6,21 @@ import (
 )
 
 var (
-	globalConfig *config.Config
-	configOnce   sync.Once
-	configError  error
+	globalConfig    *config.Config
+	configOnce      sync.Once
+	configError     error
+	configOverrides config.Overrides
 )
 
+// SetOverrides registers command line overrides for the global config. It
+// must be called before the first GetConfig to have any effect.
+func SetOverrides(overrides config.Overrides) {
+	configOverrides = overrides
+}
+
 func GetConfig() (*config.Config, error) {
 	configOnce.Do(func() {
-		globalConfig, configError = config.Load()
+		globalConfig, configError = config.LoadWithOverrides(configOverrides)
 	})
 	return globalConfig, configError
 }
@@ -0,0 +1,94 @@
+package httpClient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// ClientOptions configures the transport of the shared HTTP client
+type ClientOptions struct {
+	// ProxyURL overrides HTTP_PROXY/HTTPS_PROXY/NO_PROXY when set
+	ProxyURL string
+	// InsecureSkipVerify disables TLS certificate verification
+	InsecureSkipVerify bool
+	// CABundlePath adds PEM certificates to the system trust store
+	CABundlePath string
+}
+
+var (
+	defaultClient *http.Client
+	defaultMu     sync.RWMutex
+)
+
+// NewClient builds an HTTP client whose transport honors the given options
+func NewClient(opts ClientOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", opts.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if opts.InsecureSkipVerify || opts.CABundlePath != "" {
+		tlsConfig := &tls.Config{}
+
+		if opts.CABundlePath != "" {
+			pem, err := os.ReadFile(opts.CABundlePath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CABundlePath)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		if opts.InsecureSkipVerify {
+			log.Println("WARNING: TLS certificate verification is DISABLED. Connections are vulnerable to interception.")
+			tlsConfig.InsecureSkipVerify = true
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// SetDefault replaces the shared client returned by Default
+func SetDefault(client *http.Client) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultClient = client
+}
+
+// Default returns the shared client used for playlist and segment requests.
+// Until SetDefault is called it is a client built from zero ClientOptions.
+func Default() *http.Client {
+	defaultMu.RLock()
+	client := defaultClient
+	defaultMu.RUnlock()
+	if client != nil {
+		return client
+	}
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultClient == nil {
+		defaultClient, _ = NewClient(ClientOptions{})
+	}
+	return defaultClient
+}
@@ -0,0 +1,143 @@
+package httpClient
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestNewClient_RoutesThroughProxy(t *testing.T) {
+	var mu sync.Mutex
+	var proxied []string
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(ClientOptions{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+
+	// The origin host does not exist, so a response can only come from the proxy
+	resp, err := client.Get("http://origin.invalid/stream/playlist.m3u8")
+	if err != nil {
+		t.Fatalf("Request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "via proxy" {
+		t.Errorf("Expected response from proxy, got %q", string(body))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) != 1 || proxied[0] != "http://origin.invalid/stream/playlist.m3u8" {
+		t.Errorf("Expected proxy to receive the absolute origin URL, got %v", proxied)
+	}
+}
+
+func TestNewClient_InvalidProxyURL(t *testing.T) {
+	if _, err := NewClient(ClientOptions{ProxyURL: "not a url"}); err == nil {
+		t.Error("Expected error for invalid proxy URL")
+	}
+}
+
+func TestDefault_SetDefault(t *testing.T) {
+	original := Default()
+	if original == nil {
+		t.Fatal("Default() returned nil")
+	}
+	defer SetDefault(original)
+
+	custom := &http.Client{}
+	SetDefault(custom)
+	if Default() != custom {
+		t.Error("Default() did not return the client passed to SetDefault")
+	}
+}
+
+func TestNewClient_SelfSignedTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U"))
+	}))
+	defer server.Close()
+
+	secure, err := NewClient(ClientOptions{})
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	if resp, err := secure.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("Expected certificate verification failure with default options")
+	}
+
+	insecure, err := NewClient(ClientOptions{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	resp, err := insecure.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected request to succeed with verification disabled: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewClient_CABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U"))
+	}))
+	defer server.Close()
+
+	tempDir, err := os.MkdirTemp("", "client_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	bundlePath := filepath.Join(tempDir, "ca.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundlePath, bundle, 0644); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+
+	client, err := NewClient(ClientOptions{CABundlePath: bundlePath})
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected request to succeed with custom CA bundle: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewClient_InvalidCABundle(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "client_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	bundlePath := filepath.Join(tempDir, "empty.pem")
+	if err := os.WriteFile(bundlePath, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+
+	if _, err := NewClient(ClientOptions{CABundlePath: bundlePath}); err == nil {
+		t.Error("Expected error for CA bundle without certificates")
+	}
+	if _, err := NewClient(ClientOptions{CABundlePath: filepath.Join(tempDir, "missing.pem")}); err == nil {
+		t.Error("Expected error for missing CA bundle")
+	}
+}
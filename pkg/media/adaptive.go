@@ -0,0 +1,121 @@
+package media
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// adaptiveWindow is how many segment downloads AdaptiveConcurrency counts
+// before deciding whether to back off or ramp up
+const adaptiveWindow = 20
+
+// AdaptiveConcurrency shrinks the shared download semaphore when segment
+// downloads start failing, since a CDN answering with 403s only gets worse
+// under full load. It backs off by holding slots of the semaphore itself:
+// every window whose failure rate is above the threshold halves the usable
+// slots, down to one, and every window at or below it gives one back.
+type AdaptiveConcurrency struct {
+	sem       chan struct{}
+	threshold float64
+	window    int
+	changed   chan struct{}
+
+	mu       sync.Mutex
+	limit    int
+	outcomes int
+	failures int
+}
+
+// NewAdaptiveConcurrency returns a controller for sem that starts with every
+// slot usable. It has no effect until Run is started.
+func NewAdaptiveConcurrency(sem chan struct{}, threshold float64) *AdaptiveConcurrency {
+	return &AdaptiveConcurrency{
+		sem:       sem,
+		threshold: threshold,
+		window:    adaptiveWindow,
+		changed:   make(chan struct{}, 1),
+		limit:     cap(sem),
+	}
+}
+
+// Limit returns how many slots of the semaphore downloads may use
+func (a *AdaptiveConcurrency) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// Record counts the outcome of one segment download. A nil
+// *AdaptiveConcurrency ignores it.
+func (a *AdaptiveConcurrency) Record(err error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.outcomes++
+	if err != nil {
+		a.failures++
+	}
+	if a.outcomes < a.window {
+		return
+	}
+
+	rate := float64(a.failures) / float64(a.outcomes)
+	a.outcomes, a.failures = 0, 0
+	previous := a.limit
+	if rate > a.threshold {
+		a.limit = max(1, a.limit/2)
+	} else if a.limit < cap(a.sem) {
+		a.limit++
+	}
+	if a.limit == previous {
+		return
+	}
+
+	if a.limit < previous {
+		log.Printf("%.0f%% of recent segment downloads failed, reducing concurrency to %d of %d", rate*100, a.limit, cap(a.sem))
+	} else if a.limit == cap(a.sem) {
+		log.Printf("Segment downloads recovered, concurrency back to %d", a.limit)
+	}
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run holds the slots above the current limit until ctx is done, taking each
+// one as a download releases it, and then gives them all back
+func (a *AdaptiveConcurrency) Run(ctx context.Context) {
+	held := 0
+	defer func() {
+		for ; held > 0; held-- {
+			<-a.sem
+		}
+	}()
+
+	for {
+		want := cap(a.sem) - a.Limit()
+		switch {
+		case held > want:
+			<-a.sem
+			held--
+		case held < want:
+			select {
+			case a.sem <- struct{}{}:
+				held++
+			case <-a.changed:
+			case <-ctx.Done():
+				return
+			}
+		default:
+			select {
+			case <-a.changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForHeld waits until the controller holds want slots of sem
+func waitForHeld(t *testing.T, sem chan struct{}, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sem) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d held slots, got %d", want, len(sem))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// recordWindow records one full window of outcomes, failures of them errors
+func recordWindow(a *AdaptiveConcurrency, failures int) {
+	for i := 0; i < a.window; i++ {
+		var err error
+		if i < failures {
+			err = errors.New("403")
+		}
+		a.Record(err)
+	}
+}
+
+func TestAdaptiveConcurrency_BacksOffAndRecovers(t *testing.T) {
+	sem := make(chan struct{}, 8)
+	a := NewAdaptiveConcurrency(sem, 0.25)
+	a.window = 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx)
+	}()
+
+	// An error burst halves the usable slots each window, down to one
+	for _, want := range []int{4, 2, 1, 1} {
+		recordWindow(a, 3)
+		if got := a.Limit(); got != want {
+			t.Fatalf("Expected limit %d after an error burst, got %d", want, got)
+		}
+		waitForHeld(t, sem, 8-want)
+	}
+
+	// Only one download can start while backed off
+	select {
+	case sem <- struct{}{}:
+	default:
+		t.Fatal("Expected one usable slot while backed off")
+	}
+	select {
+	case sem <- struct{}{}:
+		t.Fatal("Expected a second download to wait while backed off")
+	default:
+	}
+	<-sem
+
+	// A window at the threshold isn't a burst
+	recordWindow(a, 1)
+	if got := a.Limit(); got != 2 {
+		t.Errorf("Expected limit 2 after a window at the threshold, got %d", got)
+	}
+
+	// Healthy windows give one slot back each until every slot is usable
+	for want := 3; want <= 8; want++ {
+		recordWindow(a, 0)
+		if got := a.Limit(); got != want {
+			t.Fatalf("Expected limit %d while recovering, got %d", want, got)
+		}
+		waitForHeld(t, sem, 8-want)
+	}
+	recordWindow(a, 0)
+	if got := a.Limit(); got != 8 {
+		t.Errorf("Expected limit to stay at capacity 8, got %d", got)
+	}
+
+	cancel()
+	<-done
+	if len(sem) != 0 {
+		t.Errorf("Expected every slot released after Run returns, %d still held", len(sem))
+	}
+}
+
+func TestAdaptiveConcurrency_WaitsForBusySlots(t *testing.T) {
+	sem := make(chan struct{}, 4)
+	a := NewAdaptiveConcurrency(sem, 0.5)
+	a.window = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every slot is busy downloading when the burst comes
+	for i := 0; i < 4; i++ {
+		sem <- struct{}{}
+	}
+	go a.Run(ctx)
+	recordWindow(a, 2)
+	if got := a.Limit(); got != 2 {
+		t.Fatalf("Expected limit 2, got %d", got)
+	}
+
+	// Finished downloads hand their slots to the controller instead of the
+	// next segment until it holds enough
+	<-sem
+	<-sem
+	waitForHeld(t, sem, 4)
+	<-sem
+	<-sem
+	waitForHeld(t, sem, 2)
+	select {
+	case sem <- struct{}{}:
+	default:
+		t.Error("Expected a slot once downloads drop below the limit")
+	}
+}
+
+func TestAdaptiveConcurrency_NilIgnoresOutcomes(t *testing.T) {
+	var a *AdaptiveConcurrency
+	a.Record(errors.New("403"))
+}
@@ -0,0 +1,28 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"m3u8-downloader/pkg/config"
+)
+
+// newSegmentHash returns the hash for a Core.SegmentChecksum setting, or nil
+// when no checksum is recorded
+func newSegmentHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case config.ChecksumSHA256:
+		return sha256.New()
+	case config.ChecksumCRC32:
+		return crc32.NewIEEE()
+	default:
+		return nil
+	}
+}
+
+// formatChecksum renders a finished hash as "<algorithm>:<hex>", so a later
+// audit knows which hash to recompute
+func formatChecksum(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,127 @@
+package media
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/constants"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setSegmentChecksum(t *testing.T, algorithm string) {
+	t.Helper()
+	cfg := constants.MustGetConfig()
+	old := cfg.Core.SegmentChecksum
+	cfg.Core.SegmentChecksum = algorithm
+	t.Cleanup(func() { cfg.Core.SegmentChecksum = old })
+}
+
+func TestDownloadSegment_Checksum(t *testing.T) {
+	content := []byte("segment content")
+	sha := sha256.Sum256(content)
+
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{config.ChecksumNone, ""},
+		{config.ChecksumSHA256, "sha256:" + hex.EncodeToString(sha[:])},
+		{config.ChecksumCRC32, fmt.Sprintf("crc32:%08x", crc32.ChecksumIEEE(content))},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			setSegmentChecksum(t, tt.algorithm)
+
+			tempDir, err := os.MkdirTemp("", "checksum_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			written, checksum, err := DownloadSegment(context.Background(), server.Client(), server.URL+"/media_0001.ts", tempDir, 0, nil)
+			if err != nil {
+				t.Fatalf("DownloadSegment() failed: %v", err)
+			}
+			if written != int64(len(content)) {
+				t.Errorf("Expected %d bytes written, got %d", len(content), written)
+			}
+			if checksum != tt.expected {
+				t.Errorf("Expected checksum %q, got %q", tt.expected, checksum)
+			}
+		})
+	}
+}
+
+func TestVariantDownloader_RecordsChecksums(t *testing.T) {
+	setSegmentChecksum(t, config.ChecksumSHA256)
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "checksum_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		fmt.Fprint(w, "#EXTINF:6.0,\nmedia_0001.ts\n#EXTINF:6.0,\nmedia_0002.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Distinct content per segment, so a mixed-up checksum shows
+		w.Write([]byte("content of " + r.URL.Path))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	manifest := &ManifestWriter{ManifestPath: filepath.Join(tempDir, "manifest.json")}
+	VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), manifest, nil, DownloadOptions{})
+	if err := manifest.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	items, err := ReadManifest(manifest.ManifestPath, false)
+	if err != nil {
+		t.Fatalf("ReadManifest() error: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 manifest items, got %+v", items)
+	}
+	for _, item := range items {
+		data, err := os.ReadFile(filepath.Join(tempDir, "1080p", fmt.Sprintf("media_%04s.ts", item.SeqNo)))
+		if err != nil {
+			t.Fatalf("Failed to read segment %s: %v", item.SeqNo, err)
+		}
+		sum := sha256.Sum256(data)
+		expected := "sha256:" + hex.EncodeToString(sum[:])
+		if item.Checksums["1080p"] != expected {
+			t.Errorf("Sequence %s: expected checksum %s, got %s", item.SeqNo, expected, item.Checksums["1080p"])
+		}
+	}
+}
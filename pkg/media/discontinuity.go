@@ -0,0 +1,135 @@
+package media
+
+import (
+	"fmt"
+	"github.com/grafov/m3u8"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// discontinuityTracker numbers a variant's segments by encoder run so that
+// sequence numbers repeated after a restart are not mistaken for segments
+// already downloaded. A run ends at an #EXT-X-DISCONTINUITY tag or when the
+// media sequence jumps backwards between polls.
+type discontinuityTracker struct {
+	started     bool
+	current     uint64
+	windowStart uint64
+	next        uint64            // first media sequence not yet numbered
+	assigned    map[uint64]uint64 // media sequence -> discontinuity, for the live window
+}
+
+func newDiscontinuityTracker() *discontinuityTracker {
+	return &discontinuityTracker{assigned: make(map[uint64]uint64)}
+}
+
+// Assign returns the discontinuity number of each segment in playlist, in
+// playlist order. Segments still in the window from an earlier poll keep the
+// number they were first given.
+func (t *discontinuityTracker) Assign(playlist *m3u8.MediaPlaylist) []uint64 {
+	restarted := t.started && playlist.SeqNo < t.windowStart
+	if restarted {
+		t.current++
+		t.next = playlist.SeqNo
+		t.assigned = make(map[uint64]uint64)
+	}
+	if !t.started {
+		t.next = playlist.SeqNo
+		t.started = true
+	}
+	t.windowStart = playlist.SeqNo
+
+	for seq := range t.assigned {
+		if seq < playlist.SeqNo {
+			delete(t.assigned, seq)
+		}
+	}
+
+	result := make([]uint64, 0, len(playlist.Segments))
+	seq := playlist.SeqNo
+	for _, seg := range playlist.Segments {
+		if seg == nil {
+			continue
+		}
+		if seq >= t.next {
+			// A restart that also tags its first segment is one run, not two
+			if seg.Discontinuity && !(restarted && seq == playlist.SeqNo) {
+				t.current++
+			}
+			t.assigned[seq] = t.current
+			t.next = seq + 1
+		}
+		result = append(result, t.assigned[seq])
+		seq++
+	}
+	return result
+}
+
+// discontinuityFileName tags a segment filename with its discontinuity so a
+// repeated name from a later encoder run doesn't overwrite the earlier file.
+// The first run keeps the original name.
+func discontinuityFileName(name string, discontinuity uint64) string {
+	if discontinuity == 0 {
+		return name
+	}
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s_d%d%s", strings.TrimSuffix(name, ext), discontinuity, ext)
+}
+
+// segmentSeqPattern captures the trailing sequence number of a segment name,
+// and the number of any discontinuity tag from discontinuityFileName
+var segmentSeqPattern = regexp.MustCompile(`(\d+)(?:_d(\d+))?$`)
+
+// SegmentSeqNo parses the sequence number from a segment filename such as
+// media_0001.ts or media_0001_d1.ts
+func SegmentSeqNo(name string) (int, error) {
+	seq, _, err := ParseSegmentName(name)
+	return seq, err
+}
+
+// ParseSegmentName parses the sequence number and discontinuity from a
+// segment filename: 1 and 0 for media_0001.ts, 1 and 1 for media_0001_d1.ts.
+// Manifest keys from ManifestKey parse the same way.
+func ParseSegmentName(name string) (seq int, discontinuity int, err error) {
+	base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	match := segmentSeqPattern.FindStringSubmatch(base)
+	if match == nil {
+		return 0, 0, fmt.Errorf("no sequence number in segment name %q", name)
+	}
+	if seq, err = strconv.Atoi(match[1]); err != nil {
+		return 0, 0, err
+	}
+	if match[2] != "" {
+		if discontinuity, err = strconv.Atoi(match[2]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return seq, discontinuity, nil
+}
+
+// ManifestKey is the manifest SeqNo of a segment: its sequence number, tagged
+// like discontinuityFileName after the first encoder run so a restarted
+// sequence number gets its own item
+func ManifestKey(seq, discontinuity uint64) string {
+	return discontinuityFileName(strconv.FormatUint(seq, 10), discontinuity)
+}
+
+// manifestKeyLess orders manifest keys by discontinuity, then sequence
+// number. Keys that don't parse sort after those that do, by their text.
+func manifestKeyLess(a, b string) bool {
+	seqA, discA, errA := ParseSegmentName(a)
+	seqB, discB, errB := ParseSegmentName(b)
+	switch {
+	case errA != nil || errB != nil:
+		if (errA == nil) != (errB == nil) {
+			return errA == nil
+		}
+		return a < b
+	case discA != discB:
+		return discA < discB
+	default:
+		return seqA < seqB
+	}
+}
@@ -0,0 +1,189 @@
+package media
+
+import (
+	"fmt"
+	"github.com/grafov/m3u8"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func decodeTestMediaPlaylist(t *testing.T, body string) *m3u8.MediaPlaylist {
+	t.Helper()
+	pl, listType, err := decodePlaylist(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to decode playlist: %v", err)
+	}
+	if listType != m3u8.MEDIA {
+		t.Fatalf("Expected a media playlist")
+	}
+	return pl.(*m3u8.MediaPlaylist)
+}
+
+// testPlaylist builds a live playlist starting at mediaSeq; a "!" prefix on
+// a name marks that segment with #EXT-X-DISCONTINUITY
+func testPlaylist(mediaSeq int, names ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSeq)
+	for _, name := range names {
+		if strings.HasPrefix(name, "!") {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+			name = name[1:]
+		}
+		fmt.Fprintf(&b, "#EXTINF:6.0,\n%s\n", name)
+	}
+	return b.String()
+}
+
+func jobKeys(t *testing.T, tracker *discontinuityTracker, body string) []string {
+	t.Helper()
+	playlist := decodeTestMediaPlaylist(t, body)
+	discs := tracker.Assign(playlist)
+
+	var keys []string
+	for i, seg := range playlist.Segments {
+		if seg == nil {
+			continue
+		}
+		job := SegmentJob{URI: seg.URI, Seq: playlist.SeqNo + uint64(i), Discontinuity: discs[i]}
+		keys = append(keys, job.Key())
+	}
+	return keys
+}
+
+func TestDiscontinuityTracker_RestartedSequence(t *testing.T) {
+	tracker := newDiscontinuityTracker()
+	seen := make(map[string]bool)
+	var downloaded []string
+
+	polls := []string{
+		testPlaylist(1, "media_0001.ts", "media_0002.ts", "media_0003.ts"),
+		testPlaylist(2, "media_0002.ts", "media_0003.ts", "media_0004.ts"),
+		// Encoder restarted without tagging the discontinuity
+		testPlaylist(1, "media_0001.ts", "media_0002.ts"),
+		testPlaylist(1, "media_0001.ts", "media_0002.ts", "media_0003.ts"),
+	}
+	for _, body := range polls {
+		for _, key := range jobKeys(t, tracker, body) {
+			if !seen[key] {
+				seen[key] = true
+				downloaded = append(downloaded, key)
+			}
+		}
+	}
+
+	expected := []string{
+		"0:1:media_0001.ts", "0:2:media_0002.ts", "0:3:media_0003.ts", "0:4:media_0004.ts",
+		"1:1:media_0001.ts", "1:2:media_0002.ts", "1:3:media_0003.ts",
+	}
+	if strings.Join(downloaded, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected downloads %v, got %v", expected, downloaded)
+	}
+}
+
+func TestDiscontinuityTracker_TaggedDiscontinuity(t *testing.T) {
+	tracker := newDiscontinuityTracker()
+
+	first := jobKeys(t, tracker, testPlaylist(10, "a_0010.ts", "!b_0001.ts", "b_0002.ts"))
+	expected := []string{"0:10:a_0010.ts", "1:11:b_0001.ts", "1:12:b_0002.ts"}
+	if strings.Join(first, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, first)
+	}
+
+	// The tagged segment slides out; later segments keep their number
+	second := jobKeys(t, tracker, testPlaylist(12, "b_0002.ts", "b_0003.ts"))
+	expected = []string{"1:12:b_0002.ts", "1:13:b_0003.ts"}
+	if strings.Join(second, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, second)
+	}
+}
+
+func TestDiscontinuityTracker_TaggedRestartCountsOnce(t *testing.T) {
+	tracker := newDiscontinuityTracker()
+	jobKeys(t, tracker, testPlaylist(50, "media_0050.ts", "media_0051.ts"))
+
+	keys := jobKeys(t, tracker, testPlaylist(1, "!media_0001.ts", "media_0002.ts"))
+	expected := []string{"1:1:media_0001.ts", "1:2:media_0002.ts"}
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+func TestDiscontinuityFileName(t *testing.T) {
+	tests := []struct {
+		name          string
+		discontinuity uint64
+		want          string
+	}{
+		{"media_0001.ts", 0, "media_0001.ts"},
+		{"media_0001.ts", 1, "media_0001_d1.ts"},
+		{"media_0001.ts", 12, "media_0001_d12.ts"},
+		{"segment", 2, "segment_d2"},
+	}
+
+	for _, tt := range tests {
+		if got := discontinuityFileName(tt.name, tt.discontinuity); got != tt.want {
+			t.Errorf("discontinuityFileName(%q, %d) = %q, want %q", tt.name, tt.discontinuity, got, tt.want)
+		}
+	}
+}
+
+func TestSegmentSeqNo(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    int
+		wantErr bool
+	}{
+		{name: "media_0001.ts", want: 1},
+		{name: "media_1234.ts", want: 1234},
+		{name: "media_0042_d2.ts", want: 42},
+		{name: "1080p/segment99.ts", want: 99},
+		{name: "index.ts", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SegmentSeqNo(tt.name)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %s, got %d", tt.name, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSegmentName(t *testing.T) {
+	tests := []struct {
+		name              string
+		wantSeq, wantDisc int
+	}{
+		{"media_0001.ts", 1, 0},
+		{"media_0042_d2.ts", 42, 2},
+		{"1080p/segment99_d10.ts", 99, 10},
+		{ManifestKey(7, 0), 7, 0},
+		{ManifestKey(7, 3), 7, 3},
+	}
+
+	for _, tt := range tests {
+		seq, disc, err := ParseSegmentName(tt.name)
+		if err != nil || seq != tt.wantSeq || disc != tt.wantDisc {
+			t.Errorf("ParseSegmentName(%q) = %d, %d, %v, want %d, %d", tt.name, seq, disc, err, tt.wantSeq, tt.wantDisc)
+		}
+	}
+}
+
+func TestManifestKeyLess(t *testing.T) {
+	keys := []string{"1_d1", "1000", "999", "2_d1", "1"}
+	sort.Slice(keys, func(i, j int) bool { return manifestKeyLess(keys[i], keys[j]) })
+	if got := strings.Join(keys, ","); got != "1,999,1000,1_d1,2_d1" {
+		t.Errorf("Expected keys ordered by discontinuity then sequence, got %s", got)
+	}
+}
@@ -0,0 +1,133 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var digitsPattern = regexp.MustCompile(`\d+`)
+
+// segmentURIForSeq turns uri, the URI of segment seq, into the URI segment
+// target would have by replacing the number in its file name that equals
+// seq. It fails for names that don't carry the sequence number.
+func segmentURIForSeq(uri string, seq, target uint64) (string, bool) {
+	rest, query := uri, ""
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		rest, query = uri[:i], uri[i:]
+	}
+	dir, name := path.Split(rest)
+
+	matches := digitsPattern.FindAllStringIndex(name, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		start, end := matches[i][0], matches[i][1]
+		n, err := strconv.ParseUint(name[start:end], 10, 64)
+		if err != nil || n != seq {
+			continue
+		}
+		// Zero-padded names keep their width
+		width := 0
+		if name[start] == '0' {
+			width = end - start
+		}
+		digits := fmt.Sprintf("%0*d", width, target)
+		return dir + name[:start] + digits + name[end:] + query, true
+	}
+	return "", false
+}
+
+// missedJobs returns jobs for the segments after lastSeq that left the live
+// window before playlist was fetched, newest first, with URIs guessed from
+// the playlist's first segment. They are assumed to share its key, as only
+// keys still listed can be known. ok is false if the URIs can't be guessed,
+// which includes byte-range segments since their ranges can't be.
+func missedJobs(variant *StreamVariant, playlist *m3u8.MediaPlaylist, discontinuity, lastSeq uint64) ([]SegmentJob, bool) {
+	if len(playlist.Segments) == 0 || playlist.Segments[0] == nil || playlist.Segments[0].Limit > 0 {
+		return nil, false
+	}
+	first := playlist.Segments[0]
+	jobs := make([]SegmentJob, 0, playlist.SeqNo-lastSeq-1)
+	for seq := playlist.SeqNo - 1; seq > lastSeq; seq-- {
+		uri, ok := segmentURIForSeq(first.URI, playlist.SeqNo, seq)
+		if !ok {
+			return nil, false
+		}
+		jobs = append(jobs, SegmentJob{
+			URI:           uri,
+			Seq:           seq,
+			Discontinuity: discontinuity,
+			Duration:      time.Duration(playlist.TargetDuration * float64(time.Second)),
+			VariantID:     variant.ID,
+			Variant:       variant,
+			EncryptionKey: first.Key,
+		})
+	}
+	return jobs, true
+}
+
+// missedInRange places jobs from missedJobs on clock, oldest first as they
+// aired, and returns the ones within timeRange, still newest first
+func missedInRange(jobs []SegmentJob, timeRange CaptureRange, clock *rangeClock, target time.Duration) []SegmentJob {
+	kept := make([]bool, len(jobs))
+	for i := len(jobs) - 1; i >= 0; i-- {
+		offset := clock.Place(jobs[i].Seq, jobs[i].Duration, target)
+		kept[i] = timeRange.Contains(offset, jobs[i].Duration)
+	}
+	inRange := jobs[:0]
+	for i, j := range jobs {
+		if kept[i] {
+			inRange = append(inRange, j)
+		}
+	}
+	return inRange
+}
+
+// backfillMissed tries jobs from missedJobs in order until one fails, since
+// the oldest segments are the first a CDN expires, and records the rest as
+// missing. Each download waits on opts' inode guard and segment limiter, then
+// takes a slot in variantSem before sem, the same order VariantDownloader
+// uses. It returns how many were recovered.
+func backfillMissed(ctx context.Context, jobs []SegmentJob, variantSem, sem chan struct{}, fetch func(SegmentJob) error, manifest *ManifestWriter, opts DownloadOptions) int {
+	recovered := 0
+	for i, j := range jobs {
+		if err := opts.InodeGuard.Wait(ctx); err != nil {
+			return recovered
+		}
+		if err := opts.SegmentLimiter.Wait(ctx); err != nil {
+			return recovered
+		}
+		select {
+		case variantSem <- struct{}{}:
+		case <-ctx.Done():
+			return recovered
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			<-variantSem
+			return recovered
+		}
+		err := fetch(j)
+		<-sem
+		<-variantSem
+		if err != nil {
+			if manifest != nil {
+				for _, rest := range jobs[i+1:] {
+					manifest.RecordMissing(ManifestKey(rest.Seq, rest.Discontinuity), rest.Variant.Resolution)
+				}
+			}
+			break
+		}
+		recovered++
+	}
+	if len(jobs) > 0 {
+		log.Printf("%s: recovered %d of %d segments missing from the live window", jobs[0].Variant.Resolution, recovered, len(jobs))
+	}
+	return recovered
+}
@@ -0,0 +1,284 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSegmentURIForSeq(t *testing.T) {
+	tests := []struct {
+		uri    string
+		seq    uint64
+		target uint64
+		want   string
+		ok     bool
+	}{
+		{"media_0010.ts", 10, 7, "media_0007.ts", true},
+		{"media_10.ts", 10, 7, "media_7.ts", true},
+		{"chunk_1080p_1001.ts?token=10", 1001, 998, "chunk_1080p_998.ts?token=10", true},
+		{"1080p/seg-1001-v2.ts", 1001, 999, "1080p/seg-999-v2.ts", true},
+		{"media_0099.ts", 99, 100, "media_0100.ts", true},
+		{"segment_abc.ts", 10, 7, "", false},
+		{"media_0005.ts", 10, 7, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := segmentURIForSeq(tt.uri, tt.seq, tt.target)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("segmentURIForSeq(%q, %d, %d) = %q, %v; want %q, %v", tt.uri, tt.seq, tt.target, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// outagePlaylist serves segments 1-3, then fails failures polls, then serves
+// segments 8-10 and ends, so 4-7 leave the live window during the outage
+type outagePlaylist struct {
+	mu       sync.Mutex
+	polls    int
+	failures int
+}
+
+func (o *outagePlaylist) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.polls++
+	poll := o.polls
+	o.mu.Unlock()
+
+	first := 1
+	switch {
+	case poll == 1:
+	case poll <= 1+o.failures:
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	default:
+		first = 8
+	}
+
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for seq := first; seq < first+3; seq++ {
+		fmt.Fprintf(w, "#EXTINF:6.0,\nmedia_%04d.ts\n", seq)
+	}
+	if first == 8 {
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	}
+}
+
+func TestVariantDownloader_RecoversSegmentsAfterOutage(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "gap_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The CDN still has 6 and 7 but has already expired 4 and 5
+	mux := http.NewServeMux()
+	mux.Handle("/1080/chunklist.m3u8", &outagePlaylist{failures: 3})
+	mux.HandleFunc("/1080/media_0004.ts", http.NotFound)
+	mux.HandleFunc("/1080/media_0005.ts", http.NotFound)
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	manifest := &ManifestWriter{ManifestPath: filepath.Join(tempDir, "manifest.json")}
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	if err := VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), manifest, nil, DownloadOptions{}); err != nil {
+		t.Fatalf("VariantDownloader() error: %v", err)
+	}
+
+	for seq := 1; seq <= 10; seq++ {
+		_, err := os.Stat(filepath.Join(variant.OutputDir, fmt.Sprintf("media_%04d.ts", seq)))
+		want := seq < 4 || seq > 5
+		if got := err == nil; got != want {
+			t.Errorf("media_%04d.ts: expected exists=%v, got %v", seq, want, got)
+		}
+	}
+
+	for _, seq := range []string{"4", "5"} {
+		item, ok := manifest.Index[seq]
+		if !ok || len(item.Missing) != 1 || item.Missing[0] != "1080p" {
+			t.Errorf("Expected sequence %s recorded missing, got %+v", seq, item)
+		}
+	}
+	for _, seq := range []string{"6", "7"} {
+		if item, ok := manifest.Index[seq]; !ok || item.Resolution != "1080p" {
+			t.Errorf("Expected sequence %s recovered, got %+v", seq, item)
+		}
+	}
+}
+
+func TestVariantDownloader_GapWithoutSequenceNames(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "gap_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var mu sync.Mutex
+	polls := 0
+	var requested []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls++
+		first := 1
+		if polls > 1 {
+			first = 8
+		}
+		mu.Unlock()
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+		for seq := first; seq < first+3; seq++ {
+			fmt.Fprintf(w, "#EXTINF:6.0,\nsegment_%c.ts\n", 'a'+seq)
+		}
+		if first == 8 {
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		}
+	})
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), nil, nil, DownloadOptions{})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requested) != 6 {
+		t.Errorf("Expected only the 6 listed segments to be fetched, got %v", requested)
+	}
+}
+
+func TestBackfillMissed_WaitsForVariantSlot(t *testing.T) {
+	variant := &StreamVariant{Resolution: "1080p"}
+	jobs := []SegmentJob{{Seq: 1, Variant: variant}, {Seq: 2, Variant: variant}}
+
+	// The variant's only slot is taken, though the shared pool is free
+	variantSem := make(chan struct{}, 1)
+	variantSem <- struct{}{}
+	sem := make(chan struct{}, 10)
+
+	fetched := make(chan uint64, len(jobs))
+	done := make(chan int, 1)
+	go func() {
+		done <- backfillMissed(context.Background(), jobs, variantSem, sem, func(j SegmentJob) error {
+			fetched <- j.Seq
+			return nil
+		}, nil, DownloadOptions{})
+	}()
+
+	select {
+	case seq := <-fetched:
+		t.Fatalf("Backfill fetched sequence %d without a variant slot", seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-variantSem
+	if recovered := <-done; recovered != len(jobs) {
+		t.Errorf("Expected %d recovered, got %d", len(jobs), recovered)
+	}
+	if len(variantSem) != 0 || len(sem) != 0 {
+		t.Errorf("Expected every slot released, got variant=%d shared=%d", len(variantSem), len(sem))
+	}
+}
+
+func TestBackfillMissed_WaitsForInodeGuardAndLimiter(t *testing.T) {
+	variant := &StreamVariant{Resolution: "1080p"}
+	jobs := []SegmentJob{{Seq: 3, Variant: variant}, {Seq: 2, Variant: variant}, {Seq: 1, Variant: variant}}
+
+	// The volume is out of inodes until the test frees some
+	var free atomic.Uint64
+	guard := &InodeGuard{minFree: 10, interval: 5 * time.Millisecond, free: func(string) (uint64, bool, error) {
+		return free.Load(), true, nil
+	}}
+	opts := DownloadOptions{InodeGuard: guard, SegmentLimiter: utils.NewRateLimiter(20, 1)}
+
+	fetched := make(chan time.Time, len(jobs))
+	done := make(chan int, 1)
+	go func() {
+		done <- backfillMissed(context.Background(), jobs, make(chan struct{}, 4), make(chan struct{}, 4), func(j SegmentJob) error {
+			fetched <- time.Now()
+			return nil
+		}, nil, opts)
+	}()
+
+	select {
+	case <-fetched:
+		t.Fatal("Backfill fetched a segment while the inode guard was paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	free.Store(100)
+	if recovered := <-done; recovered != len(jobs) {
+		t.Errorf("Expected %d recovered, got %d", len(jobs), recovered)
+	}
+	first := <-fetched
+	<-fetched
+	last := <-fetched
+	// 20 per second with no burst spaces three fetches at least 100ms apart
+	if elapsed := last.Sub(first); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected the segment limiter to space out backfill, took %v", elapsed)
+	}
+}
+
+func TestMissedInRange(t *testing.T) {
+	const target = 6 * time.Second
+	var clock rangeClock
+	clock.Place(1, target, target)
+
+	// Sequences 2-5 left the live window; only 3 and 4 are in the range
+	variant := &StreamVariant{Resolution: "1080p"}
+	var jobs []SegmentJob
+	for seq := uint64(5); seq >= 2; seq-- {
+		jobs = append(jobs, SegmentJob{Seq: seq, Duration: target, Variant: variant})
+	}
+	got := missedInRange(jobs, CaptureRange{Start: 12 * time.Second, Duration: 12 * time.Second}, &clock, target)
+
+	if len(got) != 2 || got[0].Seq != 4 || got[1].Seq != 3 {
+		t.Errorf("Expected sequences 4 and 3, got %+v", got)
+	}
+	// The next listed segment is placed after the missed ones
+	if offset := clock.Place(6, target, target); offset != 30*time.Second {
+		t.Errorf("Expected the next segment at 30s, got %v", offset)
+	}
+}
@@ -0,0 +1,140 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// stallPolls is how many poll intervals may pass without a new segment
+// before a variant is reported as stalled
+const stallPolls = 3
+
+// VariantHealth is one variant's recent download activity. Succeeded and
+// Failed cover the current reporting window only.
+type VariantHealth struct {
+	Variant      string
+	Started      time.Time
+	LastSegment  time.Time
+	Succeeded    int
+	Failed       int
+	PollInterval time.Duration
+}
+
+// SuccessRate returns the percentage of downloads in the window that
+// succeeded, or -1 if there were none
+func (h VariantHealth) SuccessRate() float64 {
+	total := h.Succeeded + h.Failed
+	if total == 0 {
+		return -1
+	}
+	return float64(h.Succeeded) * 100 / float64(total)
+}
+
+// Stalled reports whether no segment has arrived for stallPolls poll
+// intervals, counting from startup if none has arrived yet
+func (h VariantHealth) Stalled(now time.Time) bool {
+	if h.PollInterval <= 0 {
+		return false
+	}
+	last := h.LastSegment
+	if last.IsZero() {
+		last = h.Started
+	}
+	return now.Sub(last) > stallPolls*h.PollInterval
+}
+
+// Summary formats the health line logged for this variant
+func (h VariantHealth) Summary(now time.Time) string {
+	age := "never"
+	if !h.LastSegment.IsZero() {
+		age = now.Sub(h.LastSegment).Round(time.Second).String() + " ago"
+	}
+
+	rate := "n/a"
+	if r := h.SuccessRate(); r >= 0 {
+		rate = fmt.Sprintf("%.0f%% (%d/%d)", r, h.Succeeded, h.Succeeded+h.Failed)
+	}
+
+	status := "OK"
+	if h.Stalled(now) {
+		status = "STALLED"
+	}
+
+	return fmt.Sprintf("%s: %s, last segment: %s, success: %s, poll: %v",
+		h.Variant, status, age, rate, h.PollInterval)
+}
+
+func (s *DownloadStats) variantLocked(variant string) *VariantHealth {
+	h, ok := s.health[variant]
+	if !ok {
+		h = &VariantHealth{Variant: variant, Started: time.Now()}
+		s.health[variant] = h
+	}
+	return h
+}
+
+// StartVariant registers a variant and its poll interval so it is reported
+// even before its first segment
+func (s *DownloadStats) StartVariant(variant string, pollInterval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.variantLocked(variant).PollInterval = pollInterval
+	s.totalsLocked(variant)
+}
+
+// RecordVariant adds one finished download for variant to both the overall
+// stats and that variant's health window
+func (s *DownloadStats) RecordVariant(variant string, duration time.Duration, err error) {
+	s.Record(duration, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.variantLocked(variant)
+	if err != nil {
+		h.Failed++
+		s.totalsLocked(variant).failed++
+		return
+	}
+	h.Succeeded++
+	h.LastSegment = time.Now()
+}
+
+// HealthSnapshot returns every variant's health sorted by name and starts a
+// new success-rate window
+func (s *DownloadStats) HealthSnapshot() []VariantHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make([]VariantHealth, 0, len(s.health))
+	for _, h := range s.health {
+		snapshot = append(snapshot, *h)
+		h.Succeeded = 0
+		h.Failed = 0
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Variant < snapshot[j].Variant
+	})
+	return snapshot
+}
+
+// ReportHealth logs one health line per variant every interval until ctx is
+// cancelled
+func (s *DownloadStats) ReportHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			for _, h := range s.HealthSnapshot() {
+				log.Printf("Stream Health: %s", h.Summary(now))
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package media
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVariantHealth_Summary(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		health VariantHealth
+		want   string
+	}{
+		{
+			name: "healthy",
+			health: VariantHealth{
+				Variant:      "1080p",
+				Started:      now.Add(-10 * time.Minute),
+				LastSegment:  now.Add(-4 * time.Second),
+				Succeeded:    19,
+				Failed:       1,
+				PollInterval: 3 * time.Second,
+			},
+			want: "1080p: OK, last segment: 4s ago, success: 95% (19/20), poll: 3s",
+		},
+		{
+			name: "stalled",
+			health: VariantHealth{
+				Variant:      "720p",
+				Started:      now.Add(-10 * time.Minute),
+				LastSegment:  now.Add(-45 * time.Second),
+				Failed:       4,
+				PollInterval: 3 * time.Second,
+			},
+			want: "720p: STALLED, last segment: 45s ago, success: 0% (0/4), poll: 3s",
+		},
+		{
+			name: "no segments yet",
+			health: VariantHealth{
+				Variant:      "480p",
+				Started:      now.Add(-2 * time.Second),
+				PollInterval: 3 * time.Second,
+			},
+			want: "480p: OK, last segment: never, success: n/a, poll: 3s",
+		},
+		{
+			name: "never produced a segment",
+			health: VariantHealth{
+				Variant:      "360p",
+				Started:      now.Add(-time.Minute),
+				PollInterval: 3 * time.Second,
+			},
+			want: "360p: STALLED, last segment: never, success: n/a, poll: 3s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.health.Summary(now); got != tt.want {
+				t.Errorf("Summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadStats_HealthSnapshotResetsWindow(t *testing.T) {
+	stats := NewDownloadStats()
+	stats.StartVariant("720p", 3*time.Second)
+	stats.StartVariant("1080p", 3*time.Second)
+	stats.RecordVariant("1080p", 100*time.Millisecond, nil)
+	stats.RecordVariant("1080p", 10*time.Second, errors.New("timeout"))
+
+	snapshot := stats.HealthSnapshot()
+	if len(snapshot) != 2 || snapshot[0].Variant != "1080p" || snapshot[1].Variant != "720p" {
+		t.Fatalf("Expected sorted snapshot of 1080p and 720p, got %+v", snapshot)
+	}
+	if snapshot[0].Succeeded != 1 || snapshot[0].Failed != 1 || snapshot[0].LastSegment.IsZero() {
+		t.Errorf("Unexpected 1080p health: %+v", snapshot[0])
+	}
+	if stats.Succeeded != 1 || stats.Failed != 1 {
+		t.Errorf("Expected overall stats to include variant downloads, got %d/%d", stats.Succeeded, stats.Failed)
+	}
+
+	next := stats.HealthSnapshot()
+	if next[0].Succeeded != 0 || next[0].Failed != 0 {
+		t.Errorf("Expected window counts to reset, got %+v", next[0])
+	}
+	if next[0].LastSegment.IsZero() {
+		t.Error("Last segment time should survive the window reset")
+	}
+}
@@ -0,0 +1,92 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// indexFlushInterval is how often Run writes a changed SegmentIndex
+const indexFlushInterval = 5 * time.Second
+
+// SegmentIndex maps each sequence number to the local file of every
+// resolution that has it, e.g. {"1001": {"1080p": ".../1080p/media_1001.ts"}},
+// for players that switch resolution per segment. Unlike the manifest it
+// keeps file paths and is rewritten while the download runs.
+type SegmentIndex struct {
+	path    string
+	entries map[string]map[string]string
+	dirty   bool
+	mu      sync.Mutex
+}
+
+// NewSegmentIndex returns an empty index written to path
+func NewSegmentIndex(path string) *SegmentIndex {
+	return &SegmentIndex{path: path, entries: make(map[string]map[string]string)}
+}
+
+// Add records that resolution saved seqNo at filePath
+func (x *SegmentIndex) Add(seqNo, resolution, filePath string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	files, ok := x.entries[seqNo]
+	if !ok {
+		files = make(map[string]string)
+		x.entries[seqNo] = files
+	}
+	files[resolution] = filePath
+	x.dirty = true
+}
+
+// Flush writes the index via a temp file and rename if anything was added
+// since the last write
+func (x *SegmentIndex) Flush() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.dirty {
+		return nil
+	}
+
+	// encoding/json sorts map keys, so the file is stable between writes
+	data, err := json.MarshalIndent(x.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal segment index: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0755); err != nil {
+		return fmt.Errorf("failed to create segment index directory: %w", err)
+	}
+	tmpPath := x.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write segment index: %w", err)
+	}
+	if err := os.Rename(tmpPath, x.path); err != nil {
+		return fmt.Errorf("failed to replace segment index: %w", err)
+	}
+	x.dirty = false
+	return nil
+}
+
+// Run flushes the index every indexFlushInterval until ctx is cancelled,
+// then flushes once more
+func (x *SegmentIndex) Run(ctx context.Context) {
+	ticker := time.NewTicker(indexFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := x.Flush(); err != nil {
+				log.Printf("%v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := x.Flush(); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
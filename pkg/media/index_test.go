@@ -0,0 +1,153 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"m3u8-downloader/pkg/constants"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readSegmentIndex(t *testing.T, path string) map[string]map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	var entries map[string]map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Failed to parse index: %v", err)
+	}
+	return entries
+}
+
+func TestSegmentIndex_Flush(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "index_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	indexPath := filepath.Join(tempDir, "manifests", "event_index.json")
+	index := NewSegmentIndex(indexPath)
+
+	if err := index.Flush(); err != nil {
+		t.Fatalf("Flush() error: %v", err)
+	}
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no index file before any segment, got %v", err)
+	}
+
+	index.Add("1", "1080p", "/data/1080p/media_1.ts")
+	index.Add("1", "720p", "/data/720p/media_1.ts")
+	index.Add("2", "720p", "/data/720p/media_2.ts")
+	if err := index.Flush(); err != nil {
+		t.Fatalf("Flush() error: %v", err)
+	}
+
+	entries := readSegmentIndex(t, indexPath)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 sequence numbers, got %v", entries)
+	}
+	if entries["1"]["1080p"] != "/data/1080p/media_1.ts" || entries["1"]["720p"] != "/data/720p/media_1.ts" {
+		t.Errorf("Expected both resolutions for sequence 1, got %v", entries["1"])
+	}
+	if len(entries["2"]) != 1 || entries["2"]["720p"] != "/data/720p/media_2.ts" {
+		t.Errorf("Expected only 720p for sequence 2, got %v", entries["2"])
+	}
+	if _, err := os.Stat(indexPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected temp file to be renamed away, got %v", err)
+	}
+
+	// A later segment for another resolution shows up on the next flush
+	index.Add("2", "1080p", "/data/1080p/media_2.ts")
+	if err := index.Flush(); err != nil {
+		t.Fatalf("Flush() error: %v", err)
+	}
+	if got := readSegmentIndex(t, indexPath)["2"]; len(got) != 2 {
+		t.Errorf("Expected both resolutions for sequence 2 after update, got %v", got)
+	}
+}
+
+func TestVariantDownloader_WritesSegmentIndex(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "index_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 720p is missing segment 2
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		fmt.Fprint(w, "#EXTINF:6.0,\nmedia_0001.ts\n#EXTINF:6.0,\nmedia_0002.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/720/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		fmt.Fprint(w, "#EXTINF:6.0,\nmedia_0001.ts\n#EXTINF:6.0,\nmedia_0002.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/720/media_0002.ts", http.NotFound)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	indexPath := filepath.Join(tempDir, "event_index.json")
+	index := NewSegmentIndex(indexPath)
+
+	for _, v := range []struct{ dir, resolution string }{{"1080", "1080p"}, {"720", "720p"}} {
+		variantURL := server.URL + "/" + v.dir + "/chunklist.m3u8"
+		base, _ := url.Parse(variantURL)
+		variant := &StreamVariant{
+			URL:        variantURL,
+			BaseURL:    base,
+			Resolution: v.resolution,
+			OutputDir:  filepath.Join(tempDir, v.resolution),
+		}
+		VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), nil, nil, DownloadOptions{SegmentIndex: index})
+	}
+
+	if err := index.Flush(); err != nil {
+		t.Fatalf("Flush() error: %v", err)
+	}
+	entries := readSegmentIndex(t, indexPath)
+
+	want := map[string]map[string]string{
+		"1": {
+			"1080p": filepath.Join(tempDir, "1080p", "media_0001.ts"),
+			"720p":  filepath.Join(tempDir, "720p", "media_0001.ts"),
+		},
+		"2": {
+			"1080p": filepath.Join(tempDir, "1080p", "media_0002.ts"),
+		},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, entries)
+	}
+	for seq, files := range want {
+		if len(entries[seq]) != len(files) {
+			t.Errorf("Sequence %s: expected %v, got %v", seq, files, entries[seq])
+			continue
+		}
+		for resolution, path := range files {
+			if entries[seq][resolution] != path {
+				t.Errorf("Sequence %s %s: expected %s, got %s", seq, resolution, path, entries[seq][resolution])
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("Indexed file %s does not exist: %v", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package media
+
+import (
+	"context"
+	"log"
+	"m3u8-downloader/pkg/utils"
+	"sync"
+	"time"
+)
+
+// inodeRecheckInterval is how often a paused InodeGuard checks again
+const inodeRecheckInterval = 10 * time.Second
+
+// InodeGuard pauses segment downloads while the download volume is low on
+// free inodes. A capture writes thousands of small segments, so a volume can
+// run out of inodes long before it runs out of bytes.
+type InodeGuard struct {
+	path     string
+	minFree  uint64
+	interval time.Duration
+	free     func(path string) (uint64, bool, error)
+	mu       sync.Mutex
+	paused   bool
+}
+
+// NewInodeGuard returns a guard that holds downloads while the filesystem
+// holding path has fewer than minFree inodes free
+func NewInodeGuard(path string, minFree uint64) *InodeGuard {
+	return &InodeGuard{
+		path:     path,
+		minFree:  minFree,
+		interval: inodeRecheckInterval,
+		free:     utils.FreeInodes,
+	}
+}
+
+// Wait returns once enough inodes are free, or with ctx's error if ctx ends
+// first. Filesystems without an inode limit and stat errors never block.
+func (g *InodeGuard) Wait(ctx context.Context) error {
+	if g == nil || g.minFree == 0 {
+		return nil
+	}
+	for {
+		free, ok, err := g.free(g.path)
+		if err != nil || !ok || free >= g.minFree {
+			g.setPaused(false, free)
+			return nil
+		}
+		g.setPaused(true, free)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(g.interval):
+		}
+	}
+}
+
+// setPaused logs when downloads pause or resume, once per transition rather
+// than once per waiting segment
+func (g *InodeGuard) setPaused(paused bool, free uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if paused == g.paused {
+		return
+	}
+	g.paused = paused
+	if paused {
+		log.Printf("Low on inodes: %d free on %s (minimum %d), pausing segment downloads", free, g.path, g.minFree)
+	} else {
+		log.Printf("Inodes available on %s, resuming segment downloads", g.path)
+	}
+}
@@ -0,0 +1,78 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInodeGuard_PausesUntilInodesFreed(t *testing.T) {
+	var free uint64 = 50
+	guard := NewInodeGuard("/data", 100)
+	guard.interval = 5 * time.Millisecond
+	guard.free = func(string) (uint64, bool, error) {
+		return atomic.LoadUint64(&free), true, nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- guard.Wait(context.Background()) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returned while low on inodes: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	atomic.StoreUint64(&free, 500)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected nil once inodes are freed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not resume after inodes were freed")
+	}
+}
+
+func TestInodeGuard_NeverBlocks(t *testing.T) {
+	tests := []struct {
+		name  string
+		guard *InodeGuard
+		free  uint64
+		ok    bool
+		err   error
+	}{
+		{name: "nil guard"},
+		{name: "disabled", guard: NewInodeGuard("/data", 0), free: 0, ok: true},
+		{name: "enough free", guard: NewInodeGuard("/data", 100), free: 100, ok: true},
+		{name: "no inode limit", guard: NewInodeGuard("/data", 100), free: 0, ok: false},
+		{name: "stat error", guard: NewInodeGuard("/data", 100), err: errors.New("statfs failed")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.guard != nil {
+				tt.guard.free = func(string) (uint64, bool, error) { return tt.free, tt.ok, tt.err }
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := tt.guard.Wait(ctx); err != nil {
+				t.Errorf("Expected Wait to return immediately, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInodeGuard_CancelWhilePaused(t *testing.T) {
+	guard := NewInodeGuard("/data", 100)
+	guard.interval = time.Hour
+	guard.free = func(string) (uint64, bool, error) { return 10, true, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := guard.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"io"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/httpClient"
+	"m3u8-downloader/pkg/utils"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupportedEncryption is returned for an #EXT-X-KEY method other than
+// NONE or AES-128, such as SAMPLE-AES, which can't be undone on whole segments
+var ErrUnsupportedEncryption = errors.New("unsupported segment encryption")
+
+// SegmentKey is what DownloadSegment needs to AES-128-CBC decrypt one segment
+type SegmentKey struct {
+	Key []byte
+	IV  []byte
+}
+
+// Decrypt returns the plaintext of an encrypted segment with its PKCS#7
+// padding removed. An empty segment decrypts to nothing.
+func (k *SegmentKey) Decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment is %d bytes, not a multiple of %d", len(data), aes.BlockSize)
+	}
+	block, err := aes.NewCipher(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, k.IV).CryptBlocks(plain, data)
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("invalid padding after decryption, wrong key or IV")
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// segmentIV returns the IV for a segment: the key line's IV attribute when
+// it has one, and otherwise the media sequence number as a 128-bit
+// big-endian integer, as the HLS spec requires
+func segmentIV(key *m3u8.Key, seq uint64) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if key.IV == "" {
+		binary.BigEndian.PutUint64(iv[8:], seq)
+		return iv, nil
+	}
+
+	digits := strings.TrimPrefix(strings.TrimPrefix(key.IV, "0x"), "0X")
+	if len(digits)%2 == 1 {
+		digits = "0" + digits
+	}
+	parsed, err := hex.DecodeString(digits)
+	if err != nil || len(parsed) > aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV %q", key.IV)
+	}
+	copy(iv[aes.BlockSize-len(parsed):], parsed)
+	return iv, nil
+}
+
+// keyCache fetches each key URI once. Keys rotate at most every few
+// segments, so everything fetched is kept for the life of the variant.
+type keyCache struct {
+	client *http.Client
+	mu     sync.Mutex
+	keys   map[string][]byte
+}
+
+func newKeyCache(client *http.Client) *keyCache {
+	return &keyCache{client: client, keys: make(map[string][]byte)}
+}
+
+// ForJob returns the key that decrypts j, or nil if j isn't encrypted
+func (c *keyCache) ForJob(ctx context.Context, j SegmentJob) (*SegmentKey, error) {
+	if j.EncryptionKey == nil || j.EncryptionKey.Method == "" || j.EncryptionKey.Method == "NONE" {
+		return nil, nil
+	}
+	if j.EncryptionKey.Method != "AES-128" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, j.EncryptionKey.Method)
+	}
+
+	iv, err := segmentIV(j.EncryptionKey, j.Seq)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.get(ctx, j.KeyURL())
+	if err != nil {
+		return nil, err
+	}
+	return &SegmentKey{Key: key, IV: iv}, nil
+}
+
+// get holds the lock while fetching so concurrent segments under a new key
+// wait for one request instead of each making their own. Failures aren't
+// cached, so the next segment tries again.
+func (c *keyCache) get(ctx context.Context, keyURL string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[keyURL]; ok {
+		return key, nil
+	}
+
+	key, err := fetchKey(ctx, c.client, keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key %s: %w", keyURL, err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("key %s is %d bytes, expected %d", keyURL, len(key), aes.BlockSize)
+	}
+	c.keys[keyURL] = key
+	return key, nil
+}
+
+// fetchKey downloads a key with the same headers as segments, retrying like
+// a segment download. A file:// URL or plain path is read from disk.
+func fetchKey(ctx context.Context, client *http.Client, keyURL string) ([]byte, error) {
+	if localPath, ok := localPlaylistPath(keyURL); ok {
+		return os.ReadFile(localPath)
+	}
+
+	var key []byte
+	err := utils.Retry(ctx, segmentRetryPolicy, func(attempt int) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", keyURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", constants.HTTPUserAgent)
+		req.Header.Set("Referer", constants.REFERRER)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			io.Copy(io.Discard, resp.Body)
+			return &httpClient.HttpError{Code: resp.StatusCode}
+		}
+		key, err = io.ReadAll(io.LimitReader(resp.Body, aes.BlockSize+1))
+		return err
+	})
+	return key, err
+}
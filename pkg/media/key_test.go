@@ -0,0 +1,253 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"m3u8-downloader/pkg/constants"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fixtureKey encrypts fixtureSegment as sequence 7 with no IV attribute
+var (
+	fixtureKey, _       = hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	fixtureSegment, _   = hex.DecodeString("344ec9f04df932feb0406e2282ad4faa72fc29fb4f56d7950e4c3e23772785d2")
+	fixturePlaintext    = "FloDownload test segment"
+	fixtureSegmentSeqNo = uint64(7)
+)
+
+// encryptSegment AES-128-CBC encrypts plain with PKCS#7 padding, as a
+// packager would
+func encryptSegment(t *testing.T, key, iv []byte, plain string) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append([]byte(plain), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func TestSegmentKey_DecryptFixture(t *testing.T) {
+	iv, err := segmentIV(&m3u8.Key{Method: "AES-128"}, fixtureSegmentSeqNo)
+	if err != nil {
+		t.Fatalf("segmentIV() failed: %v", err)
+	}
+	key := &SegmentKey{Key: fixtureKey, IV: iv}
+
+	plain, err := key.Decrypt(fixtureSegment)
+	if err != nil {
+		t.Fatalf("Decrypt() failed: %v", err)
+	}
+	if string(plain) != fixturePlaintext {
+		t.Errorf("Expected %q, got %q", fixturePlaintext, plain)
+	}
+
+	wrongIV, _ := segmentIV(&m3u8.Key{Method: "AES-128"}, fixtureSegmentSeqNo+1)
+	if plain, err := (&SegmentKey{Key: fixtureKey, IV: wrongIV}).Decrypt(fixtureSegment); err == nil && string(plain) == fixturePlaintext {
+		t.Error("Expected the next sequence number's IV not to decrypt the fixture")
+	}
+	if _, err := key.Decrypt(fixtureSegment[:20]); err == nil {
+		t.Error("Expected an error for a segment that isn't whole blocks")
+	}
+}
+
+func TestSegmentIV(t *testing.T) {
+	tests := []struct {
+		name    string
+		iv      string
+		seq     uint64
+		want    string
+		wantErr bool
+	}{
+		{"from sequence number", "", 7, "00000000000000000000000000000007", false},
+		{"large sequence number", "", 1<<40 + 1, "00000000000000000000010000000001", false},
+		{"explicit", "0x0F0E0D0C0B0A09080706050403020100", 7, "0f0e0d0c0b0a09080706050403020100", false},
+		{"short explicit is left-padded", "0x1ab", 7, "000000000000000000000000000001ab", false},
+		{"not hex", "0xZZ", 7, "", true},
+		{"too long", "0x" + hex.EncodeToString(make([]byte, 17)), 7, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iv, err := segmentIV(&m3u8.Key{Method: "AES-128", IV: tt.iv}, tt.seq)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error for IV %q", tt.iv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("segmentIV() failed: %v", err)
+			}
+			if got := hex.EncodeToString(iv); got != tt.want {
+				t.Errorf("Expected IV %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestKeyCache_ForJob(t *testing.T) {
+	var requests, withoutHeaders int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Referer") == "" || r.Header.Get("User-Agent") == "" {
+			atomic.AddInt32(&withoutHeaders, 1)
+		}
+		w.Write(fixtureKey)
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL + "/1080/chunklist.m3u8")
+	variant := &StreamVariant{BaseURL: base}
+	cache := newKeyCache(server.Client())
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		job := SegmentJob{Seq: seq, Variant: variant, EncryptionKey: &m3u8.Key{Method: "AES-128", URI: "key.bin"}}
+		key, err := cache.ForJob(context.Background(), job)
+		if err != nil {
+			t.Fatalf("ForJob() failed: %v", err)
+		}
+		if !bytes.Equal(key.Key, fixtureKey) || key.IV[15] != byte(seq) {
+			t.Errorf("Expected the fixture key with IV for sequence %d, got %+v", seq, key)
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("Expected the key to be fetched once, got %d requests", got)
+	}
+	if atomic.LoadInt32(&withoutHeaders) != 0 {
+		t.Error("Expected the key request to carry Referer and User-Agent")
+	}
+
+	for _, method := range []string{"", "NONE"} {
+		key, err := cache.ForJob(context.Background(), SegmentJob{Variant: variant, EncryptionKey: &m3u8.Key{Method: method}})
+		if key != nil || err != nil {
+			t.Errorf("Expected no key for method %q, got %v, %v", method, key, err)
+		}
+	}
+	_, err := cache.ForJob(context.Background(), SegmentJob{Variant: variant, EncryptionKey: &m3u8.Key{Method: "SAMPLE-AES", URI: "key.bin"}})
+	if !errors.Is(err, ErrUnsupportedEncryption) {
+		t.Errorf("Expected ErrUnsupportedEncryption for SAMPLE-AES, got %v", err)
+	}
+}
+
+func TestDownloadSegment_Decrypts(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "key_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fixtureSegment)
+	}))
+	defer server.Close()
+
+	iv, _ := segmentIV(&m3u8.Key{Method: "AES-128"}, fixtureSegmentSeqNo)
+	written, _, err := DownloadSegment(context.Background(), server.Client(), server.URL+"/media_0007.ts", tempDir, 0, &SegmentKey{Key: fixtureKey, IV: iv})
+	if err != nil {
+		t.Fatalf("DownloadSegment() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "media_0007.ts"))
+	if err != nil {
+		t.Fatalf("Failed to read downloaded segment: %v", err)
+	}
+	if string(data) != fixturePlaintext {
+		t.Errorf("Expected decrypted segment %q, got %q", fixturePlaintext, data)
+	}
+	if written != int64(len(fixturePlaintext)) {
+		t.Errorf("Expected size of the plaintext %d, got %d", len(fixturePlaintext), written)
+	}
+}
+
+func TestVariantDownloader_DecryptsRotatingKeys(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "key_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	keyA := []byte("aaaaaaaaaaaaaaaa")
+	keyB := []byte("bbbbbbbbbbbbbbbb")
+	explicitIV, _ := hex.DecodeString("0102030405060708090a0b0c0d0e0f10")
+
+	// Sequences 1 and 2 use key A with IVs from their sequence numbers; the
+	// key rotates to B with an explicit IV for 3 and 4
+	segments := map[string][]byte{}
+	for seq := uint64(1); seq <= 4; seq++ {
+		key, iv := keyA, make([]byte, aes.BlockSize)
+		iv[15] = byte(seq)
+		if seq > 2 {
+			key, iv = keyB, explicitIV
+		}
+		segments[fmt.Sprintf("/1080/media_%04d.ts", seq)] = encryptSegment(t, key, iv, fmt.Sprintf("segment %d", seq))
+	}
+
+	var keyRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		fmt.Fprint(w, "#EXT-X-KEY:METHOD=AES-128,URI=\"keys/a.key\"\n#EXTINF:6.0,\nmedia_0001.ts\n#EXTINF:6.0,\nmedia_0002.ts\n")
+		fmt.Fprint(w, "#EXT-X-KEY:METHOD=AES-128,URI=\"keys/b.key\",IV=0x0102030405060708090a0b0c0d0e0f10\n#EXTINF:6.0,\nmedia_0003.ts\n#EXTINF:6.0,\nmedia_0004.ts\n")
+	})
+	mux.HandleFunc("/1080/keys/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&keyRequests, 1)
+		if r.URL.Path == "/1080/keys/a.key" {
+			w.Write(keyA)
+		} else {
+			w.Write(keyB)
+		}
+	})
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(segments[r.URL.Path])
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+
+	if err := VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), nil, nil, DownloadOptions{}); err != nil {
+		t.Fatalf("VariantDownloader() returned error: %v", err)
+	}
+
+	for seq := 1; seq <= 4; seq++ {
+		data, err := os.ReadFile(filepath.Join(variant.OutputDir, fmt.Sprintf("media_%04d.ts", seq)))
+		if err != nil {
+			t.Errorf("Failed to read segment %d: %v", seq, err)
+			continue
+		}
+		if want := fmt.Sprintf("segment %d", seq); string(data) != want {
+			t.Errorf("Expected segment %d to decrypt to %q, got %q", seq, want, data)
+		}
+	}
+	if got := atomic.LoadInt32(&keyRequests); got != 2 {
+		t.Errorf("Expected each key to be fetched once, got %d key requests", got)
+	}
+}
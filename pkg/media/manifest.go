@@ -2,84 +2,304 @@ package media
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"m3u8-downloader/pkg/constants"
 	"m3u8-downloader/pkg/utils"
 	"os"
 	"sort"
+	"sync"
 )
 
+var ErrCorruptManifest = errors.New("corrupt manifest")
+
 type ManifestWriter struct {
 	ManifestPath string
 	Segments     []ManifestItem
 	Index        map[string]*ManifestItem
+	positions    map[string]int // seqNo -> index in Segments
+	flushed      bool           // nothing has changed since the last write
+	closed       bool
+	mu           sync.Mutex
 }
 
+// ManifestItem records one sequence number, keyed by ManifestKey so sequence
+// numbers repeated after a discontinuity stay apart. Resolution is the best one
+// downloaded; Available lists every resolution that has the segment and
+// Missing those that failed it, so processing can fill a gap in one
+// resolution from another.
 type ManifestItem struct {
-	SeqNo      string `json:"seqNo"`
-	Resolution string `json:"resolution"`
+	SeqNo      string   `json:"seqNo"`
+	Resolution string   `json:"resolution"`
+	Available  []string `json:"available,omitempty"`
+	Missing    []string `json:"missing,omitempty"`
+	// Checksums maps each available resolution to its segment's checksum,
+	// when Core.SegmentChecksum is set
+	Checksums map[string]string `json:"checksums,omitempty"`
 }
 
+var (
+	openManifestsMu sync.Mutex
+	openManifests   = make(map[string]*ManifestWriter) // manifest path -> writer not yet closed
+)
+
+// NewManifestWriter returns the open writer for eventName's manifest,
+// creating it if there is none. Every caller in a run shares one writer, so
+// a second writer can't overwrite the first one's segments with its own.
 func NewManifestWriter(eventName string) *ManifestWriter {
 	cfg := constants.MustGetConfig()
-	return &ManifestWriter{
-		ManifestPath: cfg.GetManifestPath(eventName),
+	manifestPath := cfg.GetManifestPath(eventName)
+
+	openManifestsMu.Lock()
+	defer openManifestsMu.Unlock()
+	if m, ok := openManifests[manifestPath]; ok {
+		return m
+	}
+	m := &ManifestWriter{
+		ManifestPath: manifestPath,
 		Segments:     make([]ManifestItem, 0),
 		Index:        make(map[string]*ManifestItem),
 	}
+	openManifests[manifestPath] = m
+	return m
 }
 
+// AddOrUpdateSegment records that resolution downloaded seqNo, keeping the
+// highest resolution as the item's Resolution
 func (m *ManifestWriter) AddOrUpdateSegment(seqNo string, resolution string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		log.Printf("Manifest closed, not recording segment %s (%s)", seqNo, resolution)
+		return
+	}
+
+	item, added := m.itemLocked(seqNo)
+	if added || ResolutionHeight(resolution) > ResolutionHeight(item.Resolution) {
+		item.Resolution = resolution
+	}
+	item.Available = appendUnique(item.Available, resolution)
+	item.Missing = removeString(item.Missing, resolution)
+	m.syncIndexLocked(seqNo)
+}
+
+// RecordMissing records that resolution failed seqNo for good, unless it
+// already has the segment
+func (m *ManifestWriter) RecordMissing(seqNo string, resolution string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+
+	item, _ := m.itemLocked(seqNo)
+	for _, r := range item.Available {
+		if r == resolution {
+			return
+		}
+	}
+	item.Missing = appendUnique(item.Missing, resolution)
+	m.syncIndexLocked(seqNo)
+}
+
+// RecordChecksum stores the checksum of resolution's copy of seqNo, which
+// must already have been recorded with AddOrUpdateSegment
+func (m *ManifestWriter) RecordChecksum(seqNo string, resolution string, checksum string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+
+	item, _ := m.itemLocked(seqNo)
+	checksums := make(map[string]string, len(item.Checksums)+1)
+	for r, sum := range item.Checksums {
+		checksums[r] = sum
+	}
+	checksums[resolution] = checksum
+	item.Checksums = checksums
+	m.syncIndexLocked(seqNo)
+}
+
+// itemLocked returns the item for seqNo within Segments, appending it if new
+func (m *ManifestWriter) itemLocked(seqNo string) (*ManifestItem, bool) {
 	if m.Index == nil {
 		m.Index = make(map[string]*ManifestItem)
 	}
-
 	if m.Segments == nil {
 		m.Segments = make([]ManifestItem, 0)
 	}
+	// Segments may have been set directly, or re-sorted by WriteManifest
+	if m.positions == nil || len(m.positions) != len(m.Segments) {
+		m.positions = make(map[string]int, len(m.Segments))
+		for i, item := range m.Segments {
+			m.positions[item.SeqNo] = i
+		}
+	}
 
-	if existing, ok := m.Index[seqNo]; ok {
-		if resolution > existing.Resolution {
-			existing.Resolution = resolution
+	if i, ok := m.positions[seqNo]; ok {
+		return &m.Segments[i], false
+	}
+	m.Segments = append(m.Segments, ManifestItem{SeqNo: seqNo})
+	m.positions[seqNo] = len(m.Segments) - 1
+	return &m.Segments[len(m.Segments)-1], true
+}
+
+// syncIndexLocked points Index at a copy of the current item, since pointers
+// into Segments don't survive it growing
+func (m *ManifestWriter) syncIndexLocked(seqNo string) {
+	item := m.Segments[m.positions[seqNo]]
+	m.Index[seqNo] = &item
+	m.flushed = false
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
 		}
-		return
-	} else {
-		item := ManifestItem{
-			SeqNo:      seqNo,
-			Resolution: resolution,
+	}
+	return append(list, s)
+}
+
+func removeString(list []string, s string) []string {
+	for i, existing := range list {
+		if existing == s {
+			return append(list[:i], list[i+1:]...)
 		}
-		m.Segments = append(m.Segments, item)
-		m.Index[seqNo] = &item
 	}
+	return list
 }
 
 func (m *ManifestWriter) WriteManifest() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.writeLocked(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// Close writes any segments recorded since the last write and stops
+// recording; later updates are dropped. Calling it again does nothing.
+func (m *ManifestWriter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	openManifestsMu.Lock()
+	if openManifests[m.ManifestPath] == m {
+		delete(openManifests, m.ManifestPath)
+	}
+	openManifestsMu.Unlock()
+
+	if m.flushed {
+		return nil
+	}
+	err := m.writeLocked()
+	// The lookup maps only serve updates, which are over
+	m.positions = nil
+	m.Index = nil
+	return err
+}
+
+func (m *ManifestWriter) writeLocked() error {
+	if len(m.Segments) == 0 {
+		// Usually a writer that was never passed to the variant downloaders
+		log.Printf("Warning: manifest empty — check writer wiring (%s)", m.ManifestPath)
+	}
+
 	sort.Slice(m.Segments, func(i, j int) bool {
-		return m.Segments[i].SeqNo < m.Segments[j].SeqNo
+		return manifestKeyLess(m.Segments[i].SeqNo, m.Segments[j].SeqNo)
 	})
+	m.positions = nil
 
 	data, err := json.MarshalIndent(m.Segments, "", "  ")
 	if err != nil {
-		log.Printf("Failed to marshal manifest: %v", err)
-		return
+		return fmt.Errorf("Failed to marshal manifest: %w", err)
 	}
 
 	if err := utils.ValidateWritablePath(m.ManifestPath); err != nil {
-		log.Printf("Manifest path validation failed: %v", err)
-		return
+		return fmt.Errorf("Manifest path validation failed: %w", err)
+	}
+
+	// Write to a temp file and rename it over the manifest so a crash never
+	// leaves a truncated or missing manifest behind. The previous manifest is
+	// kept as a .bak for recovery.
+	tmpPath := m.ManifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write manifest file: %w", err)
+	}
+
+	if utils.PathExists(m.ManifestPath) {
+		if err := backupManifest(m.ManifestPath); err != nil {
+			log.Printf("Failed to back up previous manifest: %v", err)
+		}
 	}
 
-	file, err := os.Create(m.ManifestPath)
+	if err := os.Rename(tmpPath, m.ManifestPath); err != nil {
+		return fmt.Errorf("Failed to replace manifest file: %w", err)
+	}
+
+	m.flushed = true
+	return nil
+}
+
+// backupManifest links the manifest to its .bak, or copies it where links are
+// unsupported, leaving the manifest itself in place
+func backupManifest(manifestPath string) error {
+	backupPath := manifestPath + ".bak"
+	if err := os.Remove(backupPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(manifestPath, backupPath); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(manifestPath)
 	if err != nil {
-		log.Printf("Failed to create manifest file: %v", err)
-		return
+		return err
+	}
+	return os.WriteFile(backupPath, data, 0644)
+}
+
+// ReadManifest loads a manifest written by WriteManifest. A truncated or
+// otherwise undecodable file yields an error wrapping ErrCorruptManifest. When
+// tryBackup is set, the .bak from the previous save is used in that case, and
+// also when the manifest is missing but a .bak exists.
+func ReadManifest(manifestPath string, tryBackup bool) ([]ManifestItem, error) {
+	items, err := decodeManifestFile(manifestPath)
+	if err == nil || !tryBackup {
+		return items, err
+	}
+	if !errors.Is(err, ErrCorruptManifest) && !errors.Is(err, os.ErrNotExist) {
+		return items, err
 	}
 
-	defer file.Close()
+	backupPath := manifestPath + ".bak"
+	backupItems, backupErr := decodeManifestFile(backupPath)
+	if backupErr != nil {
+		return nil, fmt.Errorf("%w (backup unusable: %v)", err, backupErr)
+	}
+
+	log.Printf("Manifest %s is unreadable, recovered %d segments from %s", manifestPath, len(backupItems), backupPath)
+	return backupItems, nil
+}
 
-	_, err = file.Write(data)
+func decodeManifestFile(manifestPath string) ([]ManifestItem, error) {
+	data, err := os.ReadFile(manifestPath)
 	if err != nil {
-		log.Printf("Failed to write manifest file: %v", err)
-		return
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var items []ManifestItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptManifest, manifestPath, err)
 	}
+
+	return items, nil
 }
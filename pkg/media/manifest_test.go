@@ -1,9 +1,15 @@
 package media
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"m3u8-downloader/pkg/constants"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -82,6 +88,34 @@ func TestManifestWriter_AddOrUpdateSegment(t *testing.T) {
 	}
 }
 
+func TestManifestWriter_AddOrUpdateSegment_ComparesHeights(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		want  string
+	}{
+		{"1080p after 720p", []string{"720p", "1080p"}, "1080p"},
+		{"720p after 1080p", []string{"1080p", "720p"}, "1080p"},
+		{"480p and 720p after 1080p", []string{"1080p", "480p", "720p"}, "1080p"},
+		{"2160p after 720p", []string{"720p", "2160p"}, "2160p"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &ManifestWriter{
+				Segments: make([]ManifestItem, 0),
+				Index:    make(map[string]*ManifestItem),
+			}
+			for _, resolution := range tt.order {
+				writer.AddOrUpdateSegment("1001", resolution)
+			}
+			if got := writer.Segments[0].Resolution; got != tt.want {
+				t.Errorf("Expected resolution '%s', got '%s'", tt.want, got)
+			}
+		})
+	}
+}
+
 func TestManifestWriter_AddOrUpdateSegment_NilFields(t *testing.T) {
 	writer := &ManifestWriter{
 		ManifestPath: "test.json",
@@ -101,6 +135,36 @@ func TestManifestWriter_AddOrUpdateSegment_NilFields(t *testing.T) {
 	}
 }
 
+func TestManifestWriter_RecordsAvailability(t *testing.T) {
+	writer := &ManifestWriter{ManifestPath: "test.json"}
+
+	writer.RecordMissing("1003", "1080p")
+	writer.AddOrUpdateSegment("1003", "720p")
+	writer.AddOrUpdateSegment("1003", "480p")
+
+	item := writer.Segments[0]
+	if item.Resolution != "720p" {
+		t.Errorf("Expected best available resolution '720p', got '%s'", item.Resolution)
+	}
+	if len(item.Available) != 2 || item.Available[0] != "720p" || item.Available[1] != "480p" {
+		t.Errorf("Expected available [720p 480p], got %v", item.Available)
+	}
+	if len(item.Missing) != 1 || item.Missing[0] != "1080p" {
+		t.Errorf("Expected missing [1080p], got %v", item.Missing)
+	}
+	if writer.Index["1003"].Resolution != "720p" {
+		t.Errorf("Index should match Segments, got %+v", writer.Index["1003"])
+	}
+
+	// A late success clears the gap; a failure after a success is ignored
+	writer.AddOrUpdateSegment("1003", "1080p")
+	writer.RecordMissing("1003", "720p")
+	item = writer.Segments[0]
+	if item.Resolution != "1080p" || len(item.Missing) != 0 {
+		t.Errorf("Expected 1080p with no missing resolutions, got %+v", item)
+	}
+}
+
 func TestManifestWriter_WriteManifest(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "manifest_test_*")
 	if err != nil {
@@ -161,6 +225,54 @@ func TestManifestWriter_WriteManifest(t *testing.T) {
 	}
 }
 
+func TestManifestWriter_WriteManifest_PersistsUpgrade(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "test-manifest.json")
+	writer := &ManifestWriter{ManifestPath: manifestPath}
+
+	writer.AddOrUpdateSegment("1001", "720p")
+	// Grow Segments so any pointer taken into it before would be stale
+	for i := 1002; i < 1100; i++ {
+		writer.AddOrUpdateSegment(fmt.Sprint(i), "720p")
+	}
+	writer.AddOrUpdateSegment("1001", "1080p")
+	writer.WriteManifest()
+
+	// An upgrade after WriteManifest has re-sorted Segments
+	writer.AddOrUpdateSegment("1050", "1080p")
+	writer.WriteManifest()
+
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to read manifest file: %v", err)
+	}
+	var segments []ManifestItem
+	if err := json.Unmarshal(content, &segments); err != nil {
+		t.Fatalf("Failed to unmarshal manifest JSON: %v", err)
+	}
+
+	written := make(map[string]string, len(segments))
+	for _, segment := range segments {
+		written[segment.SeqNo] = segment.Resolution
+	}
+	for _, seqNo := range []string{"1001", "1050"} {
+		if written[seqNo] != "1080p" {
+			t.Errorf("Expected %s written as '1080p', got '%s'", seqNo, written[seqNo])
+		}
+		if got := writer.Index[seqNo].Resolution; got != "1080p" {
+			t.Errorf("Expected Index[%s] resolution '1080p', got '%s'", seqNo, got)
+		}
+	}
+	if written["1002"] != "720p" {
+		t.Errorf("Expected 1002 to stay '720p', got '%s'", written["1002"])
+	}
+}
+
 func TestManifestWriter_WriteManifest_EmptySegments(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "manifest_test_*")
 	if err != nil {
@@ -239,3 +351,250 @@ func TestManifestItem_JSONSerialization(t *testing.T) {
 		t.Errorf("Resolution mismatch: expected '%s', got '%s'", item.Resolution, unmarshaled.Resolution)
 	}
 }
+
+func TestReadManifest_Truncated(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "truncated.json")
+	truncated := `[
+  {
+    "seqNo": "1001",
+    "resolution": "1080p"
+  },
+  {
+    "seqNo": "10`
+	if err := os.WriteFile(manifestPath, []byte(truncated), 0644); err != nil {
+		t.Fatalf("Failed to write truncated manifest: %v", err)
+	}
+
+	_, err = ReadManifest(manifestPath, false)
+	if err == nil {
+		t.Fatal("Expected error for truncated manifest")
+	}
+	if !errors.Is(err, ErrCorruptManifest) {
+		t.Errorf("Expected ErrCorruptManifest, got: %v", err)
+	}
+}
+
+func TestReadManifest_MissingIsNotCorrupt(t *testing.T) {
+	_, err := ReadManifest(filepath.Join(os.TempDir(), "does-not-exist-manifest.json"), true)
+	if err == nil {
+		t.Fatal("Expected error for missing manifest")
+	}
+	if errors.Is(err, ErrCorruptManifest) {
+		t.Errorf("Missing manifest should not be reported as corrupt: %v", err)
+	}
+}
+
+func TestReadManifest_RecoversFromBackup(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "event.json")
+	writer := &ManifestWriter{
+		ManifestPath: manifestPath,
+		Segments:     make([]ManifestItem, 0),
+		Index:        make(map[string]*ManifestItem),
+	}
+
+	// Two saves so the first one is rotated into the .bak
+	writer.AddOrUpdateSegment("1001", "1080p")
+	writer.WriteManifest()
+	writer.AddOrUpdateSegment("1002", "1080p")
+	writer.WriteManifest()
+
+	if _, err := os.Stat(manifestPath + ".bak"); err != nil {
+		t.Fatalf("Expected backup manifest to exist: %v", err)
+	}
+
+	// Simulate a crash mid-write
+	if err := os.WriteFile(manifestPath, []byte(`[{"seqNo": "10`), 0644); err != nil {
+		t.Fatalf("Failed to corrupt manifest: %v", err)
+	}
+
+	if _, err := ReadManifest(manifestPath, false); !errors.Is(err, ErrCorruptManifest) {
+		t.Errorf("Expected ErrCorruptManifest without backup recovery, got: %v", err)
+	}
+
+	segments, err := ReadManifest(manifestPath, true)
+	if err != nil {
+		t.Fatalf("Expected recovery from backup, got: %v", err)
+	}
+	if len(segments) != 1 || segments[0].SeqNo != "1001" {
+		t.Errorf("Expected backup with segment 1001, got %v", segments)
+	}
+}
+
+func TestReadManifest_RecoversMissingFromBackup(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "event.json")
+	writer := &ManifestWriter{ManifestPath: manifestPath}
+	writer.AddOrUpdateSegment("1001", "1080p")
+	writer.WriteManifest()
+	writer.AddOrUpdateSegment("1002", "1080p")
+	writer.WriteManifest()
+
+	// The manifest is replaced in place, the backup is an extra copy
+	items, err := ReadManifest(manifestPath, false)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected manifest with 2 segments after second save, got %v (%v)", items, err)
+	}
+
+	// Simulate a crash that lost the manifest but not its backup
+	if err := os.Remove(manifestPath); err != nil {
+		t.Fatalf("Failed to remove manifest: %v", err)
+	}
+	if _, err := ReadManifest(manifestPath, false); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not-exist error without backup recovery, got: %v", err)
+	}
+
+	segments, err := ReadManifest(manifestPath, true)
+	if err != nil {
+		t.Fatalf("Expected recovery from backup, got: %v", err)
+	}
+	if len(segments) != 1 || segments[0].SeqNo != "1001" {
+		t.Errorf("Expected backup with segment 1001, got %v", segments)
+	}
+}
+
+func TestManifestWriter_CloseFlushesPending(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "close-manifest.json")
+	writer := &ManifestWriter{ManifestPath: manifestPath}
+	writer.AddOrUpdateSegment("1001", "1080p")
+	writer.AddOrUpdateSegment("1002", "720p")
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	items, err := ReadManifest(manifestPath, false)
+	if err != nil {
+		t.Fatalf("ReadManifest() failed: %v", err)
+	}
+	if len(items) != 2 {
+		t.Errorf("Expected Close to flush 2 segments, got %d", len(items))
+	}
+}
+
+func TestManifestWriter_CloseIdempotent(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "close-manifest.json")
+	writer := &ManifestWriter{ManifestPath: manifestPath}
+	writer.AddOrUpdateSegment("1001", "1080p")
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("First Close() failed: %v", err)
+	}
+	os.Remove(manifestPath)
+
+	// Updates after Close are dropped and a second Close writes nothing
+	writer.AddOrUpdateSegment("1002", "1080p")
+	if err := writer.Close(); err != nil {
+		t.Errorf("Second Close() should be a no-op, got %v", err)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Error("Second Close() should not rewrite the manifest")
+	}
+	if len(writer.Segments) != 1 {
+		t.Errorf("Expected updates after Close to be dropped, got %d segments", len(writer.Segments))
+	}
+}
+
+func TestManifestWriter_CloseSkipsUnchanged(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "close-manifest.json")
+	writer := &ManifestWriter{ManifestPath: manifestPath}
+	writer.AddOrUpdateSegment("1001", "1080p")
+	writer.WriteManifest()
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err := os.Stat(manifestPath + ".bak"); !os.IsNotExist(err) {
+		t.Error("Close() after WriteManifest with no changes should not write again")
+	}
+}
+
+func TestManifestWriter_SharedPerEvent(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldDir := cfg.Paths.ManifestDir
+	cfg.Paths.ManifestDir = tempDir
+	t.Cleanup(func() { cfg.Paths.ManifestDir = oldDir })
+
+	first := NewManifestWriter("shared-event")
+	second := NewManifestWriter("shared-event")
+	if first != second {
+		t.Error("Expected writers for the same event to be shared")
+	}
+	if other := NewManifestWriter("other-event"); other == first {
+		t.Error("Expected a separate writer for another event")
+	}
+
+	// Once closed, the next writer for the event starts fresh
+	first.AddOrUpdateSegment("1001", "1080p")
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if NewManifestWriter("shared-event") == first {
+		t.Error("Expected a new writer after the shared one was closed")
+	}
+}
+
+func TestManifestWriter_WarnsWhenEmpty(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifest_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	writer := &ManifestWriter{ManifestPath: filepath.Join(tempDir, "empty.json")}
+	writer.WriteManifest()
+	if !strings.Contains(buf.String(), "manifest empty — check writer wiring") {
+		t.Errorf("Expected empty manifest warning, got %q", buf.String())
+	}
+
+	buf.Reset()
+	writer.AddOrUpdateSegment("1001", "1080p")
+	writer.WriteManifest()
+	if strings.Contains(buf.String(), "manifest empty") {
+		t.Errorf("Expected no warning once a segment was recorded, got %q", buf.String())
+	}
+}
@@ -0,0 +1,120 @@
+package media
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// MasterRefresher periodically re-fetches the master playlist so variants that
+// appear mid-event, or come back after dropping out, get their own downloader
+// and variants that drop out are logged.
+type MasterRefresher struct {
+	MasterURL string
+	OutputDir string
+	Writer    *ManifestWriter
+	Interval  time.Duration
+	// Classify labels variants; nil uses DefaultClassifier
+	Classify VariantClassifier
+
+	known   map[string]*StreamVariant
+	present map[string]bool
+	nextID  int
+	mu      sync.Mutex
+}
+
+func NewMasterRefresher(masterURL string, outputDir string, writer *ManifestWriter, interval time.Duration) *MasterRefresher {
+	return &MasterRefresher{
+		MasterURL: masterURL,
+		OutputDir: outputDir,
+		Writer:    writer,
+		Interval:  interval,
+		known:     make(map[string]*StreamVariant),
+		present:   make(map[string]bool),
+	}
+}
+
+// Track records the given variants and returns those that weren't present on
+// the previous call as added, and those that were but are missing now as
+// removed. A variant stays reported once while it remains present, so
+// callers can spawn a downloader for every added variant without duplicates.
+// One that left and comes back is added again, keeping its ID, so a master
+// playlist that briefly drops it doesn't end its capture.
+func (r *MasterRefresher) Track(variants []*StreamVariant) (added []*StreamVariant, removed []*StreamVariant) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		current[v.URL] = true
+		if r.present[v.URL] {
+			continue
+		}
+		if known, ok := r.known[v.URL]; ok {
+			v.ID = known.ID
+		} else {
+			v.ID = r.nextID
+			r.nextID++
+		}
+		r.known[v.URL] = v
+		added = append(added, v)
+	}
+
+	for key := range r.present {
+		if !current[key] {
+			removed = append(removed, r.known[key])
+		}
+	}
+	r.present = current
+
+	return added, removed
+}
+
+// Refresh fetches the master playlist once and tracks the result.
+func (r *MasterRefresher) Refresh() (added []*StreamVariant, removed []*StreamVariant, err error) {
+	variants, err := GetAllVariants(r.MasterURL, r.OutputDir, r.Writer, r.Classify)
+	if err != nil {
+		return nil, nil, err
+	}
+	added, removed = r.Track(variants)
+	return added, removed, nil
+}
+
+// Run re-fetches the master playlist every Interval until ctx is cancelled,
+// calling onNew for each newly discovered variant and onRemoved, when not
+// nil, for each one that left the playlist. Fetch errors are logged and
+// retried on the next tick.
+func (r *MasterRefresher) Run(ctx context.Context, onNew func(*StreamVariant), onRemoved func(*StreamVariant)) {
+	if r.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		added, removed, err := r.Refresh()
+		if err != nil {
+			log.Printf("Failed to refresh master playlist: %v", err)
+			continue
+		}
+
+		for _, v := range removed {
+			log.Printf("Variant %s disappeared from master playlist (bandwidth: %d)", v.Resolution, v.Bandwidth)
+			if onRemoved != nil {
+				onRemoved(v)
+			}
+		}
+		for _, v := range added {
+			log.Printf("New variant %s found in master playlist (bandwidth: %d)", v.Resolution, v.Bandwidth)
+			onNew(v)
+		}
+	}
+}
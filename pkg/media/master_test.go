@@ -0,0 +1,377 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/httpClient"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func masterPlaylist(variants ...string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, v := range variants {
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+const (
+	variant1080 = "#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080\n1080/chunklist.m3u8\n"
+	variant720  = "#EXT-X-STREAM-INF:BANDWIDTH=3500000,RESOLUTION=1280x720\n720/chunklist.m3u8\n"
+	variant480  = "#EXT-X-STREAM-INF:BANDWIDTH=1600000,RESOLUTION=854x480\n480/chunklist.m3u8\n"
+)
+
+func newChangingMasterServer(t *testing.T, bodies ...string) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	fetch := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body := bodies[len(bodies)-1]
+		if fetch < len(bodies) {
+			body = bodies[fetch]
+		}
+		fetch++
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMasterRefresher_DetectsAddedAndRemovedVariants(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "master_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := newChangingMasterServer(t,
+		masterPlaylist(variant1080, variant720),
+		masterPlaylist(variant1080, variant480),
+		masterPlaylist(variant1080, variant720, variant480),
+	)
+
+	refresher := NewMasterRefresher(server.URL+"/master.m3u8", tempDir, nil, 0)
+
+	added, removed, err := refresher.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if len(added) != 2 || len(removed) != 0 {
+		t.Fatalf("First refresh: expected 2 added and 0 removed, got %d added and %d removed", len(added), len(removed))
+	}
+	firstID720 := added[1].ID
+
+	added, removed, err = refresher.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if len(added) != 1 || added[0].Resolution != "480p" {
+		t.Errorf("Second refresh: expected 480p to be added, got %v", added)
+	}
+	if len(removed) != 1 || removed[0].Resolution != "720p" {
+		t.Errorf("Second refresh: expected 720p to be removed, got %v", removed)
+	}
+
+	// 720p reappears; its downloader was stopped, so it is added again with
+	// its old ID, while 480p stays reported once
+	added, removed, err = refresher.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if len(added) != 1 || added[0].Resolution != "720p" || added[0].ID != firstID720 {
+		t.Errorf("Third refresh: expected 720p added again with ID %d, got %v", firstID720, added)
+	}
+	if len(removed) != 0 {
+		t.Errorf("Third refresh: expected no removed variants, got %d", len(removed))
+	}
+}
+
+func TestMasterRefresher_RunReportsRemovedVariants(t *testing.T) {
+	server := newChangingMasterServer(t,
+		masterPlaylist(variant1080, variant720),
+		masterPlaylist(variant1080),
+	)
+
+	refresher := NewMasterRefresher(server.URL+"/master.m3u8", "/event", nil, 10*time.Millisecond)
+	if _, _, err := refresher.Refresh(); err != nil {
+		t.Fatalf("Initial refresh failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	removed := make(chan *StreamVariant, 1)
+	go refresher.Run(ctx, func(*StreamVariant) {
+		t.Error("No variant should be reported as new")
+	}, func(v *StreamVariant) {
+		removed <- v
+	})
+
+	select {
+	case v := <-removed:
+		if v.Resolution != "720p" {
+			t.Errorf("Expected the 720p variant to be reported removed, got %s", v.Resolution)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not report the variant that left the master playlist")
+	}
+}
+
+func TestMasterRefresher_AssignsUniqueIDs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "master_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := newChangingMasterServer(t,
+		masterPlaylist(variant1080),
+		masterPlaylist(variant720, variant1080),
+	)
+
+	refresher := NewMasterRefresher(server.URL+"/master.m3u8", tempDir, nil, 0)
+
+	first, _, err := refresher.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	second, _, err := refresher.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("Expected one new variant per refresh, got %d and %d", len(first), len(second))
+	}
+	if first[0].ID == second[0].ID {
+		t.Errorf("Expected unique variant IDs, both were %d", first[0].ID)
+	}
+}
+
+func TestGetAllVariants_CustomClassifier(t *testing.T) {
+	server := newChangingMasterServer(t, masterPlaylist(variant1080, variant720, variant480))
+
+	classify := func(v *m3u8.Variant) string {
+		if v.Bandwidth >= 3000000 {
+			return "high"
+		}
+		return "low"
+	}
+
+	variants, err := GetAllVariants(server.URL+"/master.m3u8", "/event", nil, classify)
+	if err != nil {
+		t.Fatalf("GetAllVariants() failed: %v", err)
+	}
+
+	expected := []string{"high", "high", "low"}
+	if len(variants) != len(expected) {
+		t.Fatalf("Expected %d variants, got %d", len(expected), len(variants))
+	}
+	for i, v := range variants {
+		if v.Resolution != expected[i] {
+			t.Errorf("Variant %d: expected resolution %s, got %s", i, expected[i], v.Resolution)
+		}
+		if v.OutputDir != path.Join("/event", expected[i]) {
+			t.Errorf("Variant %d: expected output dir under %s, got %s", i, expected[i], v.OutputDir)
+		}
+	}
+}
+
+func TestGetAllVariants_DefaultClassifier(t *testing.T) {
+	server := newChangingMasterServer(t, masterPlaylist(variant1080, variant720))
+
+	variants, err := GetAllVariants(server.URL+"/master.m3u8", "/event", nil, nil)
+	if err != nil {
+		t.Fatalf("GetAllVariants() failed: %v", err)
+	}
+	if len(variants) != 2 || variants[0].Resolution != "1080p" || variants[1].Resolution != "720p" {
+		t.Errorf("Expected default labels 1080p and 720p, got %+v", variants)
+	}
+}
+
+func TestMasterRefresher_UsesClassifier(t *testing.T) {
+	server := newChangingMasterServer(t, masterPlaylist(variant1080))
+
+	refresher := NewMasterRefresher(server.URL+"/master.m3u8", "/event", nil, 0)
+	refresher.Classify = func(v *m3u8.Variant) string { return "main" }
+
+	added, _, err := refresher.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if len(added) != 1 || added[0].Resolution != "main" {
+		t.Errorf("Expected variant labelled by refresher classifier, got %+v", added)
+	}
+}
+
+// fastMasterRetries shortens the master playlist backoff for the test
+func fastMasterRetries(t *testing.T) {
+	original := masterRetryPolicy
+	masterRetryPolicy.InitialDelay = time.Millisecond
+	masterRetryPolicy.MaxDelay = time.Millisecond
+	t.Cleanup(func() { masterRetryPolicy = original })
+}
+
+func TestGetAllVariants_RetriesEmptyBody(t *testing.T) {
+	fastMasterRetries(t)
+	server := newChangingMasterServer(t, "", "  \n", masterPlaylist(variant1080, variant720))
+
+	variants, err := GetAllVariants(server.URL+"/master.m3u8", "/event", nil, nil)
+	if err != nil {
+		t.Fatalf("Expected empty responses to be retried, got %v", err)
+	}
+	if len(variants) != 2 {
+		t.Errorf("Expected 2 variants after retry, got %d", len(variants))
+	}
+}
+
+func TestGetAllVariants_EmptyBodyExhaustsRetries(t *testing.T) {
+	fastMasterRetries(t)
+	server := newChangingMasterServer(t, "")
+
+	_, err := GetAllVariants(server.URL+"/master.m3u8", "/event", nil, nil)
+	if !errors.Is(err, ErrEmptyPlaylist) {
+		t.Errorf("Expected ErrEmptyPlaylist after exhausting retries, got %v", err)
+	}
+}
+
+func TestGetAllVariants_ErrorStatusNotEmpty(t *testing.T) {
+	fastMasterRetries(t)
+	for _, code := range []int{http.StatusNotFound, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			var fetches int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&fetches, 1)
+				w.WriteHeader(code)
+			}))
+			defer server.Close()
+
+			_, err := GetAllVariants(server.URL+"/master.m3u8", "/event", nil, nil)
+			var httpErr *httpClient.HttpError
+			if !errors.As(err, &httpErr) || httpErr.Code != code {
+				t.Errorf("Expected HTTP %d error, got %v", code, err)
+			}
+			if errors.Is(err, ErrEmptyPlaylist) {
+				t.Errorf("An HTTP %d response should not be reported as an empty playlist", code)
+			}
+			if n := atomic.LoadInt32(&fetches); n != 1 {
+				t.Errorf("Expected an error status to fail without retrying, got %d fetches", n)
+			}
+		})
+	}
+}
+
+func TestGetAllVariants_MalformedBodyNotRetried(t *testing.T) {
+	fastMasterRetries(t)
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprint(w, "<html>not a playlist</html>")
+	}))
+	defer server.Close()
+
+	if _, err := GetAllVariants(server.URL+"/master.m3u8", "/event", nil, nil); err == nil {
+		t.Fatal("Expected an error decoding a non-playlist body")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("Expected a malformed body to fail without retrying, got %d fetches", n)
+	}
+}
+
+// writeLocalPlaylist saves body to a temp file and returns its path
+func writeLocalPlaylist(t *testing.T, body string) string {
+	t.Helper()
+	tempDir, err := os.MkdirTemp("", "master_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	playlistPath := filepath.Join(tempDir, "master.m3u8")
+	if err := os.WriteFile(playlistPath, []byte(body), 0644); err != nil {
+		t.Fatalf("Failed to write playlist: %v", err)
+	}
+	return playlistPath
+}
+
+func TestGetAllVariants_LocalFile(t *testing.T) {
+	playlistPath := writeLocalPlaylist(t, masterPlaylist(variant1080, variant720))
+	fileURL := "file://" + filepath.ToSlash(playlistPath)
+	if !strings.HasPrefix(filepath.ToSlash(playlistPath), "/") {
+		fileURL = "file:///" + filepath.ToSlash(playlistPath)
+	}
+
+	for _, masterURL := range []string{playlistPath, fileURL} {
+		variants, err := GetAllVariants(masterURL, "/event", nil, nil)
+		if err != nil {
+			t.Fatalf("GetAllVariants(%q) failed: %v", masterURL, err)
+		}
+		if len(variants) != 2 || variants[0].Resolution != "1080p" || variants[1].Resolution != "720p" {
+			t.Fatalf("Expected 1080p and 720p from %q, got %+v", masterURL, variants)
+		}
+		// Without a base URL, variants resolve next to the saved file
+		want := "file://" + path.Join(path.Dir(strings.TrimPrefix(fileURL, "file://")), "1080/chunklist.m3u8")
+		if variants[0].URL != want {
+			t.Errorf("Expected variant URL %s, got %s", want, variants[0].URL)
+		}
+	}
+}
+
+func TestGetAllVariants_LocalFileWithBaseURL(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	original := cfg.Core.MasterBaseURL
+	cfg.Core.MasterBaseURL = "https://cdn.example.com/live/"
+	t.Cleanup(func() { cfg.Core.MasterBaseURL = original })
+
+	playlistPath := writeLocalPlaylist(t, masterPlaylist(variant1080, variant720))
+	variants, err := GetAllVariants(playlistPath, "/event", nil, nil)
+	if err != nil {
+		t.Fatalf("GetAllVariants() failed: %v", err)
+	}
+	if len(variants) != 2 {
+		t.Fatalf("Expected 2 variants, got %d", len(variants))
+	}
+	if want := "https://cdn.example.com/live/1080/chunklist.m3u8"; variants[0].URL != want {
+		t.Errorf("Expected variant URL %s, got %s", want, variants[0].URL)
+	}
+
+	job := SegmentJob{URI: "media_0001.ts", Variant: variants[0]}
+	if want := "https://cdn.example.com/live/1080/media_0001.ts"; job.AbsoluteURL() != want {
+		t.Errorf("Expected segment URL %s, got %s", want, job.AbsoluteURL())
+	}
+}
+
+func TestGetAllVariants_LocalMediaPlaylist(t *testing.T) {
+	body := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:6.0,\nmedia_0010.ts\n"
+	playlistPath := writeLocalPlaylist(t, body)
+
+	variants, err := GetAllVariants(playlistPath, "/event", nil, nil)
+	if err != nil {
+		t.Fatalf("GetAllVariants() failed: %v", err)
+	}
+	if len(variants) != 1 || variants[0].Resolution != "unknown" {
+		t.Fatalf("Expected one single-quality variant, got %+v", variants)
+	}
+
+	playlist, err := LoadMediaPlaylist(context.Background(), variants[0].URL)
+	if err != nil {
+		t.Fatalf("LoadMediaPlaylist() failed: %v", err)
+	}
+	if playlist.SeqNo != 10 || playlist.Segments[0] == nil || playlist.Segments[0].URI != "media_0010.ts" {
+		t.Errorf("Unexpected playlist loaded from disk: seq %d", playlist.SeqNo)
+	}
+}
@@ -0,0 +1,37 @@
+package media
+
+// MergeManifests records every item of each manifest in writer, so a sequence
+// captured by more than one run appears once. As during a download, the
+// tallest available resolution becomes the item's Resolution, and a
+// resolution one run missed is not recorded missing if another run has it.
+// It returns how many distinct sequences writer holds afterwards.
+func MergeManifests(writer *ManifestWriter, manifests ...[]ManifestItem) int {
+	for _, items := range manifests {
+		for _, item := range items {
+			available := item.Available
+			if len(available) == 0 && item.Resolution != "" {
+				// Manifests written before Available was added
+				available = []string{item.Resolution}
+			}
+			for _, resolution := range available {
+				writer.AddOrUpdateSegment(item.SeqNo, resolution)
+				if sum, ok := item.Checksums[resolution]; ok {
+					writer.RecordChecksum(item.SeqNo, resolution, sum)
+				}
+			}
+		}
+	}
+
+	// Missing only once every run's available resolutions are in
+	for _, items := range manifests {
+		for _, item := range items {
+			for _, resolution := range item.Missing {
+				writer.RecordMissing(item.SeqNo, resolution)
+			}
+		}
+	}
+
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	return len(writer.Segments)
+}
@@ -1,15 +1,101 @@
 package media
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/grafov/m3u8"
+	"io"
 	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/httpClient"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 )
 
-func LoadMediaPlaylist(mediaURL string) (*m3u8.MediaPlaylist, error) {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", mediaURL, nil)
+// ErrEmptyPlaylist is returned when a playlist request succeeds but the body
+// is too short to be a playlist, as CDNs occasionally do during a blip.
+var ErrEmptyPlaylist = errors.New("empty playlist response")
+
+// decodePlaylist reads a playlist body, rejecting empty responses with
+// ErrEmptyPlaylist before they reach the decoder.
+func decodePlaylist(body io.Reader) (m3u8.Playlist, m3u8.ListType, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(bytes.TrimSpace(data)) < len("#EXTM3U") {
+		return nil, 0, fmt.Errorf("%w (%d bytes)", ErrEmptyPlaylist, len(data))
+	}
+	return m3u8.Decode(*bytes.NewBuffer(data), true)
+}
+
+// localPlaylistPath returns the filesystem path of a file:// URL or a plain
+// path, and false for remote URLs
+func localPlaylistPath(playlistURL string) (string, bool) {
+	u, err := url.Parse(playlistURL)
+	if err != nil {
+		return playlistURL, true
+	}
+	if u.Scheme == "file" {
+		p := u.Path
+		// file:///C:/dir parses to /C:/dir
+		if len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+			p = p[1:]
+		}
+		return filepath.FromSlash(p), true
+	}
+	// A one-letter scheme is a Windows drive, e.g. C:\streams\master.m3u8
+	if len(u.Scheme) > 1 {
+		return "", false
+	}
+	return playlistURL, true
+}
+
+// localFileURL is the file:// URL of a local playlist, for resolving the
+// relative URIs inside it
+func localFileURL(localPath string) (*url.URL, error) {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return nil, err
+	}
+	slashed := filepath.ToSlash(abs)
+	if len(slashed) > 0 && slashed[0] != '/' {
+		slashed = "/" + slashed
+	}
+	return &url.URL{Scheme: "file", Path: slashed}, nil
+}
+
+func readLocalPlaylist(localPath string) (m3u8.Playlist, m3u8.ListType, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open playlist file: %w", err)
+	}
+	defer f.Close()
+	return decodePlaylist(f)
+}
+
+// LoadMediaPlaylist fetches and decodes a media playlist, giving up when ctx
+// is done. A file:// URL or plain path is read from disk.
+func LoadMediaPlaylist(ctx context.Context, mediaURL string) (*m3u8.MediaPlaylist, error) {
+	if localPath, ok := localPlaylistPath(mediaURL); ok {
+		pl, listType, err := readLocalPlaylist(localPath)
+		if err != nil {
+			return nil, err
+		}
+		if listType == m3u8.MASTER {
+			return nil, fmt.Errorf("expected media playlist but got master")
+		}
+		return pl.(*m3u8.MediaPlaylist), nil
+	}
+
+	client := httpClient.Default()
+	req, err := http.NewRequestWithContext(ctx, "GET", mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("User-Agent", constants.HTTPUserAgent)
 	req.Header.Set("Referer", constants.REFERRER)
 	resp, err := client.Do(req)
@@ -17,8 +103,11 @@ func LoadMediaPlaylist(mediaURL string) (*m3u8.MediaPlaylist, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpClient.HttpError{Code: resp.StatusCode}
+	}
 
-	pl, listType, err := m3u8.DecodeFrom(resp.Body, true)
+	pl, listType, err := decodePlaylist(resp.Body)
 	if err != nil {
 		return nil, err
 	}
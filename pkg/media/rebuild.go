@@ -0,0 +1,55 @@
+package media
+
+import (
+	"fmt"
+	"log"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RebuildManifest records every finished segment under eventPath in writer,
+// treating each subdirectory as one resolution and taking sequence numbers
+// from the file names. As during a download, the tallest resolution that has
+// a sequence becomes its Resolution. It returns how many segment files were
+// recorded.
+func RebuildManifest(eventPath string, writer *ManifestWriter) (int, error) {
+	dirs, err := os.ReadDir(eventPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read event directory: %w", err)
+	}
+
+	recorded := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		resolution := dir.Name()
+
+		files, err := os.ReadDir(filepath.Join(eventPath, resolution))
+		if err != nil {
+			return recorded, fmt.Errorf("failed to read resolution directory %s: %w", resolution, err)
+		}
+
+		count := 0
+		for _, file := range files {
+			if file.IsDir() || !utils.IsSegmentFile(file.Name()) {
+				continue
+			}
+			seqNo, discontinuity, err := ParseSegmentName(file.Name())
+			if err != nil {
+				log.Printf("Skipping %s/%s: %v", resolution, file.Name(), err)
+				continue
+			}
+			writer.AddOrUpdateSegment(ManifestKey(uint64(seqNo), uint64(discontinuity)), resolution)
+			count++
+		}
+		if count > 0 {
+			log.Printf("Found %d segments in %s", count, resolution)
+		}
+		recorded += count
+	}
+
+	return recorded, nil
+}
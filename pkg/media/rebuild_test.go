@@ -0,0 +1,96 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRebuildManifest(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "rebuild_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 1080p is missing 3 and 720p is missing 1 and 4; partial files,
+	// non-segment files and hidden directories must be ignored
+	files := []string{
+		"1080p/media_0001.ts",
+		"1080p/media_0002.ts",
+		"1080p/media_0004.ts",
+		"1080p/media_0004.ts.tmp",
+		"720p/media_0002.ts",
+		"720p/media_0003.ts",
+		"720p/media_0003_d1.ts",
+		"720p/notes.txt",
+		"audio/media_0005.aac",
+		".partial/media_0006.ts",
+	}
+	for _, f := range files {
+		p := filepath.Join(tempDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", f, err)
+		}
+	}
+
+	manifestPath := filepath.Join(tempDir, "event.json")
+	writer := &ManifestWriter{ManifestPath: manifestPath}
+	count, err := RebuildManifest(tempDir, writer)
+	if err != nil {
+		t.Fatalf("RebuildManifest failed: %v", err)
+	}
+	if count != 6 {
+		t.Errorf("Expected 6 segment files recorded, got %d", count)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	items, err := ReadManifest(manifestPath, false)
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+
+	want := map[string]struct {
+		resolution string
+		available  []string
+	}{
+		"1": {resolution: "1080p", available: []string{"1080p"}},
+		"2": {resolution: "1080p", available: []string{"1080p", "720p"}},
+		"3": {resolution: "720p", available: []string{"720p"}},
+		"4": {resolution: "1080p", available: []string{"1080p"}},
+		// A restarted sequence number is its own item, after the first run
+		"3_d1": {resolution: "720p", available: []string{"720p"}},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("Expected %d manifest items, got %d: %+v", len(want), len(items), items)
+	}
+	if last := items[len(items)-1].SeqNo; last != "3_d1" {
+		t.Errorf("Expected the restarted sequence last, got %s", last)
+	}
+	for _, item := range items {
+		w, ok := want[item.SeqNo]
+		if !ok {
+			t.Errorf("Unexpected sequence %s in manifest", item.SeqNo)
+			continue
+		}
+		if item.Resolution != w.resolution {
+			t.Errorf("Sequence %s: expected resolution %s, got %s", item.SeqNo, w.resolution, item.Resolution)
+		}
+		if strings.Join(item.Available, ",") != strings.Join(w.available, ",") {
+			t.Errorf("Sequence %s: expected available %v, got %v", item.SeqNo, w.available, item.Available)
+		}
+	}
+}
+
+func TestRebuildManifest_MissingEventDir(t *testing.T) {
+	writer := &ManifestWriter{ManifestPath: "test.json"}
+	if _, err := RebuildManifest(filepath.Join(os.TempDir(), "no_such_event_dir"), writer); err == nil {
+		t.Error("Expected error for missing event directory")
+	}
+}
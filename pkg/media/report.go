@@ -0,0 +1,157 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CaptureReport summarizes a finished download or processing run. It is
+// written as <event>_report.json when Core.WriteReport is enabled.
+type CaptureReport struct {
+	Event      string            `json:"event"`
+	Source     string            `json:"source,omitempty"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+	Duration   string            `json:"duration"`
+	Segments   int               `json:"segments"`
+	Bytes      int64             `json:"bytes"`
+	Failed     int               `json:"failed"`
+	Latency    *LatencyReport    `json:"latency,omitempty"`
+	Variants   []VariantReport   `json:"variants"`
+	Gaps       []SequenceGap     `json:"gaps,omitempty"`
+	Outputs    map[string]string `json:"outputs,omitempty"`
+}
+
+// VariantReport is the per-resolution part of a CaptureReport
+type VariantReport struct {
+	Resolution string        `json:"resolution"`
+	Segments   int           `json:"segments"`
+	Bytes      int64         `json:"bytes"`
+	Failed     int           `json:"failed"`
+	Gaps       []SequenceGap `json:"gaps,omitempty"`
+}
+
+// LatencyReport holds the download latency percentiles, as bucket bounds
+type LatencyReport struct {
+	P50 string `json:"p50"`
+	P90 string `json:"p90"`
+	P99 string `json:"p99"`
+	Max string `json:"max"`
+}
+
+// SequenceGap is a run of missing sequence numbers, From to To inclusive,
+// within one discontinuity
+type SequenceGap struct {
+	Discontinuity uint64 `json:"discontinuity,omitempty"`
+	From          uint64 `json:"from"`
+	To            uint64 `json:"to"`
+}
+
+// NewCaptureReport starts a report for event covering started to finished
+func NewCaptureReport(event, source string, started, finished time.Time) *CaptureReport {
+	return &CaptureReport{
+		Event:      event,
+		Source:     source,
+		StartedAt:  started,
+		FinishedAt: finished,
+		Duration:   finished.Sub(started).Round(time.Second).String(),
+		Variants:   make([]VariantReport, 0),
+		Outputs:    make(map[string]string),
+	}
+}
+
+// AddVariant appends a variant and adds it to the report totals
+func (r *CaptureReport) AddVariant(v VariantReport) {
+	r.Variants = append(r.Variants, v)
+	r.Segments += v.Segments
+	r.Bytes += v.Bytes
+	r.Failed += v.Failed
+}
+
+// FindGaps returns the missing runs between the lowest and highest of seqs
+func FindGaps(discontinuity uint64, seqs []uint64) []SequenceGap {
+	if len(seqs) == 0 {
+		return nil
+	}
+	sorted := append([]uint64(nil), seqs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var gaps []SequenceGap
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] > sorted[i-1]+1 {
+			gaps = append(gaps, SequenceGap{
+				Discontinuity: discontinuity,
+				From:          sorted[i-1] + 1,
+				To:            sorted[i] - 1,
+			})
+		}
+	}
+	return gaps
+}
+
+// Write saves the report as indented JSON via a temp file and rename
+func (r *CaptureReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace report: %w", err)
+	}
+	return nil
+}
+
+// Report builds a CaptureReport from everything recorded so far
+func (s *DownloadStats) Report(event, source string, started, finished time.Time) *CaptureReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := NewCaptureReport(event, source, started, finished)
+	if s.Succeeded > 0 {
+		r.Latency = &LatencyReport{
+			P50: s.percentileLocked(50).String(),
+			P90: s.percentileLocked(90).String(),
+			P99: s.percentileLocked(99).String(),
+			Max: s.max.String(),
+		}
+	}
+
+	variants := make([]string, 0, len(s.totals))
+	for variant := range s.totals {
+		variants = append(variants, variant)
+	}
+	sort.Strings(variants)
+
+	for _, variant := range variants {
+		t := s.totals[variant]
+		v := VariantReport{
+			Resolution: variant,
+			Segments:   t.segments,
+			Bytes:      t.bytes,
+			Failed:     t.failed,
+		}
+		discontinuities := make([]uint64, 0, len(t.seqs))
+		for d := range t.seqs {
+			discontinuities = append(discontinuities, d)
+		}
+		sort.Slice(discontinuities, func(i, j int) bool { return discontinuities[i] < discontinuities[j] })
+		for _, d := range discontinuities {
+			v.Gaps = append(v.Gaps, FindGaps(d, t.seqs[d])...)
+		}
+		r.AddVariant(v)
+	}
+	return r
+}
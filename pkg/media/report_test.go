@@ -0,0 +1,111 @@
+package media
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadStats_Report(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "report_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Stubbed run: 1080p misses 3-4, restarts, then misses 2; 720p never
+	// saves anything
+	stats := NewDownloadStats()
+	stats.StartVariant("1080p", 3*time.Second)
+	stats.StartVariant("720p", 3*time.Second)
+	for _, seq := range []uint64{1, 2, 5} {
+		stats.RecordVariant("1080p", 100*time.Millisecond, nil)
+		stats.RecordSaved("1080p", 0, seq, 1000)
+	}
+	for _, seq := range []uint64{1, 3} {
+		stats.RecordVariant("1080p", 100*time.Millisecond, nil)
+		stats.RecordSaved("1080p", 1, seq, 500)
+	}
+	stats.RecordVariant("1080p", 10*time.Second, errors.New("timeout"))
+	stats.RecordVariant("720p", 10*time.Second, errors.New("timeout"))
+
+	started := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	report := stats.Report("test-event", "https://example.com/master.m3u8", started, started.Add(90*time.Minute))
+	report.Outputs["segments"] = filepath.Join(tempDir, "test-event")
+
+	reportPath := filepath.Join(tempDir, "manifests", "test-event_report.json")
+	if err := report.Write(reportPath); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var got CaptureReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Report is not valid JSON: %v", err)
+	}
+
+	if got.Event != "test-event" || got.Duration != "1h30m0s" {
+		t.Errorf("Unexpected event/duration: %s, %s", got.Event, got.Duration)
+	}
+	if got.Segments != 5 || got.Bytes != 4000 || got.Failed != 2 {
+		t.Errorf("Expected totals 5 segments, 4000 bytes, 2 failed, got %d, %d, %d", got.Segments, got.Bytes, got.Failed)
+	}
+	if got.Latency == nil || got.Latency.P50 != "100ms" {
+		t.Errorf("Expected p50 latency of 100ms, got %+v", got.Latency)
+	}
+	if got.Outputs["segments"] != filepath.Join(tempDir, "test-event") {
+		t.Errorf("Expected segments output path, got %v", got.Outputs)
+	}
+
+	if len(got.Variants) != 2 {
+		t.Fatalf("Expected 2 variants, got %d", len(got.Variants))
+	}
+	hd := got.Variants[0]
+	if hd.Resolution != "1080p" || hd.Segments != 5 || hd.Bytes != 4000 || hd.Failed != 1 {
+		t.Errorf("Unexpected 1080p report: %+v", hd)
+	}
+	expectedGaps := []SequenceGap{{Discontinuity: 0, From: 3, To: 4}, {Discontinuity: 1, From: 2, To: 2}}
+	if len(hd.Gaps) != len(expectedGaps) {
+		t.Fatalf("Expected gaps %v, got %v", expectedGaps, hd.Gaps)
+	}
+	for i, gap := range expectedGaps {
+		if hd.Gaps[i] != gap {
+			t.Errorf("Gap %d: expected %+v, got %+v", i, gap, hd.Gaps[i])
+		}
+	}
+	if sd := got.Variants[1]; sd.Resolution != "720p" || sd.Segments != 0 || sd.Failed != 1 {
+		t.Errorf("Unexpected 720p report: %+v", sd)
+	}
+}
+
+func TestFindGaps(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint64
+		want []SequenceGap
+	}{
+		{"empty", nil, nil},
+		{"contiguous", []uint64{3, 1, 2}, nil},
+		{"unsorted with gaps", []uint64{10, 4, 1, 5}, []SequenceGap{{From: 2, To: 3}, {From: 6, To: 9}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FindGaps(0, tt.seqs)
+			if len(got) != len(tt.want) {
+				t.Fatalf("FindGaps(%v) = %v, want %v", tt.seqs, got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("FindGaps(%v)[%d] = %+v, want %+v", tt.seqs, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package media
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// RollingWindow keeps only the newest segments of each resolution on disk,
+// deleting the oldest once a resolution has more than limit. A segment that
+// canEvict refuses, such as one not yet transferred, is kept along with
+// every newer one until a later Add finds it can go.
+type RollingWindow struct {
+	limit    int
+	canEvict func(path string) bool
+	files    map[string][]string // resolution -> segment paths, oldest first
+	mu       sync.Mutex
+}
+
+// NewRollingWindow keeps limit segments per resolution. canEvict may be nil
+// when any segment can be deleted.
+func NewRollingWindow(limit int, canEvict func(path string) bool) *RollingWindow {
+	return &RollingWindow{
+		limit:    limit,
+		canEvict: canEvict,
+		files:    make(map[string][]string),
+	}
+}
+
+// Add records a newly downloaded segment and deletes the oldest segments of
+// its resolution beyond the limit, returning the paths deleted
+func (w *RollingWindow) Add(resolution, path string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := append(w.files[resolution], path)
+	var evicted []string
+	for len(files) > w.limit {
+		oldest := files[0]
+		if w.canEvict != nil && !w.canEvict(oldest) {
+			break
+		}
+		if err := os.Remove(oldest); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s from rolling window: %v", oldest, err)
+		} else {
+			evicted = append(evicted, oldest)
+		}
+		files = files[1:]
+	}
+	w.files[resolution] = files
+	return evicted
+}
+
+// Len returns how many segments of resolution the window holds
+func (w *RollingWindow) Len(resolution string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.files[resolution])
+}
@@ -0,0 +1,144 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"m3u8-downloader/pkg/constants"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRollingSegments(t *testing.T, dir string, count int) []string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	paths := make([]string, count)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("media_%04d.ts", i+1))
+		os.WriteFile(paths[i], []byte("segment"), 0644)
+	}
+	return paths
+}
+
+func TestRollingWindow_EvictsOldestPerResolution(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "rolling_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	hd := writeRollingSegments(t, filepath.Join(tempDir, "1080p"), 5)
+	sd := writeRollingSegments(t, filepath.Join(tempDir, "720p"), 2)
+
+	w := NewRollingWindow(3, nil)
+	for _, p := range sd {
+		if evicted := w.Add("720p", p); len(evicted) != 0 {
+			t.Errorf("Expected no eviction under the limit, got %v", evicted)
+		}
+	}
+	var evicted []string
+	for _, p := range hd {
+		evicted = append(evicted, w.Add("1080p", p)...)
+	}
+
+	if len(evicted) != 2 || evicted[0] != hd[0] || evicted[1] != hd[1] {
+		t.Errorf("Expected the two oldest 1080p segments to be evicted, got %v", evicted)
+	}
+	for i, p := range hd {
+		_, err := os.Stat(p)
+		if exists := err == nil; exists != (i >= 2) {
+			t.Errorf("%s: expected exists=%v, got %v", filepath.Base(p), i >= 2, exists)
+		}
+	}
+	if w.Len("1080p") != 3 || w.Len("720p") != 2 {
+		t.Errorf("Expected 3 1080p and 2 720p segments, got %d and %d", w.Len("1080p"), w.Len("720p"))
+	}
+}
+
+func TestRollingWindow_KeepsUntransferredSegments(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "rolling_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	paths := writeRollingSegments(t, tempDir, 4)
+	transferred := map[string]bool{paths[1]: true}
+	w := NewRollingWindow(2, func(path string) bool { return transferred[path] })
+
+	for _, p := range paths[:3] {
+		if evicted := w.Add("1080p", p); len(evicted) != 0 {
+			t.Errorf("Expected the untransferred oldest segment to hold back eviction, got %v", evicted)
+		}
+	}
+	if w.Len("1080p") != 3 {
+		t.Errorf("Expected the window to grow past its limit, got %d", w.Len("1080p"))
+	}
+
+	// Once the oldest is transferred, the backlog is evicted down to the limit
+	transferred[paths[0]] = true
+	evicted := w.Add("1080p", paths[3])
+	if len(evicted) != 2 || evicted[0] != paths[0] || evicted[1] != paths[1] {
+		t.Errorf("Expected %v to be evicted, got %v", paths[:2], evicted)
+	}
+
+	// A segment already removed elsewhere, as by transfer cleanup, still counts as evicted
+	os.Remove(paths[2])
+	transferred[paths[2]] = true
+	if evicted := w.Add("1080p", filepath.Join(tempDir, "media_0005.ts")); len(evicted) != 1 || evicted[0] != paths[2] {
+		t.Errorf("Expected already-removed %s to be dropped, got %v", paths[2], evicted)
+	}
+}
+
+func TestVariantDownloader_RollingWindow(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "rolling_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		for i := 1; i <= 5; i++ {
+			fmt.Fprintf(w, "#EXTINF:6.0,\nmedia_%04d.ts\n", i)
+		}
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	window := NewRollingWindow(2, nil)
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), nil, nil, DownloadOptions{RollingWindow: window})
+
+	entries, err := os.ReadDir(variant.OutputDir)
+	if err != nil {
+		t.Fatalf("Failed to read output dir: %v", err)
+	}
+	if len(entries) != 2 || window.Len("1080p") != 2 {
+		t.Errorf("Expected 2 segments left on disk, got %d (window holds %d)", len(entries), window.Len("1080p"))
+	}
+}
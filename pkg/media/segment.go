@@ -1,94 +1,271 @@
 package media
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/grafov/m3u8"
 	"io"
+	"m3u8-downloader/pkg/config"
 	"m3u8-downloader/pkg/constants"
 	"m3u8-downloader/pkg/httpClient"
+	"m3u8-downloader/pkg/utils"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
 type SegmentJob struct {
-	URI       string
-	Seq       uint64
-	VariantID int
-	Variant   *StreamVariant
+	URI           string
+	Seq           uint64
+	Discontinuity uint64
+	Duration      time.Duration // from #EXTINF
+	VariantID     int
+	Variant       *StreamVariant
+	EncryptionKey *m3u8.Key  // latest #EXT-X-KEY before the segment, nil if none
+	Range         *ByteRange // from #EXT-X-BYTERANGE, nil for the whole URI
 }
 
+// ByteRange is the part of a segment URI that holds the segment, for
+// playlists that list one media file as many byte ranges
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// header is the Range header value requesting r
+func (r ByteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1)
+}
+
+// Path is where the segment is saved. Byte-range segments share a URI, so
+// each one's file is named for its range and then its sequence number, e.g.
+// main_1000-1999_42.ts, keeping the sequence number last for SegmentSeqNo.
+func (j SegmentJob) Path() string {
+	if j.Range == nil {
+		return SegmentPath(j.Variant.OutputDir, j.AbsoluteURL(), j.Discontinuity)
+	}
+	name := safeFileName(path.Base(j.AbsoluteURL()), constants.MustGetConfig().Paths.SegmentNamePolicy)
+	ext := path.Ext(name)
+	name = fmt.Sprintf("%s_%d-%d_%d%s", strings.TrimSuffix(name, ext), j.Range.Offset, j.Range.Offset+j.Range.Length-1, j.Seq, ext)
+	return filepath.Join(j.Variant.OutputDir, discontinuityFileName(name, j.Discontinuity))
+}
+
+// AbsoluteURL resolves the segment URI against the variant playlist. A URI
+// that already has a scheme, often on a different CDN host, is returned
+// untouched, since resolving it would clean its path and could change what
+// a signed URL points to. Protocol-relative URIs take the playlist's scheme.
 func (j SegmentJob) AbsoluteURL() string {
-	rel, _ := url.Parse(j.URI)
+	return j.resolve(j.URI)
+}
+
+// KeyURL resolves the URI of the segment's key the same way as AbsoluteURL
+func (j SegmentJob) KeyURL() string {
+	if j.EncryptionKey == nil {
+		return ""
+	}
+	return j.resolve(j.EncryptionKey.URI)
+}
+
+func (j SegmentJob) resolve(uri string) string {
+	rel, err := url.Parse(uri)
+	if err != nil || rel.IsAbs() || j.Variant == nil || j.Variant.BaseURL == nil {
+		return uri
+	}
 	return j.Variant.BaseURL.ResolveReference(rel).String()
 }
 
 func (j SegmentJob) Key() string {
-	return fmt.Sprintf("%d:%s", j.Seq, j.URI)
+	return fmt.Sprintf("%d:%d:%s", j.Discontinuity, j.Seq, j.URI)
+}
+
+// segmentRetryPolicy retries transport failures and a single 403, which the
+// CDN occasionally returns while a freshly listed segment is still propagating.
+var segmentRetryPolicy = utils.RetryPolicy{
+	Attempts:     2,
+	InitialDelay: 300 * time.Millisecond,
+	Retryable: func(err error) bool {
+		var urlErr *url.Error
+		return errors.As(err, &urlErr) || httpClient.IsHTTPStatus(err, 403)
+	},
 }
 
-func DownloadSegment(ctx context.Context, client *http.Client, segmentURL string, outputDir string) error {
-	for attempt := 0; attempt < 2; attempt++ {
-		if attempt > 0 {
-			time.Sleep(300 * time.Millisecond)
+// ErrEmptySegment is returned by DownloadSegment when the segment response
+// has no body. Core.EmptySegment decides whether it is retried.
+var ErrEmptySegment = errors.New("zero-byte download")
+
+// DownloadSegment saves segmentURL into outputDir and returns its size and,
+// when Core.SegmentChecksum is set, its checksum as "<algorithm>:<hex>".
+// Segments after the first discontinuity get the discontinuity number in
+// their filename. A non-nil key decrypts the segment before it is written,
+// so the size and checksum are of the plaintext.
+func DownloadSegment(ctx context.Context, client *http.Client, segmentURL string, outputDir string, discontinuity uint64, key *SegmentKey) (int64, string, error) {
+	return downloadSegment(ctx, client, segmentURL, SegmentPath(outputDir, segmentURL, discontinuity), nil, key)
+}
+
+// downloadSegment saves segmentURL, or only r of it when r is set, to
+// fileName. A server that ignores the Range header and sends the whole
+// resource has the range cut out of it instead.
+func downloadSegment(ctx context.Context, client *http.Client, segmentURL string, fileName string, r *ByteRange, key *SegmentKey) (int64, string, error) {
+	cfg := constants.MustGetConfig()
+	outputDir := filepath.Dir(fileName)
+	policy := segmentRetryPolicy
+	if cfg.Core.EmptySegment == config.EmptySegmentRetry {
+		policy.Retryable = func(err error) bool {
+			return errors.Is(err, ErrEmptySegment) || segmentRetryPolicy.Retryable(err)
 		}
+	}
+
+	var written int64
+	var checksum string
+	err := utils.Retry(ctx, policy, func(attempt int) error {
 		req, err := http.NewRequestWithContext(ctx, "GET", segmentURL, nil)
 		if err != nil {
 			return err
 		}
 		req.Header.Set("User-Agent", constants.HTTPUserAgent)
 		req.Header.Set("Referer", constants.REFERRER)
+		if r != nil {
+			req.Header.Set("Range", r.header())
+		}
 
 		resp, err := client.Do(req)
 		if err != nil {
-			if attempt == 1 {
-				return err
-			}
-			continue
+			return err
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
+		ok := resp.StatusCode == http.StatusOK || (r != nil && resp.StatusCode == http.StatusPartialContent)
+		if !ok {
 			io.Copy(io.Discard, resp.Body)
-			httpErr := &httpClient.HttpError{Code: resp.StatusCode}
-			if resp.StatusCode == 403 && attempt == 0 {
-				continue
+			return &httpClient.HttpError{Code: resp.StatusCode}
+		}
+
+		src := io.Reader(resp.Body)
+		if r != nil {
+			if resp.StatusCode == http.StatusOK {
+				if _, err := io.CopyN(io.Discard, resp.Body, r.Offset); err != nil {
+					return fmt.Errorf("failed to skip to byte %d of %s: %w", r.Offset, segmentURL, err)
+				}
 			}
-			return httpErr
+			src = io.LimitReader(resp.Body, r.Length)
 		}
 
 		if err := os.MkdirAll(outputDir, 0755); err != nil {
 			return fmt.Errorf("failed to create output directory: %w", err)
 		}
 
-		fileName := safeFileName(path.Join(outputDir, path.Base(segmentURL)))
-		out, err := os.Create(fileName)
-		if err != nil {
-			return err
+		tempDir := cfg.Paths.TempDir
+		if tempDir == "" {
+			tempDir = outputDir
 		}
-		defer out.Close()
+		h := newSegmentHash(cfg.Core.SegmentChecksum)
+		return writeAtomic(fileName, tempDir, func(out io.Writer) error {
+			if h != nil {
+				// Hashed as it is written, so the file is never read back
+				out = io.MultiWriter(out, h)
+			}
+			body := src
+			if key != nil {
+				data, err := io.ReadAll(src)
+				if err != nil {
+					return err
+				}
+				plain, err := key.Decrypt(data)
+				if err != nil {
+					return fmt.Errorf("failed to decrypt %s: %w", segmentURL, err)
+				}
+				body = bytes.NewReader(plain)
+			}
+			n, err := io.Copy(out, body)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("%w for %s", ErrEmptySegment, segmentURL)
+			}
+			written = n
+			if h != nil {
+				checksum = formatChecksum(cfg.Core.SegmentChecksum, h)
+			}
+			return nil
+		})
+	})
+	return written, checksum, err
+}
 
-		n, err := io.Copy(out, resp.Body)
-		if err != nil {
-			return err
-		}
-		if n == 0 {
-			return fmt.Errorf("zero-byte download for %s", segmentURL)
-		}
+// SegmentPath is where DownloadSegment saves segmentURL in outputDir
+func SegmentPath(outputDir string, segmentURL string, discontinuity uint64) string {
+	policy := constants.MustGetConfig().Paths.SegmentNamePolicy
+	return filepath.Join(outputDir, discontinuityFileName(safeFileName(path.Base(segmentURL), policy), discontinuity))
+}
+
+// writeAtomic streams into a hidden .part file in tempDir and only renames it
+// to fileName once write succeeds, so the file watcher never sees a segment
+// that is still downloading.
+func writeAtomic(fileName string, tempDir string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(tempDir, "."+filepath.Base(fileName)+".*.part")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once renamed
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return moveFile(tmpName, fileName)
+}
+
+// moveFile renames src to dst, falling back to a copy staged beside dst when
+// the temp directory is on a different volume.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
 		return nil
 	}
-	return fmt.Errorf("exhausted retries")
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	staged, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+
+	if _, err := io.Copy(staged, in); err != nil {
+		staged.Close()
+		return err
+	}
+	if err := staged.Close(); err != nil {
+		return err
+	}
+	return os.Rename(staged.Name(), dst)
 }
 
-func safeFileName(base string) string {
+func safeFileName(base string, policy string) string {
 	if i := strings.IndexAny(base, "?&#"); i >= 0 {
 		base = base[:i]
 	}
 	if base == "" {
 		base = fmt.Sprintf("seg-%d.ts", time.Now().UnixNano())
 	}
-	return base
+	return utils.SanitizeFileName(base, policy)
 }
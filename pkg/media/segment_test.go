@@ -0,0 +1,258 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/grafov/m3u8"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadSegment_NoPartialFileAtFinalPath(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	halfSent := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first half "))
+		w.(http.Flusher).Flush()
+		close(halfSent)
+		<-release
+		w.Write([]byte("second half"))
+	}))
+	defer server.Close()
+
+	outputDir := filepath.Join(tempDir, "1080p")
+	finalPath := filepath.Join(outputDir, "media_0001.ts")
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := DownloadSegment(context.Background(), server.Client(), server.URL+"/media_0001.ts", outputDir, 0, nil)
+		done <- err
+	}()
+
+	<-halfSent
+	// Give the client time to write what it has received
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(finalPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no file at final path mid-download, stat returned %v", err)
+	}
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("DownloadSegment() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(finalPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded segment: %v", err)
+	}
+	if string(data) != "first half second half" {
+		t.Errorf("Expected full segment content, got %q", data)
+	}
+
+	entries, _ := os.ReadDir(outputDir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the finished segment in the output dir, got %d entries", len(entries))
+	}
+}
+
+func TestWriteAtomic_SeparateTempDir(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	stagingDir := filepath.Join(tempDir, "tmp")
+	fileName := filepath.Join(tempDir, "1080p", "media_0001.ts")
+	os.MkdirAll(filepath.Dir(fileName), 0755)
+
+	err = writeAtomic(fileName, stagingDir, func(w io.Writer) error {
+		_, err := w.Write([]byte("segment"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("writeAtomic() failed: %v", err)
+	}
+
+	if data, err := os.ReadFile(fileName); err != nil || string(data) != "segment" {
+		t.Errorf("Expected segment at final path, got %q (err: %v)", data, err)
+	}
+	if entries, _ := os.ReadDir(stagingDir); len(entries) != 0 {
+		t.Errorf("Expected temp dir to be empty after rename, got %d entries", len(entries))
+	}
+}
+
+func TestWriteAtomic_FailureLeavesNothing(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fileName := filepath.Join(tempDir, "media_0001.ts")
+	writeErr := errors.New("connection reset")
+	err = writeAtomic(fileName, tempDir, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return writeErr
+	})
+	if !errors.Is(err, writeErr) {
+		t.Fatalf("Expected write error, got %v", err)
+	}
+
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("Expected no files after a failed write, got %d entries", len(entries))
+	}
+}
+
+func TestSegmentJob_AbsoluteURL(t *testing.T) {
+	base, _ := url.Parse("https://origin.example.com/live/1080/chunklist.m3u8?token=abc")
+	variant := &StreamVariant{BaseURL: base}
+
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{"relative", "media_0001.ts", "https://origin.example.com/live/1080/media_0001.ts"},
+		{"relative parent", "../720/media_0001.ts", "https://origin.example.com/live/720/media_0001.ts"},
+		{"root relative", "/segments/media_0001.ts", "https://origin.example.com/segments/media_0001.ts"},
+		{"absolute other host", "https://cdn2.example.net/a/media_0001.ts?sig=x%2Fy", "https://cdn2.example.net/a/media_0001.ts?sig=x%2Fy"},
+		{"absolute kept as is", "https://cdn2.example.net/a/./b/../media_0001.ts", "https://cdn2.example.net/a/./b/../media_0001.ts"},
+		{"absolute http", "http://cdn3.example.org/media_0001.ts", "http://cdn3.example.org/media_0001.ts"},
+		{"protocol relative", "//cdn2.example.net/a/media_0001.ts", "https://cdn2.example.net/a/media_0001.ts"},
+		{"unparseable", "https://cdn2.example.net/%zz.ts", "https://cdn2.example.net/%zz.ts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := SegmentJob{URI: tt.uri, Variant: variant}
+			if got := job.AbsoluteURL(); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDownloadSegment_ByteRange(t *testing.T) {
+	media := make([]byte, 4096)
+	for i := range media {
+		media[i] = byte(i * 7)
+	}
+	r := &ByteRange{Offset: 1000, Length: 1500}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"partial content", func(w http.ResponseWriter, req *http.Request) {
+			if got := req.Header.Get("Range"); got != "bytes=1000-2499" {
+				t.Errorf("Expected Range bytes=1000-2499, got %q", got)
+			}
+			http.ServeContent(w, req, "main.ts", time.Time{}, bytes.NewReader(media))
+		}},
+		{"range ignored", func(w http.ResponseWriter, req *http.Request) {
+			w.Write(media)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "segment_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			fileName := filepath.Join(tempDir, "1080p", "main_1000-2499_7.ts")
+			written, _, err := downloadSegment(context.Background(), server.Client(), server.URL+"/main.ts", fileName, r, nil)
+			if err != nil {
+				t.Fatalf("downloadSegment() failed: %v", err)
+			}
+
+			data, err := os.ReadFile(fileName)
+			if err != nil {
+				t.Fatalf("Failed to read downloaded range: %v", err)
+			}
+			if !bytes.Equal(data, media[1000:2500]) {
+				t.Errorf("Expected bytes 1000-2499 of the media file, got %d bytes starting %v", len(data), data[:min(len(data), 4)])
+			}
+			if written != 1500 {
+				t.Errorf("Expected 1500 bytes written, got %d", written)
+			}
+		})
+	}
+}
+
+func TestSegmentJob_Path(t *testing.T) {
+	variant := &StreamVariant{OutputDir: filepath.Join("out", "1080p")}
+
+	tests := []struct {
+		name string
+		job  SegmentJob
+		want string
+	}{
+		{"whole segment", SegmentJob{URI: "media_0042.ts", Seq: 42}, "media_0042.ts"},
+		{"byte range", SegmentJob{URI: "main.ts", Seq: 42, Range: &ByteRange{Offset: 1000, Length: 1000}}, "main_1000-1999_42.ts"},
+		{"byte range after discontinuity", SegmentJob{URI: "main.ts", Seq: 42, Discontinuity: 1, Range: &ByteRange{Offset: 0, Length: 10}}, "main_0-9_42_d1.ts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.job.Variant = variant
+			got := tt.job.Path()
+			if want := filepath.Join(variant.OutputDir, tt.want); got != want {
+				t.Errorf("Expected %s, got %s", want, got)
+			}
+			if seq, err := SegmentSeqNo(got); err != nil || seq != 42 {
+				t.Errorf("Expected sequence 42 parsed back from %s, got %d, %v", got, seq, err)
+			}
+		})
+	}
+}
+
+func TestRangeTracker_ContinuesOffsets(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+		"#EXTINF:6.0,\n#EXT-X-BYTERANGE:1000@0\nmain.ts\n" +
+		"#EXTINF:6.0,\n#EXT-X-BYTERANGE:1200\nmain.ts\n" +
+		"#EXTINF:6.0,\n#EXT-X-BYTERANGE:800@5000\nmain.ts\n" +
+		"#EXTINF:6.0,\n#EXT-X-BYTERANGE:300\nmain.ts\n" +
+		"#EXTINF:6.0,\n#EXT-X-BYTERANGE:400\nother.ts\n" +
+		"#EXTINF:6.0,\nmedia_0006.ts\n"
+	pl, _, err := m3u8.DecodeFrom(strings.NewReader(playlist), true)
+	if err != nil {
+		t.Fatalf("Failed to decode playlist: %v", err)
+	}
+
+	want := []*ByteRange{
+		{Offset: 0, Length: 1000},
+		{Offset: 1000, Length: 1200},
+		{Offset: 5000, Length: 800},
+		{Offset: 5800, Length: 300},
+		{Offset: 0, Length: 400},
+		nil,
+	}
+	var ranges rangeTracker
+	for i, seg := range pl.(*m3u8.MediaPlaylist).Segments[:len(want)] {
+		got := ranges.Next(seg)
+		if (got == nil) != (want[i] == nil) || (got != nil && *got != *want[i]) {
+			t.Errorf("Segment %d: expected range %v, got %v", i, want[i], got)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package media
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResolutionHeight parses a label like "1080p" into its height, returning 0
+// for labels without one such as "unknown" or custom classifier names.
+func ResolutionHeight(resolution string) int {
+	height, err := strconv.Atoi(strings.TrimSuffix(resolution, "p"))
+	if err != nil || height < 0 {
+		return 0
+	}
+	return height
+}
+
+// SelectVariant returns the tallest variant no taller than targetHeight,
+// preferring the higher bandwidth between equal heights, for capturing a
+// single quality. Variants with no known height are never chosen. A
+// targetHeight of 0 means no limit; nil means nothing fits.
+func SelectVariant(variants []*StreamVariant, targetHeight int) *StreamVariant {
+	var best *StreamVariant
+	bestHeight := 0
+	for _, v := range variants {
+		height := ResolutionHeight(v.Resolution)
+		if height == 0 || (targetHeight > 0 && height > targetHeight) {
+			continue
+		}
+		if best == nil || height > bestHeight || (height == bestHeight && v.Bandwidth > best.Bandwidth) {
+			best = v
+			bestHeight = height
+		}
+	}
+	return best
+}
+
+// SelectVariants drops variants taller than maxHeight and keeps the top
+// maxVariants by bandwidth, highest first. Variants with no known height are
+// never dropped by maxHeight. Zero disables either limit. A single variant
+// under a height limit is chosen by SelectVariant instead. Subtitle
+// renditions are always kept, after the selected video variants.
+func SelectVariants(variants []*StreamVariant, maxVariants int, maxHeight int) []*StreamVariant {
+	var subtitles []*StreamVariant
+	video := make([]*StreamVariant, 0, len(variants))
+	for _, v := range variants {
+		if v.Subtitles {
+			subtitles = append(subtitles, v)
+		} else {
+			video = append(video, v)
+		}
+	}
+
+	if maxVariants == 1 && maxHeight > 0 {
+		if v := SelectVariant(video, maxHeight); v != nil {
+			return append([]*StreamVariant{v}, subtitles...)
+		}
+		return append([]*StreamVariant{}, subtitles...)
+	}
+
+	selected := make([]*StreamVariant, 0, len(variants))
+	for _, v := range video {
+		if maxHeight > 0 && ResolutionHeight(v.Resolution) > maxHeight {
+			continue
+		}
+		selected = append(selected, v)
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool {
+		if selected[i].Bandwidth != selected[j].Bandwidth {
+			return selected[i].Bandwidth > selected[j].Bandwidth
+		}
+		return ResolutionHeight(selected[i].Resolution) > ResolutionHeight(selected[j].Resolution)
+	})
+
+	if maxVariants > 0 && len(selected) > maxVariants {
+		selected = selected[:maxVariants]
+	}
+	return append(selected, subtitles...)
+}
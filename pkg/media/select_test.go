@@ -0,0 +1,149 @@
+package media
+
+import (
+	"testing"
+)
+
+func testVariants() []*StreamVariant {
+	return []*StreamVariant{
+		{Resolution: "480p", Bandwidth: 1600000},
+		{Resolution: "1080p", Bandwidth: 6000000},
+		{Resolution: "360p", Bandwidth: 900000},
+		{Resolution: "720p", Bandwidth: 3500000},
+		{Resolution: "240p", Bandwidth: 400000},
+	}
+}
+
+func resolutions(variants []*StreamVariant) []string {
+	var out []string
+	for _, v := range variants {
+		out = append(out, v.Resolution)
+	}
+	return out
+}
+
+func TestSelectVariants(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxVariants int
+		maxHeight   int
+		expected    []string
+	}{
+		{"no limits keeps all by bandwidth", 0, 0, []string{"1080p", "720p", "480p", "360p", "240p"}},
+		{"top two", 2, 0, []string{"1080p", "720p"}},
+		{"cap above count", 10, 0, []string{"1080p", "720p", "480p", "360p", "240p"}},
+		{"max resolution only", 0, 720, []string{"720p", "480p", "360p", "240p"}},
+		{"top two under 720p", 2, 720, []string{"720p", "480p"}},
+		{"top one under 480p", 1, 480, []string{"480p"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolutions(SelectVariants(testVariants(), tt.maxVariants, tt.maxHeight))
+			if len(got) != len(tt.expected) {
+				t.Fatalf("Expected %v, got %v", tt.expected, got)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Errorf("Expected %v, got %v", tt.expected, got)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestSelectVariants_UnknownHeightKept(t *testing.T) {
+	variants := []*StreamVariant{
+		{Resolution: "unknown", Bandwidth: 0},
+		{Resolution: "1080p", Bandwidth: 6000000},
+	}
+	got := resolutions(SelectVariants(variants, 0, 720))
+	if len(got) != 1 || got[0] != "unknown" {
+		t.Errorf("Expected only the unknown-height variant under a 720p cap, got %v", got)
+	}
+}
+
+func TestSelectVariants_SubtitlesAlwaysKept(t *testing.T) {
+	variants := append([]*StreamVariant{{Resolution: "subtitles_en", Subtitles: true}}, testVariants()...)
+
+	got := resolutions(SelectVariants(variants, 2, 0))
+	expected := []string{"1080p", "720p", "subtitles_en"}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] || got[2] != expected[2] {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	got = resolutions(SelectVariants(variants, 1, 144))
+	if len(got) != 1 || got[0] != "subtitles_en" {
+		t.Errorf("Expected only the subtitles when no video variant fits, got %v", got)
+	}
+}
+
+func TestResolutionHeight(t *testing.T) {
+	tests := map[string]int{
+		"2160p":   2160,
+		"1440p":   1440,
+		"1080p":   1080,
+		"720p":    720,
+		"unknown": 0,
+		"high":    0,
+		"":        0,
+	}
+	for label, expected := range tests {
+		if got := ResolutionHeight(label); got != expected {
+			t.Errorf("ResolutionHeight(%q) = %d, expected %d", label, got, expected)
+		}
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	variants := append(testVariants(),
+		&StreamVariant{Resolution: "720p", Bandwidth: 2500000},
+		&StreamVariant{Resolution: "unknown", Bandwidth: 9000000},
+	)
+
+	tests := []struct {
+		name      string
+		target    int
+		expected  string
+		bandwidth uint32
+	}{
+		{"exact match", 480, "480p", 1600000},
+		{"between heights takes the one below", 900, "720p", 3500000},
+		{"equal heights prefer bandwidth", 720, "720p", 3500000},
+		{"above every variant", 2160, "1080p", 6000000},
+		{"no limit", 0, "1080p", 6000000},
+		{"lowest", 240, "240p", 400000},
+		{"below every variant", 144, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SelectVariant(variants, tt.target)
+			if tt.expected == "" {
+				if got != nil {
+					t.Errorf("Expected no variant, got %s", got.Resolution)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("Expected %s, got nil", tt.expected)
+			}
+			if got.Resolution != tt.expected || got.Bandwidth != tt.bandwidth {
+				t.Errorf("Expected %s at %d, got %s at %d", tt.expected, tt.bandwidth, got.Resolution, got.Bandwidth)
+			}
+		})
+	}
+}
+
+func TestSelectVariants_SingleUsesClosestHeight(t *testing.T) {
+	// A high-bandwidth 480p must not beat 720p for a single 720p capture
+	variants := append(testVariants(), &StreamVariant{Resolution: "480p", Bandwidth: 8000000})
+
+	got := resolutions(SelectVariants(variants, 1, 720))
+	if len(got) != 1 || got[0] != "720p" {
+		t.Errorf("Expected [720p], got %v", got)
+	}
+	if got := SelectVariants(variants, 1, 144); len(got) != 0 {
+		t.Errorf("Expected no variants below every height, got %v", resolutions(got))
+	}
+}
@@ -0,0 +1,201 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds of the download latency histogram.
+// Percentiles are reported as the upper bound of the bucket they fall in.
+var durationBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// DownloadStats tracks segment download outcomes and latency across all variants
+type DownloadStats struct {
+	mu        sync.Mutex
+	Succeeded int
+	Failed    int
+	counts    []int // one per bucket plus overflow
+	max       time.Duration
+	health    map[string]*VariantHealth
+	totals    map[string]*variantTotals
+}
+
+// variantTotals accumulates a variant's saved segments for the capture report
+type variantTotals struct {
+	segments int
+	bytes    int64
+	failed   int
+	captured time.Duration       // sum of the saved segments' #EXTINF durations
+	seqs     map[uint64][]uint64 // discontinuity -> saved sequence numbers
+}
+
+func NewDownloadStats() *DownloadStats {
+	return &DownloadStats{
+		counts: make([]int, len(durationBuckets)+1),
+		health: make(map[string]*VariantHealth),
+		totals: make(map[string]*variantTotals),
+	}
+}
+
+func (s *DownloadStats) totalsLocked(variant string) *variantTotals {
+	t, ok := s.totals[variant]
+	if !ok {
+		t = &variantTotals{seqs: make(map[uint64][]uint64)}
+		s.totals[variant] = t
+	}
+	return t
+}
+
+// RecordSaved notes a segment written to disk for variant, for the capture
+// report's counts, bytes and gaps
+func (s *DownloadStats) RecordSaved(variant string, discontinuity, seq uint64, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.totalsLocked(variant)
+	t.segments++
+	t.bytes += bytes
+	t.seqs[discontinuity] = append(t.seqs[discontinuity], seq)
+}
+
+// RecordCaptured adds the media duration of a segment saved for variant
+func (s *DownloadStats) RecordCaptured(variant string, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totalsLocked(variant).captured += duration
+}
+
+// Captured returns the media duration saved so far for variant
+func (s *DownloadStats) Captured(variant string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.totals[variant]; ok {
+		return t.captured
+	}
+	return 0
+}
+
+// FormatCaptured formats a captured media duration as HH:MM:SS, with hours
+// going past 24 for long events
+func FormatCaptured(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	d -= h * time.Hour
+	m := d / time.Minute
+	d -= m * time.Minute
+	return fmt.Sprintf("%02d:%02d:%02d", h, m, d/time.Second)
+}
+
+// CapturedSummary formats each variant's captured media duration, e.g.
+// "1080p: 00:42:15 captured, 720p: 00:42:09 captured"
+func (s *DownloadStats) CapturedSummary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	variants := make([]string, 0, len(s.totals))
+	for variant := range s.totals {
+		variants = append(variants, variant)
+	}
+	sort.Strings(variants)
+
+	parts := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		parts = append(parts, fmt.Sprintf("%s: %s captured", variant, FormatCaptured(s.totals[variant].captured)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Record adds one finished download. Only successful downloads contribute to
+// the latency histogram so failures don't skew it toward the timeout.
+func (s *DownloadStats) Record(duration time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.Failed++
+		return
+	}
+
+	s.Succeeded++
+	if duration > s.max {
+		s.max = duration
+	}
+	for i, bound := range durationBuckets {
+		if duration <= bound {
+			s.counts[i]++
+			return
+		}
+	}
+	s.counts[len(durationBuckets)]++
+}
+
+// Percentile returns the latency bucket bound containing the p-th percentile
+// (0 < p <= 100) of successful downloads, or 0 if nothing was recorded.
+func (s *DownloadStats) Percentile(p float64) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.percentileLocked(p)
+}
+
+func (s *DownloadStats) percentileLocked(p float64) time.Duration {
+	if s.Succeeded == 0 {
+		return 0
+	}
+
+	rank := int(float64(s.Succeeded)*p/100 + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := 0
+	for i, count := range s.counts {
+		seen += count
+		if seen >= rank {
+			if i < len(durationBuckets) {
+				return durationBuckets[i]
+			}
+			return s.max
+		}
+	}
+	return s.max
+}
+
+// Summary formats counts and p50/p90/p99 latency for logging
+func (s *DownloadStats) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("Downloaded: %d, Failed: %d, p50: <=%v, p90: <=%v, p99: <=%v, Max: %v",
+		s.Succeeded, s.Failed, s.percentileLocked(50), s.percentileLocked(90), s.percentileLocked(99), s.max)
+}
+
+// ReportStats logs a summary every interval until ctx is cancelled
+func (s *DownloadStats) ReportStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.Printf("Download Stats: %s", s.Summary())
+			if captured := s.CapturedSummary(); captured != "" {
+				log.Printf("Captured Duration: %s", captured)
+			}
+		}
+	}
+}
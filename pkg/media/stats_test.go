@@ -0,0 +1,110 @@
+package media
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadStats_Percentiles(t *testing.T) {
+	stats := NewDownloadStats()
+
+	// 50 fast, 40 medium, 9 slow, 1 very slow
+	for i := 0; i < 50; i++ {
+		stats.Record(40*time.Millisecond, nil)
+	}
+	for i := 0; i < 40; i++ {
+		stats.Record(400*time.Millisecond, nil)
+	}
+	for i := 0; i < 9; i++ {
+		stats.Record(1500*time.Millisecond, nil)
+	}
+	stats.Record(45*time.Second, nil)
+
+	tests := []struct {
+		percentile float64
+		want       time.Duration
+	}{
+		{50, 50 * time.Millisecond},
+		{90, 500 * time.Millisecond},
+		{99, 2 * time.Second},
+		{100, 45 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := stats.Percentile(tt.percentile); got != tt.want {
+			t.Errorf("Percentile(%v) = %v, want %v", tt.percentile, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadStats_FailuresExcludedFromLatency(t *testing.T) {
+	stats := NewDownloadStats()
+
+	stats.Record(80*time.Millisecond, nil)
+	stats.Record(10*time.Second, errors.New("timeout"))
+	stats.Record(10*time.Second, errors.New("timeout"))
+
+	if stats.Succeeded != 1 || stats.Failed != 2 {
+		t.Errorf("Expected 1 succeeded and 2 failed, got %d and %d", stats.Succeeded, stats.Failed)
+	}
+	if got := stats.Percentile(99); got != 100*time.Millisecond {
+		t.Errorf("Percentile(99) = %v, want 100ms", got)
+	}
+}
+
+func TestDownloadStats_Empty(t *testing.T) {
+	stats := NewDownloadStats()
+
+	if got := stats.Percentile(50); got != 0 {
+		t.Errorf("Percentile(50) on empty stats = %v, want 0", got)
+	}
+	if !strings.Contains(stats.Summary(), "Downloaded: 0") {
+		t.Errorf("Unexpected summary for empty stats: %s", stats.Summary())
+	}
+}
+
+func TestFormatCaptured(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		want     string
+	}{
+		{0, "00:00:00"},
+		{6 * time.Second, "00:00:06"},
+		{42*time.Minute + 15*time.Second, "00:42:15"},
+		{2*time.Hour + 5*time.Minute + 1500*time.Millisecond, "02:05:02"},
+		{30*time.Hour + time.Minute, "30:01:00"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatCaptured(tt.duration); got != tt.want {
+			t.Errorf("FormatCaptured(%v) = %s, want %s", tt.duration, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadStats_RecordCaptured(t *testing.T) {
+	stats := NewDownloadStats()
+	if got := stats.CapturedSummary(); got != "" {
+		t.Errorf("Expected empty summary before any segment, got %q", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		stats.RecordCaptured("1080p", 6006*time.Millisecond)
+	}
+	stats.RecordCaptured("720p", 6*time.Second)
+	stats.StartVariant("480p", time.Second)
+
+	if got := stats.Captured("1080p"); got != 18018*time.Millisecond {
+		t.Errorf("Expected 18.018s captured for 1080p, got %v", got)
+	}
+	if got := stats.Captured("360p"); got != 0 {
+		t.Errorf("Expected nothing captured for an unknown variant, got %v", got)
+	}
+
+	want := "1080p: 00:00:18 captured, 480p: 00:00:00 captured, 720p: 00:00:06 captured"
+	if got := stats.CapturedSummary(); got != want {
+		t.Errorf("CapturedSummary() = %q, want %q", got, want)
+	}
+}
@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"github.com/grafov/m3u8"
 	"log"
+	"m3u8-downloader/pkg/config"
 	"m3u8-downloader/pkg/constants"
 	"m3u8-downloader/pkg/httpClient"
+	"m3u8-downloader/pkg/utils"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,8 +27,19 @@ type StreamVariant struct {
 	Resolution string
 	OutputDir  string
 	Writer     *ManifestWriter
+	// Subtitles marks a WebVTT subtitle rendition rather than a video
+	// variant. Its Resolution is the subtitles_<language> label.
+	Subtitles bool
 }
 
+// VariantClassifier maps a master playlist variant to the resolution label
+// used for its output directory and manifest entries.
+type VariantClassifier func(variant *m3u8.Variant) string
+
+// DefaultClassifier uses the declared RESOLUTION height, falling back to
+// bandwidth buckets tuned for FloMarching streams.
+var DefaultClassifier VariantClassifier = extractResolution
+
 func extractResolution(variant *m3u8.Variant) string {
 	if variant.Resolution != "" {
 		parts := strings.Split(variant.Resolution, "x")
@@ -46,24 +61,35 @@ func extractResolution(variant *m3u8.Variant) string {
 	}
 }
 
-func GetAllVariants(masterURL string, outputDir string, writer *ManifestWriter) ([]*StreamVariant, error) {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", masterURL, nil)
-	req.Header.Set("User-Agent", constants.HTTPUserAgent)
-	req.Header.Set("Referer", constants.REFERRER)
-	resp, err := client.Do(req)
+// GetAllVariants fetches the master playlist and returns one StreamVariant per
+// entry, labelled by classify (DefaultClassifier when nil), followed by its
+// subtitle renditions when Core.Subtitles is set. A file:// URL or plain path
+// is read from disk, with relative variant URIs resolved against
+// Core.MasterBaseURL, or the file's directory when that is unset.
+func GetAllVariants(masterURL string, outputDir string, writer *ManifestWriter, classify VariantClassifier) ([]*StreamVariant, error) {
+	if classify == nil {
+		classify = DefaultClassifier
+	}
+
+	var playlist m3u8.Playlist
+	var listType m3u8.ListType
+	err := utils.Retry(context.Background(), masterRetryPolicy, func(attempt int) error {
+		var err error
+		playlist, listType, err = fetchMasterPlaylist(masterURL)
+		if errors.Is(err, ErrEmptyPlaylist) {
+			log.Printf("Master playlist returned an empty body (attempt %d/%d)", attempt, masterRetryPolicy.Attempts)
+		}
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	playlist, listType, err := m3u8.DecodeFrom(resp.Body, true)
+	base, err := masterBaseURL(masterURL)
 	if err != nil {
 		return nil, err
 	}
 
-	base, _ := url.Parse(masterURL)
-
 	if listType == m3u8.MEDIA {
 		return []*StreamVariant{{
 			URL:        masterURL,
@@ -85,7 +111,7 @@ func GetAllVariants(masterURL string, outputDir string, writer *ManifestWriter)
 	for i, v := range master.Variants {
 		vURL, _ := url.Parse(v.URI)
 		fullURL := base.ResolveReference(vURL).String()
-		resolution := extractResolution(v)
+		resolution := classify(v)
 		outputDir := path.Join(outputDir, resolution)
 		variants = append(variants, &StreamVariant{
 			URL:        fullURL,
@@ -96,84 +122,460 @@ func GetAllVariants(masterURL string, outputDir string, writer *ManifestWriter)
 			OutputDir:  outputDir,
 		})
 	}
+	if constants.MustGetConfig().Core.Subtitles {
+		variants = append(variants, subtitleVariants(master, base, outputDir, len(variants))...)
+	}
 	return variants, nil
 }
 
-func VariantDownloader(ctx context.Context, variant *StreamVariant, sem chan struct{}, manifest *ManifestWriter) {
-	log.Printf("Starting %s variant downloader (bandwidth: %d)", variant.Resolution, variant.Bandwidth)
-	ticker := time.NewTicker(constants.RefreshDelay)
+// masterRetryPolicy retries empty master playlist responses, which are
+// transient CDN blips rather than a reason to abort the run.
+var masterRetryPolicy = utils.RetryPolicy{
+	Attempts:     5,
+	InitialDelay: 1 * time.Second,
+	MaxDelay:     10 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+	Retryable: func(err error) bool {
+		return errors.Is(err, ErrEmptyPlaylist)
+	},
+}
+
+// masterBaseURL returns the URL relative variant URIs resolve against
+func masterBaseURL(masterURL string) (*url.URL, error) {
+	localPath, local := localPlaylistPath(masterURL)
+	if !local {
+		base, _ := url.Parse(masterURL)
+		return base, nil
+	}
+
+	if baseURL := constants.MustGetConfig().Core.MasterBaseURL; baseURL != "" {
+		base, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master base URL %q: %w", baseURL, err)
+		}
+		return base, nil
+	}
+	return localFileURL(localPath)
+}
+
+func fetchMasterPlaylist(masterURL string) (m3u8.Playlist, m3u8.ListType, error) {
+	if localPath, ok := localPlaylistPath(masterURL); ok {
+		return readLocalPlaylist(localPath)
+	}
+
+	client := httpClient.Default()
+	req, _ := http.NewRequest("GET", masterURL, nil)
+	req.Header.Set("User-Agent", constants.HTTPUserAgent)
+	req.Header.Set("Referer", constants.REFERRER)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &httpClient.HttpError{Code: resp.StatusCode}
+	}
+
+	return decodePlaylist(resp.Body)
+}
+
+// startupJitter returns a random delay in [0, interval) so variant pollers
+// started together spread their playlist requests across the interval
+// instead of hitting the CDN in bursts.
+func startupJitter(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(interval)))
+}
+
+// timeoutContext is context.WithTimeout, except that a zero timeout means
+// none
+func timeoutContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// fatalPlaylistPolls is how many polls in a row a variant's playlist may be
+// gone (404 or 410) before the variant gives up with a FatalError
+const fatalPlaylistPolls = 10
+
+// FatalError is a variant failure that polling again won't fix, such as a
+// playlist that no longer exists. Transient failures like timeouts and 5xx
+// responses are retried on the next poll instead.
+type FatalError struct {
+	Variant string
+	Err     error
+}
+
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Variant, e.Err)
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// IsFatal reports whether err is or wraps a FatalError
+func IsFatal(err error) bool {
+	var fatal *FatalError
+	return errors.As(err, &fatal)
+}
+
+// isPlaylistGone reports whether a playlist fetch failed because the
+// playlist does not exist, as opposed to a transient failure
+func isPlaylistGone(err error) bool {
+	return httpClient.IsHTTPStatus(err, http.StatusNotFound) || httpClient.IsHTTPStatus(err, http.StatusGone)
+}
+
+// rangeTracker works out each segment's #EXT-X-BYTERANGE. A range without an
+// offset starts where the previous range of the same URI ended, but the
+// decoder reports a missing offset as 0, so a 0 offset right after a range
+// of the same URI is taken to mean that.
+type rangeTracker struct {
+	uri  string
+	next int64
+}
+
+// Next returns seg's range, or nil if seg is a whole URI
+func (t *rangeTracker) Next(seg *m3u8.MediaSegment) *ByteRange {
+	if seg.Limit <= 0 {
+		t.uri = ""
+		return nil
+	}
+	offset := seg.Offset
+	if offset == 0 && seg.URI == t.uri {
+		offset = t.next
+	}
+	t.uri, t.next = seg.URI, offset+seg.Limit
+	return &ByteRange{Offset: offset, Length: seg.Limit}
+}
+
+// variantWorkers returns the per-variant download limit, falling back to
+// constants.WorkerCount when Core.VariantWorkers is unset
+func variantWorkers(configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	return constants.WorkerCount
+}
+
+// DownloadOptions holds the per-run helpers a run shares between its variant
+// downloaders. Every field is optional; the zero value downloads with none.
+type DownloadOptions struct {
+	// SegmentLimiter caps segment downloads across every variant, regardless
+	// of worker count
+	SegmentLimiter *utils.RateLimiter
+	// InodeGuard is waited on before starting each segment
+	InodeGuard *InodeGuard
+	// CacheWarmer is called after each successful segment download
+	CacheWarmer *CacheWarmer
+	// SegmentIndex records every finished segment
+	SegmentIndex *SegmentIndex
+	// RollingWindow is given every finished segment, to evict old ones
+	RollingWindow *RollingWindow
+	// Adaptive is told the outcome of each segment download
+	Adaptive *AdaptiveConcurrency
+	// CaptureRange limits the download to part of the event
+	CaptureRange CaptureRange
+}
+
+// VariantDownloader polls a variant's playlist and downloads new segments
+// until ctx is done or the playlist ends. A VOD playlist is complete when
+// first fetched, so its segments are downloaded in a single pass. Segment
+// downloads run under downloadCtx instead, so cancelling ctx alone stops
+// polling but lets in-flight downloads finish; VariantDownloader returns
+// once they have. It returns a FatalError if the playlist stays gone for
+// fatalPlaylistPolls polls, an error wrapping ErrEmptySegment if a segment
+// comes back empty under the fail policy of Core.EmptySegment, and nil
+// otherwise.
+func VariantDownloader(ctx context.Context, downloadCtx context.Context, variant *StreamVariant, sem chan struct{}, manifest *ManifestWriter, stats *DownloadStats, opts DownloadOptions) (err error) {
+	cfg := constants.MustGetConfig()
+	// The manifest picks a video segment for each sequence number, so
+	// subtitle segments stay out of it
+	if variant.Subtitles {
+		manifest = nil
+	}
+	refreshDelay := cfg.Core.RefreshDelay
+	delay := startupJitter(refreshDelay)
+	log.Printf("Starting %s variant downloader (bandwidth: %d, offset: %v)", variant.Resolution, variant.Bandwidth, delay.Round(time.Millisecond))
+
+	// Wait before creating the ticker so every later poll keeps the offset
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(delay):
+	}
+
+	if stats != nil {
+		stats.StartVariant(variant.Resolution, refreshDelay)
+	}
+	ticker := time.NewTicker(refreshDelay)
 	defer ticker.Stop()
-	client := &http.Client{}
+	client := httpClient.Default()
+	keys := newKeyCache(client)
 	seen := make(map[string]bool)
+	discontinuities := newDiscontinuityTracker()
+
+	var inFlight sync.WaitGroup
+	// An empty segment under the fail policy stops polling; it is reported
+	// once in-flight downloads finish if the loop hasn't returned it already
+	emptyFailed := make(chan error, 1)
+	defer func() {
+		inFlight.Wait()
+		if err == nil {
+			select {
+			case err = <-emptyFailed:
+			default:
+			}
+		}
+	}()
+	variantSem := make(chan struct{}, variantWorkers(cfg.Core.VariantWorkers))
+	gonePolls := 0
+	failedPolls := 0
+
+	// The newest segment queued so far, to spot segments that left the live
+	// window between polls
+	polled := false
+	var lastSeq, lastDisc uint64
+
+	timeRange := opts.CaptureRange
+	var clock rangeClock
+	rangeEnded := false
+
+	// fetch downloads one segment and records the outcome
+	fetch := func(j SegmentJob) error {
+		ctx, cancel := timeoutContext(downloadCtx, cfg.Core.SegmentTimeout)
+		defer cancel()
+
+		start := time.Now()
+		var written int64
+		var checksum string
+		key, err := keys.ForJob(ctx, j)
+		if err == nil {
+			written, checksum, err = downloadSegment(ctx, client, j.AbsoluteURL(), j.Path(), j.Range, key)
+		}
+		skipped := errors.Is(err, ErrEmptySegment) && cfg.Core.EmptySegment == config.EmptySegmentSkip
+		if !errors.Is(err, context.Canceled) && !skipped {
+			if stats != nil {
+				stats.RecordVariant(j.Variant.Resolution, time.Since(start), err)
+			}
+			opts.Adaptive.Record(err)
+		}
+		if stats != nil && err == nil {
+			stats.RecordSaved(j.Variant.Resolution, j.Discontinuity, j.Seq, written)
+			stats.RecordCaptured(j.Variant.Resolution, j.Duration)
+		}
+		name := strings.TrimSuffix(path.Base(j.Key()), path.Ext(path.Base(j.Key())))
+		seqNo := ManifestKey(j.Seq, j.Discontinuity)
+
+		if err == nil {
+			if manifest != nil {
+				manifest.AddOrUpdateSegment(seqNo, j.Variant.Resolution)
+				if checksum != "" {
+					manifest.RecordChecksum(seqNo, j.Variant.Resolution, checksum)
+				}
+			}
+			segmentPath := j.Path()
+			if opts.SegmentIndex != nil {
+				opts.SegmentIndex.Add(seqNo, j.Variant.Resolution, segmentPath)
+			}
+			warmSegment(opts.CacheWarmer, j.AbsoluteURL())
+			if opts.RollingWindow != nil {
+				opts.RollingWindow.Add(j.Variant.Resolution, segmentPath)
+			}
+			log.Printf("✓ %s downloaded segment %s", j.Variant.Resolution, name)
+			return nil
+		}
+
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			// Suppress log: shutdown in progress
+			return err
+		}
+
+		// Retries are exhausted; processing can fill this sequence
+		// from another resolution that has it
+		if manifest != nil {
+			manifest.RecordMissing(seqNo, j.Variant.Resolution)
+		}
+
+		if skipped {
+			log.Printf("- %s skipped empty segment %s", j.Variant.Resolution, name)
+			return nil
+		}
+		if errors.Is(err, ErrEmptySegment) && cfg.Core.EmptySegment == config.EmptySegmentFail {
+			log.Printf("✗ %s got empty segment %s, stopping variant", j.Variant.Resolution, name)
+			select {
+			case emptyFailed <- fmt.Errorf("%s: %w", j.Variant.Resolution, err):
+			default:
+			}
+			return err
+		}
+
+		if httpClient.IsHTTPStatus(err, 403) {
+			log.Printf("✗ %s failed to download segment %s (403)", j.Variant.Resolution, name)
+		} else {
+			log.Printf("✗ %s failed to download segment %s: %v", j.Variant.Resolution, name, err)
+		}
+		return err
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
+		case err := <-emptyFailed:
+			return err
 		default:
 		}
 
-		playlist, err := LoadMediaPlaylist(variant.URL)
-		seq := playlist.SeqNo
+		var discs []uint64
+		var position uint64
+		var key *m3u8.Key
+		var ranges rangeTracker
+		pollCtx, cancelPoll := timeoutContext(ctx, cfg.Core.PlaylistTimeout)
+		playlist, err := LoadMediaPlaylist(pollCtx, variant.URL)
+		cancelPoll()
 		if err != nil {
-			log.Printf("%s: Error loading playlist playlist: %v", variant.Resolution, err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("%s: Playlist fetch timed out after %v, retrying next poll", variant.Resolution, cfg.Core.PlaylistTimeout)
+			} else {
+				log.Printf("%s: Error loading playlist playlist: %v", variant.Resolution, err)
+			}
+			failedPolls++
+			if isPlaylistGone(err) {
+				gonePolls++
+				if gonePolls >= fatalPlaylistPolls {
+					return &FatalError{Variant: variant.Resolution, Err: fmt.Errorf("playlist unavailable for %d polls: %w", gonePolls, err)}
+				}
+			} else {
+				gonePolls = 0
+			}
 			goto waitTick
 		}
+		gonePolls = 0
+		discs = discontinuities.Assign(playlist)
+
+		if polled && len(discs) > 0 && discs[0] == lastDisc && playlist.SeqNo > lastSeq+1 {
+			missed := playlist.SeqNo - lastSeq - 1
+			lost := time.Duration(missed) * time.Duration(playlist.TargetDuration*float64(time.Second))
+			if failedPolls > 0 {
+				log.Printf("%s: Playlist recovered after %d failed polls; %d segments (~%v) left the live window meanwhile", variant.Resolution, failedPolls, missed, lost)
+			} else {
+				log.Printf("%s: %d segments (~%v) left the live window between polls", variant.Resolution, missed, lost)
+			}
+			if jobs, ok := missedJobs(variant, playlist, discs[0], lastSeq); ok {
+				for _, j := range jobs {
+					seen[j.Key()] = true
+				}
+				if !timeRange.IsZero() {
+					jobs = missedInRange(jobs, timeRange, &clock, time.Duration(playlist.TargetDuration*float64(time.Second)))
+				}
+				inFlight.Add(1)
+				go func() {
+					defer inFlight.Done()
+					backfillMissed(downloadCtx, jobs, variantSem, sem, fetch, manifest, opts)
+				}()
+			} else {
+				log.Printf("%s: Segment names don't carry sequence numbers, can't fetch the missed segments", variant.Resolution)
+			}
+		}
+		failedPolls = 0
 
+		// Sequence numbers come from each segment's position so no path
+		// through the loop can leave them out of step. A key applies to every
+		// segment after its #EXT-X-KEY until the next one rotates it.
+		position = 0
+		key = nil
 		for _, seg := range playlist.Segments {
 			if seg == nil {
 				continue
 			}
+			seq := playlist.SeqNo + position
+			position++
+			if seg.Key != nil {
+				key = seg.Key
+			}
 			job := SegmentJob{
-				URI:       seg.URI,
-				Seq:       seq,
-				VariantID: variant.ID,
-				Variant:   variant,
+				URI:           seg.URI,
+				Seq:           seq,
+				Discontinuity: discs[0],
+				Duration:      time.Duration(seg.Duration * float64(time.Second)),
+				VariantID:     variant.ID,
+				Variant:       variant,
+				EncryptionKey: key,
+				Range:         ranges.Next(seg),
 			}
+			discs = discs[1:]
+			polled, lastSeq, lastDisc = true, job.Seq, job.Discontinuity
 			segmentKey := job.Key()
 			if seen[segmentKey] {
-				seq++
 				continue
 			}
 			seen[segmentKey] = true
 
-			sem <- struct{}{} // Acquire
-			go func(j SegmentJob) {
-				defer func() { <-sem }() // Release
-				ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-				defer cancel()
-
-				err := DownloadSegment(ctx, client, j.AbsoluteURL(), j.Variant.OutputDir)
-				name := strings.TrimSuffix(path.Base(j.Key()), path.Ext(path.Base(j.Key())))
-
-				if err == nil {
-					log.Printf("✓ %s downloaded segment %s", j.Variant.Resolution, name)
-					return
+			if !timeRange.IsZero() {
+				offset := clock.Place(job.Seq, job.Duration, time.Duration(playlist.TargetDuration*float64(time.Second)))
+				if timeRange.Ended(offset) {
+					rangeEnded = true
 				}
-
-				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-					// Suppress log: shutdown in progress
-					return
+				if !timeRange.Contains(offset, job.Duration) {
+					continue
 				}
+			}
 
-				if httpClient.IsHTTPStatus(err, 403) {
-					log.Printf("✗ %s failed to download segment %s (403)", j.Variant.Resolution, name)
-				} else {
-					log.Printf("✗ %s failed to download segment %s: %v", j.Variant.Resolution, name, err)
-				}
+			if err := opts.InodeGuard.Wait(ctx); err != nil {
+				return nil
+			}
+			if err := opts.SegmentLimiter.Wait(ctx); err != nil {
+				return nil
+			}
+			// The first poll can list a whole back-window at once, so the
+			// variant's own limit keeps it from taking every shared slot
+			select {
+			case variantSem <- struct{}{}:
+			case <-ctx.Done():
+				return nil
+			}
+			select {
+			case sem <- struct{}{}: // Acquire
+			case <-ctx.Done():
+				<-variantSem
+				return nil
+			}
+			inFlight.Add(1)
+			go func(j SegmentJob) {
+				defer inFlight.Done()
+				defer func() { <-sem; <-variantSem }() // Release
+				fetch(j)
 			}(job)
-			seq++
 		}
 
+		if rangeEnded {
+			log.Printf("%s: Reached the end of the capture range (%v from %v)", variant.Resolution, timeRange.Duration, timeRange.Start)
+			return nil
+		}
+		if playlist.MediaType == m3u8.VOD {
+			log.Printf("%s: VOD playlist (#EXT-X-PLAYLIST-TYPE:VOD), queued all %d segments", variant.Resolution, len(seen))
+			return nil
+		}
 		if playlist.Closed {
 			log.Printf("%s: Playlist closed (#EXT-X-ENDLIST)", variant.Resolution)
-			return
+			return nil
 		}
 
 	waitTick:
 		select {
 		case <-ctx.Done():
-			return
+			return nil
+		case err := <-emptyFailed:
+			return err
 		case <-ticker.C:
 		}
 	}
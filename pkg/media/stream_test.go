@@ -0,0 +1,732 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStartupJitter_StaggersVariants(t *testing.T) {
+	const variants = 8
+	interval := 3 * time.Second
+
+	offsets := make(map[time.Duration]bool)
+	for i := 0; i < variants; i++ {
+		delay := startupJitter(interval)
+		if delay < 0 || delay >= interval {
+			t.Errorf("Expected offset within [0, %v), got %v", interval, delay)
+		}
+		offsets[delay] = true
+	}
+
+	if len(offsets) < variants {
+		t.Errorf("Expected %d distinct offsets, got %d", variants, len(offsets))
+	}
+}
+
+func TestStartupJitter_ZeroInterval(t *testing.T) {
+	if delay := startupJitter(0); delay != 0 {
+		t.Errorf("Expected no offset for a zero interval, got %v", delay)
+	}
+}
+
+func TestVariantDownloader_StopPollingFinishesInFlight(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "stream_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:6.0,\nmedia_0001.ts\n")
+	})
+	mux.HandleFunc("/1080/media_0001.ts", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-release
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	downloadCtx, force := context.WithCancel(context.Background())
+	defer force()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		VariantDownloader(pollCtx, downloadCtx, variant, make(chan struct{}, 4), nil, nil, DownloadOptions{})
+	}()
+
+	select {
+	case <-requested:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Segment was never requested")
+	}
+
+	// First phase: stop polling while the segment is still downloading
+	stopPolling()
+	select {
+	case <-done:
+		t.Fatal("VariantDownloader returned before its in-flight download finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("VariantDownloader did not return after the in-flight download finished")
+	}
+
+	if _, err := os.Stat(filepath.Join(variant.OutputDir, "media_0001.ts")); err != nil {
+		t.Errorf("Expected in-flight segment to be completed after polling stopped: %v", err)
+	}
+}
+
+func TestVariantDownloader_PlaylistTimeoutRetries(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "stream_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldTimeout, oldDelay := cfg.Core.PlaylistTimeout, cfg.Core.RefreshDelay
+	cfg.Core.PlaylistTimeout = 100 * time.Millisecond
+	cfg.Core.RefreshDelay = 200 * time.Millisecond
+	t.Cleanup(func() {
+		cfg.Core.PlaylistTimeout, cfg.Core.RefreshDelay = oldTimeout, oldDelay
+	})
+
+	// The first playlist fetch hangs; later ones answer normally
+	var fetches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:6.0,\nmedia_0001.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/1080/media_0001.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), nil, nil, DownloadOptions{})
+	}()
+
+	// The playlist is closed, so the downloader returns once it recovers
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("VariantDownloader stayed stuck on the hung playlist fetch")
+	}
+
+	if got := atomic.LoadInt32(&fetches); got < 2 {
+		t.Errorf("Expected the playlist to be fetched again after the timeout, got %d fetches", got)
+	}
+	if _, err := os.Stat(filepath.Join(variant.OutputDir, "media_0001.ts")); err != nil {
+		t.Errorf("Expected the segment to download after the retry: %v", err)
+	}
+}
+
+func TestVariantDownloader_SegmentRateLimit(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "stream_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	const rate = 20
+	const segments = 6
+
+	var mu sync.Mutex
+	var requests []time.Time
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		for i := 1; i <= segments; i++ {
+			fmt.Fprintf(w, "#EXTINF:6.0,\nmedia_%04d.ts\n", i)
+		}
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		mu.Unlock()
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+
+	// Plenty of workers, so only the limiter spaces the downloads out
+	VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, segments), nil, nil, DownloadOptions{SegmentLimiter: utils.NewRateLimiter(rate, 1)})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != segments {
+		t.Fatalf("Expected %d segment requests, got %d", segments, len(requests))
+	}
+	span := requests[len(requests)-1].Sub(requests[0])
+	minimum := time.Duration(float64(segments-1) / rate * float64(time.Second))
+	// Allow for request scheduling jitter around the limiter's spacing
+	if span < minimum-20*time.Millisecond {
+		t.Errorf("Expected %d segments to span at least %v at %d/s, took %v", segments, minimum, rate, span)
+	}
+}
+
+func TestVariantDownloader_PlaylistType(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tests := []struct {
+		name         string
+		playlistType string
+		wantPolling  bool
+	}{
+		{"VOD downloads once", "VOD", false},
+		{"EVENT keeps polling", "EVENT", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "stream_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			// Neither playlist has #EXT-X-ENDLIST, so only the type can end it
+			var polls int32
+			mux := http.NewServeMux()
+			mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&polls, 1)
+				fmt.Fprintf(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:%s\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n", tt.playlistType)
+				fmt.Fprint(w, "#EXTINF:6.0,\nmedia_0001.ts\n#EXTINF:6.0,\nmedia_0002.ts\n")
+			})
+			mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("segment"))
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			variantURL := server.URL + "/1080/chunklist.m3u8"
+			base, _ := url.Parse(variantURL)
+			variant := &StreamVariant{
+				URL:        variantURL,
+				BaseURL:    base,
+				Resolution: "1080p",
+				OutputDir:  filepath.Join(tempDir, "1080p"),
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				VariantDownloader(ctx, context.Background(), variant, make(chan struct{}, 4), nil, nil, DownloadOptions{})
+			}()
+
+			select {
+			case <-done:
+				if tt.wantPolling {
+					t.Fatal("EVENT playlist should keep polling until cancelled")
+				}
+			case <-time.After(500 * time.Millisecond):
+				if !tt.wantPolling {
+					t.Fatal("VOD playlist should finish without polling")
+				}
+				cancel()
+				<-done
+			}
+
+			got := atomic.LoadInt32(&polls)
+			if !tt.wantPolling && got != 1 {
+				t.Errorf("Expected a single playlist fetch for VOD, got %d", got)
+			}
+			if tt.wantPolling && got < 2 {
+				t.Errorf("Expected repeated playlist fetches for EVENT, got %d", got)
+			}
+			for _, name := range []string{"media_0001.ts", "media_0002.ts"} {
+				if _, err := os.Stat(filepath.Join(variant.OutputDir, name)); err != nil {
+					t.Errorf("Expected %s to be downloaded: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestVariantDownloader_FatalPlaylistError(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 5 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tests := []struct {
+		name      string
+		status    int
+		wantFatal bool
+	}{
+		{"404 is fatal", http.StatusNotFound, true},
+		{"410 is fatal", http.StatusGone, true},
+		{"503 is retried", http.StatusServiceUnavailable, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&polls, 1)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			base, _ := url.Parse(server.URL)
+			variant := &StreamVariant{URL: server.URL + "/chunklist.m3u8", BaseURL: base, Resolution: "1080p"}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- VariantDownloader(ctx, context.Background(), variant, make(chan struct{}, 4), nil, nil, DownloadOptions{})
+			}()
+
+			var err error
+			select {
+			case err = <-done:
+				if !tt.wantFatal {
+					t.Fatalf("Expected %d to be retried until cancelled, returned %v", tt.status, err)
+				}
+			case <-time.After(time.Second):
+				if tt.wantFatal {
+					t.Fatalf("Expected %d to end the variant", tt.status)
+				}
+				cancel()
+				err = <-done
+			}
+
+			if IsFatal(err) != tt.wantFatal {
+				t.Errorf("Expected fatal=%v, got %v", tt.wantFatal, err)
+			}
+			if tt.wantFatal && atomic.LoadInt32(&polls) != fatalPlaylistPolls {
+				t.Errorf("Expected %d polls before giving up, got %d", fatalPlaylistPolls, polls)
+			}
+		})
+	}
+}
+
+func TestVariantDownloader_InitialBackWindow(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "stream_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	// A live window of 20 segments, all listed by the first poll
+	const segments = 20
+	var active, peak, downloaded int32
+	var mu sync.Mutex
+	requested := make(map[string]int)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:100\n")
+		for i := 0; i < segments; i++ {
+			fmt.Fprintf(w, "#EXTINF:6.0,\nmedia_%d.ts\n", 100+i)
+		}
+	})
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		mu.Lock()
+		requested[r.URL.Path]++
+		mu.Unlock()
+		w.Write([]byte("segment"))
+		atomic.AddInt32(&downloaded, 1)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	manifest := &ManifestWriter{ManifestPath: filepath.Join(tempDir, "manifest.json")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The shared pool is large enough that only the variant's own limit applies
+		VariantDownloader(ctx, context.Background(), variant, make(chan struct{}, 100), manifest, nil, DownloadOptions{})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&downloaded) < segments && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let a few more polls of the unchanged window go by
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requested) != segments {
+		t.Errorf("Expected %d distinct segments downloaded, got %d", segments, len(requested))
+	}
+	for path, n := range requested {
+		if n != 1 {
+			t.Errorf("Expected %s downloaded once, got %d", path, n)
+		}
+	}
+	if p := atomic.LoadInt32(&peak); p > constants.WorkerCount {
+		t.Errorf("Expected at most %d concurrent downloads for one variant, got %d", constants.WorkerCount, p)
+	}
+	for i := 0; i < segments; i++ {
+		seqNo := fmt.Sprint(100 + i)
+		if _, ok := manifest.Index[seqNo]; !ok {
+			t.Errorf("Expected sequence %s in the manifest", seqNo)
+		}
+	}
+	if len(manifest.Segments) != segments {
+		t.Errorf("Expected %d manifest entries, got %d", segments, len(manifest.Segments))
+	}
+}
+
+func TestVariantDownloader_VariantWorkersCap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "stream_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	oldDelay, oldWorkers := cfg.Core.RefreshDelay, cfg.Core.VariantWorkers
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	cfg.Core.VariantWorkers = 3
+	t.Cleanup(func() { cfg.Core.RefreshDelay, cfg.Core.VariantWorkers = oldDelay, oldWorkers })
+
+	// A back-window far larger than the cap or the shared pool's slack
+	const segments = 300
+	var active, peak, downloaded int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:0\n")
+		for i := 0; i < segments; i++ {
+			fmt.Fprintf(w, "#EXTINF:6.0,\nmedia_%d.ts\n", i)
+		}
+	})
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		w.Write([]byte("segment"))
+		atomic.AddInt32(&downloaded, 1)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+
+	baseline := runtime.NumGoroutine()
+	var peakGoroutines int32
+	sampling := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-sampling:
+				return
+			default:
+			}
+			if n := int32(runtime.NumGoroutine()); n > atomic.LoadInt32(&peakGoroutines) {
+				atomic.StoreInt32(&peakGoroutines, n)
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		VariantDownloader(ctx, context.Background(), variant, make(chan struct{}, 10000), nil, nil, DownloadOptions{})
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&downloaded) < segments && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	close(sampling)
+	<-sampled
+
+	if got := atomic.LoadInt32(&downloaded); got != segments {
+		t.Errorf("Expected %d segments downloaded, got %d", segments, got)
+	}
+	if p := atomic.LoadInt32(&peak); p > 3 {
+		t.Errorf("Expected at most 3 concurrent downloads, got %d", p)
+	}
+	// The downloader, the sampler, and the HTTP server and client add a
+	// handful of goroutines per download; a goroutine per segment would
+	// add hundreds
+	if grown := int(atomic.LoadInt32(&peakGoroutines)) - baseline; grown > 50 {
+		t.Errorf("Expected goroutines to stay bounded by the cap, grew by %d", grown)
+	}
+}
+
+func TestVariantDownloader_EmptySegmentPolicy(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay, oldPolicy := cfg.Core.RefreshDelay, cfg.Core.EmptySegment
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay, cfg.Core.EmptySegment = oldDelay, oldPolicy })
+
+	tests := []struct {
+		policy       string
+		emptyReplies int32 // empty bodies served for media_0002.ts before real data
+		wantRequests int32
+		wantFile     bool
+		wantMissing  bool
+		wantErr      bool
+	}{
+		{config.EmptySegmentRetry, 1, 2, true, false, false},
+		{config.EmptySegmentSkip, 100, 1, false, true, false},
+		{config.EmptySegmentFail, 100, 1, false, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg.Core.EmptySegment = tt.policy
+
+			tempDir, err := os.MkdirTemp("", "stream_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			var requests int32
+			mux := http.NewServeMux()
+			mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+				fmt.Fprint(w, "#EXTINF:6.0,\nmedia_0001.ts\n#EXTINF:6.0,\nmedia_0002.ts\n#EXTINF:6.0,\nmedia_0003.ts\n")
+			})
+			mux.HandleFunc("/1080/media_0002.ts", func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= tt.emptyReplies {
+					return
+				}
+				w.Write([]byte("segment"))
+			})
+			mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("segment"))
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			variantURL := server.URL + "/1080/chunklist.m3u8"
+			base, _ := url.Parse(variantURL)
+			variant := &StreamVariant{
+				URL:        variantURL,
+				BaseURL:    base,
+				Resolution: "1080p",
+				OutputDir:  filepath.Join(tempDir, "1080p"),
+			}
+			manifest := &ManifestWriter{ManifestPath: filepath.Join(tempDir, "manifest.json")}
+
+			err = VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), manifest, nil, DownloadOptions{})
+			if tt.wantErr {
+				if !errors.Is(err, ErrEmptySegment) {
+					t.Errorf("Expected an empty segment error, got %v", err)
+				}
+				if IsFatal(err) {
+					t.Error("An empty segment should stop only its own variant, not the run")
+				}
+			} else if err != nil {
+				t.Errorf("VariantDownloader() returned error: %v", err)
+			}
+
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("Expected %d requests for the empty segment, got %d", tt.wantRequests, got)
+			}
+			_, statErr := os.Stat(filepath.Join(variant.OutputDir, "media_0002.ts"))
+			if got := statErr == nil; got != tt.wantFile {
+				t.Errorf("Expected media_0002.ts exists=%v, got %v", tt.wantFile, got)
+			}
+			item, ok := manifest.Index["2"]
+			missing := ok && len(item.Missing) == 1 && item.Missing[0] == "1080p"
+			if missing != tt.wantMissing {
+				t.Errorf("Expected sequence 2 missing=%v, got %+v", tt.wantMissing, item)
+			}
+			if !tt.wantErr {
+				for _, name := range []string{"media_0001.ts", "media_0003.ts"} {
+					if _, err := os.Stat(filepath.Join(variant.OutputDir, name)); err != nil {
+						t.Errorf("Expected %s to be downloaded: %v", name, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestVariantDownloader_ByteRangeSegments(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "stream_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	media := []byte("first segment|second segment|third")
+	var fullRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		fmt.Fprint(w, "#EXTINF:6.0,\n#EXT-X-BYTERANGE:14@0\nmain.ts\n#EXTINF:6.0,\n#EXT-X-BYTERANGE:15\nmain.ts\n#EXTINF:6.0,\n#EXT-X-BYTERANGE:5\nmain.ts\n")
+	})
+	mux.HandleFunc("/1080/main.ts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			atomic.AddInt32(&fullRequests, 1)
+		}
+		http.ServeContent(w, r, "main.ts", time.Time{}, bytes.NewReader(media))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	manifest := &ManifestWriter{ManifestPath: filepath.Join(tempDir, "manifest.json")}
+
+	if err := VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), manifest, nil, DownloadOptions{}); err != nil {
+		t.Fatalf("VariantDownloader() returned error: %v", err)
+	}
+
+	want := map[string]string{
+		"main_0-13_1.ts":  "first segment|",
+		"main_14-28_2.ts": "second segment|",
+		"main_29-33_3.ts": "third",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(variant.OutputDir, name))
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", name, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q", name, content, data)
+		}
+	}
+	if entries, _ := os.ReadDir(variant.OutputDir); len(entries) != len(want) {
+		t.Errorf("Expected %d segment files, got %d", len(want), len(entries))
+	}
+	if got := atomic.LoadInt32(&fullRequests); got != 0 {
+		t.Errorf("Expected every request to carry a Range header, got %d without", got)
+	}
+	for _, seqNo := range []string{"1", "2", "3"} {
+		if item, ok := manifest.Index[seqNo]; !ok || item.Resolution != "1080p" {
+			t.Errorf("Expected sequence %s in the manifest, got %+v", seqNo, item)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package media
+
+import (
+	"fmt"
+	"github.com/grafov/m3u8"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SubtitleDirPrefix starts the directory name of every subtitle rendition,
+// which keeps them apart from resolution directories
+const SubtitleDirPrefix = "subtitles_"
+
+// subtitleVariants returns a StreamVariant for each WebVTT subtitle rendition
+// declared with #EXT-X-MEDIA:TYPE=SUBTITLES, numbered from firstID. Every
+// variant referencing a group lists its renditions, so each URI is returned
+// once. The label is subtitles_<language>, or the NAME when there is no
+// LANGUAGE, with _2, _3... added when several renditions share one.
+func subtitleVariants(master *m3u8.MasterPlaylist, base *url.URL, outputDir string, firstID int) []*StreamVariant {
+	var variants []*StreamVariant
+	seen := make(map[string]bool)
+	labels := make(map[string]int)
+	for _, v := range master.Variants {
+		for _, alt := range v.Alternatives {
+			if alt == nil || alt.Type != "SUBTITLES" || alt.URI == "" {
+				continue
+			}
+			altURL, err := url.Parse(alt.URI)
+			if err != nil {
+				continue
+			}
+			full := base.ResolveReference(altURL)
+			if seen[full.String()] {
+				continue
+			}
+			seen[full.String()] = true
+
+			name := alt.Language
+			if name == "" {
+				name = alt.Name
+			}
+			label := SubtitleDirPrefix + subtitleLabel(name)
+			labels[label]++
+			if n := labels[label]; n > 1 {
+				label = fmt.Sprintf("%s_%d", label, n)
+			}
+
+			variants = append(variants, &StreamVariant{
+				URL:        full.String(),
+				BaseURL:    full,
+				ID:         firstID + len(variants),
+				Resolution: label,
+				OutputDir:  path.Join(outputDir, label),
+				Subtitles:  true,
+			})
+		}
+	}
+	return variants
+}
+
+// subtitleLabel makes a rendition's language or name safe for a directory
+// name: lower case letters, digits and dashes, or "und" if nothing is left
+func subtitleLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, name)
+	label = strings.Trim(label, "-")
+	if label == "" {
+		return "und"
+	}
+	return label
+}
+
+// SubtitleLanguage returns the language of a subtitle rendition directory,
+// e.g. "en" for subtitles_en_2, or "" for any other directory
+func SubtitleLanguage(dir string) string {
+	label, ok := strings.CutPrefix(dir, SubtitleDirPrefix)
+	if !ok {
+		return ""
+	}
+	language, _, _ := strings.Cut(label, "_")
+	return language
+}
@@ -0,0 +1,169 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"m3u8-downloader/pkg/constants"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setSubtitles(t *testing.T, enabled bool) {
+	t.Helper()
+	cfg := constants.MustGetConfig()
+	old := cfg.Core.Subtitles
+	cfg.Core.Subtitles = enabled
+	t.Cleanup(func() { cfg.Core.Subtitles = old })
+}
+
+const subtitleMaster = "#EXTM3U\n" +
+	"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",LANGUAGE=\"en\",NAME=\"English\",URI=\"subs/en.m3u8\"\n" +
+	"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",LANGUAGE=\"es\",NAME=\"Español\",URI=\"subs/es.m3u8\"\n" +
+	"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",LANGUAGE=\"en\",NAME=\"English (CC)\",URI=\"subs/en_cc.m3u8\"\n" +
+	"#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,SUBTITLES=\"subs\"\n1080/chunklist.m3u8\n" +
+	"#EXT-X-STREAM-INF:BANDWIDTH=3500000,RESOLUTION=1280x720,SUBTITLES=\"subs\"\n720/chunklist.m3u8\n"
+
+func TestGetAllVariants_SubtitleRenditions(t *testing.T) {
+	server := newChangingMasterServer(t, subtitleMaster)
+
+	setSubtitles(t, false)
+	variants, err := GetAllVariants(server.URL+"/master.m3u8", "/event", nil, nil)
+	if err != nil {
+		t.Fatalf("GetAllVariants() failed: %v", err)
+	}
+	if len(variants) != 2 {
+		t.Fatalf("Expected only the 2 video variants with subtitles off, got %d", len(variants))
+	}
+
+	setSubtitles(t, true)
+	variants, err = GetAllVariants(server.URL+"/master.m3u8", "/event", nil, nil)
+	if err != nil {
+		t.Fatalf("GetAllVariants() failed: %v", err)
+	}
+
+	expected := []struct {
+		label    string
+		uri      string
+		language string
+	}{
+		{"subtitles_en", "/subs/en.m3u8", "en"},
+		{"subtitles_es", "/subs/es.m3u8", "es"},
+		{"subtitles_en_2", "/subs/en_cc.m3u8", "en"},
+	}
+	if len(variants) != 2+len(expected) {
+		t.Fatalf("Expected 2 video variants and %d subtitle renditions once each, got %d", len(expected), len(variants))
+	}
+	ids := make(map[int]bool)
+	for _, v := range variants {
+		ids[v.ID] = true
+	}
+	if len(ids) != len(variants) {
+		t.Errorf("Expected unique variant IDs, got %d distinct of %d", len(ids), len(variants))
+	}
+	for i, tt := range expected {
+		v := variants[2+i]
+		if !v.Subtitles {
+			t.Errorf("Expected %s to be marked as subtitles", tt.label)
+		}
+		if v.Resolution != tt.label {
+			t.Errorf("Rendition %d: expected label %s, got %s", i, tt.label, v.Resolution)
+		}
+		if v.URL != server.URL+tt.uri {
+			t.Errorf("Rendition %d: expected URL %s, got %s", i, server.URL+tt.uri, v.URL)
+		}
+		if v.OutputDir != path.Join("/event", tt.label) {
+			t.Errorf("Rendition %d: expected output dir %s, got %s", i, path.Join("/event", tt.label), v.OutputDir)
+		}
+		if got := SubtitleLanguage(v.Resolution); got != tt.language {
+			t.Errorf("Rendition %d: expected language %s, got %s", i, tt.language, got)
+		}
+	}
+	if variants[0].Subtitles || variants[1].Subtitles {
+		t.Error("Expected video variants not to be marked as subtitles")
+	}
+}
+
+func TestSubtitleLabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"en", "en"},
+		{"pt-BR", "pt-br"},
+		{"English (CC)", "english--cc"},
+		{"../..", "und"},
+		{"", "und"},
+	}
+	for _, tt := range tests {
+		if got := subtitleLabel(tt.name); got != tt.expected {
+			t.Errorf("subtitleLabel(%q) = %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestSubtitleLanguage(t *testing.T) {
+	tests := []struct {
+		dir      string
+		expected string
+	}{
+		{"subtitles_en", "en"},
+		{"subtitles_pt-br_3", "pt-br"},
+		{"1080p", ""},
+	}
+	for _, tt := range tests {
+		if got := SubtitleLanguage(tt.dir); got != tt.expected {
+			t.Errorf("SubtitleLanguage(%q) = %q, expected %q", tt.dir, got, tt.expected)
+		}
+	}
+}
+
+func TestVariantDownloader_SubtitlesStayOutOfManifest(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "subtitles_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subs/en.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		fmt.Fprint(w, "#EXTINF:6.0,\nsub_0001.vtt\n#EXTINF:6.0,\nsub_0002.vtt\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "WEBVTT\n\n00:00:00.000 --> 00:00:01.000\n"+r.URL.Path+"\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	variantURL := server.URL + "/subs/en.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "subtitles_en",
+		OutputDir:  filepath.Join(tempDir, "subtitles_en"),
+		Subtitles:  true,
+	}
+	manifest := &ManifestWriter{ManifestPath: filepath.Join(tempDir, "manifest.json")}
+	VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), manifest, nil, DownloadOptions{})
+
+	for _, name := range []string{"sub_0001.vtt", "sub_0002.vtt"} {
+		if _, err := os.Stat(filepath.Join(tempDir, "subtitles_en", name)); err != nil {
+			t.Errorf("Expected %s downloaded: %v", name, err)
+		}
+	}
+	if len(manifest.Segments) != 0 {
+		t.Errorf("Expected no manifest entries for subtitle segments, got %+v", manifest.Segments)
+	}
+}
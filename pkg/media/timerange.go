@@ -0,0 +1,79 @@
+package media
+
+import (
+	"time"
+)
+
+// CaptureRange limits a download to part of an event, measured from the
+// first segment of the first playlist fetched using #EXTINF durations. A
+// zero Duration runs to the end of the event.
+type CaptureRange struct {
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// IsZero reports whether r captures the whole event
+func (r CaptureRange) IsZero() bool {
+	return r.Start <= 0 && r.Duration <= 0
+}
+
+// Contains reports whether a segment starting at offset and lasting length
+// overlaps the range, so the segment covering Start is included
+func (r CaptureRange) Contains(offset, length time.Duration) bool {
+	if offset < r.Start && offset+length <= r.Start {
+		return false
+	}
+	return !r.Ended(offset)
+}
+
+// Ended reports whether a segment starting at offset is past the range
+func (r CaptureRange) Ended(offset time.Duration) bool {
+	return r.Duration > 0 && offset >= r.Start+r.Duration
+}
+
+// SegmentRange returns the segments of a playlist with the given durations
+// that fall within r, as indexes [first, end). first == end when none do.
+func SegmentRange(durations []time.Duration, r CaptureRange) (first, end int) {
+	first = -1
+	var offset time.Duration
+	for i, d := range durations {
+		if r.Ended(offset) {
+			break
+		}
+		if r.Contains(offset, d) {
+			if first < 0 {
+				first = i
+			}
+			end = i + 1
+		}
+		offset += d
+	}
+	if first < 0 {
+		return 0, 0
+	}
+	return first, end
+}
+
+// rangeClock places a variant's segments on the event timeline in the order
+// they are first seen, for checking them against a CaptureRange
+type rangeClock struct {
+	started bool
+	nextSeq uint64
+	offset  time.Duration
+}
+
+// Place returns where the segment seq, first seen now, starts. Sequence
+// numbers skipped since the last segment are counted at target each.
+func (c *rangeClock) Place(seq uint64, length, target time.Duration) time.Duration {
+	if !c.started {
+		c.started = true
+		c.nextSeq = seq
+	}
+	if seq > c.nextSeq {
+		c.offset += time.Duration(seq-c.nextSeq) * target
+	}
+	start := c.offset
+	c.offset += length
+	c.nextSeq = seq + 1
+	return start
+}
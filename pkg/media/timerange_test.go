@@ -0,0 +1,118 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"m3u8-downloader/pkg/constants"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSegmentRange(t *testing.T) {
+	// Segments start at 0, 6, 12, 16, 22 and 28s
+	durations := []time.Duration{
+		6 * time.Second, 6 * time.Second, 4 * time.Second,
+		6 * time.Second, 6 * time.Second, 6 * time.Second,
+	}
+
+	tests := []struct {
+		name      string
+		r         CaptureRange
+		wantFirst int
+		wantEnd   int
+	}{
+		{"whole event", CaptureRange{}, 0, 6},
+		{"start on a boundary", CaptureRange{Start: 12 * time.Second}, 2, 6},
+		{"start inside a segment", CaptureRange{Start: 14 * time.Second}, 2, 6},
+		{"duration ending on a boundary", CaptureRange{Start: 6 * time.Second, Duration: 10 * time.Second}, 1, 3},
+		{"duration ending inside a segment", CaptureRange{Start: 6 * time.Second, Duration: 11 * time.Second}, 1, 4},
+		{"duration only", CaptureRange{Duration: 7 * time.Second}, 0, 2},
+		{"start past the end", CaptureRange{Start: time.Hour}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, end := SegmentRange(durations, tt.r)
+			if first != tt.wantFirst || end != tt.wantEnd {
+				t.Errorf("SegmentRange() = [%d, %d), want [%d, %d)", first, end, tt.wantFirst, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestRangeClock_Place(t *testing.T) {
+	var c rangeClock
+	target := 6 * time.Second
+
+	if got := c.Place(100, 6*time.Second, target); got != 0 {
+		t.Errorf("Expected first segment at 0, got %v", got)
+	}
+	if got := c.Place(101, 4*time.Second, target); got != 6*time.Second {
+		t.Errorf("Expected second segment at 6s, got %v", got)
+	}
+	// 102 and 103 were never seen, so they count at the target duration
+	if got := c.Place(104, 6*time.Second, target); got != 22*time.Second {
+		t.Errorf("Expected segment after a gap at 22s, got %v", got)
+	}
+}
+
+func TestVariantDownloader_CaptureRange(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "timerange_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		for i := 1; i <= 10; i++ {
+			fmt.Fprintf(w, "#EXTINF:10.0,\nmedia_%04d.ts\n", i)
+		}
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// 25s falls in the third segment; 30s more ends inside the sixth
+	opts := DownloadOptions{CaptureRange: CaptureRange{Start: 25 * time.Second, Duration: 30 * time.Second}}
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), nil, nil, opts)
+
+	entries, err := os.ReadDir(variant.OutputDir)
+	if err != nil {
+		t.Fatalf("Failed to read output dir: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	sort.Strings(got)
+
+	want := []string{"media_0003.ts", "media_0004.ts", "media_0005.ts", "media_0006.ts"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,87 @@
+package media
+
+import (
+	"context"
+	"io"
+	"log"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/httpClient"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// warmTimeout bounds each cache warmer request
+const warmTimeout = 10 * time.Second
+
+// CacheWarmer re-requests each downloaded segment through a caching proxy so
+// the proxy holds a copy of the capture. The endpoint's {url} placeholder is
+// replaced with the escaped segment URL; without one, the segment URL is sent
+// as the url query parameter.
+type CacheWarmer struct {
+	endpoint string
+	method   string
+	client   *http.Client
+}
+
+// NewCacheWarmer returns a warmer sending method (HEAD or GET) requests to
+// endpoint, HEAD when method is empty
+func NewCacheWarmer(endpoint, method string, client *http.Client) *CacheWarmer {
+	if method == "" {
+		method = http.MethodHead
+	}
+	return &CacheWarmer{endpoint: endpoint, method: method, client: client}
+}
+
+// RequestURL returns the warmer URL for segmentURL
+func (w *CacheWarmer) RequestURL(segmentURL string) string {
+	escaped := url.QueryEscape(segmentURL)
+	if strings.Contains(w.endpoint, "{url}") {
+		return strings.ReplaceAll(w.endpoint, "{url}", escaped)
+	}
+	sep := "?"
+	if strings.Contains(w.endpoint, "?") {
+		sep = "&"
+	}
+	return w.endpoint + sep + "url=" + escaped
+}
+
+// Warm requests segmentURL through the warmer. A GET body is read to the end
+// so the proxy caches the whole segment.
+func (w *CacheWarmer) Warm(ctx context.Context, segmentURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, warmTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, w.method, w.RequestURL(segmentURL), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", constants.HTTPUserAgent)
+	req.Header.Set("Referer", constants.REFERRER)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return &httpClient.HttpError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// warmSegment sends segmentURL to w, if there is one, without holding up the
+// download
+func warmSegment(w *CacheWarmer, segmentURL string) {
+	if w == nil {
+		return
+	}
+	go func() {
+		if err := w.Warm(context.Background(), segmentURL); err != nil {
+			log.Printf("Cache warmer request for %s failed: %v", segmentURL, err)
+		}
+	}()
+}
@@ -0,0 +1,110 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"m3u8-downloader/pkg/constants"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheWarmer_RequestURL(t *testing.T) {
+	segment := "https://cdn.example.com/1080/media_0001.ts?token=a&b=c"
+	escaped := url.QueryEscape(segment)
+
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"http://cache:8080/warm?u={url}", "http://cache:8080/warm?u=" + escaped},
+		{"http://cache:8080/warm", "http://cache:8080/warm?url=" + escaped},
+		{"http://cache:8080/warm?key=x", "http://cache:8080/warm?key=x&url=" + escaped},
+	}
+
+	for _, tt := range tests {
+		w := NewCacheWarmer(tt.endpoint, "", http.DefaultClient)
+		if got := w.RequestURL(segment); got != tt.want {
+			t.Errorf("RequestURL() with %s = %s, want %s", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestVariantDownloader_WarmsCache(t *testing.T) {
+	cfg := constants.MustGetConfig()
+	oldDelay := cfg.Core.RefreshDelay
+	cfg.Core.RefreshDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.Core.RefreshDelay = oldDelay })
+
+	tempDir, err := os.MkdirTemp("", "warmer_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var mu sync.Mutex
+	var warmed []string
+	var methods []string
+	warmer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		warmed = append(warmed, r.URL.Query().Get("url"))
+		methods = append(methods, r.Method)
+	}))
+	defer warmer.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1080/chunklist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n")
+		fmt.Fprint(w, "#EXTINF:6.0,\nmedia_0001.ts\n#EXTINF:6.0,\nmedia_0002.ts\n#EXTINF:6.0,\nmissing.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/1080/missing.ts", http.NotFound)
+	mux.HandleFunc("/1080/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	opts := DownloadOptions{CacheWarmer: NewCacheWarmer(warmer.URL+"/warm", http.MethodGet, http.DefaultClient)}
+
+	variantURL := server.URL + "/1080/chunklist.m3u8"
+	base, _ := url.Parse(variantURL)
+	variant := &StreamVariant{
+		URL:        variantURL,
+		BaseURL:    base,
+		Resolution: "1080p",
+		OutputDir:  filepath.Join(tempDir, "1080p"),
+	}
+	VariantDownloader(context.Background(), context.Background(), variant, make(chan struct{}, 4), nil, nil, opts)
+
+	// Warming runs in the background after each download
+	want := []string{server.URL + "/1080/media_0001.ts", server.URL + "/1080/media_0002.ts"}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(warmed)
+		mu.Unlock()
+		if n >= len(want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(warmed)
+	if len(warmed) != len(want) || warmed[0] != want[0] || warmed[1] != want[1] {
+		t.Errorf("Expected warmer to receive %v (not the failed segment), got %v", want, warmed)
+	}
+	for _, m := range methods {
+		if m != http.MethodGet {
+			t.Errorf("Expected GET warmer requests, got %s", m)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package media
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webVTTCue is one cue of a WebVTT segment, timed on the MPEG-TS clock
+type webVTTCue struct {
+	start, end time.Duration
+	// settings follow the end time on the timing line, with their leading
+	// space
+	settings string
+	text     string
+}
+
+// MergeWebVTT writes the cues of the WebVTT segment files, in the order
+// given, to w as one WebVTT file. Each segment's X-TIMESTAMP-MAP places its
+// cues on the MPEG-TS clock, and start on that clock becomes time zero, so
+// passing the first PTS of the video stitched from the same segments lines
+// the cues up with it. Cues that are repeated in consecutive segments are
+// written once, and cues that end before start or begin at or after end are
+// dropped, so segments needn't line up with the video's. It returns the
+// number of cues written.
+func MergeWebVTT(w io.Writer, segments []string, start, end time.Duration) (int, error) {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+
+	written := make(map[webVTTCue]bool)
+	count := 0
+	for _, segment := range segments {
+		data, err := os.ReadFile(segment)
+		if err != nil {
+			return count, err
+		}
+		cues, err := parseWebVTT(string(data))
+		if err != nil {
+			return count, fmt.Errorf("%s: %w", segment, err)
+		}
+
+		for _, cue := range cues {
+			if cue.start >= end {
+				continue
+			}
+			cue.start -= start
+			cue.end -= start
+			if cue.end <= 0 {
+				continue
+			}
+			cue.start = max(cue.start, 0)
+			if written[cue] {
+				continue
+			}
+			written[cue] = true
+			fmt.Fprintf(bw, "\n%s --> %s%s\n%s\n", formatVTTTime(cue.start), formatVTTTime(cue.end), cue.settings, cue.text)
+			count++
+		}
+	}
+	return count, bw.Flush()
+}
+
+// parseWebVTT returns the cues of one segment. NOTE, STYLE and REGION blocks
+// and cue identifiers are dropped, since identifiers needn't be unique
+// across segments.
+func parseWebVTT(data string) ([]webVTTCue, error) {
+	data = strings.TrimPrefix(strings.ReplaceAll(data, "\r\n", "\n"), "\ufeff")
+	blocks := strings.Split(data, "\n\n")
+	if !strings.HasPrefix(blocks[0], "WEBVTT") {
+		return nil, errors.New("missing WEBVTT header")
+	}
+
+	var offset time.Duration
+	for _, line := range strings.Split(blocks[0], "\n")[1:] {
+		if value, ok := strings.CutPrefix(line, "X-TIMESTAMP-MAP="); ok {
+			var err error
+			if offset, err = parseTimestampMap(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var cues []webVTTCue
+	for _, block := range blocks[1:] {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if !strings.Contains(lines[0], "-->") {
+			lines = lines[1:] // identifier, or not a cue
+		}
+		if len(lines) == 0 || !strings.Contains(lines[0], "-->") {
+			continue
+		}
+
+		startText, rest, _ := strings.Cut(lines[0], "-->")
+		endText, settings, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		start, err := parseVTTTime(strings.TrimSpace(startText))
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseVTTTime(endText)
+		if err != nil {
+			return nil, err
+		}
+		if settings != "" {
+			settings = " " + settings
+		}
+		cues = append(cues, webVTTCue{
+			start:    start + offset,
+			end:      end + offset,
+			settings: settings,
+			text:     strings.Join(lines[1:], "\n"),
+		})
+	}
+	return cues, nil
+}
+
+// parseTimestampMap returns how far a segment's cue times are behind the
+// MPEG-TS clock, from a header like MPEGTS:900000,LOCAL:00:00:00.000
+func parseTimestampMap(value string) (time.Duration, error) {
+	var mpegts, local time.Duration
+	for _, field := range strings.Split(value, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(field), ":")
+		switch key {
+		case "MPEGTS":
+			ticks, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid X-TIMESTAMP-MAP %q: %w", value, err)
+			}
+			mpegts = time.Duration(ticks) * time.Second / utils.TSClockRate
+		case "LOCAL":
+			var err error
+			if local, err = parseVTTTime(val); err != nil {
+				return 0, fmt.Errorf("invalid X-TIMESTAMP-MAP %q: %w", value, err)
+			}
+		}
+	}
+	return mpegts - local, nil
+}
+
+// parseVTTTime parses a cue timestamp, hh:mm:ss.ttt or mm:ss.ttt
+func parseVTTTime(s string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid WebVTT timestamp %q", s)
+	parts := strings.Split(s, ":")
+	seconds, millis, ok := strings.Cut(parts[len(parts)-1], ".")
+	if len(parts) < 2 || len(parts) > 3 || !ok || len(millis) != 3 {
+		return 0, invalid
+	}
+
+	minutes := 0
+	for _, part := range parts[:len(parts)-1] {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, invalid
+		}
+		minutes = minutes*60 + n
+	}
+	sec, err := strconv.Atoi(seconds)
+	if err != nil || sec < 0 || sec > 59 {
+		return 0, invalid
+	}
+	ms, err := strconv.Atoi(millis)
+	if err != nil || ms < 0 {
+		return 0, invalid
+	}
+	return time.Duration(minutes)*time.Minute + time.Duration(sec)*time.Second + time.Duration(ms)*time.Millisecond, nil
+}
+
+// formatVTTTime formats d as a cue timestamp, hh:mm:ss.ttt
+func formatVTTTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
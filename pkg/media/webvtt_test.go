@@ -0,0 +1,94 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeVTT(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return p
+}
+
+func TestMergeWebVTT(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Segment timestamps are on the MPEG-TS clock: 900000 is 10s, so the
+	// first cue is at 10s of stream time
+	first := writeVTT(t, tempDir, "sub_0001.vtt", "\ufeffWEBVTT\r\n"+
+		"X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\r\n\r\n"+
+		"NOTE a comment\r\n\r\n"+
+		"1\r\n00:00:00.000 --> 00:00:01.500\r\nbefore the video\r\n\r\n"+
+		"cue-2\r\n00:00:01.000 --> 00:00:04.000 align:start line:90%\r\nHello\r\nthere\r\n")
+	// The second segment repeats the cue that spans the boundary
+	second := writeVTT(t, tempDir, "sub_0002.vtt", "WEBVTT\n"+
+		"X-TIMESTAMP-MAP=LOCAL:00:00:00.000,MPEGTS:900000\n\n"+
+		"00:01.000 --> 00:04.000 align:start line:90%\nHello\nthere\n\n"+
+		"00:00:06.000 --> 00:00:08.250\nSecond\n\n"+
+		"00:00:10.000 --> 00:00:11.000\nafter the video\n")
+
+	var out strings.Builder
+	cues, err := MergeWebVTT(&out, []string{first, second}, 12*time.Second, 20*time.Second)
+	if err != nil {
+		t.Fatalf("MergeWebVTT() failed: %v", err)
+	}
+
+	expected := "WEBVTT\n" +
+		"\n00:00:00.000 --> 00:00:02.000 align:start line:90%\nHello\nthere\n" +
+		"\n00:00:04.000 --> 00:00:06.250\nSecond\n"
+	if out.String() != expected {
+		t.Errorf("Expected merged file:\n%s\ngot:\n%s", expected, out.String())
+	}
+	if cues != 2 {
+		t.Errorf("Expected 2 cues, got %d", cues)
+	}
+}
+
+func TestMergeWebVTT_NotWebVTT(t *testing.T) {
+	tempDir := t.TempDir()
+	bad := writeVTT(t, tempDir, "sub_0001.vtt", "<html>403 Forbidden</html>")
+
+	var out strings.Builder
+	if _, err := MergeWebVTT(&out, []string{bad}, 0, time.Hour); err == nil {
+		t.Error("Expected an error for a segment without a WEBVTT header")
+	}
+}
+
+func TestParseVTTTime(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"00:00:01.500", 1500 * time.Millisecond, false},
+		{"01:02:03.004", time.Hour + 2*time.Minute + 3*time.Second + 4*time.Millisecond, false},
+		{"02:03.250", 2*time.Minute + 3250*time.Millisecond, false},
+		{"1.500", 0, true},
+		{"00:00:01", 0, true},
+		{"00:xx:01.000", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseVTTTime(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVTTTime(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("parseVTTTime(%q) = %v, expected %v", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestFormatVTTTime(t *testing.T) {
+	d := time.Hour + 2*time.Minute + 3*time.Second + 4*time.Millisecond
+	if got := formatVTTTime(d); got != "01:02:03.004" {
+		t.Errorf("Expected 01:02:03.004, got %s", got)
+	}
+}
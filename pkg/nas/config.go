@@ -9,4 +9,14 @@ type NASConfig struct {
 	Timeout    time.Duration
 	RetryLimit int
 	VerifySize bool
+	// MaxConnections caps simultaneous copy operations; 0 means unlimited
+	MaxConnections int
+	// ListingCacheTTL caches directory listings for this long; 0 disables
+	ListingCacheTTL time.Duration
+	// PathStyle picks the separator for NAS paths (utils.PathStyle*); empty
+	// means auto
+	PathStyle string
+	// MountPoint is where a network share in Path is mounted outside
+	// Windows; Path is then reached under it
+	MountPoint string
 }
@@ -0,0 +1,36 @@
+//go:build !unix
+
+package nas
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// netCommand runs "net use"; tests replace it with a stub
+var netCommand = "net"
+
+// connect maps the share with "net use"
+func (nt *NASService) connect(ctx context.Context, networkPath string) error {
+	cmd := exec.CommandContext(ctx, netCommand, netUseArgs(networkPath, nt.Config.Username, nt.Config.Password)...)
+	return runConnectCommand(cmd)
+}
+
+// netUseArgs builds the "net use" arguments for either spelling of the share
+func netUseArgs(networkPath, username, password string) []string {
+	share := strings.ReplaceAll(networkPath, "/", `\`)
+	if username != "" && password != "" {
+		return []string{"use", share, "/user:" + username, password, "/persistent:no"}
+	}
+	return []string{"use", share, "/persistent:no"}
+}
+
+func (nt *NASService) disconnectCommand() (*exec.Cmd, string) {
+	networkPath := nt.ExtractNetworkPath(nt.Config.Path)
+	if networkPath == "" {
+		return nil, ""
+	}
+	share := strings.ReplaceAll(networkPath, "/", `\`)
+	return exec.Command(netCommand, "use", share, "/delete"), networkPath
+}
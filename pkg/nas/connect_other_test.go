@@ -0,0 +1,30 @@
+//go:build !unix
+
+package nas
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNetUseArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		share    string
+		username string
+		password string
+		want     []string
+	}{
+		{"unc with credentials", `\\server\share`, "flo", "secret", []string{"use", `\\server\share`, "/user:flo", "secret", "/persistent:no"}},
+		{"forward slashes", "//server/share", "", "", []string{"use", `\\server\share`, "/persistent:no"}},
+		{"username only", `\\server\share`, "flo", "", []string{"use", `\\server\share`, "/persistent:no"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := netUseArgs(tt.share, tt.username, tt.password); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+//go:build unix
+
+package nas
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// mountCommand and umountCommand mount shares outside Windows; tests replace
+// them with stubs
+var (
+	mountCommand  = "mount"
+	umountCommand = "umount"
+)
+
+// connect mounts the share on Config.MountPoint, unless something is already
+// mounted there, and points Config.Path at the same directory under it
+func (nt *NASService) connect(ctx context.Context, networkPath string) error {
+	mountPoint := nt.Config.MountPoint
+	if mountPoint == "" {
+		return fmt.Errorf("%s is a network share: set NAS_MOUNT_POINT to mount it, or mount it yourself and set NAS_OUTPUT_PATH to the mounted directory", networkPath)
+	}
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	mounted, err := isMountPoint(mountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to check mount point %s: %w", mountPoint, err)
+	}
+	if mounted {
+		log.Printf("%s is already mounted, using it for %s", mountPoint, networkPath)
+	} else {
+		cmd := mountCmd(ctx, runtime.GOOS, networkPath, mountPoint, nt.Config.Username, nt.Config.Password)
+		if err := runConnectCommand(cmd); err != nil {
+			return err
+		}
+		nt.mounted = true
+	}
+
+	rest := strings.ReplaceAll(nt.Config.Path[len(networkPath):], `\`, "/")
+	nt.Config.Path = filepath.Join(mountPoint, filepath.FromSlash(rest))
+	return nil
+}
+
+// mountCmd builds the command mounting networkPath on mountPoint: CIFS on
+// Linux, with the password passed in the environment so it doesn't show up
+// in the process list, and SMB on macOS, which only takes credentials in the
+// share URL
+func mountCmd(ctx context.Context, goos, networkPath, mountPoint, username, password string) *exec.Cmd {
+	share := strings.ReplaceAll(networkPath, `\`, "/")
+
+	if goos == "darwin" {
+		if username != "" {
+			user := url.User(username)
+			if password != "" {
+				user = url.UserPassword(username, password)
+			}
+			share = "//" + user.String() + "@" + share[2:]
+		}
+		return exec.CommandContext(ctx, mountCommand, "-t", "smbfs", share, mountPoint)
+	}
+
+	options := "guest"
+	if username != "" {
+		options = "username=" + username
+	}
+	cmd := exec.CommandContext(ctx, mountCommand, "-t", "cifs", share, mountPoint, "-o", options)
+	if password != "" {
+		cmd.Env = append(os.Environ(), "PASSWD="+password)
+	}
+	return cmd
+}
+
+// disconnectCommand unmounts Config.MountPoint if connect mounted it. A share
+// that was already mounted is left alone.
+func (nt *NASService) disconnectCommand() (*exec.Cmd, string) {
+	if !nt.mounted {
+		return nil, ""
+	}
+	return exec.Command(umountCommand, nt.Config.MountPoint), nt.Config.MountPoint
+}
+
+// isMountPoint reports whether dir is on a different device than its parent
+func isMountPoint(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	// Not filepath.Join, which would skip the parent of a symlinked dir
+	parent, err := os.Stat(dir + string(filepath.Separator) + "..")
+	if err != nil {
+		return false, err
+	}
+	return info.Sys().(*syscall.Stat_t).Dev != parent.Sys().(*syscall.Stat_t).Dev, nil
+}
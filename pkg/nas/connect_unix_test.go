@@ -0,0 +1,172 @@
+//go:build unix
+
+package nas
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubMount replaces the mount and umount commands with scripts that log
+// their arguments to the returned file and then run script
+func stubMount(t *testing.T, script string) string {
+	t.Helper()
+	tempDir := t.TempDir()
+	logFile := filepath.Join(tempDir, "calls")
+	for _, name := range []string{"mount", "umount"} {
+		stub := filepath.Join(tempDir, name)
+		body := "#!/bin/sh\necho " + name + " \"$@\" >> " + logFile + "\n" + script + "\n"
+		if err := os.WriteFile(stub, []byte(body), 0755); err != nil {
+			t.Fatalf("Failed to write stub %s command: %v", name, err)
+		}
+	}
+	mountCommand = filepath.Join(tempDir, "mount")
+	umountCommand = filepath.Join(tempDir, "umount")
+	t.Cleanup(func() {
+		mountCommand = "mount"
+		umountCommand = "umount"
+	})
+	return logFile
+}
+
+func TestNASService_EstablishConnectionTimesOut(t *testing.T) {
+	// Hangs like mounting an unreachable share
+	stubMount(t, "exec sleep 10")
+
+	nt := &NASService{Config: NASConfig{
+		Path:       `\\server\share\events`,
+		Timeout:    100 * time.Millisecond,
+		MountPoint: t.TempDir(),
+	}}
+
+	start := time.Now()
+	err := nt.EstablishConnection()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected EstablishConnection to give up near the timeout, took %v", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), `timed out after 100ms establishing network connection to \\server\share`) {
+		t.Errorf("Expected a clear timeout message, got %v", err)
+	}
+}
+
+func TestNASService_MountsShare(t *testing.T) {
+	calls := stubMount(t, "exit 0")
+	mountPoint := t.TempDir()
+
+	nt := &NASService{Config: NASConfig{
+		Path:       "//server/share/events/finals",
+		Username:   "flo",
+		Password:   "secret",
+		MountPoint: mountPoint,
+	}}
+	if err := nt.EstablishConnection(); err != nil {
+		t.Fatalf("EstablishConnection() failed: %v", err)
+	}
+	if want := filepath.Join(mountPoint, "events", "finals"); nt.Config.Path != want {
+		t.Errorf("Expected the NAS path moved under the mount point %q, got %q", want, nt.Config.Path)
+	}
+
+	if err := nt.Disconnect(); err != nil {
+		t.Fatalf("Disconnect() failed: %v", err)
+	}
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("Failed to read stub calls: %v", err)
+	}
+	if got := string(data); !strings.HasPrefix(got, "mount -t ") || !strings.Contains(got, "umount "+mountPoint+"\n") {
+		t.Errorf("Expected a mount then an unmount of %s, got %q", mountPoint, got)
+	}
+}
+
+func TestNASService_MountPointRequired(t *testing.T) {
+	calls := stubMount(t, "exit 0")
+
+	nt := &NASService{Config: NASConfig{Path: "//server/share/events"}}
+	err := nt.EstablishConnection()
+	if err == nil || !strings.Contains(err.Error(), "NAS_MOUNT_POINT") {
+		t.Errorf("Expected an error naming NAS_MOUNT_POINT, got %v", err)
+	}
+	if _, err := os.Stat(calls); !os.IsNotExist(err) {
+		t.Errorf("Expected no mount command without a mount point")
+	}
+}
+
+func TestMountCmd(t *testing.T) {
+	tests := []struct {
+		name     string
+		goos     string
+		share    string
+		username string
+		password string
+		wantArgs []string
+		wantEnv  string
+	}{
+		{
+			name:     "linux with credentials",
+			goos:     "linux",
+			share:    `\\server\share`,
+			username: "flo",
+			password: "p@ss,word",
+			wantArgs: []string{"-t", "cifs", "//server/share", "/mnt/nas", "-o", "username=flo"},
+			wantEnv:  "PASSWD=p@ss,word",
+		},
+		{
+			name:     "linux guest",
+			goos:     "linux",
+			share:    "//server/share",
+			wantArgs: []string{"-t", "cifs", "//server/share", "/mnt/nas", "-o", "guest"},
+		},
+		{
+			name:     "macos with credentials",
+			goos:     "darwin",
+			share:    "//server/share",
+			username: "flo",
+			password: "p@ss",
+			wantArgs: []string{"-t", "smbfs", "//flo:p%40ss@server/share", "/mnt/nas"},
+		},
+		{
+			name:     "macos guest",
+			goos:     "darwin",
+			share:    `\\server\share`,
+			wantArgs: []string{"-t", "smbfs", "//server/share", "/mnt/nas"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := mountCmd(context.Background(), tt.goos, tt.share, "/mnt/nas", tt.username, tt.password)
+			if got := cmd.Args[1:]; !reflect.DeepEqual(got, tt.wantArgs) {
+				t.Errorf("Expected args %q, got %q", tt.wantArgs, got)
+			}
+			for _, arg := range cmd.Args {
+				if tt.password != "" && strings.Contains(arg, tt.password) && tt.goos != "darwin" {
+					t.Errorf("Expected the password kept off the command line, got %q", cmd.Args)
+				}
+			}
+			if tt.wantEnv == "" && cmd.Env != nil {
+				t.Errorf("Expected the inherited environment, got %d variables", len(cmd.Env))
+			}
+			if tt.wantEnv != "" && !containsString(cmd.Env, tt.wantEnv) {
+				t.Errorf("Expected %s in the command's environment", tt.wantEnv)
+			}
+		})
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package nas
+
+import "syscall"
+
+// diskFullErrnos are the errors returned when the destination volume is full
+var diskFullErrnos = []syscall.Errno{syscall.ENOSPC}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package nas
+
+import "syscall"
+
+// diskFullErrnos are the Windows errors for a full volume: ERROR_HANDLE_DISK_FULL
+// and ERROR_DISK_FULL. The syscall package doesn't name them.
+var diskFullErrnos = []syscall.Errno{39, 112, syscall.ENOSPC}
@@ -2,24 +2,48 @@ package nas
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"m3u8-downloader/pkg/utils"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 type NASService struct {
 	Config    NASConfig
 	connected bool
+	connSem   chan struct{}
+	// mounted is set when EstablishConnection mounted Config.MountPoint, so
+	// Disconnect only unmounts what it mounted
+	mounted bool
+
+	listingCache map[string]cachedListing
+	cacheMu      sync.Mutex
+}
+
+type cachedListing struct {
+	entries []os.DirEntry
+	expires time.Time
 }
 
 func NewNASService(config NASConfig) *NASService {
 	nt := &NASService{
 		Config: config,
 	}
+	if config.MaxConnections > 0 {
+		nt.connSem = make(chan struct{}, config.MaxConnections)
+	}
+	if config.ListingCacheTTL > 0 {
+		nt.listingCache = make(map[string]cachedListing)
+	}
 
 	// Establish network connection with credentials before accessing the path
 	if err := nt.EstablishConnection(); err != nil {
@@ -33,7 +57,32 @@ func NewNASService(config NASConfig) *NASService {
 	return nt
 }
 
+// acquireConnection blocks until a NAS connection slot is free or ctx is done
+func (nt *NASService) acquireConnection(ctx context.Context) error {
+	if nt.connSem == nil {
+		return nil
+	}
+	select {
+	case nt.connSem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (nt *NASService) releaseConnection() {
+	if nt.connSem != nil {
+		<-nt.connSem
+	}
+}
+
 func (nt *NASService) CopyFile(ctx context.Context, srcPath, destPath string) error {
+	if err := nt.acquireConnection(ctx); err != nil {
+		return err
+	}
+	defer nt.releaseConnection()
+	defer nt.invalidateListing(parentDir(destPath))
+
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return fmt.Errorf("Failed to open source file: %w", err)
@@ -82,13 +131,68 @@ func (nt *NASService) VerifyTransfer(srcPath, destPath string) error {
 	return nil
 }
 
+// IsDiskFull reports whether err was caused by the NAS running out of space.
+// Retrying such a failure is pointless until space is freed.
+func IsDiskFull(err error) bool {
+	for _, errno := range diskFullErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrChecksumMismatch is returned by VerifyChecksum when the copy's contents
+// differ from the source
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// VerifyChecksum compares the SHA-256 of the source and its copy. It reads
+// both files in full, so it is much slower than VerifyTransfer.
+func (nt *NASService) VerifyChecksum(srcPath, destPath string) error {
+	srcSum, err := fileChecksum(srcPath)
+	if err != nil {
+		return fmt.Errorf("Failed to checksum source file: %w", err)
+	}
+	destSum, err := fileChecksum(destPath)
+	if err != nil {
+		return fmt.Errorf("Failed to checksum destination file: %w", err)
+	}
+	if srcSum != destSum {
+		return fmt.Errorf("%w: source=%s, dest=%s", ErrChecksumMismatch, srcSum, destSum)
+	}
+	return nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (nt *NASService) EnsureDirectoryExists(path string) error {
+	defer nt.invalidateListing(parentDir(path))
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return fmt.Errorf("Failed to create directory: %w", err)
 	}
 	return nil
 }
 
+// defaultConnectTimeout bounds connecting to the share when Config.Timeout is
+// unset
+const defaultConnectTimeout = 30 * time.Second
+
+// EstablishConnection connects the network share in Config.Path, if it is
+// one: with "net use" on Windows, and elsewhere by mounting it on
+// Config.MountPoint and pointing Config.Path there. It gives up after
+// Config.Timeout so a hung share can't block startup.
 func (nt *NASService) EstablishConnection() error {
 	networkPath := nt.ExtractNetworkPath(nt.Config.Path)
 	if networkPath == "" {
@@ -97,38 +201,83 @@ func (nt *NASService) EstablishConnection() error {
 
 	log.Printf("Establishing network connection to %s with user %s", networkPath, nt.Config.Username)
 
-	var cmd *exec.Cmd
-	if nt.Config.Username != "" && nt.Config.Password != "" {
-		cmd = exec.Command("net", "use", networkPath, "/user:"+nt.Config.Username, nt.Config.Password, "/persistent:no")
-	} else {
-		cmd = exec.Command("net", "use", networkPath, "/persistent:no")
+	timeout := nt.Config.Timeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	output, err := cmd.CombinedOutput()
+	err := nt.connect(ctx, networkPath)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v establishing network connection to %s: %w", timeout, networkPath, ctx.Err())
+	}
 	if err != nil {
-		return fmt.Errorf("failed to establish network connection: %w\nOutput: %s", err, string(output))
+		return err
 	}
 
 	log.Printf("Network connection established successfully")
 	return nil
 }
 
+// runConnectCommand runs the command that connects the share
+func runConnectCommand(cmd *exec.Cmd) error {
+	// Don't wait on output pipes held open by anything the command started
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to establish network connection: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// ExtractNetworkPath returns the share a network path is on, \\server\share
+// for a UNC path or //server/share for the same path written with forward
+// slashes, or "" for a local path
 func (nt *NASService) ExtractNetworkPath(fullPath string) string {
-	// Extract \\server\share from paths like \\server\share\folder\subfolder
-	if !strings.HasPrefix(fullPath, "\\\\") {
-		return "" // Not a UNC path
+	var sep string
+	switch {
+	case strings.HasPrefix(fullPath, `\\`):
+		sep = `\`
+	case strings.HasPrefix(fullPath, "//"):
+		sep = "/"
+	default:
+		return "" // Not a network path
 	}
 
-	parts := strings.Split(fullPath[2:], "\\") // Remove leading \\
-	if len(parts) < 2 {
-		return "" // Invalid UNC path
+	parts := strings.Split(fullPath[2:], sep) // Remove leading separators
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "" // No server and share, e.g. ///data on Linux
+	}
+
+	return sep + sep + parts[0] + sep + parts[1]
+}
+
+// JoinPath builds a path under the NAS root with the separator chosen by
+// Config.PathStyle, whatever separators the elements use
+func (nt *NASService) JoinPath(elements ...string) string {
+	style := nt.Config.PathStyle
+	if style == "" {
+		style = utils.PathStyleAuto
 	}
+	return utils.JoinStyledPath(style, append([]string{nt.Config.Path}, elements...)...)
+}
 
-	return "\\\\" + parts[0] + "\\" + parts[1]
+// parentDir is filepath.Dir for NAS paths, which may use either separator
+func parentDir(path string) string {
+	i := strings.LastIndexAny(path, `/\`)
+	if i < 0 {
+		return "."
+	}
+	if i == 0 {
+		return path[:1]
+	}
+	return path[:i]
 }
 
 func (nt *NASService) TestConnection() error {
-	testFile := filepath.Join(nt.Config.Path, ".connection_test")
+	testFile := nt.JoinPath(".connection_test")
 
 	f, err := os.Create(testFile)
 	if err != nil {
@@ -147,37 +296,70 @@ func (nt *NASService) IsConnected() bool {
 	return nt.connected
 }
 
-// Disconnect removes the network connection
+// Disconnect removes the network connection, or unmounts the share if
+// EstablishConnection mounted it
 func (nt *NASService) Disconnect() error {
-	networkPath := nt.ExtractNetworkPath(nt.Config.Path)
-	if networkPath == "" {
-		return nil // Local path, nothing to disconnect
+	cmd, target := nt.disconnectCommand()
+	if cmd == nil {
+		nt.connected = false
+		return nil // Local path, or mounted by someone else
 	}
 
-	cmd := exec.Command("net", "use", networkPath, "/delete")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("Warning: failed to disconnect from %s: %v\nOutput: %s", networkPath, err, string(output))
+		log.Printf("Warning: failed to disconnect from %s: %v\nOutput: %s", target, err, string(output))
 		// Don't return error since this is cleanup
 	} else {
-		log.Printf("Disconnected from network path: %s", networkPath)
+		log.Printf("Disconnected from network path: %s", target)
+		nt.mounted = false
 	}
 
 	nt.connected = false
 	return nil
 }
 
+// statNAS stats a NAS path; tests replace it to simulate share errors
+var statNAS = os.Stat
+
+// existsRetryPolicy retries a FileExists stat that failed for a reason other
+// than the file being absent, such as an SMB share briefly dropping, so a
+// blip doesn't make callers re-transfer a file that is already there.
+// Permission errors won't clear up by waiting and are returned at once.
+var existsRetryPolicy = utils.RetryPolicy{
+	Attempts:     3,
+	InitialDelay: 250 * time.Millisecond,
+	Multiplier:   2,
+	Jitter:       0.2,
+	Retryable: func(err error) bool {
+		return !errors.Is(err, os.ErrPermission)
+	},
+}
+
 // FileExists checks if a file already exists on the NAS and optionally verifies size
 func (nt *NASService) FileExists(destinationPath string, expectedSize int64) (bool, error) {
-	fullDestPath := filepath.Join(nt.Config.Path, destinationPath)
+	fullDestPath := nt.JoinPath(destinationPath)
 
-	destInfo, err := os.Stat(fullDestPath)
-	if err != nil {
+	var destInfo os.FileInfo
+	err := utils.Retry(context.Background(), existsRetryPolicy, func(attempt int) error {
+		info, err := statNAS(fullDestPath)
 		if os.IsNotExist(err) {
-			return false, nil // File doesn't exist, no error
+			return nil
 		}
+		if err != nil {
+			if attempt < existsRetryPolicy.Attempts && existsRetryPolicy.Retryable(err) {
+				log.Printf("Stat of NAS file %s failed (attempt %d), retrying: %v", fullDestPath, attempt, err)
+			}
+			return err
+		}
+		destInfo = info
+		return nil
+	})
+	if err != nil {
 		return false, fmt.Errorf("failed to stat NAS file: %w", err)
 	}
+	if destInfo == nil {
+		return false, nil // File doesn't exist, no error
+	}
 
 	// File exists, check size if expected size is provided
 	if expectedSize > 0 && destInfo.Size() != expectedSize {
@@ -189,9 +371,107 @@ func (nt *NASService) FileExists(destinationPath string, expectedSize int64) (bo
 	return true, nil
 }
 
+// ReadDir lists a NAS directory, serving repeated calls from a short-lived
+// cache when ListingCacheTTL is set. Safe to call on a nil service, in which
+// case it reads the directory directly.
+func (nt *NASService) ReadDir(dir string) ([]os.DirEntry, error) {
+	if nt == nil || nt.listingCache == nil {
+		return os.ReadDir(dir)
+	}
+
+	key := filepath.Clean(dir)
+	nt.cacheMu.Lock()
+	cached, ok := nt.listingCache[key]
+	nt.cacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.entries, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	nt.cacheMu.Lock()
+	nt.listingCache[key] = cachedListing{entries: entries, expires: time.Now().Add(nt.Config.ListingCacheTTL)}
+	nt.cacheMu.Unlock()
+	return entries, nil
+}
+
+// invalidateListing drops the cached listing for dir after a write into it
+func (nt *NASService) invalidateListing(dir string) {
+	if nt == nil || nt.listingCache == nil {
+		return
+	}
+	nt.cacheMu.Lock()
+	delete(nt.listingCache, filepath.Clean(dir))
+	nt.cacheMu.Unlock()
+}
+
+// minBatchListing is the number of queries in one directory at which
+// FileExistsBatch lists the directory instead of stat-ing each file
+const minBatchListing = 8
+
+// FileExistsBatch answers FileExists for many NAS-relative paths at once,
+// keyed by path with the expected size as value (0 skips the size check).
+// Directories with enough queries are listed once and answered from the
+// listing; small groups fall back to a stat per file.
+func (nt *NASService) FileExistsBatch(files map[string]int64) (map[string]bool, error) {
+	result := make(map[string]bool, len(files))
+
+	byDir := make(map[string][]string)
+	for destPath := range files {
+		dir := filepath.Dir(destPath)
+		byDir[dir] = append(byDir[dir], destPath)
+	}
+
+	for dir, paths := range byDir {
+		if len(paths) < minBatchListing {
+			for _, destPath := range paths {
+				exists, err := nt.FileExists(destPath, files[destPath])
+				if err != nil {
+					return nil, err
+				}
+				result[destPath] = exists
+			}
+			continue
+		}
+
+		entries, err := nt.ReadDir(nt.JoinPath(dir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list NAS directory: %w", err)
+		}
+
+		sizes := make(map[string]int64, len(entries))
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue // removed since listing
+			}
+			sizes[entry.Name()] = info.Size()
+		}
+
+		for _, destPath := range paths {
+			size, ok := sizes[filepath.Base(destPath)]
+			expected := files[destPath]
+			if ok && expected > 0 && size != expected {
+				log.Printf("NAS file size mismatch for %s: expected=%d, actual=%d",
+					nt.JoinPath(destPath), expected, size)
+				ok = false
+			}
+			result[destPath] = ok
+		}
+	}
+
+	return result, nil
+}
+
 // GetFileSize returns the size of a file on the NAS
 func (nt *NASService) GetFileSize(destinationPath string) (int64, error) {
-	fullDestPath := filepath.Join(nt.Config.Path, destinationPath)
+	fullDestPath := nt.JoinPath(destinationPath)
 
 	destInfo, err := os.Stat(fullDestPath)
 	if err != nil {
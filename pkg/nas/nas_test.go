@@ -0,0 +1,408 @@
+package nas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestNASService(t *testing.T, config NASConfig) *NASService {
+	t.Helper()
+	tempDir, err := os.MkdirTemp("", "nas_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	config.Path = tempDir
+	return NewNASService(config)
+}
+
+func TestNASService_MaxConnectionsEnforced(t *testing.T) {
+	const maxConnections = 2
+	const workers = 20
+
+	nt := newTestNASService(t, NASConfig{MaxConnections: maxConnections})
+
+	var active, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := nt.acquireConnection(context.Background()); err != nil {
+				t.Errorf("acquireConnection() failed: %v", err)
+				return
+			}
+			defer nt.releaseConnection()
+
+			current := atomic.AddInt32(&active, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+		}()
+	}
+	wg.Wait()
+
+	if peak > maxConnections {
+		t.Errorf("Expected at most %d concurrent connections, observed %d", maxConnections, peak)
+	}
+	if peak == 0 {
+		t.Error("Expected at least one connection to be acquired")
+	}
+}
+
+func TestNASService_AcquireRespectsContext(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{MaxConnections: 1})
+
+	if err := nt.acquireConnection(context.Background()); err != nil {
+		t.Fatalf("acquireConnection() failed: %v", err)
+	}
+	defer nt.releaseConnection()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := nt.acquireConnection(ctx); err == nil {
+		nt.releaseConnection()
+		t.Error("Expected acquireConnection() to fail when all slots are held and context expires")
+	}
+}
+
+func TestNASService_CopyFileUnderConnectionCap(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{MaxConnections: 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			src := filepath.Join(nt.Config.Path, fmt.Sprintf("src_%d.ts", i))
+			dest := filepath.Join(nt.Config.Path, fmt.Sprintf("dest_%d.ts", i))
+			if err := os.WriteFile(src, []byte("segment data"), 0644); err != nil {
+				t.Errorf("Failed to write source file: %v", err)
+				return
+			}
+			if err := nt.CopyFile(context.Background(), src, dest); err != nil {
+				t.Errorf("CopyFile() failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(nt.connSem) != 0 {
+		t.Errorf("Expected all connection slots to be released, %d still held", len(nt.connSem))
+	}
+}
+
+func TestNASService_FileExistsBatchMatchesPerFile(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{})
+
+	// A large directory (listed) and a small one (stat per file)
+	query := make(map[string]int64)
+	for i := 0; i < 20; i++ {
+		rel := filepath.Join("event", "1080p", fmt.Sprintf("media_%04d.ts", i))
+		if i%3 != 0 {
+			full := filepath.Join(nt.Config.Path, rel)
+			os.MkdirAll(filepath.Dir(full), 0755)
+			if err := os.WriteFile(full, make([]byte, 100), 0644); err != nil {
+				t.Fatalf("Failed to write NAS file: %v", err)
+			}
+		}
+		size := int64(100)
+		if i%5 == 0 {
+			size = 99 // size mismatch
+		}
+		if i == 7 {
+			size = 0 // no size check
+		}
+		query[rel] = size
+	}
+	small := filepath.Join("event", "720p", "media_0001.ts")
+	os.MkdirAll(filepath.Join(nt.Config.Path, "event", "720p"), 0755)
+	os.WriteFile(filepath.Join(nt.Config.Path, small), make([]byte, 50), 0644)
+	query[small] = 50
+	query[filepath.Join("event", "720p", "missing.ts")] = 50
+	query[filepath.Join("other-event", "480p", "media_0001.ts")] = 10
+
+	batch, err := nt.FileExistsBatch(query)
+	if err != nil {
+		t.Fatalf("FileExistsBatch() failed: %v", err)
+	}
+
+	if len(batch) != len(query) {
+		t.Errorf("Expected %d results, got %d", len(query), len(batch))
+	}
+	for path, size := range query {
+		single, err := nt.FileExists(path, size)
+		if err != nil {
+			t.Fatalf("FileExists(%s) failed: %v", path, err)
+		}
+		if batch[path] != single {
+			t.Errorf("Mismatch for %s (size %d): batch=%v, per-file=%v", path, size, batch[path], single)
+		}
+	}
+}
+
+func TestNASService_ReadDirCachesListing(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{ListingCacheTTL: time.Minute})
+	dir := filepath.Join(nt.Config.Path, "event", "1080p")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "media_0001.ts"), []byte("data"), 0644)
+
+	first, err := nt.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+
+	// Written behind the service's back, so a cache hit won't see it
+	os.WriteFile(filepath.Join(dir, "media_0002.ts"), []byte("data"), 0644)
+
+	second, err := nt.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+	if len(first) != 1 || len(second) != 1 {
+		t.Errorf("Expected cached listing of 1 entry, got %d then %d", len(first), len(second))
+	}
+}
+
+func TestNASService_CopyFileInvalidatesListing(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{ListingCacheTTL: time.Minute})
+	dir := filepath.Join(nt.Config.Path, "event", "1080p")
+	os.MkdirAll(dir, 0755)
+
+	if entries, err := nt.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("Expected empty listing, got %d entries (err: %v)", len(entries), err)
+	}
+
+	src := filepath.Join(nt.Config.Path, "src.ts")
+	os.WriteFile(src, []byte("segment data"), 0644)
+	if err := nt.CopyFile(context.Background(), src, filepath.Join(dir, "media_0001.ts")); err != nil {
+		t.Fatalf("CopyFile() failed: %v", err)
+	}
+
+	entries, err := nt.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected listing to include copied file, got %d entries", len(entries))
+	}
+}
+
+func TestNASService_ReadDirWithoutCache(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{})
+	os.WriteFile(filepath.Join(nt.Config.Path, "a.ts"), []byte("data"), 0644)
+	nt.ReadDir(nt.Config.Path)
+	os.WriteFile(filepath.Join(nt.Config.Path, "b.ts"), []byte("data"), 0644)
+
+	entries, err := nt.ReadDir(nt.Config.Path)
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected uncached listing to see both files, got %d", len(entries))
+	}
+}
+
+func TestNASService_VerifyChecksum(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{})
+	src := filepath.Join(nt.Config.Path, "src.ts")
+	same := filepath.Join(nt.Config.Path, "same.ts")
+	corrupt := filepath.Join(nt.Config.Path, "corrupt.ts")
+	os.WriteFile(src, []byte("segment data"), 0644)
+	os.WriteFile(same, []byte("segment data"), 0644)
+	// Same size, different contents: passes VerifyTransfer but not this
+	os.WriteFile(corrupt, []byte("segment dat4"), 0644)
+
+	if err := nt.VerifyChecksum(src, same); err != nil {
+		t.Errorf("Expected identical files to verify, got %v", err)
+	}
+	if err := nt.VerifyTransfer(src, corrupt); err != nil {
+		t.Fatalf("Expected size check to pass for same-size files, got %v", err)
+	}
+	if err := nt.VerifyChecksum(src, corrupt); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestNASService_JoinPathNormalizesSeparators(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{PathStyle: utils.PathStylePosix})
+	dir := filepath.Join(nt.Config.Path, "event", "1080p")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "media_0001.ts"), []byte("segment"), 0644)
+
+	// A destination recorded on a Windows host still resolves on the NAS
+	exists, err := nt.FileExists(`event\1080p\media_0001.ts`, 7)
+	if err != nil {
+		t.Fatalf("FileExists() failed: %v", err)
+	}
+	if !exists {
+		t.Error("Expected a backslash destination path to find the file")
+	}
+
+	windows := &NASService{Config: NASConfig{Path: `\\nas\share`, PathStyle: utils.PathStyleWindows}}
+	if got, want := windows.JoinPath("event/1080p/media_0001.ts"), `\\nas\share\event\1080p\media_0001.ts`; got != want {
+		t.Errorf("JoinPath() = %q, want %q", got, want)
+	}
+	if got, want := parentDir(windows.JoinPath("event", "media_0001.ts")), `\\nas\share\event`; got != want {
+		t.Errorf("parentDir() = %q, want %q", got, want)
+	}
+}
+
+func TestIsDiskFull(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"errno", syscall.ENOSPC, true},
+		{"path error", &os.PathError{Op: "write", Path: "/nas/seg.ts", Err: syscall.ENOSPC}, true},
+		{"wrapped", fmt.Errorf("Failed to copy file: %w", &os.PathError{Op: "write", Path: "/nas/seg.ts", Err: syscall.ENOSPC}), true},
+		{"other errno", &os.PathError{Op: "open", Path: "/nas/seg.ts", Err: syscall.EACCES}, false},
+		{"plain error", errors.New("no space left on device"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsDiskFull(tt.err); got != tt.want {
+				t.Errorf("IsDiskFull(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// stubStat makes the first `failures` stats fail with err before
+// falling through to os.Stat, and counts every call
+func stubStat(t *testing.T, failures int, err error) *int32 {
+	t.Helper()
+	var calls int32
+	statNAS = func(name string) (os.FileInfo, error) {
+		if int(atomic.AddInt32(&calls, 1)) <= failures {
+			return nil, err
+		}
+		return os.Stat(name)
+	}
+	oldPolicy := existsRetryPolicy
+	existsRetryPolicy.InitialDelay = time.Millisecond
+	t.Cleanup(func() {
+		statNAS = os.Stat
+		existsRetryPolicy = oldPolicy
+	})
+	return &calls
+}
+
+func TestNASService_FileExistsRetriesTransientErrors(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{})
+	if err := os.WriteFile(nt.JoinPath("media_0001.ts"), make([]byte, 100), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	transient := &os.PathError{Op: "stat", Path: "media_0001.ts", Err: syscall.EIO}
+
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantFound bool
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"succeeds after one transient error", 1, transient, true, false, 2},
+		{"succeeds on the last attempt", 2, transient, true, false, 3},
+		{"gives up after every attempt fails", 3, transient, false, true, 3},
+		{"permission error is not retried", 1, &os.PathError{Op: "stat", Path: "media_0001.ts", Err: os.ErrPermission}, false, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := stubStat(t, tt.failures, tt.err)
+
+			found, err := nt.FileExists("media_0001.ts", 100)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if found != tt.wantFound {
+				t.Errorf("Expected found=%v, got %v", tt.wantFound, found)
+			}
+			if got := atomic.LoadInt32(calls); got != tt.wantCalls {
+				t.Errorf("Expected %d stat calls, got %d", tt.wantCalls, got)
+			}
+		})
+	}
+}
+
+func TestNASService_FileExistsMissingIsNotRetried(t *testing.T) {
+	nt := newTestNASService(t, NASConfig{})
+	calls := stubStat(t, 0, nil)
+
+	found, err := nt.FileExists("missing.ts", 0)
+	if err != nil || found {
+		t.Errorf("Expected a missing file to report false without error, got %v, %v", found, err)
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("Expected 1 stat call for a missing file, got %d", got)
+	}
+}
+
+func TestNASService_ExtractNetworkPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"unc", `\\server\share\events\2024`, `\\server\share`},
+		{"unc share root", `\\server\share`, `\\server\share`},
+		{"unc trailing separator", `\\server\share\`, `\\server\share`},
+		{"unc without share", `\\server`, ""},
+		{"posix", "//server/share/events/2024", "//server/share"},
+		{"posix share root", "//server/share", "//server/share"},
+		{"posix without share", "//server", ""},
+		{"posix extra slash", "///data/events", ""},
+		{"absolute posix", "/mnt/nas/events", ""},
+		{"drive letter", `Z:\events`, ""},
+		{"relative", "events", ""},
+	}
+
+	nt := &NASService{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nt.ExtractNetworkPath(tt.path); got != tt.want {
+				t.Errorf("ExtractNetworkPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNASService_LocalPathNeedsNoConnection(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "nas_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	nt := &NASService{Config: NASConfig{Path: tempDir}}
+	if err := nt.EstablishConnection(); err != nil {
+		t.Errorf("Expected no connection for a local path, got %v", err)
+	}
+	if nt.Config.Path != tempDir {
+		t.Errorf("Expected the local path unchanged, got %q", nt.Config.Path)
+	}
+	if err := nt.Disconnect(); err != nil {
+		t.Errorf("Expected nothing to disconnect, got %v", err)
+	}
+}
@@ -1,7 +1,31 @@
 package processing
 
+import "time"
+
 type SegmentInfo struct {
-	Name       string
-	SeqNo      int
-	Resolution string
+	Name          string
+	SeqNo         int
+	Discontinuity int // encoder run, from the _dN tag of the name
+	Resolution    string
+	ModTime       time.Time
+	Size          int64
+}
+
+// SegmentKey identifies the same segment across resolutions. Sequence numbers
+// restart after a discontinuity, so the sequence number alone does not.
+type SegmentKey struct {
+	Discontinuity int
+	SeqNo         int
+}
+
+func (s SegmentInfo) Key() SegmentKey {
+	return SegmentKey{Discontinuity: s.Discontinuity, SeqNo: s.SeqNo}
+}
+
+// Less orders keys by discontinuity, then sequence number
+func (k SegmentKey) Less(other SegmentKey) bool {
+	if k.Discontinuity != other.Discontinuity {
+		return k.Discontinuity < other.Discontinuity
+	}
+	return k.SeqNo < other.SeqNo
 }
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/media"
 	"m3u8-downloader/pkg/nas"
 	"m3u8-downloader/pkg/utils"
 	"os"
@@ -17,12 +19,16 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type ProcessingService struct {
 	config    *config.Config
 	eventName string
 	nas       *nas.NASService
+	eventPath string          // NAS event directory, once GetResolutions has found it
+	stagePath string          // local copy of the selected segments, when staged
+	subtitles []subtitleTrack // muxed into the merged video, when Processing.MuxSubtitles is on
 }
 
 func NewProcessingService(eventName string, cfg *config.Config) (*ProcessingService, error) {
@@ -31,12 +37,15 @@ func NewProcessingService(eventName string, cfg *config.Config) (*ProcessingServ
 	}
 
 	nasConfig := nas.NASConfig{
-		Path:       cfg.NAS.OutputPath,
-		Username:   cfg.NAS.Username,
-		Password:   cfg.NAS.Password,
-		Timeout:    cfg.NAS.Timeout,
-		RetryLimit: cfg.NAS.RetryLimit,
-		VerifySize: true,
+		Path:            cfg.NAS.OutputPath,
+		Username:        cfg.NAS.Username,
+		Password:        cfg.NAS.Password,
+		Timeout:         cfg.NAS.Timeout,
+		RetryLimit:      cfg.NAS.RetryLimit,
+		VerifySize:      cfg.Transfer.VerifySize,
+		MaxConnections:  cfg.NAS.MaxConnections,
+		ListingCacheTTL: cfg.NAS.ListingCacheTTL,
+		MountPoint:      cfg.NAS.MountPoint,
 	}
 
 	nasService := nas.NewNASService(nasConfig)
@@ -45,6 +54,14 @@ func NewProcessingService(eventName string, cfg *config.Config) (*ProcessingServ
 		return nil, fmt.Errorf("failed to connect to NAS: %w", err)
 	}
 
+	// Outside Windows a network share is reached under its mount point, so
+	// the NAS paths processing builds from the config have to start there
+	if nasService.Config.Path != cfg.NAS.OutputPath {
+		mounted := *cfg
+		mounted.NAS.OutputPath = nasService.Config.Path
+		cfg = &mounted
+	}
+
 	return &ProcessingService{
 		config:    cfg,
 		eventName: eventName,
@@ -54,7 +71,7 @@ func NewProcessingService(eventName string, cfg *config.Config) (*ProcessingServ
 
 func (ps *ProcessingService) GetEventDirs() ([]string, error) {
 	if ps.eventName == "" {
-		sourcePath := ps.config.NAS.OutputPath
+		sourcePath := ps.config.GetNASEventsRoot()
 		dirs, err := os.ReadDir(sourcePath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read directory %s: %w", sourcePath, err)
@@ -106,6 +123,13 @@ func (ps *ProcessingService) Start(ctx context.Context) error {
 		}
 	}
 
+	started := time.Now()
+	lock, err := utils.AcquireLock(ps.config.GetEventLockPath(ps.eventName))
+	if err != nil {
+		return fmt.Errorf("cannot process event %q: %w", ps.eventName, err)
+	}
+	defer lock.Release()
+
 	//Get all present resolutions
 	dirs, err := ps.GetResolutions()
 	if err != nil {
@@ -125,15 +149,47 @@ func (ps *ProcessingService) Start(ctx context.Context) error {
 		close(ch)
 	}()
 
-	segments, err := ps.AggregateSegmentInfo(ch)
+	// Every resolution's own segments, for the per-resolution videos
+	var byResolution map[string]map[SegmentKey]SegmentInfo
+	aggCh := (<-chan SegmentInfo)(ch)
+	if ps.config.Processing.PerResolution {
+		byResolution = make(map[string]map[SegmentKey]SegmentInfo, len(dirs))
+		tee := make(chan SegmentInfo, 100)
+		go func() {
+			defer close(tee)
+			for segment := range ch {
+				if byResolution[segment.Resolution] == nil {
+					byResolution[segment.Resolution] = make(map[SegmentKey]SegmentInfo)
+				}
+				byResolution[segment.Resolution][segment.Key()] = segment
+				tee <- segment
+			}
+		}()
+		aggCh = tee
+	}
+
+	segments, err := ps.AggregateSegmentInfo(aggCh)
 	if err != nil {
 		return fmt.Errorf("Failed to aggregate segment info: %w", err)
 	}
+	// FFmpeg fails cryptically on an empty concat list
+	if len(segments) == 0 {
+		return fmt.Errorf("no segments found in the resolution directories of event %q (%s)", ps.eventName, strings.Join(dirs, ", "))
+	}
+
+	if ps.config.Paths.StageDir != "" {
+		stagePath, err := ps.StageSegments(ctx, segments)
+		if err != nil {
+			return fmt.Errorf("failed to stage segments: %w", err)
+		}
+		defer ps.removeStaged(stagePath)
+	}
 
 	aggFile, err := ps.WriteConcatFile(segments)
 	if err != nil {
 		return fmt.Errorf("Failed to write concat file: %w", err)
 	}
+	defer ps.removeConcatFile(aggFile)
 
 	// Feed info to ffmpeg to stitch files together
 	outPath := ps.config.GetProcessOutputPath(ps.eventName)
@@ -141,17 +197,119 @@ func (ps *ProcessingService) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
+	subtitles, err := ps.WriteSubtitles(segments, outPath)
+	if err != nil {
+		log.Printf("Failed to write subtitles: %v", err)
+	}
+	if ps.config.Processing.MuxSubtitles {
+		ps.subtitles = subtitles
+	}
+
 	concatErr := ps.RunFFmpeg(aggFile, outPath)
 	if concatErr != nil {
 		return concatErr
 	}
 
+	var inputBytes int64
+	for _, segment := range segments {
+		inputBytes += segment.Size
+	}
+	videoPath := utils.SafeJoin(outPath, ps.eventName+".mp4")
+	if err := ValidateOutput(videoPath, inputBytes, ps.config.Processing.MinOutputRatio); err != nil {
+		return err
+	}
+
+	var resolutionFiles, resolutionVideos map[string]string
+	if ps.config.Processing.PerResolution {
+		resolutionFiles, err = ps.WriteConcatFilesPerResolution(byResolution)
+		if err != nil {
+			return fmt.Errorf("Failed to write per-resolution concat files: %w", err)
+		}
+		for _, concatFile := range resolutionFiles {
+			defer ps.removeConcatFile(concatFile)
+		}
+		resolutionVideos, err = ps.runPerResolution(resolutionFiles, byResolution, outPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ps.config.Core.WriteReport {
+		report := ps.BuildReport(segments, started, time.Now())
+		if !ps.config.Processing.RemoveConcatFile {
+			report.Outputs["concat"] = aggFile
+			for resolution, concatFile := range resolutionFiles {
+				report.Outputs["concat_"+resolution] = concatFile
+			}
+		}
+		report.Outputs["video"] = videoPath
+		for resolution, video := range resolutionVideos {
+			report.Outputs["video_"+resolution] = video
+		}
+		for _, track := range subtitles {
+			report.Outputs[track.Label] = track.Path
+		}
+		reportPath := utils.SafeJoin(outPath, ps.eventName+"_report.json")
+		if err := report.Write(reportPath); err != nil {
+			log.Printf("Failed to write processing report: %v", err)
+		} else {
+			log.Printf("Processing report written to %s", reportPath)
+		}
+	}
+
 	return nil
 }
 
+// BuildReport summarizes the segments chosen for the output: how many came
+// from each resolution, their size, and any sequence numbers missing from
+// the stitched video, per discontinuity.
+func (ps *ProcessingService) BuildReport(segmentMap map[SegmentKey]SegmentInfo, started, finished time.Time) *media.CaptureReport {
+	report := media.NewCaptureReport(ps.eventName, ps.nasEventPath(), started, finished)
+
+	byResolution := make(map[string]*media.VariantReport)
+	seqs := make(map[int][]uint64)
+	for _, segment := range segmentMap {
+		v, ok := byResolution[segment.Resolution]
+		if !ok {
+			v = &media.VariantReport{Resolution: segment.Resolution}
+			byResolution[segment.Resolution] = v
+		}
+		v.Segments++
+		v.Bytes += segment.Size
+		seqs[segment.Discontinuity] = append(seqs[segment.Discontinuity], uint64(segment.SeqNo))
+	}
+
+	resolutions := make([]string, 0, len(byResolution))
+	for resolution := range byResolution {
+		resolutions = append(resolutions, resolution)
+	}
+	sort.Strings(resolutions)
+	for _, resolution := range resolutions {
+		report.AddVariant(*byResolution[resolution])
+	}
+
+	discontinuities := make([]int, 0, len(seqs))
+	for discontinuity := range seqs {
+		discontinuities = append(discontinuities, discontinuity)
+	}
+	sort.Ints(discontinuities)
+	for _, discontinuity := range discontinuities {
+		report.Gaps = append(report.Gaps, media.FindGaps(uint64(discontinuity), seqs[discontinuity])...)
+	}
+	return report
+}
+
+// singleQualityDir is where the downloader puts segments when the URL was a
+// media playlist rather than a master, so no resolution is known
+const singleQualityDir = "unknown"
+
+// GetResolutions lists the resolution directories of the event. A
+// single-quality capture, which only has the "unknown" directory, is
+// processed from that directory.
 func (ps *ProcessingService) GetResolutions() ([]string, error) {
-	eventPath := ps.config.GetNASEventPath(ps.eventName)
-	dirs, err := os.ReadDir(eventPath)
+	eventPath := ps.nasEventPath()
+	ps.eventPath = eventPath
+	dirs, err := ps.nas.ReadDir(eventPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read source directory %s: %w", eventPath, err)
 	}
@@ -159,93 +317,312 @@ func (ps *ProcessingService) GetResolutions() ([]string, error) {
 	re := regexp.MustCompile(`^\d+p$`)
 
 	var resolutions []string
+	singleQuality := false
 	for _, dir := range dirs {
-		if dir.IsDir() && re.MatchString(dir.Name()) {
+		if !dir.IsDir() {
+			continue
+		}
+		if re.MatchString(dir.Name()) {
 			resolutions = append(resolutions, dir.Name())
+		} else if dir.Name() == singleQualityDir {
+			singleQuality = true
 		}
 	}
 
+	if len(resolutions) == 0 && singleQuality {
+		log.Printf("Single-quality capture (media playlist URL), processing segments from %q", singleQualityDir)
+		return []string{singleQualityDir}, nil
+	}
+	if len(resolutions) == 0 {
+		return nil, fmt.Errorf("no resolution directories (e.g. 1080p) found for event %q in %s", ps.eventName, eventPath)
+	}
+
 	return resolutions, nil
 }
 
-func (ps *ProcessingService) ParseResolutionDirectory(resolution string, ch chan<- SegmentInfo, wg *sync.WaitGroup) {
-	defer wg.Done()
+// nasEventPath is the event's directory on the NAS. When NAS.PathTemplate
+// includes the date, the most recent capture of the event is used.
+func (ps *ProcessingService) nasEventPath() string {
+	if ps.eventPath != "" {
+		return ps.eventPath
+	}
+	if !strings.Contains(ps.config.NAS.PathTemplate, config.NASTemplateDate) {
+		return ps.config.GetNASEventPath(ps.eventName)
+	}
 
-	resolutionPath := utils.SafeJoin(ps.config.GetNASEventPath(ps.eventName), resolution)
-	files, err := os.ReadDir(resolutionPath)
+	var dirs []string
+	matches, err := filepath.Glob(ps.config.GetNASEventGlob(ps.eventName))
 	if err != nil {
-		log.Printf("Failed to read resolution directory %s: %v", resolutionPath, err)
-		return
+		log.Printf("Failed to search for dated captures of %s: %v", ps.eventName, err)
+	}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+	sort.Strings(dirs)
+	if len(dirs) == 0 {
+		return ps.config.GetNASEventPath(ps.eventName)
+	}
+	if len(dirs) > 1 {
+		log.Printf("Found %d dated captures of %s, processing the latest: %s", len(dirs), ps.eventName, dirs[len(dirs)-1])
 	}
+	return dirs[len(dirs)-1]
+}
+
+// dirReadBatch is how many entries ParseResolutionDirectory reads from a
+// resolution directory at a time
+var dirReadBatch = 1000
 
-	for _, file := range files {
-		if !file.IsDir() {
-			if !strings.HasSuffix(strings.ToLower(file.Name()), ".ts") {
+// ParseResolutionDirectory sends a SegmentInfo for every finished segment in
+// the resolution's directory. The directory is read in batches of
+// dirReadBatch and each batch is sent before the next is read, so a huge
+// event doesn't hold a whole listing per resolution in memory.
+func (ps *ProcessingService) ParseResolutionDirectory(resolution string, ch chan<- SegmentInfo, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	resolutionPath := utils.SafeJoin(ps.nasEventPath(), resolution)
+	err := readDirBatches(resolutionPath, dirReadBatch, func(files []os.DirEntry) {
+		for _, file := range files {
+			if file.IsDir() || !utils.IsSegmentFile(file.Name()) {
 				continue
 			}
-			no, err := strconv.Atoi(file.Name()[6:10])
+			no, discontinuity, err := media.ParseSegmentName(file.Name())
 			if err != nil {
 				log.Printf("Failed to parse segment number: %v", err)
 				continue
 			}
+			var modTime time.Time
+			var size int64
+			if info, err := file.Info(); err == nil {
+				modTime = info.ModTime()
+				size = info.Size()
+			}
 			ch <- SegmentInfo{
-				Name:       file.Name(),
-				SeqNo:      no,
-				Resolution: resolution,
+				Name:          file.Name(),
+				SeqNo:         no,
+				Discontinuity: discontinuity,
+				Resolution:    resolution,
+				ModTime:       modTime,
+				Size:          size,
 			}
 		}
+	})
+	if err != nil {
+		log.Printf("Failed to read resolution directory %s: %v", resolutionPath, err)
 	}
 }
 
-func (ps *ProcessingService) AggregateSegmentInfo(ch <-chan SegmentInfo) (map[int]SegmentInfo, error) {
-	segmentMap := make(map[int]SegmentInfo)
+// readDirBatches calls fn with successive batches of at most n entries of
+// dir, in directory order, until the directory is exhausted
+func readDirBatches(dir string, n int, fn func([]os.DirEntry)) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	rank := map[string]int{
-		"1080p": 1,
-		"720p":  2,
-		"540p":  3,
-		"480p":  4,
-		"450p":  5,
-		"360p":  6,
-		"270p":  7,
-		"240p":  8,
+	for {
+		entries, err := f.ReadDir(n)
+		if len(entries) > 0 {
+			fn(entries)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (ps *ProcessingService) AggregateSegmentInfo(ch <-chan SegmentInfo) (map[SegmentKey]SegmentInfo, error) {
+	var segmentMap map[SegmentKey]SegmentInfo
+
+	if ps.config != nil && len(ps.config.Processing.ResolutionOrder) > 0 {
+		log.Printf("Merging resolutions in preference order: %s", strings.Join(ps.config.Processing.ResolutionOrder, ", "))
 	}
 
+	var primary string
+	if ps.config != nil && ps.config.Processing.AggregateShards > 1 {
+		segmentMap, primary = ps.collectSharded(ch, ps.config.Processing.AggregateShards)
+	} else {
+		segmentMap, primary = ps.collectSegments(ch)
+	}
+
+	// Every sequence the best resolution has was chosen from it above, so
+	// anything else fills a gap in it
+	fillGaps := ps.config == nil || ps.config.Processing.FillGaps
+	filled := make(map[string]int)
+	for key, segment := range segmentMap {
+		if segment.Resolution == primary {
+			continue
+		}
+		if !fillGaps {
+			delete(segmentMap, key)
+			continue
+		}
+		filled[segment.Resolution]++
+	}
+	for resolution, count := range filled {
+		log.Printf("Filled %d segments missing from %s with %s", count, primary, resolution)
+	}
+
+	return segmentMap, nil
+}
+
+// collectSegments keeps the preferred segment for each sequence number and
+// discontinuity in ch and returns them with the most preferred resolution seen
+func (ps *ProcessingService) collectSegments(ch <-chan SegmentInfo) (map[SegmentKey]SegmentInfo, string) {
+	segmentMap := make(map[SegmentKey]SegmentInfo)
+	primary := ""
 	for segment := range ch {
 		fmt.Printf("Received segment %s in resolution %s \n", segment.Name, segment.Resolution)
-		current, exists := segmentMap[segment.SeqNo]
-		if !exists || rank[segment.Resolution] < rank[current.Resolution] {
-			segmentMap[segment.SeqNo] = segment
+		current, exists := segmentMap[segment.Key()]
+		if !exists || ps.prefers(segment.Resolution, current.Resolution) {
+			segmentMap[segment.Key()] = segment
+		}
+		if primary == "" || ps.prefers(segment.Resolution, primary) {
+			primary = segment.Resolution
 		}
 	}
+	return segmentMap, primary
+}
 
-	return segmentMap, nil
+// collectSharded is collectSegments split across shards goroutines. Each
+// sequence number always goes to the same shard, in the order received, so
+// the shards' maps are disjoint and merging them gives the serial result.
+func (ps *ProcessingService) collectSharded(ch <-chan SegmentInfo, shards int) (map[SegmentKey]SegmentInfo, string) {
+	inputs := make([]chan SegmentInfo, shards)
+	maps := make([]map[SegmentKey]SegmentInfo, shards)
+	primaries := make([]string, shards)
+
+	var wg sync.WaitGroup
+	for i := range inputs {
+		inputs[i] = make(chan SegmentInfo, 100)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			maps[i], primaries[i] = ps.collectSegments(inputs[i])
+		}()
+	}
+
+	for segment := range ch {
+		inputs[segment.SeqNo%shards] <- segment
+	}
+	for _, input := range inputs {
+		close(input)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, m := range maps {
+		total += len(m)
+	}
+	segmentMap := make(map[SegmentKey]SegmentInfo, total)
+	primary := ""
+	for i, m := range maps {
+		for key, segment := range m {
+			segmentMap[key] = segment
+		}
+		if primaries[i] != "" && (primary == "" || ps.prefers(primaries[i], primary)) {
+			primary = primaries[i]
+		}
+	}
+	return segmentMap, primary
 }
 
-func (ps *ProcessingService) WriteConcatFile(segmentMap map[int]SegmentInfo) (string, error) {
-	concatPath := ps.config.GetProcessOutputPath(ps.eventName)
+// prefers reports whether a segment from resolution a should be used over one
+// from b. Resolutions in Processing.ResolutionOrder win in list order over any
+// that aren't listed; otherwise the taller resolution wins, by the height in
+// the label, so any ladder ranks correctly and labels without one such as
+// "unknown" rank lowest.
+func (ps *ProcessingService) prefers(a, b string) bool {
+	if ps.config != nil {
+		ia, ib := -1, -1
+		for i, resolution := range ps.config.Processing.ResolutionOrder {
+			if resolution == a && ia < 0 {
+				ia = i
+			}
+			if resolution == b && ib < 0 {
+				ib = i
+			}
+		}
+		if ia >= 0 || ib >= 0 {
+			return ia >= 0 && (ib < 0 || ia < ib)
+		}
+	}
+	return media.ResolutionHeight(a) > media.ResolutionHeight(b)
+}
 
-	if err := utils.EnsureDir(concatPath); err != nil {
-		return "", fmt.Errorf("failed to create directories for concat path: %w", err)
+// WriteConcatFile writes the FFmpeg concat list for segmentMap and returns
+// its path. It goes in Paths.ConcatDir when set, otherwise next to the video,
+// or under a unique name in the system temp directory when
+// Processing.RemoveConcatFile is on.
+func (ps *ProcessingService) WriteConcatFile(segmentMap map[SegmentKey]SegmentInfo) (string, error) {
+	root := ps.nasEventPath()
+	if ps.stagePath != "" {
+		root = ps.stagePath
 	}
+	return ps.writeConcatList(ps.eventName, root, segmentMap)
+}
 
-	concatFilePath := utils.SafeJoin(concatPath, ps.eventName+".txt")
-	f, err := os.Create(concatFilePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create concat file: %w", err)
+// WriteConcatFilesPerResolution writes a concat list of every segment of each
+// resolution, named <event>_<resolution>.txt and placed like the aggregate
+// list, and returns their paths by resolution. The lists always read the
+// NAS, since only the aggregate's segments are staged.
+func (ps *ProcessingService) WriteConcatFilesPerResolution(byResolution map[string]map[SegmentKey]SegmentInfo) (map[string]string, error) {
+	files := make(map[string]string, len(byResolution))
+	for resolution, segmentMap := range byResolution {
+		path, err := ps.writeConcatList(ps.eventName+"_"+resolution, ps.nasEventPath(), segmentMap)
+		if err != nil {
+			return files, err
+		}
+		files[resolution] = path
 	}
-	defer f.Close()
+	return files, nil
+}
 
-	// Sort keys to preserve order
-	keys := make([]int, 0, len(segmentMap))
-	for k := range segmentMap {
-		keys = append(keys, k)
+// runPerResolution runs FFmpeg on each per-resolution concat list, writing
+// <event>_<resolution>.mp4 to outPath, and returns the videos by resolution
+func (ps *ProcessingService) runPerResolution(concatFiles map[string]string, byResolution map[string]map[SegmentKey]SegmentInfo, outPath string) (map[string]string, error) {
+	resolutions := make([]string, 0, len(concatFiles))
+	for resolution := range concatFiles {
+		resolutions = append(resolutions, resolution)
 	}
-	sort.Ints(keys)
+	sort.Slice(resolutions, func(i, j int) bool { return ps.prefers(resolutions[i], resolutions[j]) })
 
-	for _, seq := range keys {
-		segment := segmentMap[seq]
-		filePath := utils.SafeJoin(ps.config.GetNASEventPath(ps.eventName), segment.Resolution, segment.Name)
+	videos := make(map[string]string, len(resolutions))
+	for _, resolution := range resolutions {
+		video := utils.SafeJoin(outPath, ps.eventName+"_"+resolution+".mp4")
+		if err := ps.runFFmpeg(concatFiles[resolution], video, nil); err != nil {
+			return videos, fmt.Errorf("%s: %w", resolution, err)
+		}
+
+		var inputBytes int64
+		for _, segment := range byResolution[resolution] {
+			inputBytes += segment.Size
+		}
+		if err := ValidateOutput(video, inputBytes, ps.config.Processing.MinOutputRatio); err != nil {
+			return videos, err
+		}
+		videos[resolution] = video
+	}
+	return videos, nil
+}
+
+// writeConcatList writes the concat list name.txt for segmentMap, reading
+// each segment from root
+func (ps *ProcessingService) writeConcatList(name string, root string, segmentMap map[SegmentKey]SegmentInfo) (string, error) {
+	f, err := ps.createConcatFile(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	concatFilePath := f.Name()
+
+	for _, segment := range ps.orderSegments(segmentMap) {
+		filePath := utils.SafeJoin(root, segment.Resolution, segment.Name)
 		line := fmt.Sprintf("file '%s'\n", filePath)
 		if _, err := f.WriteString(line); err != nil {
 			return "", fmt.Errorf("failed to write to concat file: %w", err)
@@ -255,12 +632,138 @@ func (ps *ProcessingService) WriteConcatFile(segmentMap map[int]SegmentInfo) (st
 	return concatFilePath, nil
 }
 
+// StageSegments copies the segments in segmentMap from the NAS into a new
+// directory under Paths.StageDir, laid out like the event directory, so
+// FFmpeg reads them from local storage. WriteConcatFile then lists the
+// staged copies. It returns the staging directory, which is removed again if
+// any copy fails.
+func (ps *ProcessingService) StageSegments(ctx context.Context, segmentMap map[SegmentKey]SegmentInfo) (string, error) {
+	stagePath, err := os.MkdirTemp(ps.config.Paths.StageDir, ps.eventName+"_*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	log.Printf("Staging %d segments in %s", len(segmentMap), stagePath)
+	started := time.Now()
+	for _, segment := range segmentMap {
+		dir := utils.SafeJoin(stagePath, segment.Resolution)
+		if err := utils.EnsureDir(dir); err != nil {
+			os.RemoveAll(stagePath)
+			return "", err
+		}
+		src := utils.SafeJoin(ps.nasEventPath(), segment.Resolution, segment.Name)
+		if err := ps.nas.CopyFile(ctx, src, utils.SafeJoin(dir, segment.Name)); err != nil {
+			os.RemoveAll(stagePath)
+			return "", fmt.Errorf("failed to stage %s/%s: %w", segment.Resolution, segment.Name, err)
+		}
+	}
+	log.Printf("Staged %d segments in %v", len(segmentMap), time.Since(started).Round(time.Millisecond))
+
+	ps.stagePath = stagePath
+	return stagePath, nil
+}
+
+// removeStaged deletes the staged segment copies once FFmpeg is done
+func (ps *ProcessingService) removeStaged(stagePath string) {
+	ps.stagePath = ""
+	if err := os.RemoveAll(stagePath); err != nil {
+		log.Printf("Failed to remove staged segments %s: %v", stagePath, err)
+	}
+}
+
+func (ps *ProcessingService) createConcatFile(name string) (*os.File, error) {
+	concatPath := ps.config.Paths.ConcatDir
+	if concatPath == "" {
+		if ps.config.Processing.RemoveConcatFile {
+			f, err := os.CreateTemp("", name+"_*.txt")
+			if err != nil {
+				return nil, fmt.Errorf("failed to create concat file: %w", err)
+			}
+			return f, nil
+		}
+		concatPath = ps.config.GetProcessOutputPath(ps.eventName)
+	}
+
+	if err := utils.EnsureDir(concatPath); err != nil {
+		return nil, fmt.Errorf("failed to create directories for concat path: %w", err)
+	}
+
+	f, err := os.Create(utils.SafeJoin(concatPath, name+".txt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create concat file: %w", err)
+	}
+	return f, nil
+}
+
+// removeConcatFile deletes the concat list when Processing.RemoveConcatFile
+// is on
+func (ps *ProcessingService) removeConcatFile(path string) {
+	if !ps.config.Processing.RemoveConcatFile {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove concat file %s: %v", path, err)
+	}
+}
+
+// orderSegments sorts segments for the concat file. Sequence order within
+// each discontinuity is right for a capture whose sequence numbers were
+// tagged when they reset; modification time handles VODs whose sequence
+// numbers reset at a discontinuity without a tag.
+func (ps *ProcessingService) orderSegments(segmentMap map[SegmentKey]SegmentInfo) []SegmentInfo {
+	segments := make([]SegmentInfo, 0, len(segmentMap))
+	for _, segment := range segmentMap {
+		segments = append(segments, segment)
+	}
+
+	if ps.config.Processing.ConcatSort == config.ConcatSortModTime {
+		sort.Slice(segments, func(i, j int) bool {
+			if !segments[i].ModTime.Equal(segments[j].ModTime) {
+				return segments[i].ModTime.Before(segments[j].ModTime)
+			}
+			return segments[i].Key().Less(segments[j].Key())
+		})
+	} else {
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].Key().Less(segments[j].Key())
+		})
+	}
+
+	return segments
+}
+
 func (ps *ProcessingService) getFFmpegPath() (string, error) {
+	return FindFFmpeg(ps.config.Processing.FFmpegPath)
+}
+
+// ffmpegInstallHint suggests how to install FFmpeg on goos
+func ffmpegInstallHint(goos string) string {
+	switch goos {
+	case "windows":
+		return "install it with 'choco install ffmpeg' or 'winget install ffmpeg', or put ffmpeg.exe in a bin folder next to this program"
+	case "darwin":
+		return "install it with 'brew install ffmpeg'"
+	default:
+		return "install it with your package manager, e.g. 'sudo apt install ffmpeg' or 'sudo dnf install ffmpeg'"
+	}
+}
+
+// FindFFmpeg resolves the FFmpeg executable from the configured path, PATH,
+// or a bin directory next to the executable or working directory. When none
+// has it, the error lists where it looked and how to install FFmpeg.
+func FindFFmpeg(configuredPath string) (string, error) {
+	var searched []string
+
 	// First try the configured path
-	configuredPath := ps.config.Processing.FFmpegPath
 	if configuredPath != "" {
-		// Check if it's just the command name or a full path
 		if filepath.IsAbs(configuredPath) {
+			searched = append(searched, configuredPath)
+		} else {
+			searched = append(searched, fmt.Sprintf("%q in PATH", configuredPath))
+		}
+
+		// Check if it's just the command name or a full path
+		if filepath.IsAbs(configuredPath) && utils.PathExists(configuredPath) {
 			return configuredPath, nil
 		}
 
@@ -290,6 +793,7 @@ func (ps *ProcessingService) getFFmpegPath() (string, error) {
 	if utils.PathExists(ffmpeg) {
 		return ffmpeg, nil
 	}
+	searched = append(searched, ffmpeg)
 
 	// Try current working directory
 	cwd, err := os.Getwd()
@@ -304,14 +808,99 @@ func (ps *ProcessingService) getFFmpegPath() (string, error) {
 	if utils.PathExists(ffmpeg) {
 		return ffmpeg, nil
 	}
+	if ffmpeg != searched[len(searched)-1] {
+		searched = append(searched, ffmpeg)
+	}
+
+	return "", fmt.Errorf("FFmpeg not found. Please install FFmpeg or set FFMPEG_PATH environment variable. Searched: %s. To fix, %s",
+		strings.Join(searched, ", "), ffmpegInstallHint(runtime.GOOS))
+}
+
+// reservedFFmpegFlags are set by buildFFmpegArgs for concat and stream copy
+// and can't be overridden by extra arguments
+var reservedFFmpegFlags = []string{"-f", "-safe", "-i", "-c", "-codec"}
+
+// ValidateFFmpegExtraArgs rejects extra arguments that would replace the
+// concat demuxer, input, or stream copy flags
+func ValidateFFmpegExtraArgs(extra []string) error {
+	for _, arg := range extra {
+		for _, flag := range reservedFFmpegFlags {
+			// Also catches per-stream forms like -c:v
+			if arg == flag || strings.HasPrefix(arg, flag+":") {
+				return fmt.Errorf("ffmpeg extra argument %q conflicts with the concat flags", arg)
+			}
+		}
+	}
+	return nil
+}
+
+// buildFFmpegArgs returns the concat command line with extra inserted before
+// the output path. fastStart adds -movflags +faststart, which makes FFmpeg
+// rewrite the finished file to move the index to the front, so it costs a
+// second full pass over the output even with stream copy. Each of subtitles
+// is added as a further input and converted to a mov_text track, the only
+// text subtitles MP4 holds.
+func buildFFmpegArgs(inputPath, outputFile string, fastStart bool, extra []string, subtitles []subtitleTrack) ([]string, error) {
+	if err := ValidateFFmpegExtraArgs(extra); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-f", "concat", "-safe", "0", "-i", inputPath}
+	if len(subtitles) == 0 {
+		args = append(args, "-c", "copy")
+	} else {
+		for _, track := range subtitles {
+			args = append(args, "-i", track.Path)
+		}
+		args = append(args, "-map", "0")
+		for i := range subtitles {
+			args = append(args, "-map", strconv.Itoa(i+1))
+		}
+		args = append(args, "-c", "copy", "-c:s", "mov_text")
+		for i, track := range subtitles {
+			// Only ISO 639 codes are valid track languages
+			if n := len(track.Language); n == 2 || n == 3 {
+				args = append(args, fmt.Sprintf("-metadata:s:s:%d", i), "language="+track.Language)
+			}
+		}
+	}
+	if fastStart {
+		args = append(args, "-movflags", "+faststart")
+	}
+	args = append(args, extra...)
+	return append(args, outputFile), nil
+}
 
-	return "", fmt.Errorf("FFmpeg not found. Please install FFmpeg or set FFMPEG_PATH environment variable")
+// ValidateOutput checks that FFmpeg actually wrote the video: it fails if
+// outputFile is missing, empty, or smaller than minRatio of inputBytes, which
+// catches runs that exit cleanly without muxing anything. Stream copy only
+// changes the container, so a healthy MP4 is close to the input size.
+func ValidateOutput(outputFile string, inputBytes int64, minRatio float64) error {
+	info, err := os.Stat(outputFile)
+	if err != nil {
+		return fmt.Errorf("ffmpeg output not found: %w", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("ffmpeg output %s is empty", outputFile)
+	}
+
+	minSize := int64(float64(inputBytes) * minRatio)
+	if info.Size() < minSize {
+		return fmt.Errorf("ffmpeg output %s is %d bytes, expected at least %d (%.0f%% of %d input bytes)",
+			outputFile, info.Size(), minSize, minRatio*100, inputBytes)
+	}
+	return nil
 }
 
 func (ps *ProcessingService) RunFFmpeg(inputPath, outputPath string) error {
+	return ps.runFFmpeg(inputPath, utils.SafeJoin(outputPath, ps.eventName+".mp4"), ps.subtitles)
+}
+
+// runFFmpeg concatenates the segments listed in inputPath into fileOutPath,
+// with subtitles as text tracks
+func (ps *ProcessingService) runFFmpeg(inputPath, fileOutPath string, subtitles []subtitleTrack) error {
 	fmt.Println("Running ffmpeg...")
 
-	fileOutPath := utils.SafeJoin(outputPath, ps.eventName+".mp4")
 	fmt.Println("Input path:", inputPath)
 	fmt.Println("Output path:", fileOutPath)
 
@@ -320,7 +909,12 @@ func (ps *ProcessingService) RunFFmpeg(inputPath, outputPath string) error {
 		return fmt.Errorf("failed to find FFmpeg: %w", err)
 	}
 
-	cmd := exec.Command(path, "-f", "concat", "-safe", "0", "-i", inputPath, "-c", "copy", fileOutPath)
+	args, err := buildFFmpegArgs(inputPath, fileOutPath, ps.config.Processing.FastStart, ps.config.Processing.FFmpegExtraArgs, subtitles)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
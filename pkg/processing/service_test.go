@@ -1,11 +1,16 @@
 package processing
 
 import (
+	"context"
+	"fmt"
 	"m3u8-downloader/pkg/config"
+	"m3u8-downloader/pkg/nas"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -182,11 +187,361 @@ func TestProcessingService_GetResolutions(t *testing.T) {
 	}
 }
 
+func TestProcessingService_ParseResolutionDirectory_SkipsJunk(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	eventName := "test-event"
+
+	resolutionPath := filepath.Join(cfg.NAS.OutputPath, eventName, "1080p")
+	os.MkdirAll(resolutionPath, 0755)
+	files := []string{
+		"media_0001.ts",
+		"media_0002.ts",
+		"media_0003.ts.part", // partial download
+		".media_0004.ts",     // hidden
+		"~media_0005.ts",     // editor temp
+		".seen.json",
+		"x.ts", // too short to carry a sequence number
+	}
+	for _, name := range files {
+		os.WriteFile(filepath.Join(resolutionPath, name), []byte("test"), 0644)
+	}
+
+	ps := &ProcessingService{
+		config:    cfg,
+		eventName: eventName,
+	}
+
+	ch := make(chan SegmentInfo, len(files))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ps.ParseResolutionDirectory("1080p", ch, &wg)
+	close(ch)
+
+	var names []string
+	for seg := range ch {
+		names = append(names, seg.Name)
+	}
+	if len(names) != 2 {
+		t.Errorf("Expected only the 2 finished segments, got %v", names)
+	}
+}
+
+func TestProcessingService_ParseResolutionDirectory_ReadsInBatches(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	eventName := "test-event"
+
+	const segments = 2500
+	resolutionPath := filepath.Join(cfg.NAS.OutputPath, eventName, "1080p")
+	os.MkdirAll(resolutionPath, 0755)
+	for i := 1; i <= segments; i++ {
+		os.WriteFile(filepath.Join(resolutionPath, fmt.Sprintf("media_%05d.ts", i)), []byte("test"), 0644)
+	}
+
+	oldBatch := dirReadBatch
+	dirReadBatch = 100
+	defer func() { dirReadBatch = oldBatch }()
+
+	largest, total := 0, 0
+	if err := readDirBatches(resolutionPath, dirReadBatch, func(entries []os.DirEntry) {
+		if len(entries) > largest {
+			largest = len(entries)
+		}
+		total += len(entries)
+	}); err != nil {
+		t.Fatalf("readDirBatches() failed: %v", err)
+	}
+	if largest > dirReadBatch {
+		t.Errorf("Expected batches of at most %d entries, got %d", dirReadBatch, largest)
+	}
+	if total != segments {
+		t.Errorf("Expected %d entries in total, got %d", segments, total)
+	}
+
+	ps := &ProcessingService{
+		config:    cfg,
+		eventName: eventName,
+	}
+
+	// An unbuffered channel makes the reader wait on the consumer between
+	// segments instead of listing the directory up front
+	ch := make(chan SegmentInfo)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go ps.ParseResolutionDirectory("1080p", ch, &wg)
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	seen := make(map[int]bool)
+	for seg := range ch {
+		seen[seg.SeqNo] = true
+	}
+	if len(seen) != segments {
+		t.Errorf("Expected %d distinct segments, got %d", segments, len(seen))
+	}
+}
+
+func TestProcessingService_GetResolutions_SingleQuality(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	eventName := "test-event"
+
+	// A media playlist capture only has the "unknown" directory
+	unknownPath := filepath.Join(cfg.NAS.OutputPath, eventName, "unknown")
+	os.MkdirAll(unknownPath, 0755)
+	for _, name := range []string{"media_0002.ts", "media_0001.ts"} {
+		os.WriteFile(filepath.Join(unknownPath, name), []byte("test"), 0644)
+	}
+
+	ps := &ProcessingService{
+		config:    cfg,
+		eventName: eventName,
+	}
+
+	resolutions, err := ps.GetResolutions()
+	if err != nil {
+		t.Fatalf("GetResolutions() failed: %v", err)
+	}
+	if len(resolutions) != 1 || resolutions[0] != "unknown" {
+		t.Fatalf("Expected single-quality resolution [unknown], got %v", resolutions)
+	}
+
+	ch := make(chan SegmentInfo, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ps.ParseResolutionDirectory(resolutions[0], ch, &wg)
+	close(ch)
+
+	segments, err := ps.AggregateSegmentInfo(ch)
+	if err != nil {
+		t.Fatalf("AggregateSegmentInfo() failed: %v", err)
+	}
+	if len(segments) != 2 || segments[SegmentKey{SeqNo: 1}].Resolution != "unknown" {
+		t.Errorf("Expected 2 segments from the unknown directory, got %v", segments)
+	}
+}
+
+func TestProcessingService_GetResolutions_PrefersKnownResolutions(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	eventPath := filepath.Join(cfg.NAS.OutputPath, "test-event")
+	os.MkdirAll(filepath.Join(eventPath, "1080p"), 0755)
+	os.MkdirAll(filepath.Join(eventPath, "unknown"), 0755)
+
+	ps := &ProcessingService{config: cfg, eventName: "test-event"}
+	resolutions, err := ps.GetResolutions()
+	if err != nil {
+		t.Fatalf("GetResolutions() failed: %v", err)
+	}
+	if len(resolutions) != 1 || resolutions[0] != "1080p" {
+		t.Errorf("Expected only [1080p] when real resolutions exist, got %v", resolutions)
+	}
+}
+
+func TestProcessingService_NASSubpath(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.NAS.Subpath = "finals"
+	os.MkdirAll(filepath.Join(cfg.NAS.OutputPath, "finals", "test-event", "1080p"), 0755)
+	// Same event name outside the subpath, which must be ignored
+	os.MkdirAll(filepath.Join(cfg.NAS.OutputPath, "other-event", "720p"), 0755)
+
+	ps := &ProcessingService{config: cfg}
+	events, err := ps.GetEventDirs()
+	if err != nil {
+		t.Fatalf("GetEventDirs() failed: %v", err)
+	}
+	if len(events) != 1 || events[0] != "test-event" {
+		t.Errorf("Expected only test-event under the subpath, got %v", events)
+	}
+
+	ps.eventName = "test-event"
+	resolutions, err := ps.GetResolutions()
+	if err != nil {
+		t.Fatalf("GetResolutions() failed: %v", err)
+	}
+	if len(resolutions) != 1 || resolutions[0] != "1080p" {
+		t.Errorf("Expected [1080p], got %v", resolutions)
+	}
+	if want := filepath.Join(cfg.NAS.OutputPath, "finals", "test-event"); ps.nasEventPath() != want {
+		t.Errorf("Expected event path %s, got %s", want, ps.nasEventPath())
+	}
+}
+
+func TestProcessingService_GetResolutions_NoneFound(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	os.MkdirAll(filepath.Join(cfg.NAS.OutputPath, "test-event", "misc"), 0755)
+
+	ps := &ProcessingService{config: cfg, eventName: "test-event"}
+	if _, err := ps.GetResolutions(); err == nil || !strings.Contains(err.Error(), "no resolution directories") {
+		t.Errorf("Expected a clear error when no resolution directories exist, got %v", err)
+	}
+}
+
+func TestProcessingService_Start_NothingToProcess(t *testing.T) {
+	tests := []struct {
+		name     string
+		dirs     []string
+		expected string
+	}{
+		{"no resolution directories", []string{"misc"}, `no resolution directories (e.g. 1080p) found for event "test-event"`},
+		{"empty resolution directories", []string{"1080p", "720p"}, `no segments found in the resolution directories of event "test-event"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "processing_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			cfg := createTestConfig(tempDir)
+			cfg.Paths.BaseDir = tempDir
+			for _, dir := range tt.dirs {
+				os.MkdirAll(filepath.Join(cfg.NAS.OutputPath, "test-event", dir), 0755)
+			}
+
+			ps := &ProcessingService{config: cfg, eventName: "test-event"}
+			err = ps.Start(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.GetProcessOutputPath("test-event"), "test-event.txt")); !os.IsNotExist(err) {
+				t.Errorf("Expected no concat file to be written, stat returned %v", err)
+			}
+		})
+	}
+}
+
+// syntheticSegments lists n sequences across three resolutions, with some
+// sequences missing from the tallest, in the interleaved order the
+// per-resolution producers would send them
+func syntheticSegments(n int) []SegmentInfo {
+	segments := make([]SegmentInfo, 0, n*3)
+	for seq := 1; seq <= n; seq++ {
+		for _, resolution := range []string{"480p", "1080p", "720p"} {
+			if resolution == "1080p" && seq%7 == 0 {
+				continue
+			}
+			if resolution == "720p" && seq%5 == 0 {
+				continue
+			}
+			segments = append(segments, SegmentInfo{
+				Name:       fmt.Sprintf("media_%06d.ts", seq),
+				SeqNo:      seq,
+				Resolution: resolution,
+				Size:       int64(seq),
+			})
+		}
+	}
+	return segments
+}
+
+func aggregate(t testing.TB, ps *ProcessingService, segments []SegmentInfo) map[SegmentKey]SegmentInfo {
+	ch := make(chan SegmentInfo, 100)
+	go func() {
+		for _, segment := range segments {
+			ch <- segment
+		}
+		close(ch)
+	}()
+	segmentMap, err := ps.AggregateSegmentInfo(ch)
+	if err != nil {
+		t.Fatalf("AggregateSegmentInfo() failed: %v", err)
+	}
+	return segmentMap
+}
+
+func TestProcessingService_AggregateSegmentInfo_ShardedMatchesSerial(t *testing.T) {
+	segments := syntheticSegments(2000)
+
+	for _, fillGaps := range []bool{true, false} {
+		cfg := createTestConfig(os.TempDir())
+		cfg.Processing.FillGaps = fillGaps
+		serial := aggregate(t, &ProcessingService{config: cfg}, segments)
+
+		for _, shards := range []int{2, 3, 8} {
+			cfg := createTestConfig(os.TempDir())
+			cfg.Processing.FillGaps = fillGaps
+			cfg.Processing.AggregateShards = shards
+			sharded := aggregate(t, &ProcessingService{config: cfg}, segments)
+
+			if !reflect.DeepEqual(serial, sharded) {
+				t.Errorf("fillGaps=%v, shards=%d: sharded result differs from serial (%d vs %d segments)",
+					fillGaps, shards, len(sharded), len(serial))
+			}
+		}
+	}
+}
+
+func benchmarkAggregateSegmentInfo(b *testing.B, shards int) {
+	// Keep the per-segment progress lines out of the benchmark output
+	stdout := os.Stdout
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		b.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	segments := syntheticSegments(50000)
+	cfg := createTestConfig(os.TempDir())
+	cfg.Processing.AggregateShards = shards
+	ps := &ProcessingService{config: cfg}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aggregate(b, ps, segments)
+	}
+}
+
+func BenchmarkAggregateSegmentInfo_Serial(b *testing.B)  { benchmarkAggregateSegmentInfo(b, 1) }
+func BenchmarkAggregateSegmentInfo_Shards4(b *testing.B) { benchmarkAggregateSegmentInfo(b, 4) }
+func BenchmarkAggregateSegmentInfo_Shards8(b *testing.B) { benchmarkAggregateSegmentInfo(b, 8) }
+
 func TestProcessingService_AggregateSegmentInfo(t *testing.T) {
 	ps := &ProcessingService{}
 
 	// Create test channel with segments
-	ch := make(chan SegmentInfo, 5)
+	ch := make(chan SegmentInfo, 16)
 
 	// Add segments with different qualities for same sequence
 	ch <- SegmentInfo{Name: "seg_1001.ts", SeqNo: 1001, Resolution: "720p"}
@@ -195,6 +550,16 @@ func TestProcessingService_AggregateSegmentInfo(t *testing.T) {
 	ch <- SegmentInfo{Name: "seg_1003.ts", SeqNo: 1003, Resolution: "1080p"}
 	ch <- SegmentInfo{Name: "seg_1001.ts", SeqNo: 1001, Resolution: "540p"} // Lower than 1080p, should not replace
 
+	// Ranking comes from the pixel height, so ladders above 1080p work too
+	ch <- SegmentInfo{Name: "seg_1004.ts", SeqNo: 1004, Resolution: "1080p"}
+	ch <- SegmentInfo{Name: "seg_1004.ts", SeqNo: 1004, Resolution: "2160p"} // Highest, should win
+	ch <- SegmentInfo{Name: "seg_1004.ts", SeqNo: 1004, Resolution: "1440p"}
+	ch <- SegmentInfo{Name: "seg_1005.ts", SeqNo: 1005, Resolution: "1080p"}
+	ch <- SegmentInfo{Name: "seg_1005.ts", SeqNo: 1005, Resolution: "1440p"} // Higher than 1080p, should replace
+	ch <- SegmentInfo{Name: "seg_1006.ts", SeqNo: 1006, Resolution: "240p"}
+	ch <- SegmentInfo{Name: "seg_1006.ts", SeqNo: 1006, Resolution: "unknown"} // Ranks lowest
+	ch <- SegmentInfo{Name: "seg_1007.ts", SeqNo: 1007, Resolution: "unknown"}
+
 	close(ch)
 
 	segmentMap, err := ps.AggregateSegmentInfo(ch)
@@ -202,13 +567,13 @@ func TestProcessingService_AggregateSegmentInfo(t *testing.T) {
 		t.Fatalf("AggregateSegmentInfo() failed: %v", err)
 	}
 
-	// Should have 3 unique sequence numbers
-	if len(segmentMap) != 3 {
-		t.Errorf("Expected 3 unique segments, got %d", len(segmentMap))
+	// Should have 7 unique sequence numbers
+	if len(segmentMap) != 7 {
+		t.Errorf("Expected 7 unique segments, got %d", len(segmentMap))
 	}
 
 	// Check sequence 1001 has the highest quality (1080p)
-	seg1001, exists := segmentMap[1001]
+	seg1001, exists := segmentMap[SegmentKey{SeqNo: 1001}]
 	if !exists {
 		t.Fatal("Segment 1001 should exist")
 	}
@@ -217,7 +582,7 @@ func TestProcessingService_AggregateSegmentInfo(t *testing.T) {
 	}
 
 	// Check sequence 1002 has 480p
-	seg1002, exists := segmentMap[1002]
+	seg1002, exists := segmentMap[SegmentKey{SeqNo: 1002}]
 	if !exists {
 		t.Fatal("Segment 1002 should exist")
 	}
@@ -226,13 +591,113 @@ func TestProcessingService_AggregateSegmentInfo(t *testing.T) {
 	}
 
 	// Check sequence 1003 has 1080p
-	seg1003, exists := segmentMap[1003]
+	seg1003, exists := segmentMap[SegmentKey{SeqNo: 1003}]
 	if !exists {
 		t.Fatal("Segment 1003 should exist")
 	}
 	if seg1003.Resolution != "1080p" {
 		t.Errorf("Expected segment 1003 to have resolution '1080p', got '%s'", seg1003.Resolution)
 	}
+
+	for seqNo, want := range map[int]string{1004: "2160p", 1005: "1440p", 1006: "240p", 1007: "unknown"} {
+		if got := segmentMap[SegmentKey{SeqNo: seqNo}].Resolution; got != want {
+			t.Errorf("Expected segment %d to have resolution '%s', got '%s'", seqNo, want, got)
+		}
+	}
+}
+
+func TestProcessingService_AggregateSegmentInfo_FillsGaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		fillGaps bool
+		want     map[int]string
+	}{
+		{"fill from lower resolution", true, map[int]string{1: "1080p", 2: "1080p", 3: "720p", 4: "1080p", 5: "480p"}},
+		{"fill disabled", false, map[int]string{1: "1080p", 2: "1080p", 4: "1080p"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := &ProcessingService{config: createTestConfig(t.TempDir())}
+			ps.config.Processing.FillGaps = tt.fillGaps
+
+			// 1080p failed sequence 3 and 5; 720p has 3, only 480p has 5
+			ch := make(chan SegmentInfo, 10)
+			for _, seq := range []int{1, 2, 4} {
+				ch <- SegmentInfo{Name: fmt.Sprintf("media_%04d.ts", seq), SeqNo: seq, Resolution: "1080p"}
+			}
+			for _, seq := range []int{1, 2, 3, 4} {
+				ch <- SegmentInfo{Name: fmt.Sprintf("media_%04d.ts", seq), SeqNo: seq, Resolution: "720p"}
+			}
+			ch <- SegmentInfo{Name: "media_0005.ts", SeqNo: 5, Resolution: "480p"}
+			close(ch)
+
+			segmentMap, err := ps.AggregateSegmentInfo(ch)
+			if err != nil {
+				t.Fatalf("AggregateSegmentInfo() failed: %v", err)
+			}
+			if len(segmentMap) != len(tt.want) {
+				t.Errorf("Expected %d segments, got %d", len(tt.want), len(segmentMap))
+			}
+			for seq, resolution := range tt.want {
+				if got := segmentMap[SegmentKey{SeqNo: seq}].Resolution; got != resolution {
+					t.Errorf("Expected segment %d from %s, got %q", seq, resolution, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessingService_AggregateSegmentInfo_ResolutionOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		want  map[int]string
+	}{
+		{"tallest first by default", nil, map[int]string{1: "1080p", 2: "1080p", 3: "720p"}},
+		{"prefer 720p", []string{"720p"}, map[int]string{1: "720p", 2: "1080p", 3: "720p"}},
+		{"prefer 480p then 720p", []string{"480p", "720p"}, map[int]string{1: "480p", 2: "1080p", 3: "480p"}},
+		{"unknown entries ignored", []string{"4k", "720p", "1080p"}, map[int]string{1: "720p", 2: "1080p", 3: "720p"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "processing_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			ps := &ProcessingService{config: createTestConfig(tempDir)}
+			ps.config.Processing.FillGaps = true
+			ps.config.Processing.ResolutionOrder = tt.order
+
+			// 720p is missing sequence 2; only 720p and 480p have 3
+			ch := make(chan SegmentInfo, 10)
+			for _, seg := range []SegmentInfo{
+				{SeqNo: 1, Resolution: "1080p"},
+				{SeqNo: 2, Resolution: "1080p"},
+				{SeqNo: 1, Resolution: "720p"},
+				{SeqNo: 3, Resolution: "720p"},
+				{SeqNo: 1, Resolution: "480p"},
+				{SeqNo: 3, Resolution: "480p"},
+			} {
+				seg.Name = fmt.Sprintf("media_%04d.ts", seg.SeqNo)
+				ch <- seg
+			}
+			close(ch)
+
+			segmentMap, err := ps.AggregateSegmentInfo(ch)
+			if err != nil {
+				t.Fatalf("AggregateSegmentInfo() failed: %v", err)
+			}
+			for seq, resolution := range tt.want {
+				if got := segmentMap[SegmentKey{SeqNo: seq}].Resolution; got != resolution {
+					t.Errorf("Expected segment %d from %s, got %q", seq, resolution, got)
+				}
+			}
+		})
+	}
 }
 
 func TestProcessingService_WriteConcatFile(t *testing.T) {
@@ -251,10 +716,10 @@ func TestProcessingService_WriteConcatFile(t *testing.T) {
 	}
 
 	// Create test segment map
-	segmentMap := map[int]SegmentInfo{
-		1003: {Name: "seg_1003.ts", SeqNo: 1003, Resolution: "1080p"},
-		1001: {Name: "seg_1001.ts", SeqNo: 1001, Resolution: "720p"},
-		1002: {Name: "seg_1002.ts", SeqNo: 1002, Resolution: "1080p"},
+	segmentMap := map[SegmentKey]SegmentInfo{
+		{SeqNo: 1003}: {Name: "seg_1003.ts", SeqNo: 1003, Resolution: "1080p"},
+		{SeqNo: 1001}: {Name: "seg_1001.ts", SeqNo: 1001, Resolution: "720p"},
+		{SeqNo: 1002}: {Name: "seg_1002.ts", SeqNo: 1002, Resolution: "1080p"},
 	}
 
 	concatFilePath, err := ps.WriteConcatFile(segmentMap)
@@ -292,6 +757,531 @@ func TestProcessingService_WriteConcatFile(t *testing.T) {
 	}
 }
 
+func TestProcessingService_RestartedSequenceKeptApart(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.Processing.FillGaps = true
+	eventName := "test-event"
+
+	// The encoder restarted after media_0002, so its sequence numbers repeat
+	// with a _d1 tag; 720p fills the restarted run's missing 0001
+	files := map[string][]string{
+		"1080p": {"media_0001.ts", "media_0002.ts", "media_0002_d1.ts"},
+		"720p":  {"media_0001.ts", "media_0001_d1.ts", "media_0002_d1.ts"},
+	}
+	for resolution, names := range files {
+		dir := filepath.Join(cfg.NAS.OutputPath, eventName, resolution)
+		os.MkdirAll(dir, 0755)
+		for _, name := range names {
+			os.WriteFile(filepath.Join(dir, name), []byte("test"), 0644)
+		}
+	}
+
+	ps := &ProcessingService{config: cfg, eventName: eventName}
+	ch := make(chan SegmentInfo, 10)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ps.ParseResolutionDirectory("1080p", ch, &wg)
+	ps.ParseResolutionDirectory("720p", ch, &wg)
+	close(ch)
+
+	segmentMap, err := ps.AggregateSegmentInfo(ch)
+	if err != nil {
+		t.Fatalf("AggregateSegmentInfo() failed: %v", err)
+	}
+	if len(segmentMap) != 4 {
+		t.Fatalf("Expected 4 segments across both runs, got %d: %v", len(segmentMap), segmentMap)
+	}
+
+	concatFilePath, err := ps.WriteConcatFile(segmentMap)
+	if err != nil {
+		t.Fatalf("WriteConcatFile() failed: %v", err)
+	}
+	content, err := os.ReadFile(concatFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read concat file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+
+	expected := []string{
+		filepath.Join("1080p", "media_0001.ts"),
+		filepath.Join("1080p", "media_0002.ts"),
+		filepath.Join("720p", "media_0001_d1.ts"),
+		filepath.Join("1080p", "media_0002_d1.ts"),
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines in concat file, got %d: %v", len(expected), len(lines), lines)
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, expected[i]) {
+			t.Errorf("Line %d should contain '%s', got: %s", i, expected[i], line)
+		}
+	}
+}
+
+func TestProcessingService_WriteConcatFilesPerResolution(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	ps := &ProcessingService{config: cfg, eventName: "test-event"}
+
+	byResolution := map[string]map[SegmentKey]SegmentInfo{
+		"1080p": {
+			{SeqNo: 3}: {Name: "media_0003.ts", SeqNo: 3, Resolution: "1080p"},
+			{SeqNo: 1}: {Name: "media_0001.ts", SeqNo: 1, Resolution: "1080p"},
+		},
+		"720p": {
+			{SeqNo: 2}: {Name: "media_0002.ts", SeqNo: 2, Resolution: "720p"},
+			{SeqNo: 1}: {Name: "media_0001.ts", SeqNo: 1, Resolution: "720p"},
+			{SeqNo: 3}: {Name: "media_0003.ts", SeqNo: 3, Resolution: "720p"},
+		},
+	}
+
+	files, err := ps.WriteConcatFilesPerResolution(byResolution)
+	if err != nil {
+		t.Fatalf("WriteConcatFilesPerResolution() failed: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected a concat file per resolution, got %v", files)
+	}
+
+	eventPath := filepath.Join(cfg.NAS.OutputPath, "test-event")
+	expected := map[string][]string{
+		"1080p": {"media_0001.ts", "media_0003.ts"},
+		"720p":  {"media_0001.ts", "media_0002.ts", "media_0003.ts"},
+	}
+	for resolution, names := range expected {
+		path := files[resolution]
+		wantPath := filepath.Join(cfg.GetProcessOutputPath("test-event"), "test-event_"+resolution+".txt")
+		if path != wantPath {
+			t.Errorf("Expected %s concat file at %s, got %s", resolution, wantPath, path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s concat file: %v", resolution, err)
+		}
+		var want string
+		for _, name := range names {
+			want += fmt.Sprintf("file '%s'\n", filepath.Join(eventPath, resolution, name))
+		}
+		if string(content) != want {
+			t.Errorf("%s concat file:\nexpected %q\ngot      %q", resolution, want, content)
+		}
+	}
+}
+
+func TestProcessingService_Start_PerResolution(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub ffmpeg is a shell script")
+	}
+
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.Paths.BaseDir = tempDir
+	cfg.Processing.PerResolution = true
+	cfg.Processing.FillGaps = true
+	cfg.Processing.FFmpegPath = writeConcatStub(t, tempDir, filepath.Join(tempDir, "read.log"))
+	eventName := "test-event"
+
+	// 1080p is missing sequence 2, which the merged video takes from 720p
+	segments := map[string][]string{
+		"1080p": {"media_0001.ts", "media_0003.ts"},
+		"720p":  {"media_0001.ts", "media_0002.ts", "media_0003.ts"},
+	}
+	for resolution, names := range segments {
+		dir := filepath.Join(cfg.NAS.OutputPath, eventName, resolution)
+		os.MkdirAll(dir, 0755)
+		for _, name := range names {
+			os.WriteFile(filepath.Join(dir, name), []byte(resolution+" "), 0644)
+		}
+	}
+
+	ps := &ProcessingService{config: cfg, eventName: eventName}
+	if err := ps.Start(context.Background()); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	outPath := cfg.GetProcessOutputPath(eventName)
+	expected := map[string]string{
+		eventName + ".mp4":       "1080p 720p 1080p ",
+		eventName + "_1080p.mp4": "1080p 1080p ",
+		eventName + "_720p.mp4":  "720p 720p 720p ",
+	}
+	for name, want := range expected {
+		data, err := os.ReadFile(filepath.Join(outPath, name))
+		if err != nil {
+			t.Errorf("Expected output %s: %v", name, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, data)
+		}
+	}
+}
+
+func TestProcessingService_WriteConcatFile_SortModes(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Sequence numbers reset to 1 after a discontinuity at 0098
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	segmentMap := map[SegmentKey]SegmentInfo{
+		{SeqNo: 98}: {Name: "media_0098.ts", SeqNo: 98, Resolution: "1080p", ModTime: start},
+		{SeqNo: 99}: {Name: "media_0099.ts", SeqNo: 99, Resolution: "1080p", ModTime: start.Add(6 * time.Second)},
+		{SeqNo: 1}:  {Name: "media_0001.ts", SeqNo: 1, Resolution: "1080p", ModTime: start.Add(12 * time.Second)},
+		{SeqNo: 2}:  {Name: "media_0002.ts", SeqNo: 2, Resolution: "1080p", ModTime: start.Add(18 * time.Second)},
+	}
+
+	tests := []struct {
+		name     string
+		sort     string
+		expected []string
+	}{
+		{
+			name:     "sequence",
+			sort:     config.ConcatSortSequence,
+			expected: []string{"media_0001.ts", "media_0002.ts", "media_0098.ts", "media_0099.ts"},
+		},
+		{
+			name:     "mtime",
+			sort:     config.ConcatSortModTime,
+			expected: []string{"media_0098.ts", "media_0099.ts", "media_0001.ts", "media_0002.ts"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestConfig(filepath.Join(tempDir, tt.name))
+			cfg.Processing.ConcatSort = tt.sort
+			ps := &ProcessingService{config: cfg, eventName: "test-event"}
+
+			concatFilePath, err := ps.WriteConcatFile(segmentMap)
+			if err != nil {
+				t.Fatalf("WriteConcatFile() failed: %v", err)
+			}
+			content, err := os.ReadFile(concatFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read concat file: %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			if len(lines) != len(tt.expected) {
+				t.Fatalf("Expected %d lines, got %d", len(tt.expected), len(lines))
+			}
+			for i, line := range lines {
+				if !strings.Contains(line, tt.expected[i]) {
+					t.Errorf("Line %d should contain '%s', got: %s", i, tt.expected[i], line)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessingService_WriteConcatFile_Location(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	customDir := filepath.Join(tempDir, "concat")
+	segmentMap := map[SegmentKey]SegmentInfo{
+		{SeqNo: 1}: {Name: "media_0001.ts", SeqNo: 1, Resolution: "1080p"},
+	}
+
+	tests := []struct {
+		name      string
+		concatDir string
+		remove    bool
+		wantDir   string
+	}{
+		{name: "default output directory", wantDir: filepath.Join(tempDir, "out", "test-event")},
+		{name: "custom directory", concatDir: customDir, wantDir: customDir},
+		{name: "custom directory removed", concatDir: customDir, remove: true, wantDir: customDir},
+		{name: "temp directory removed", remove: true, wantDir: os.TempDir()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestConfig(tempDir)
+			cfg.Paths.ConcatDir = tt.concatDir
+			cfg.Processing.RemoveConcatFile = tt.remove
+			ps := &ProcessingService{config: cfg, eventName: "test-event"}
+
+			concatFilePath, err := ps.WriteConcatFile(segmentMap)
+			if err != nil {
+				t.Fatalf("WriteConcatFile() failed: %v", err)
+			}
+			defer os.Remove(concatFilePath)
+
+			if filepath.Clean(filepath.Dir(concatFilePath)) != filepath.Clean(tt.wantDir) {
+				t.Errorf("Expected concat file in %s, got %s", tt.wantDir, concatFilePath)
+			}
+			if !strings.HasSuffix(concatFilePath, ".txt") {
+				t.Errorf("Expected a .txt concat file, got %s", concatFilePath)
+			}
+
+			ps.removeConcatFile(concatFilePath)
+			_, statErr := os.Stat(concatFilePath)
+			if tt.remove && !os.IsNotExist(statErr) {
+				t.Errorf("Expected concat file to be removed, stat error: %v", statErr)
+			}
+			if !tt.remove && statErr != nil {
+				t.Errorf("Expected concat file to be kept, stat error: %v", statErr)
+			}
+		})
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name       string
+		size       int
+		inputBytes int64
+		minRatio   float64
+		wantErr    bool
+	}{
+		{name: "close to input size", size: 950, inputBytes: 1000, minRatio: 0.5},
+		{name: "empty", size: 0, inputBytes: 1000, minRatio: 0.5, wantErr: true},
+		{name: "empty with ratio disabled", size: 0, inputBytes: 1000, minRatio: 0, wantErr: true},
+		{name: "implausibly small", size: 100, inputBytes: 1000, minRatio: 0.5, wantErr: true},
+		{name: "small with ratio disabled", size: 100, inputBytes: 1000, minRatio: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(tempDir, strings.ReplaceAll(tt.name, " ", "_")+".mp4")
+			if err := os.WriteFile(output, make([]byte, tt.size), 0644); err != nil {
+				t.Fatalf("Failed to write output: %v", err)
+			}
+			err := ValidateOutput(output, tt.inputBytes, tt.minRatio)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := ValidateOutput(filepath.Join(tempDir, "missing.mp4"), 1000, 0.5); err == nil {
+		t.Error("Expected error for missing output")
+	}
+}
+
+func TestProcessingService_RunFFmpeg_EmptyOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub ffmpeg is a shell script")
+	}
+
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Exits successfully after creating an empty file at the output path,
+	// which is always the last argument
+	stub := filepath.Join(tempDir, "ffmpeg")
+	script := "#!/bin/sh\nfor arg; do out=\"$arg\"; done\n: > \"$out\"\n"
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write stub ffmpeg: %v", err)
+	}
+
+	cfg := createTestConfig(tempDir)
+	cfg.Processing.FFmpegPath = stub
+	ps := &ProcessingService{config: cfg, eventName: "test-event"}
+
+	outPath := filepath.Join(tempDir, "out")
+	os.MkdirAll(outPath, 0755)
+	if err := ps.RunFFmpeg(filepath.Join(tempDir, "concat.txt"), outPath); err != nil {
+		t.Fatalf("RunFFmpeg() failed: %v", err)
+	}
+
+	err = ValidateOutput(filepath.Join(outPath, "test-event.mp4"), 3000, 0.5)
+	if err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("Expected the empty output to be flagged, got %v", err)
+	}
+}
+
+// writeConcatStub writes a stub ffmpeg that logs each file in the concat
+// list to read and concatenates them into the output path, which is always
+// the last argument
+func writeConcatStub(t *testing.T, dir string, read string) string {
+	t.Helper()
+	stub := filepath.Join(dir, "ffmpeg")
+	script := fmt.Sprintf(`#!/bin/sh
+while [ $# -gt 1 ]; do
+  if [ "$1" = -i ]; then list="$2"; fi
+  shift
+done
+: > "$1"
+sed -n "s/^file '\(.*\)'$/\1/p" "$list" | while read -r f; do
+  echo "$f" >> %s
+  cat "$f" >> "$1"
+done
+`, read)
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write stub ffmpeg: %v", err)
+	}
+	return stub
+}
+
+func TestProcessingService_Start_StagesSegments(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub ffmpeg is a shell script")
+	}
+
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.Paths.BaseDir = tempDir
+	cfg.Paths.StageDir = filepath.Join(tempDir, "stage")
+	os.MkdirAll(cfg.Paths.StageDir, 0755)
+	eventName := "test-event"
+
+	resolutionPath := filepath.Join(cfg.NAS.OutputPath, eventName, "1080p")
+	os.MkdirAll(resolutionPath, 0755)
+	for _, name := range []string{"media_0001.ts", "media_0002.ts"} {
+		os.WriteFile(filepath.Join(resolutionPath, name), []byte("segment "+name), 0644)
+	}
+
+	read := filepath.Join(tempDir, "read.log")
+	cfg.Processing.FFmpegPath = writeConcatStub(t, tempDir, read)
+
+	ps := &ProcessingService{config: cfg, eventName: eventName, nas: &nas.NASService{}}
+	if err := ps.Start(context.Background()); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(read)
+	if err != nil {
+		t.Fatalf("Stub ffmpeg read no segments: %v", err)
+	}
+	files := strings.Fields(string(data))
+	if len(files) != 2 {
+		t.Fatalf("Expected ffmpeg to read 2 segments, got %v", files)
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f, cfg.Paths.StageDir+string(filepath.Separator)) {
+			t.Errorf("Expected ffmpeg to read a staged copy, got %s", f)
+		}
+	}
+
+	video, err := os.ReadFile(filepath.Join(cfg.GetProcessOutputPath(eventName), eventName+".mp4"))
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if string(video) != "segment media_0001.tssegment media_0002.ts" {
+		t.Errorf("Expected the staged segments in order, got %q", video)
+	}
+
+	entries, _ := os.ReadDir(cfg.Paths.StageDir)
+	if len(entries) != 0 {
+		t.Errorf("Expected staged copies to be removed, found %d entries", len(entries))
+	}
+	if ps.stagePath != "" {
+		t.Errorf("Expected no staging directory after Start, got %s", ps.stagePath)
+	}
+	if _, err := os.Stat(filepath.Join(resolutionPath, "media_0001.ts")); err != nil {
+		t.Errorf("Expected NAS segments to be kept: %v", err)
+	}
+}
+
+func TestProcessingService_BuildReport(t *testing.T) {
+	cfg := createTestConfig(os.TempDir())
+	ps := &ProcessingService{config: cfg, eventName: "test-event"}
+
+	segmentMap := map[SegmentKey]SegmentInfo{
+		{SeqNo: 1}: {Name: "media_0001.ts", SeqNo: 1, Resolution: "1080p", Size: 1000},
+		{SeqNo: 2}: {Name: "media_0002.ts", SeqNo: 2, Resolution: "720p", Size: 600},
+		{SeqNo: 3}: {Name: "media_0003.ts", SeqNo: 3, Resolution: "1080p", Size: 1000},
+		{SeqNo: 6}: {Name: "media_0006.ts", SeqNo: 6, Resolution: "1080p", Size: 1000},
+	}
+
+	started := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	report := ps.BuildReport(segmentMap, started, started.Add(2*time.Minute))
+
+	if report.Event != "test-event" || report.Duration != "2m0s" {
+		t.Errorf("Unexpected event/duration: %s, %s", report.Event, report.Duration)
+	}
+	if report.Segments != 4 || report.Bytes != 3600 {
+		t.Errorf("Expected 4 segments and 3600 bytes, got %d and %d", report.Segments, report.Bytes)
+	}
+	if len(report.Variants) != 2 || report.Variants[0].Resolution != "1080p" || report.Variants[0].Segments != 3 {
+		t.Errorf("Unexpected per-resolution counts: %+v", report.Variants)
+	}
+	if len(report.Gaps) != 1 || report.Gaps[0].From != 4 || report.Gaps[0].To != 5 {
+		t.Errorf("Expected a gap from 4 to 5, got %+v", report.Gaps)
+	}
+}
+
+func TestFindFFmpeg_NotFoundMessage(t *testing.T) {
+	_, err := FindFFmpeg("nonexistent_ffmpeg_command_12345")
+	if err == nil {
+		t.Fatal("Expected error for nonexistent FFmpeg")
+	}
+	msg := err.Error()
+
+	cwd, _ := os.Getwd()
+	localBin := filepath.Join(cwd, "bin", "ffmpeg")
+	if runtime.GOOS == "windows" {
+		localBin += ".exe"
+	}
+	for _, want := range []string{
+		"FFmpeg not found",
+		`"nonexistent_ffmpeg_command_12345" in PATH`,
+		localBin,
+		ffmpegInstallHint(runtime.GOOS),
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected error to contain %q, got: %s", want, msg)
+		}
+	}
+}
+
+func TestFFmpegInstallHint(t *testing.T) {
+	tests := []struct {
+		goos string
+		want string
+	}{
+		{"windows", "choco install ffmpeg"},
+		{"darwin", "brew install ffmpeg"},
+		{"linux", "apt install ffmpeg"},
+		{"freebsd", "package manager"},
+	}
+
+	for _, tt := range tests {
+		if got := ffmpegInstallHint(tt.goos); !strings.Contains(got, tt.want) {
+			t.Errorf("ffmpegInstallHint(%s) = %q, want it to mention %q", tt.goos, got, tt.want)
+		}
+	}
+}
+
 func TestProcessingService_getFFmpegPath(t *testing.T) {
 	cfg := createTestConfig("/tmp")
 
@@ -355,6 +1345,76 @@ func TestProcessingService_getFFmpegPath(t *testing.T) {
 	}
 }
 
+func TestBuildFFmpegArgs_ExtraArgs(t *testing.T) {
+	extra := []string{"-movflags", "+faststart", "-metadata", "title=Finals"}
+	args, err := buildFFmpegArgs("/out/event.txt", "/out/event.mp4", false, extra, nil)
+	if err != nil {
+		t.Fatalf("buildFFmpegArgs() failed: %v", err)
+	}
+
+	expected := []string{"-f", "concat", "-safe", "0", "-i", "/out/event.txt", "-c", "copy",
+		"-movflags", "+faststart", "-metadata", "title=Finals", "/out/event.mp4"}
+	if strings.Join(args, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected args %v, got %v", expected, args)
+	}
+}
+
+func TestBuildFFmpegArgs_NoExtraArgs(t *testing.T) {
+	args, err := buildFFmpegArgs("in.txt", "out.mp4", false, nil, nil)
+	if err != nil {
+		t.Fatalf("buildFFmpegArgs() failed: %v", err)
+	}
+	if got := strings.Join(args, " "); got != "-f concat -safe 0 -i in.txt -c copy out.mp4" {
+		t.Errorf("Unexpected default command: %s", got)
+	}
+}
+
+func TestBuildFFmpegArgs_FastStart(t *testing.T) {
+	args, err := buildFFmpegArgs("in.txt", "out.mp4", true, []string{"-metadata", "title=Finals"}, nil)
+	if err != nil {
+		t.Fatalf("buildFFmpegArgs() failed: %v", err)
+	}
+	expected := "-f concat -safe 0 -i in.txt -c copy -movflags +faststart -metadata title=Finals out.mp4"
+	if got := strings.Join(args, " "); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	args, _ = buildFFmpegArgs("in.txt", "out.mp4", false, nil, nil)
+	if strings.Contains(strings.Join(args, " "), "faststart") {
+		t.Errorf("Expected no faststart flag when disabled, got %v", args)
+	}
+}
+
+func TestBuildFFmpegArgs_Subtitles(t *testing.T) {
+	subtitles := []subtitleTrack{
+		{Label: "subtitles_en", Language: "en", Path: "event.en.vtt"},
+		{Label: "subtitles_english--cc", Language: "english--cc", Path: "event.english--cc.vtt"},
+	}
+	args, err := buildFFmpegArgs("in.txt", "out.mp4", true, nil, subtitles)
+	if err != nil {
+		t.Fatalf("buildFFmpegArgs() failed: %v", err)
+	}
+	expected := "-f concat -safe 0 -i in.txt -i event.en.vtt -i event.english--cc.vtt -map 0 -map 1 -map 2 " +
+		"-c copy -c:s mov_text -metadata:s:s:0 language=en -movflags +faststart out.mp4"
+	if got := strings.Join(args, " "); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestBuildFFmpegArgs_RejectsReservedFlags(t *testing.T) {
+	for _, extra := range [][]string{
+		{"-f", "mp4"},
+		{"-i", "other.txt"},
+		{"-safe", "1"},
+		{"-c:v", "libx264"},
+		{"-codec", "aac"},
+	} {
+		if _, err := buildFFmpegArgs("in.txt", "out.mp4", false, extra, nil); err == nil {
+			t.Errorf("Expected extra args %v to be rejected", extra)
+		}
+	}
+}
+
 func TestSegmentInfo_Structure(t *testing.T) {
 	segment := SegmentInfo{
 		Name:       "test_segment.ts",
@@ -382,3 +1442,42 @@ func TestProcessJob_Structure(t *testing.T) {
 		t.Errorf("Expected EventName='test-event', got '%s'", job.EventName)
 	}
 }
+
+func TestProcessingService_GetResolutions_DatedPath(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.NAS.PathTemplate = "{event}/{date}"
+
+	eventPath := filepath.Join(cfg.NAS.OutputPath, "test-event")
+	os.MkdirAll(filepath.Join(eventPath, "2024-06-01", "720p"), 0755)
+	os.MkdirAll(filepath.Join(eventPath, "2024-06-02", "1080p"), 0755)
+	os.MkdirAll(filepath.Join(eventPath, "2024-06-02", "480p"), 0755)
+	os.WriteFile(filepath.Join(eventPath, "2024-06-02", "1080p", "media_0001.ts"), []byte("segment"), 0644)
+
+	ps := &ProcessingService{
+		config:    cfg,
+		eventName: "test-event",
+	}
+
+	resolutions, err := ps.GetResolutions()
+	if err != nil {
+		t.Fatalf("GetResolutions() failed: %v", err)
+	}
+	if strings.Join(resolutions, ",") != "1080p,480p" {
+		t.Errorf("Expected resolutions of the latest capture [1080p 480p], got %v", resolutions)
+	}
+
+	ch := make(chan SegmentInfo, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ps.ParseResolutionDirectory("1080p", ch, &wg)
+	close(ch)
+	if segment, ok := <-ch; !ok || segment.Name != "media_0001.ts" {
+		t.Errorf("Expected media_0001.ts from the dated 1080p directory, got %+v", segment)
+	}
+}
@@ -0,0 +1,129 @@
+package processing
+
+import (
+	"fmt"
+	"log"
+	"m3u8-downloader/pkg/media"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subtitleTrack is a sidecar WebVTT file written for one subtitle rendition
+type subtitleTrack struct {
+	Label    string // rendition directory, e.g. subtitles_en
+	Language string
+	Path     string
+}
+
+// WriteSubtitles merges the segments of each subtitle rendition of the event
+// into <event>.<label>.vtt in outPath, and returns the files written.
+// Subtitle segments are read in discontinuity then sequence order, but cues
+// are picked by time rather than by sequence number, since a subtitle
+// playlist may be cut into segments of a different length than the video's:
+// only cues within the PTS span of the segments in segmentMap are kept, and
+// their times are shifted to start with the video. An event without subtitle
+// renditions, or whose video has no PTS to align them to, gets none.
+func (ps *ProcessingService) WriteSubtitles(segmentMap map[SegmentKey]SegmentInfo, outPath string) ([]subtitleTrack, error) {
+	entries, err := ps.nas.ReadDir(ps.nasEventPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event directory %s: %w", ps.nasEventPath(), err)
+	}
+	var labels []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), media.SubtitleDirPrefix) {
+			labels = append(labels, entry.Name())
+		}
+	}
+	if len(labels) == 0 || len(segmentMap) == 0 {
+		return nil, nil
+	}
+	sort.Strings(labels)
+
+	ordered := ps.orderSegments(segmentMap)
+	root := ps.nasEventPath()
+	if ps.stagePath != "" {
+		root = ps.stagePath
+	}
+	first := utils.SafeJoin(root, ordered[0].Resolution, ordered[0].Name)
+	start, err := utils.FirstPTS(first)
+	if err != nil {
+		log.Printf("Skipping %d subtitle renditions, no timestamp to align them to in %s: %v", len(labels), first, err)
+		return nil, nil
+	}
+
+	last := utils.SafeJoin(root, ordered[len(ordered)-1].Resolution, ordered[len(ordered)-1].Name)
+	end, err := utils.LastPTS(last)
+	if err != nil {
+		log.Printf("Skipping %d subtitle renditions, no timestamp to end them at in %s: %v", len(labels), last, err)
+		return nil, nil
+	}
+	if end <= start {
+		// The clock was reset by a discontinuity, so cue times can't be
+		// placed on the video
+		log.Printf("Skipping %d subtitle renditions, %s ends before %s starts", len(labels), last, first)
+		return nil, nil
+	}
+
+	var tracks []subtitleTrack
+	for _, label := range labels {
+		segments, err := subtitleSegments(utils.SafeJoin(ps.nasEventPath(), label))
+		if err != nil {
+			return tracks, err
+		}
+		if len(segments) == 0 {
+			continue
+		}
+
+		track := subtitleTrack{
+			Label:    label,
+			Language: media.SubtitleLanguage(label),
+			Path:     utils.SafeJoin(outPath, ps.eventName+"."+strings.TrimPrefix(label, media.SubtitleDirPrefix)+".vtt"),
+		}
+		f, err := os.Create(track.Path)
+		if err != nil {
+			return tracks, fmt.Errorf("failed to create subtitle file: %w", err)
+		}
+		cues, err := media.MergeWebVTT(f, segments, start, end)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return tracks, fmt.Errorf("failed to write %s: %w", track.Path, err)
+		}
+		if cues == 0 {
+			// Nothing in the rendition falls within the video
+			os.Remove(track.Path)
+			continue
+		}
+		log.Printf("Wrote %d cues from %d %s segments to %s", cues, len(segments), label, track.Path)
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// subtitleSegments returns the finished subtitle segments in dir in key order
+func subtitleSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subtitle directory %s: %w", dir, err)
+	}
+
+	keys := make(map[string]SegmentKey)
+	var segments []string
+	for _, entry := range entries {
+		if entry.IsDir() || !utils.IsSubtitleFile(entry.Name()) {
+			continue
+		}
+		no, discontinuity, err := media.ParseSegmentName(entry.Name())
+		if err != nil {
+			continue
+		}
+		path := utils.SafeJoin(dir, entry.Name())
+		keys[path] = SegmentKey{Discontinuity: discontinuity, SeqNo: no}
+		segments = append(segments, path)
+	}
+	sort.Slice(segments, func(i, j int) bool { return keys[segments[i]].Less(keys[segments[j]]) })
+	return segments, nil
+}
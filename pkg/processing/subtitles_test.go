@@ -0,0 +1,115 @@
+package processing
+
+import (
+	"m3u8-downloader/pkg/nas"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tsPacket returns one MPEG-TS packet starting a PES packet with the given
+// PTS, enough for utils.FirstPTS and utils.LastPTS
+func tsPacket(pts int64) []byte {
+	packet := make([]byte, utils.TSPacketSize)
+	packet[0] = utils.TSSyncByte
+	packet[1] = 0x41 // payload start, PID 0x100
+	packet[3] = 0x10
+	payload := packet[4:]
+	copy(payload, []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5})
+	payload[9] = 0x21 | byte(pts>>29)&0x0e
+	payload[10] = byte(pts >> 22)
+	payload[11] = byte(pts>>14) | 0x01
+	payload[12] = byte(pts >> 7)
+	payload[13] = byte(pts<<1) | 0x01
+	return packet
+}
+
+func TestProcessingService_WriteSubtitles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	eventName := "test-event"
+	eventPath := filepath.Join(cfg.NAS.OutputPath, eventName)
+
+	// The video runs from 10s to 22s on the MPEG-TS clock
+	videoPath := filepath.Join(eventPath, "1080p")
+	os.MkdirAll(videoPath, 0755)
+	os.WriteFile(filepath.Join(videoPath, "media_0002.ts"), tsPacket(900000), 0644)
+	os.WriteFile(filepath.Join(videoPath, "media_0003.ts"), append(tsPacket(1440000), tsPacket(1980000)...), 0644)
+	segments := map[SegmentKey]SegmentInfo{
+		{SeqNo: 2}: {Name: "media_0002.ts", SeqNo: 2, Resolution: "1080p"},
+		{SeqNo: 3}: {Name: "media_0003.ts", SeqNo: 3, Resolution: "1080p"},
+	}
+
+	header := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n"
+	// Cues are picked by time, so subtitle sequence numbers needn't match the
+	// video's
+	subtitles := map[string]string{
+		"subtitles_en/sub_0001.vtt": "WEBVTT\n\n00:00:05.000 --> 00:00:06.000\nbefore\n",
+		"subtitles_en/sub_0004.vtt": header + "00:00:11.000 --> 00:00:11.500\nfour\n\n00:00:19.000 --> 00:00:20.000\nafter\n",
+		"subtitles_en/sub_0003.vtt": header + "00:00:07.000 --> 00:00:08.000\nthree\n",
+		"subtitles_en/sub_0002.vtt": header + "00:00:01.000 --> 00:00:02.000\ntwo\n",
+		"subtitles_es/sub_0001.vtt": "WEBVTT\n\n00:00:05.000 --> 00:00:06.000\nantes\n",
+	}
+	for name, content := range subtitles {
+		path := filepath.Join(eventPath, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0644)
+	}
+
+	outPath := cfg.GetProcessOutputPath(eventName)
+	os.MkdirAll(outPath, 0755)
+	ps := &ProcessingService{config: cfg, eventName: eventName, nas: &nas.NASService{}}
+	tracks, err := ps.WriteSubtitles(segments, outPath)
+	if err != nil {
+		t.Fatalf("WriteSubtitles() failed: %v", err)
+	}
+
+	expectedPath := filepath.Join(outPath, "test-event.en.vtt")
+	if len(tracks) != 1 || tracks[0].Path != expectedPath || tracks[0].Language != "en" || tracks[0].Label != "subtitles_en" {
+		t.Fatalf("Expected only the English track at %s, got %+v", expectedPath, tracks)
+	}
+	data, err := os.ReadFile(expectedPath)
+	if err != nil {
+		t.Fatalf("Failed to read subtitles: %v", err)
+	}
+	expected := "WEBVTT\n" +
+		"\n00:00:01.000 --> 00:00:02.000\ntwo\n" +
+		"\n00:00:07.000 --> 00:00:08.000\nthree\n" +
+		"\n00:00:11.000 --> 00:00:11.500\nfour\n"
+	if string(data) != expected {
+		t.Errorf("Expected subtitles:\n%s\ngot:\n%s", expected, data)
+	}
+	if _, err := os.Stat(filepath.Join(outPath, "test-event.es.vtt")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file for a rendition without cues in the video, stat returned %v", err)
+	}
+}
+
+func TestProcessingService_WriteSubtitles_NoTimestamp(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "processing_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	eventName := "test-event"
+	eventPath := filepath.Join(cfg.NAS.OutputPath, eventName)
+	os.MkdirAll(filepath.Join(eventPath, "1080p"), 0755)
+	os.MkdirAll(filepath.Join(eventPath, "subtitles_en"), 0755)
+	os.WriteFile(filepath.Join(eventPath, "1080p", "media_0001.ts"), []byte("segment"), 0644)
+	os.WriteFile(filepath.Join(eventPath, "subtitles_en", "sub_0001.vtt"), []byte("WEBVTT\n"), 0644)
+
+	ps := &ProcessingService{config: cfg, eventName: eventName, nas: &nas.NASService{}}
+	tracks, err := ps.WriteSubtitles(map[SegmentKey]SegmentInfo{
+		{SeqNo: 1}: {Name: "media_0001.ts", SeqNo: 1, Resolution: "1080p"},
+	}, tempDir)
+	if err != nil || len(tracks) != 0 {
+		t.Errorf("Expected subtitles to be skipped without a video timestamp, got %+v, %v", tracks, err)
+	}
+}
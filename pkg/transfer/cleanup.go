@@ -2,9 +2,12 @@ package transfer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"m3u8-downloader/pkg/utils"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -12,6 +15,11 @@ import (
 type CleanupService struct {
 	config       CleanupConfig
 	pendingFiles []string
+	transferred  map[string]string // local path -> NAS path it was transferred to
+	onNAS        func(destPath string, size int64) (bool, error)
+	stat         func(name string) (os.FileInfo, error)
+	remove       func(name string) error
+	clock        utils.Clock
 	mu           sync.Mutex
 }
 
@@ -19,9 +27,66 @@ func NewCleanupService(config CleanupConfig) *CleanupService {
 	return &CleanupService{
 		config:       config,
 		pendingFiles: make([]string, 0),
+		transferred:  make(map[string]string),
+		stat:         os.Stat,
+		remove:       os.Remove,
+		clock:        utils.RealClock{},
 	}
 }
 
+// RecordTransferred marks a local file as transferred to destPath on the NAS.
+// With RequireTransferRecord set, only recorded files are ever deleted.
+func (cs *CleanupService) RecordTransferred(filePath, destPath string) {
+	if !cs.config.Enabled || !cs.config.RequireTransferRecord {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.transferred[filepath.Clean(filePath)] = destPath
+}
+
+// SetNASCheck sets how a recorded file's NAS copy is looked up right before
+// the local file is deleted. The record alone is written by the same code that
+// schedules the cleanup, so with RequireTransferRecord set a file is only
+// deleted once the NAS confirms it has a copy of the same size.
+func (cs *CleanupService) SetNASCheck(check func(destPath string, size int64) (bool, error)) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.onNAS = check
+}
+
+// transferRecord returns where filePath was recorded as transferred to. ok is
+// always true when no record is required.
+func (cs *CleanupService) transferRecord(filePath string) (destPath string, ok bool) {
+	if !cs.config.RequireTransferRecord {
+		return "", true
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	destPath, ok = cs.transferred[filepath.Clean(filePath)]
+	return destPath, ok
+}
+
+// onNASCheck returns the NAS lookup to confirm a transfer record with, or nil
+// when records are not required or there is no lookup
+func (cs *CleanupService) onNASCheck() func(destPath string, size int64) (bool, error) {
+	if !cs.config.RequireTransferRecord {
+		return nil
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.onNAS
+}
+
+func (cs *CleanupService) forgetTransferred(filePath string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.transferred, filepath.Clean(filePath))
+}
+
 func (cs *CleanupService) ScheduleCleanup(filePath string) error {
 	if !cs.config.Enabled {
 		return nil
@@ -42,7 +107,7 @@ func (cs *CleanupService) Start(ctx context.Context) error {
 
 	log.Printf("Cleanup service started (retention: %v, batch: %d)", cs.config.RetentionPeriod, cs.config.BatchSize)
 
-	ticker := time.NewTicker(cs.config.CheckInterval)
+	ticker := cs.clock.NewTicker(cs.config.CheckInterval)
 	defer ticker.Stop()
 
 	for {
@@ -50,19 +115,23 @@ func (cs *CleanupService) Start(ctx context.Context) error {
 		case <-ctx.Done():
 			log.Println("Cleanup service shutting down...")
 			return ctx.Err()
-		case <-ticker.C:
-			if err := cs.ExecuteCleanup(ctx); err != nil {
+		case <-ticker.C():
+			if _, err := cs.ExecuteCleanup(ctx); err != nil {
 				log.Printf("Cleanup error: %v", err)
 			}
 		}
 	}
 }
 
-func (cs *CleanupService) ExecuteCleanup(ctx context.Context) error {
+// ExecuteCleanup removes the next batch of pending files. A failure on one file
+// does not stop the batch; per-file failures are reported in the result.
+func (cs *CleanupService) ExecuteCleanup(ctx context.Context) (CleanupResult, error) {
+	var result CleanupResult
+
 	cs.mu.Lock()
 	if len(cs.pendingFiles) == 0 {
 		cs.mu.Unlock()
-		return nil
+		return result, nil
 	}
 
 	batchSize := cs.config.BatchSize
@@ -79,61 +148,148 @@ func (cs *CleanupService) ExecuteCleanup(ctx context.Context) error {
 
 	log.Printf("Processing %d files for cleanup", len(batch))
 
-	var cleanedCount int
-	var errors []error
-
-	for _, filePath := range batch {
+	for i, filePath := range batch {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			result.Requeued += cs.requeue(batch[i:])
+			return result, ctx.Err()
 		default:
 		}
 
-		if err := cs.cleanupFile(filePath); err != nil {
-			errors = append(errors, fmt.Errorf("Failed to cleanup file %s: %w", filePath, err))
-		} else {
-			cleanedCount++
+		freed, removed, err := cs.cleanupFile(ctx, filePath)
+		switch {
+		case ctx.Err() != nil:
+			result.Requeued += cs.requeue(batch[i:])
+			return result, ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded):
+			log.Printf("Cleanup of %s timed out after %v, requeued", filePath, cs.config.FileTimeout)
+			result.Requeued += cs.requeue(batch[i : i+1])
+		case err != nil:
+			result.Errors = append(result.Errors, CleanupFileError{Path: filePath, Err: err})
+		case removed:
+			result.Cleaned++
+			result.FreedBytes += freed
+		default:
+			result.Skipped++
 		}
 	}
 
-	log.Printf("Cleanup batch completed (cleaned: %d, errors: %d)", cleanedCount, len(errors))
+	log.Printf("Cleanup batch completed (cleaned: %d, skipped: %d, requeued: %d, freed: %d bytes, errors: %d)",
+		result.Cleaned, result.Skipped, result.Requeued, result.FreedBytes, len(result.Errors))
 
-	if len(errors) > 0 {
-		for i, err := range errors {
+	if len(result.Errors) > 0 {
+		for i, err := range result.Errors {
 			if i >= 3 {
-				log.Printf("... and %d more errors", len(errors)-3)
+				log.Printf("... and %d more errors", len(result.Errors)-3)
 				break
 			}
 			log.Printf("Error: %v", err)
 		}
 	}
 
-	return nil
+	return result, nil
 
 }
 
-func (cs *CleanupService) cleanupFile(filePath string) error {
-	info, err := os.Stat(filePath)
+// requeue puts files back at the end of the pending list and returns how
+// many there were
+func (cs *CleanupService) requeue(files []string) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.pendingFiles = append(cs.pendingFiles, files...)
+	return len(files)
+}
+
+// withFileTimeout runs op until it returns, ctx is done, or FileTimeout
+// passes. A call that is given up on keeps running in the background, since
+// a hung filesystem call can't be interrupted.
+func (cs *CleanupService) withFileTimeout(ctx context.Context, op func() error) error {
+	if cs.config.FileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.config.FileTimeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cleanupFile removes filePath and reports the bytes freed. removed is false
+// when the file was already gone, is still inside the retention period, or
+// has no transfer record, or no copy on the NAS, while a record is required.
+// A context error is returned as is when ctx is done or the per-file timeout
+// passes.
+func (cs *CleanupService) cleanupFile(ctx context.Context, filePath string) (freed int64, removed bool, err error) {
+	destPath, recorded := cs.transferRecord(filePath)
+	if !recorded {
+		log.Printf("Refusing to cleanup file with no transfer record: %s", filePath)
+		return 0, false, nil
+	}
+
+	var info os.FileInfo
+	err = cs.withFileTimeout(ctx, func() error {
+		var statErr error
+		info, statErr = cs.stat(filePath)
+		return statErr
+	})
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return 0, false, err
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return 0, false, nil
 		}
-		return fmt.Errorf("Failed to get file info: %w", err)
+		return 0, false, fmt.Errorf("Failed to get file info: %w", err)
 	}
 
 	if cs.config.RetentionPeriod > 0 {
-		if time.Since(info.ModTime()) < cs.config.RetentionPeriod {
+		if cs.clock.Now().Sub(info.ModTime()) < cs.config.RetentionPeriod {
 			log.Printf("File too new to cleanup: %s", filePath)
-			return nil
+			return 0, false, nil
+		}
+	}
+
+	if onNAS := cs.onNASCheck(); onNAS != nil {
+		var exists bool
+		err = cs.withFileTimeout(ctx, func() error {
+			var checkErr error
+			exists, checkErr = onNAS(destPath, info.Size())
+			return checkErr
+		})
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return 0, false, err
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("Failed to confirm NAS copy: %w", err)
+		}
+		if !exists {
+			log.Printf("Refusing to cleanup file with no matching copy on the NAS: %s (%s)", filePath, destPath)
+			return 0, false, nil
 		}
 	}
 
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("Failed to remove file: %w", err)
+	err = cs.withFileTimeout(ctx, func() error {
+		return cs.remove(filePath)
+	})
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return 0, false, err
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to remove file: %w", err)
 	}
 
+	cs.forgetTransferred(filePath)
 	log.Printf("File cleaned up: %s", filePath)
-	return nil
+	return info.Size(), true, nil
 }
 
 func (cs *CleanupService) GetPendingCount() int {
@@ -142,9 +298,11 @@ func (cs *CleanupService) GetPendingCount() int {
 	return len(cs.pendingFiles)
 }
 
-func (cs *CleanupService) ForceCleanupAll(ctx context.Context) error {
+// ForceCleanupAll drains every pending file and returns the combined result
+func (cs *CleanupService) ForceCleanupAll(ctx context.Context) (CleanupResult, error) {
 	log.Println("Force cleanup requested")
 
+	var total CleanupResult
 	for {
 		cs.mu.Lock()
 		pendingCount := len(cs.pendingFiles)
@@ -154,17 +312,24 @@ func (cs *CleanupService) ForceCleanupAll(ctx context.Context) error {
 			break
 		}
 
-		if err := cs.ExecuteCleanup(ctx); err != nil {
-			return err
+		result, err := cs.ExecuteCleanup(ctx)
+		total.Add(result)
+		if err != nil {
+			return total, err
+		}
+		if result.Requeued > 0 && result.Cleaned+result.Skipped+len(result.Errors) == 0 {
+			log.Printf("Cleanup is making no progress, leaving %d files pending", result.Requeued)
+			break
 		}
 
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(100 * time.Millisecond):
+			return total, ctx.Err()
+		case <-cs.clock.After(100 * time.Millisecond):
 		}
 	}
 
-	log.Println("Force cleanup complete")
-	return nil
+	log.Printf("Force cleanup complete (cleaned: %d, freed: %d bytes, errors: %d)",
+		total.Cleaned, total.FreedBytes, len(total.Errors))
+	return total, nil
 }
@@ -0,0 +1,422 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCleanupService(batchSize int) *CleanupService {
+	return NewCleanupService(CleanupConfig{
+		Enabled:       true,
+		BatchSize:     batchSize,
+		CheckInterval: time.Second,
+	})
+}
+
+func TestCleanupService_ExecuteCleanup_MixedResults(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := newTestCleanupService(10)
+
+	// Two removable files of known size
+	for _, name := range []string{"seg_0001.ts", "seg_0002.ts"} {
+		path := filepath.Join(tempDir, name)
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		cs.ScheduleCleanup(path)
+	}
+
+	// Already gone: neither cleaned nor an error
+	cs.ScheduleCleanup(filepath.Join(tempDir, "missing.ts"))
+
+	// A non-empty directory cannot be removed with os.Remove
+	blocked := filepath.Join(tempDir, "blocked.ts")
+	if err := os.MkdirAll(filepath.Join(blocked, "child"), 0755); err != nil {
+		t.Fatalf("Failed to create blocking directory: %v", err)
+	}
+	cs.ScheduleCleanup(blocked)
+
+	result, err := cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+
+	if result.Cleaned != 2 {
+		t.Errorf("Expected 2 cleaned files, got %d", result.Cleaned)
+	}
+	if result.FreedBytes != 200 {
+		t.Errorf("Expected 200 freed bytes, got %d", result.FreedBytes)
+	}
+	if result.Skipped != 1 {
+		t.Errorf("Expected 1 skipped file, got %d", result.Skipped)
+	}
+	if len(result.Errors) != 1 {
+		t.Fatalf("Expected 1 error, got %d", len(result.Errors))
+	}
+	if result.Errors[0].Path != blocked {
+		t.Errorf("Expected error for %s, got %s", blocked, result.Errors[0].Path)
+	}
+}
+
+func TestCleanupService_ExecuteCleanup_RetentionSkips(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := NewCleanupService(CleanupConfig{
+		Enabled:         true,
+		BatchSize:       10,
+		RetentionPeriod: time.Hour,
+		CheckInterval:   time.Second,
+	})
+
+	path := filepath.Join(tempDir, "fresh.ts")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	cs.ScheduleCleanup(path)
+
+	result, err := cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+	if result.Cleaned != 0 || result.Skipped != 1 {
+		t.Errorf("Expected file inside retention to be skipped, got cleaned=%d skipped=%d", result.Cleaned, result.Skipped)
+	}
+	if !fileExists(path) {
+		t.Error("File inside retention period should not be removed")
+	}
+}
+
+func TestCleanupService_ForceCleanupAll_AggregatesBatches(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := newTestCleanupService(2)
+	for _, name := range []string{"a.ts", "b.ts", "c.ts", "d.ts", "e.ts"} {
+		path := filepath.Join(tempDir, name)
+		if err := os.WriteFile(path, make([]byte, 10), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		cs.ScheduleCleanup(path)
+	}
+
+	result, err := cs.ForceCleanupAll(context.Background())
+	if err != nil {
+		t.Fatalf("ForceCleanupAll() returned error: %v", err)
+	}
+	if result.Cleaned != 5 {
+		t.Errorf("Expected 5 cleaned files across batches, got %d", result.Cleaned)
+	}
+	if result.FreedBytes != 50 {
+		t.Errorf("Expected 50 freed bytes, got %d", result.FreedBytes)
+	}
+	if cs.GetPendingCount() != 0 {
+		t.Errorf("Expected no pending files, got %d", cs.GetPendingCount())
+	}
+}
+
+func TestCleanupService_RequireTransferRecord_SkipsUnrecorded(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := NewCleanupService(CleanupConfig{
+		Enabled:               true,
+		BatchSize:             10,
+		CheckInterval:         time.Second,
+		RequireTransferRecord: true,
+	})
+
+	transferred := filepath.Join(tempDir, "1080p", "media_0001.ts")
+	unrecorded := filepath.Join(tempDir, "1080p", "media_0002.ts")
+	os.MkdirAll(filepath.Dir(transferred), 0755)
+	for _, path := range []string{transferred, unrecorded} {
+		if err := os.WriteFile(path, make([]byte, 10), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	// Recorded under an unclean form of the same path
+	cs.RecordTransferred(filepath.Join(tempDir, "1080p", ".", "media_0001.ts"), "event/1080p/media_0001.ts")
+	cs.ScheduleCleanup(transferred)
+	cs.ScheduleCleanup(unrecorded)
+
+	result, err := cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+	if result.Cleaned != 1 || result.Skipped != 1 {
+		t.Errorf("Expected 1 cleaned and 1 skipped, got cleaned=%d skipped=%d", result.Cleaned, result.Skipped)
+	}
+	if fileExists(transferred) {
+		t.Error("Recorded file should have been removed")
+	}
+	if !fileExists(unrecorded) {
+		t.Error("File without a transfer record must not be removed")
+	}
+}
+
+func TestCleanupService_RequiresCopyOnNAS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := NewCleanupService(CleanupConfig{
+		Enabled:               true,
+		BatchSize:             10,
+		CheckInterval:         time.Second,
+		RequireTransferRecord: true,
+	})
+	onNAS := map[string]int64{"event/1080p/media_0001.ts": 10}
+	cs.SetNASCheck(func(destPath string, size int64) (bool, error) {
+		nasSize, ok := onNAS[destPath]
+		return ok && nasSize == size, nil
+	})
+
+	transferred := filepath.Join(tempDir, "media_0001.ts")
+	neverQueued := filepath.Join(tempDir, "media_0002.ts")
+	for _, path := range []string{transferred, neverQueued} {
+		if err := os.WriteFile(path, make([]byte, 10), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	// Both are recorded and scheduled, but only one ever reached the NAS
+	cs.RecordTransferred(transferred, "event/1080p/media_0001.ts")
+	cs.RecordTransferred(neverQueued, "event/1080p/media_0002.ts")
+	cs.ScheduleCleanup(transferred)
+	cs.ScheduleCleanup(neverQueued)
+
+	result, err := cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+	if result.Cleaned != 1 || result.Skipped != 1 {
+		t.Errorf("Expected 1 cleaned and 1 skipped, got cleaned=%d skipped=%d", result.Cleaned, result.Skipped)
+	}
+	if fileExists(transferred) {
+		t.Error("File with a copy on the NAS should have been removed")
+	}
+	if !fileExists(neverQueued) {
+		t.Error("File without a copy on the NAS must not be removed")
+	}
+
+	// A failed lookup keeps the file
+	cs.SetNASCheck(func(destPath string, size int64) (bool, error) {
+		return false, fmt.Errorf("NAS unreachable")
+	})
+	cs.ScheduleCleanup(neverQueued)
+	result, _ = cs.ExecuteCleanup(context.Background())
+	if len(result.Errors) != 1 || !fileExists(neverQueued) {
+		t.Errorf("Expected the file to be kept with 1 error when the NAS check fails, got %d errors", len(result.Errors))
+	}
+}
+
+func TestCleanupService_WithoutRecordRequirement(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := newTestCleanupService(10)
+	path := filepath.Join(tempDir, "media_0001.ts")
+	os.WriteFile(path, []byte("data"), 0644)
+	cs.ScheduleCleanup(path)
+
+	result, err := cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+	if result.Cleaned != 1 {
+		t.Errorf("Expected unrecorded file to be cleaned when no record is required, got %d", result.Cleaned)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestCleanupService_SlowRemoveIsRequeued(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := NewCleanupService(CleanupConfig{
+		Enabled:     true,
+		BatchSize:   10,
+		FileTimeout: 50 * time.Millisecond,
+	})
+
+	hung := filepath.Join(tempDir, "seg_0001.ts")
+	fast := filepath.Join(tempDir, "seg_0002.ts")
+	for _, path := range []string{hung, fast} {
+		os.WriteFile(path, make([]byte, 100), 0644)
+		cs.ScheduleCleanup(path)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	cs.remove = func(name string) error {
+		if name == hung {
+			<-release
+		}
+		return os.Remove(name)
+	}
+
+	start := time.Now()
+	result, err := cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the hung remove to be abandoned after the timeout, took %v", elapsed)
+	}
+	if result.Cleaned != 1 || result.Requeued != 1 || len(result.Errors) != 0 {
+		t.Errorf("Expected 1 cleaned and 1 requeued, got %+v", result)
+	}
+	if fileExists(fast) {
+		t.Error("File after the hung one should still be cleaned")
+	}
+	if cs.GetPendingCount() != 1 {
+		t.Errorf("Expected the timed out file to be pending again, got %d pending", cs.GetPendingCount())
+	}
+}
+
+func TestCleanupService_CancelRequeuesRemaining(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := newTestCleanupService(10)
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(tempDir, fmt.Sprintf("seg_%04d.ts", i))
+		os.WriteFile(path, make([]byte, 100), 0644)
+		cs.ScheduleCleanup(path)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	cs.stat = func(name string) (os.FileInfo, error) {
+		cancel()
+		<-release
+		return os.Stat(name)
+	}
+
+	result, err := cs.ExecuteCleanup(ctx)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if result.Requeued != 3 || result.Cleaned != 0 {
+		t.Errorf("Expected all 3 files requeued, got %+v", result)
+	}
+	if cs.GetPendingCount() != 3 {
+		t.Errorf("Expected 3 files pending after cancel, got %d", cs.GetPendingCount())
+	}
+}
+
+func TestCleanupService_ForceCleanupAllStopsWhenStuck(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := NewCleanupService(CleanupConfig{
+		Enabled:     true,
+		BatchSize:   10,
+		FileTimeout: 20 * time.Millisecond,
+	})
+	path := filepath.Join(tempDir, "seg_0001.ts")
+	os.WriteFile(path, make([]byte, 100), 0644)
+	cs.ScheduleCleanup(path)
+
+	release := make(chan struct{})
+	defer close(release)
+	cs.remove = func(name string) error {
+		<-release
+		return os.Remove(name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := cs.ForceCleanupAll(ctx)
+	if err != nil {
+		t.Fatalf("ForceCleanupAll() returned error: %v", err)
+	}
+	if result.Requeued != 1 || cs.GetPendingCount() != 1 {
+		t.Errorf("Expected the stuck file to be left pending, got %+v with %d pending", result, cs.GetPendingCount())
+	}
+}
+
+func TestCleanupService_RetentionUsesClock(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "cleanup_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cs := NewCleanupService(CleanupConfig{
+		Enabled:         true,
+		BatchSize:       10,
+		RetentionPeriod: time.Hour,
+		CheckInterval:   time.Second,
+	})
+
+	path := filepath.Join(tempDir, "segment.ts")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	modTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+
+	clock := utils.NewFakeClock(modTime.Add(59 * time.Minute))
+	cs.clock = clock
+
+	cs.ScheduleCleanup(path)
+	result, err := cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+	if result.Cleaned != 0 || !fileExists(path) {
+		t.Fatal("File one minute short of the retention period should be kept")
+	}
+
+	clock.Advance(time.Minute)
+	cs.ScheduleCleanup(path)
+	result, err = cs.ExecuteCleanup(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteCleanup() returned error: %v", err)
+	}
+	if result.Cleaned != 1 || fileExists(path) {
+		t.Errorf("Expected file to be removed once the retention period passed, got cleaned=%d", result.Cleaned)
+	}
+}
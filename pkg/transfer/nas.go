@@ -10,9 +10,9 @@ import (
 )
 
 func TransferFile(nt *nas.NASService, ctx context.Context, item *TransferItem) error {
-	destPath := filepath.Join(nt.Config.Path, item.DestinationPath)
+	destPath := nt.JoinPath(item.DestinationPath)
 
-	destDir := filepath.Dir(destPath)
+	destDir := nt.JoinPath(filepath.Dir(item.DestinationPath))
 	if err := nt.EnsureDirectoryExists(destDir); err != nil {
 		return fmt.Errorf("Failed to create directory %s: %w", destDir, err)
 	}
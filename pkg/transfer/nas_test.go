@@ -0,0 +1,66 @@
+package transfer
+
+import (
+	"context"
+	"m3u8-downloader/pkg/nas"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferFile_VerifySize(t *testing.T) {
+	// procfs reports a size of 0 for files that have content, so copying one
+	// always looks like a size mismatch
+	const source = "/proc/self/status"
+	if info, err := os.Stat(source); err != nil || info.Size() != 0 {
+		t.Skip("needs procfs")
+	}
+
+	tests := []struct {
+		name       string
+		verifySize bool
+		wantErr    bool
+	}{
+		{"verification on", true, true},
+		{"verification off", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "nas_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			nasService := nas.NewNASService(nas.NASConfig{
+				Path:       tempDir,
+				Timeout:    5 * time.Second,
+				VerifySize: tt.verifySize,
+			})
+			item := &TransferItem{SourcePath: source, DestinationPath: filepath.Join("event", "status")}
+
+			err = TransferFile(nasService, context.Background(), item)
+			dest := filepath.Join(tempDir, "event", "status")
+			_, statErr := os.Stat(dest)
+
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "size mismatch") {
+					t.Errorf("Expected a size mismatch, got %v", err)
+				}
+				if statErr == nil {
+					t.Error("Expected the mismatched copy to be removed")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected no verification with VerifySize off, got %v", err)
+			}
+			if statErr != nil {
+				t.Errorf("Expected the copy to be kept: %v", statErr)
+			}
+		})
+	}
+}
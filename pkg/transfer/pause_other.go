@@ -0,0 +1,8 @@
+//go:build !unix
+
+package transfer
+
+import "context"
+
+// HandlePauseSignal is a no-op where SIGUSR1 doesn't exist
+func (ts *TransferService) HandlePauseSignal(ctx context.Context) {}
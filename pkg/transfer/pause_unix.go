@@ -0,0 +1,28 @@
+//go:build unix
+
+package transfer
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandlePauseSignal toggles Pause/Resume on each SIGUSR1 until ctx is done
+func (ts *TransferService) HandlePauseSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	log.Printf("Send SIGUSR1 (kill -USR1 %d) to pause or resume transfers", os.Getpid())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			ts.TogglePause()
+		}
+	}
+}
@@ -3,12 +3,15 @@ package transfer
 import (
 	"container/heap"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"m3u8-downloader/pkg/nas"
+	"m3u8-downloader/pkg/utils"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,38 +22,64 @@ type TransferQueue struct {
 	nasService *nas.NASService
 	cleanup    *CleanupService
 	workers    []chan TransferItem
+	dispatch   chan struct{} // signals that items or worker capacity became available
+	inFlight   int64         // items handed to a worker and not yet finished
+	paused     int32         // set by Pause; dispatch is skipped while non-zero
+	skewWarned bool          // a future-dated item has already been logged
+	restored   RestoredCounts
+	quarantine []TransferItem            // segments rejected by the TS check, never sent to the NAS
+	failed     map[string]TransferItem   // transfers that failed for good, by cleaned source path, until queued again
+	scans      map[string]string         // QueueExistingFiles checkpoints: scan root -> last file handled
+	statuses   map[string]TransferStatus // latest status by cleaned source path
+	expected   map[string]int64          // NAS destination -> size of every item added or restored
+	verifier   *verifyPool               // nil unless checksum verification is enabled
+	verify     func(item TransferItem) error
+	transfer   func(ctx context.Context, item *TransferItem) error
+	clock      utils.Clock
+	store      StateStore
 	mu         sync.RWMutex
+	saveMu     sync.Mutex // serializes snapshots to the state store
 }
 
-type PriorityQueue []*TransferItem
+// PriorityQueue orders pending items newest first, or smallest first when
+// smallestFirst is set so short segment copies don't wait behind large
+// re-encoded outputs. Equal sizes fall back to newest first.
+type PriorityQueue struct {
+	items         []*TransferItem
+	smallestFirst bool
+}
 
 func (pq PriorityQueue) Len() int {
-	return len(pq)
+	return len(pq.items)
 }
 
 func (pq PriorityQueue) Less(i, j int) bool {
-	return pq[i].Timestamp.After(pq[j].Timestamp)
+	a, b := pq.items[i], pq.items[j]
+	if pq.smallestFirst && a.FileSize != b.FileSize {
+		return a.FileSize < b.FileSize
+	}
+	return a.Timestamp.After(b.Timestamp)
 }
 
 func (pq PriorityQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
+	pq.items[i], pq.items[j] = pq.items[j], pq.items[i]
 }
 
 func (pq *PriorityQueue) Push(x interface{}) {
 	item := x.(*TransferItem)
-	*pq = append(*pq, item)
+	pq.items = append(pq.items, item)
 }
 
 func (pq *PriorityQueue) Pop() interface{} {
-	old := *pq
+	old := pq.items
 	n := len(old)
 	item := old[n-1]
-	*pq = old[0 : n-1]
+	pq.items = old[0 : n-1]
 	return item
 }
 
 func NewTransferQueue(config QueueConfig, nasTransfer *nas.NASService, cleanup *CleanupService) *TransferQueue {
-	pq := &PriorityQueue{}
+	pq := &PriorityQueue{smallestFirst: config.SmallestFirst}
 	heap.Init(pq)
 
 	tq := &TransferQueue{
@@ -60,6 +89,31 @@ func NewTransferQueue(config QueueConfig, nasTransfer *nas.NASService, cleanup *
 		nasService: nasTransfer,
 		cleanup:    cleanup,
 		workers:    make([]chan TransferItem, config.WorkerCount),
+		dispatch:   make(chan struct{}, 1),
+		scans:      make(map[string]string),
+		statuses:   make(map[string]TransferStatus),
+		failed:     make(map[string]TransferItem),
+		expected:   make(map[string]int64),
+		clock:      utils.RealClock{},
+	}
+	tq.transfer = func(ctx context.Context, item *TransferItem) error {
+		return TransferFile(tq.nasService, ctx, item)
+	}
+
+	store, err := newStateStore(&tq.config)
+	if err != nil {
+		log.Printf("Failed to open queue state store, using %s: %v", config.PersistencePath, err)
+		store = &jsonStateStore{config: &tq.config}
+	}
+	tq.store = store
+
+	if config.VerifyChecksum {
+		workers := config.VerifyWorkers
+		if workers <= 0 {
+			workers = config.WorkerCount
+		}
+		tq.verifier = newVerifyPool(workers)
+		tq.verify = tq.verifyChecksum
 	}
 
 	if err := tq.LoadState(); err != nil {
@@ -69,22 +123,79 @@ func NewTransferQueue(config QueueConfig, nasTransfer *nas.NASService, cleanup *
 	return tq
 }
 
+// Expected returns the NAS destination and size of every item added or
+// restored since the queue was created, whatever has happened to it since
+func (tq *TransferQueue) Expected() map[string]int64 {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+
+	expected := make(map[string]int64, len(tq.expected))
+	for destPath, size := range tq.expected {
+		expected[destPath] = size
+	}
+	return expected
+}
+
+// Add queues item. It is recorded in the state store before the queue lock
+// is taken, so a slow store doesn't hold up dispatch, and before a worker can
+// record a later status for it. An item turned away by a full queue is left
+// recorded, so a restart still picks it up.
 func (tq *TransferQueue) Add(item TransferItem) error {
+	if item.Timestamp.IsZero() {
+		item.Timestamp = tq.clock.Now()
+	}
+	tq.record(item)
+
 	tq.mu.Lock()
 	defer tq.mu.Unlock()
 
 	if tq.items.Len() >= tq.config.MaxQueueSize {
 		return fmt.Errorf("Queue is full (max size: %d)", tq.config.MaxQueueSize)
 	}
+	tq.checkClockSkew(item)
 
 	heap.Push(tq.items, &item)
+	tq.statuses[filepath.Clean(item.SourcePath)] = StatusPending
+	delete(tq.failed, filepath.Clean(item.SourcePath))
+	tq.expected[item.DestinationPath] = item.FileSize
 	tq.stats.IncrementAdded()
 
 	log.Printf("Added file to queue: %s", item.SourcePath)
+	tq.signalDispatch()
 
 	return nil
 }
 
+// defaultSaveInterval is how often ProcessQueue persists the queue when
+// QueueConfig.SaveInterval is unset
+const defaultSaveInterval = 30 * time.Second
+
+// maxClockSkew is how far in the future an item may be dated before the
+// queue warns that file timestamps and the local clock disagree
+const maxClockSkew = time.Minute
+
+// checkClockSkew warns once if an item is dated well ahead of the local
+// clock. Items are ordered by file modification time, so a skewed clock on
+// the download volume would put its files ahead of everything else.
+func (tq *TransferQueue) checkClockSkew(item TransferItem) {
+	ahead := item.Timestamp.Sub(tq.clock.Now())
+	if ahead <= maxClockSkew || tq.skewWarned {
+		return
+	}
+	tq.skewWarned = true
+	log.Printf("Warning: %s is dated %v in the future; the download volume's clock may be skewed and transfer order may be off",
+		item.SourcePath, ahead.Round(time.Second))
+}
+
+// signalDispatch wakes the dispatch loop without blocking. Signals coalesce,
+// and a single dispatchWork pass serves every pending one.
+func (tq *TransferQueue) signalDispatch() {
+	select {
+	case tq.dispatch <- struct{}{}:
+	default:
+	}
+}
+
 func (tq *TransferQueue) ProcessQueue(ctx context.Context) error {
 	for i := 0; i < tq.config.WorkerCount; i++ {
 		workerChan := make(chan TransferItem, 1)
@@ -99,53 +210,137 @@ func (tq *TransferQueue) ProcessQueue(ctx context.Context) error {
 					return
 				case item := <-workChan:
 					tq.processItem(ctx, item)
+					atomic.AddInt64(&tq.inFlight, -1)
+					tq.signalDispatch()
 				}
 			}
 		}(i, workerChan)
 	}
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	saveInterval := tq.config.SaveInterval
+	if saveInterval <= 0 {
+		saveInterval = defaultSaveInterval
+	}
+	saveTicker := tq.clock.NewTicker(saveInterval)
+	defer saveTicker.Stop()
+
+	// Items restored by LoadState may already be waiting
+	tq.signalDispatch()
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Transfer queue shutting down...")
 			return ctx.Err()
-		case <-ticker.C:
+		case <-tq.dispatch:
 			tq.dispatchWork()
+		case <-saveTicker.C():
+			if err := tq.SaveState(); err != nil {
+				log.Printf("Failed to save queue state: %v", err)
+			}
+		}
+	}
+}
 
-			if time.Now().Unix()%30 == 0 {
-				if err := tq.SaveState(); err != nil {
-					log.Printf("Failed to save queue state: %v", err)
-				}
+// Drain runs the queue until every item has been handed to a worker and
+// finished, then saves state and returns. Items added while draining are
+// processed as well.
+func (tq *TransferQueue) Drain(ctx context.Context) error {
+	drainCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tq.ProcessQueue(drainCtx)
+	}()
+
+	ticker := tq.clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			return ctx.Err()
+		case <-ticker.C():
+			if tq.isIdle() {
+				cancel()
+				<-done
+				return tq.SaveState()
 			}
 		}
 	}
 }
 
+// Pause stops dispatching items to workers; Add keeps queueing them. It
+// returns false if the queue was already paused.
+func (tq *TransferQueue) Pause() bool {
+	return atomic.CompareAndSwapInt32(&tq.paused, 0, 1)
+}
+
+// Resume restarts dispatch after Pause. It returns false if the queue was
+// not paused.
+func (tq *TransferQueue) Resume() bool {
+	if !atomic.CompareAndSwapInt32(&tq.paused, 1, 0) {
+		return false
+	}
+	tq.signalDispatch()
+	return true
+}
+
+// Paused reports whether dispatch is paused
+func (tq *TransferQueue) Paused() bool {
+	return atomic.LoadInt32(&tq.paused) != 0
+}
+
+// isIdle reports whether the queue is empty and no worker holds an item
+func (tq *TransferQueue) isIdle() bool {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+	return tq.items.Len() == 0 && atomic.LoadInt64(&tq.inFlight) == 0
+}
+
 func (tq *TransferQueue) dispatchWork() {
+	if tq.Paused() {
+		return
+	}
+
 	tq.mu.Lock()
 	defer tq.mu.Unlock()
 
 	for i, workerChan := range tq.workers {
-		if len(workerChan) == 0 && tq.items.Len() > 0 {
-			item := heap.Pop(tq.items).(*TransferItem)
-			item.Status = StatusInProgress
+		if tq.items.Len() == 0 {
+			return
+		}
+		if workerChan == nil || len(workerChan) >= cap(workerChan) {
+			continue
+		}
 
-			select {
-			case workerChan <- *item:
-				log.Printf("Dispatched file to worker %d: %s", i, item.SourcePath)
-			default:
-				heap.Push(tq.items, item)
-				item.Status = StatusPending
+		// Peek at the head and only remove it once the worker has accepted
+		// it, so an item is never out of the heap unless actually dispatched
+		next := *tq.items.items[0]
+		next.Status = StatusInProgress
 
-			}
+		select {
+		case workerChan <- next:
+			heap.Pop(tq.items)
+			tq.statuses[filepath.Clean(next.SourcePath)] = StatusInProgress
+			atomic.AddInt64(&tq.inFlight, 1)
+			log.Printf("Dispatched file to worker %d: %s", i, next.SourcePath)
+		default:
 		}
 	}
 }
 
 func (tq *TransferQueue) processItem(ctx context.Context, item TransferItem) {
+	// Subtitle segments are text, so only media segments are checked
+	if tq.config.VerifySegments && utils.IsSegmentFile(item.SourcePath) {
+		if err := utils.ValidateTSFile(item.SourcePath); err != nil {
+			tq.quarantineItem(item, err)
+			return
+		}
+	}
+
 	// Check if file already exists on NAS before attempting transfer
 	if exists, err := tq.nasService.FileExists(item.DestinationPath, item.FileSize); err != nil {
 		log.Printf("Failed to check if file exists on NAS for %s: %v", item.SourcePath, err)
@@ -153,10 +348,12 @@ func (tq *TransferQueue) processItem(ctx context.Context, item TransferItem) {
 	} else if exists {
 		log.Printf("File already exists on NAS, skipping transfer: %s", item.SourcePath)
 		item.Status = StatusCompleted
+		tq.setStatus(item)
 		tq.stats.IncrementCompleted(item.FileSize)
 
 		// Schedule for cleanup
 		if tq.cleanup != nil {
+			tq.cleanup.RecordTransferred(item.SourcePath, item.DestinationPath)
 			if err := tq.cleanup.ScheduleCleanup(item.SourcePath); err != nil {
 				log.Printf("Failed to schedule cleanup for existing file %s: %v", item.SourcePath, err)
 			}
@@ -165,102 +362,312 @@ func (tq *TransferQueue) processItem(ctx context.Context, item TransferItem) {
 	}
 
 	maxRetries := 3
+	policy := utils.RetryPolicy{
+		Attempts:     maxRetries,
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+		Retryable: func(err error) bool {
+			return !nas.IsDiskFull(err)
+		},
+		Clock: tq.clock,
+	}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt > 0 {
+	err := utils.Retry(ctx, policy, func(attempt int) error {
+		if attempt > 1 {
 			item.Status = StatusRetrying
-			backoff := time.Duration(attempt*attempt) * time.Second
-			log.Printf("Backing off for %d seconds before retrying (attempt %d/%d)", backoff, attempt, maxRetries)
-
-			select {
-			case <-time.After(backoff):
-			case <-ctx.Done():
-				return
-			}
+			tq.setStatus(item)
+			log.Printf("Retrying transfer of %s (attempt %d/%d)", item.SourcePath, attempt, maxRetries)
 		}
 
-		err := TransferFile(tq.nasService, ctx, &item)
-		if err == nil {
-			item.Status = StatusCompleted
-			tq.stats.IncrementCompleted(item.FileSize)
+		err := tq.transfer(ctx, &item)
+		if err != nil {
+			item.LastError = err.Error()
+			item.RetryCount++
+			log.Printf("File transfer failed: %s (attempt %d/%d): %v", item.SourcePath, attempt, maxRetries, err)
+		}
+		return err
+	})
 
-			if tq.cleanup != nil {
-				if err := tq.cleanup.ScheduleCleanup(item.SourcePath); err != nil {
-					log.Printf("Failed to add file to cleanup list: %v", err)
-				}
-			}
-			log.Printf("File transfer completed: %s", item.SourcePath)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if nas.IsDiskFull(err) {
+			tq.pauseDiskFull(item)
 			return
 		}
+		item.Status = StatusFailed
+		tq.setStatus(item)
+		tq.stats.IncrementFailed()
+		log.Printf("Transfer permanently failed for file: %s", item.SourcePath)
+		return
+	}
 
-		item.LastError = err.Error()
-		item.RetryCount++
+	if tq.verifier != nil {
+		tq.submitVerification(ctx, item)
+		return
+	}
 
-		log.Printf("File transfer failed: %s (attempt %d/%d): %v", item.SourcePath, item.RetryCount, maxRetries, err)
+	tq.completeItem(item)
+}
+
+// completeItem records a finished transfer and schedules the local file for
+// cleanup
+func (tq *TransferQueue) completeItem(item TransferItem) {
+	item.Status = StatusCompleted
+	tq.setStatus(item)
+	tq.stats.IncrementCompleted(item.FileSize)
+
+	if tq.cleanup != nil {
+		tq.cleanup.RecordTransferred(item.SourcePath, item.DestinationPath)
+		if err := tq.cleanup.ScheduleCleanup(item.SourcePath); err != nil {
+			log.Printf("Failed to add file to cleanup list: %v", err)
+		}
+	}
+	log.Printf("File transfer completed: %s", item.SourcePath)
+}
 
-		if attempt == maxRetries {
-			item.Status = StatusFailed
-			tq.stats.IncrementFailed()
-			log.Printf("Transfer permanently failed for file: %s", item.SourcePath)
+// submitVerification hands a copied item to the verify pool, freeing the
+// worker for its next copy. The item counts as in flight until verification
+// finishes so the queue isn't reported idle early.
+func (tq *TransferQueue) submitVerification(ctx context.Context, item TransferItem) {
+	atomic.AddInt64(&tq.inFlight, 1)
+	err := tq.verifier.Submit(ctx, func() error {
+		return tq.verify(item)
+	}, func(err error) {
+		defer func() {
+			atomic.AddInt64(&tq.inFlight, -1)
+			tq.signalDispatch()
+		}()
+		if err != nil {
+			tq.failVerification(item, err)
 			return
 		}
+		tq.completeItem(item)
+	})
+	if err != nil {
+		// Shutting down before a slot freed up
+		atomic.AddInt64(&tq.inFlight, -1)
 	}
 }
 
-func (tq *TransferQueue) SaveState() error {
+func (tq *TransferQueue) verifyChecksum(item TransferItem) error {
+	destPath := tq.nasService.JoinPath(item.DestinationPath)
+	return tq.nasService.VerifyChecksum(item.SourcePath, destPath)
+}
+
+// failVerification removes a copy that failed verification and marks only
+// that item failed; the local file is kept for the next attempt.
+func (tq *TransferQueue) failVerification(item TransferItem, err error) {
+	os.Remove(tq.nasService.JoinPath(item.DestinationPath))
+
+	item.Status = StatusFailed
+	item.LastError = err.Error()
+	tq.setStatus(item)
+	tq.stats.IncrementFailed()
+	log.Printf("Transfer verification failed for file %s: %v", item.SourcePath, err)
+}
+
+// quarantineItem records a segment that failed validation. The local file is
+// left in place for inspection and is not scheduled for cleanup.
+func (tq *TransferQueue) quarantineItem(item TransferItem, err error) {
+	item.Status = StatusFailed
+	item.LastError = err.Error()
+
 	tq.mu.Lock()
-	defer tq.mu.Unlock()
+	tq.quarantine = append(tq.quarantine, item)
+	tq.statuses[filepath.Clean(item.SourcePath)] = StatusFailed
+	tq.mu.Unlock()
+	tq.record(item)
+
+	tq.stats.IncrementFailed()
+	log.Printf("Quarantined invalid segment %s: %v", item.SourcePath, err)
+}
 
-	items := make([]*TransferItem, tq.items.Len())
-	tempPQ := make(PriorityQueue, tq.items.Len())
-	copy(tempPQ, *tq.items)
+// pauseDiskFull puts item back in the queue and pauses dispatch, since every
+// other transfer would fail the same way until space is freed on the NAS
+func (tq *TransferQueue) pauseDiskFull(item TransferItem) {
+	// Pause first so the item isn't dispatched again as soon as it's back
+	paused := tq.Pause()
 
-	for i := 0; i < len(items); i++ {
-		items[i] = heap.Pop(&tempPQ).(*TransferItem)
+	item.Status = StatusPending
+	tq.mu.Lock()
+	heap.Push(tq.items, &item)
+	tq.statuses[filepath.Clean(item.SourcePath)] = StatusPending
+	queued := tq.items.Len()
+	tq.mu.Unlock()
+	tq.record(item)
+
+	if paused {
+		log.Printf("NAS full: pausing transfers (%d queued); free space on the NAS, then resume", queued)
 	}
+	log.Printf("Requeued %s after NAS ran out of space", item.SourcePath)
+}
 
-	data, err := json.MarshalIndent(map[string]interface{}{
-		"items":     items,
-		"stats":     tq.stats,
-		"timestamp": time.Now(),
-	}, "", "  ")
-	if err != nil {
-		return fmt.Errorf("Failed to marshal queue state: %w", err)
+// setStatus records item's current status for Status and the state store.
+// An item that failed for good is kept for SaveState, since it has already
+// left the heap.
+func (tq *TransferQueue) setStatus(item TransferItem) {
+	key := filepath.Clean(item.SourcePath)
+	tq.mu.Lock()
+	tq.statuses[key] = item.Status
+	if item.Status == StatusFailed {
+		tq.failed[key] = item
+	} else {
+		delete(tq.failed, key)
 	}
+	tq.mu.Unlock()
+	tq.record(item)
+}
+
+// Status reports the latest status of the local file at sourcePath, or false
+// if the queue has never seen it
+func (tq *TransferQueue) Status(sourcePath string) (TransferStatus, bool) {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+	status, ok := tq.statuses[filepath.Clean(sourcePath)]
+	return status, ok
+}
 
-	if err := os.WriteFile(tq.config.PersistencePath, data, 0644); err != nil {
-		return fmt.Errorf("Failed to save queue state: %w", err)
+// Quarantined returns the segments rejected by validation
+func (tq *TransferQueue) Quarantined() []TransferItem {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+	return append([]TransferItem(nil), tq.quarantine...)
+}
+
+// ScanCheckpoint returns the last file, relative to root, that an interrupted
+// scan of root handled, or "" if there is none
+func (tq *TransferQueue) ScanCheckpoint(root string) string {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+	return tq.scans[filepath.Clean(root)]
+}
+
+// SetScanCheckpoint records progress through a scan of root; it is persisted
+// with the queue by the next SaveState. An empty relPath clears it.
+func (tq *TransferQueue) SetScanCheckpoint(root, relPath string) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if relPath == "" {
+		delete(tq.scans, filepath.Clean(root))
+		return
 	}
+	tq.scans[filepath.Clean(root)] = relPath
+}
 
-	return nil
+// snapshotScans copies the scan checkpoints under the lock
+func (tq *TransferQueue) snapshotScans() map[string]string {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+	scans := make(map[string]string, len(tq.scans))
+	for root, relPath := range tq.scans {
+		scans[root] = relPath
+	}
+	return scans
 }
 
-func (tq *TransferQueue) LoadState() error {
-	data, err := os.ReadFile(tq.config.PersistencePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+// snapshotItems copies the queued items by value under the lock
+func (tq *TransferQueue) snapshotItems() []TransferItem {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+
+	items := make([]TransferItem, tq.items.Len())
+	for i, item := range tq.items.items {
+		items[i] = *item
+	}
+	return items
+}
+
+// persistedItems returns the queued items LoadState would restore, and the
+// ones that failed for good, so completed and in-flight entries don't bloat
+// the state file
+func (tq *TransferQueue) persistedItems() []TransferItem {
+	items := tq.snapshotItems()
+	kept := items[:0]
+	for _, item := range items {
+		if item.Status == StatusPending || item.Status == StatusFailed {
+			kept = append(kept, item)
 		}
-		return fmt.Errorf("Failed to load queue state: %w", err)
 	}
 
-	var state struct {
-		Items     []*TransferItem `json:"items"`
-		Stats     *QueueStats     `json:"stats"`
-		Timestamp time.Time       `json:"timestamp"`
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+	for _, item := range tq.failed {
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// SaveState writes the pending and failed items, quarantine, scan
+// checkpoints, and stats to the state store
+func (tq *TransferQueue) SaveState() error {
+	// Sort and serialize outside the queue lock so a large queue doesn't
+	// stall Add and dispatch while it is written out
+	items := tq.persistedItems()
+	quarantined := tq.Quarantined()
+	scans := tq.snapshotScans()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Timestamp.After(items[j].Timestamp)
+	})
+
+	tq.saveMu.Lock()
+	defer tq.saveMu.Unlock()
+
+	added, completed, failed, pending, bytes := tq.stats.GetStats()
+	stats := &QueueStats{
+		TotalAdded:       added,
+		TotalCompleted:   completed,
+		TotalFailed:      failed,
+		CurrentPending:   pending,
+		BytesTransferred: bytes,
+	}
+
+	state := QueueState{
+		Items:           make([]*TransferItem, len(items)),
+		Quarantined:     quarantined,
+		ScanCheckpoints: scans,
+		Stats:           stats,
+		Timestamp:       time.Now(),
+	}
+	for i := range items {
+		state.Items[i] = &items[i]
 	}
+	return tq.store.Save(state)
+}
 
-	if err := json.Unmarshal(data, &state); err != nil {
-		return fmt.Errorf("Failed to load queue state: %w", err)
+func (tq *TransferQueue) LoadState() error {
+	state, err := tq.store.Load()
+	if err != nil || state == nil {
+		return err
 	}
 
 	tq.mu.Lock()
 	defer tq.mu.Unlock()
 
 	for _, item := range state.Items {
-		if item.Status == StatusPending || item.Status == StatusFailed {
-			heap.Push(tq.items, item)
+		switch item.Status {
+		case StatusPending:
+			tq.restored.Pending++
+		case StatusFailed:
+			tq.restored.Failed++
+		default:
+			continue
 		}
+		heap.Push(tq.items, item)
+		tq.statuses[filepath.Clean(item.SourcePath)] = item.Status
+		tq.expected[item.DestinationPath] = item.FileSize
+	}
+
+	for _, item := range state.Quarantined {
+		tq.quarantine = append(tq.quarantine, item)
+		tq.statuses[filepath.Clean(item.SourcePath)] = StatusFailed
+	}
+
+	for root, relPath := range state.ScanCheckpoints {
+		tq.scans[root] = relPath
 	}
 
 	if state.Stats != nil {
@@ -272,6 +679,27 @@ func (tq *TransferQueue) LoadState() error {
 	return nil
 }
 
+// record passes item's new status to the state store. A failed write is only
+// logged; the next one for the item, or the next SaveState, catches up.
+func (tq *TransferQueue) record(item TransferItem) {
+	if err := tq.store.Update(item); err != nil {
+		log.Printf("Failed to record queue item: %v", err)
+	}
+}
+
+// Close releases the state store. Call SaveState first to keep the latest
+// state.
+func (tq *TransferQueue) Close() error {
+	return tq.store.Close()
+}
+
+// Restored returns how many items LoadState put back on the queue
+func (tq *TransferQueue) Restored() RestoredCounts {
+	tq.mu.RLock()
+	defer tq.mu.RUnlock()
+	return tq.restored
+}
+
 func (tq *TransferQueue) GetStats() (int, int, int, int, int64) {
 	return tq.stats.GetStats()
 }
@@ -0,0 +1,1124 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"m3u8-downloader/pkg/nas"
+	"m3u8-downloader/pkg/utils"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestQueue(tb testing.TB, workers int, maxSize int) *TransferQueue {
+	tb.Helper()
+	tempDir, err := os.MkdirTemp("", "queue_test_*")
+	if err != nil {
+		tb.Fatalf("Failed to create temp dir: %v", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	config := QueueConfig{
+		WorkerCount:     workers,
+		PersistencePath: filepath.Join(tempDir, "queue.json"),
+		MaxQueueSize:    maxSize,
+		BatchSize:       1000,
+	}
+	return NewTransferQueue(config, nil, nil)
+}
+
+// newTestNASQueue returns a queue backed by a local-directory NAS service along
+// with the local source directory files should be created in.
+func newTestNASQueue(t *testing.T, workers int) (*TransferQueue, string) {
+	t.Helper()
+	tempDir, err := os.MkdirTemp("", "queue_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	srcDir := filepath.Join(tempDir, "local")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("Failed to create source dir: %v", err)
+	}
+
+	nasService := nas.NewNASService(nas.NASConfig{
+		Path:       filepath.Join(tempDir, "nas"),
+		Timeout:    5 * time.Second,
+		VerifySize: true,
+	})
+
+	config := QueueConfig{
+		WorkerCount:     workers,
+		PersistencePath: filepath.Join(tempDir, "queue.json"),
+		MaxQueueSize:    1000,
+		BatchSize:       100,
+	}
+	return NewTransferQueue(config, nasService, nil), srcDir
+}
+
+func newTestItem(i int) TransferItem {
+	return TransferItem{
+		ID:              fmt.Sprintf("transfer_%d", i),
+		SourcePath:      fmt.Sprintf("/data/event/1080p/media_%d.ts", i),
+		DestinationPath: fmt.Sprintf("event/1080p/media_%d.ts", i),
+		Resolution:      "1080p",
+		Timestamp:       time.Unix(int64(i), 0),
+		Status:          StatusPending,
+		FileSize:        1024 * 1024,
+	}
+}
+
+// silenceLogs discards log output for the duration of a benchmark; the queue
+// logs per item, which would otherwise dominate the measurements.
+func silenceLogs(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func BenchmarkTransferQueue_Add(b *testing.B) {
+	silenceLogs(b)
+	tq := newTestQueue(b, 2, b.N+1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tq.Add(newTestItem(i)); err != nil {
+			b.Fatalf("Add() failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkTransferQueue_DispatchWork(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("queue=%d", size), func(b *testing.B) {
+			silenceLogs(b)
+			tq := newTestQueue(b, 4, size+b.N)
+			for i := 0; i < size; i++ {
+				tq.Add(newTestItem(i))
+			}
+			for i := range tq.workers {
+				tq.workers[i] = make(chan TransferItem, 1)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tq.dispatchWork()
+
+				// Drain and refill so the queue stays at a realistic size
+				b.StopTimer()
+				for _, w := range tq.workers {
+					select {
+					case <-w:
+						tq.Add(newTestItem(size + i))
+					default:
+					}
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkTransferQueue_DispatchWork_BusyWorkers(b *testing.B) {
+	silenceLogs(b)
+	tq := newTestQueue(b, 4, 100001)
+	for i := 0; i < 100000; i++ {
+		tq.Add(newTestItem(i))
+	}
+	// Every worker already holds an item, so dispatch finds nothing to do
+	for i := range tq.workers {
+		tq.workers[i] = make(chan TransferItem, 1)
+		tq.workers[i] <- newTestItem(-i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tq.dispatchWork()
+	}
+}
+
+func BenchmarkTransferQueue_SaveState(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("queue=%d", size), func(b *testing.B) {
+			silenceLogs(b)
+			tq := newTestQueue(b, 2, size)
+			for i := 0; i < size; i++ {
+				tq.Add(newTestItem(i))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tq.SaveState(); err != nil {
+					b.Fatalf("SaveState() failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTransferQueue_SaveStateLockHold measures the portion of SaveState
+// that runs under the queue lock and therefore blocks Add and dispatch.
+func BenchmarkTransferQueue_SaveStateLockHold(b *testing.B) {
+	silenceLogs(b)
+	tq := newTestQueue(b, 2, 100000)
+	for i := 0; i < 100000; i++ {
+		tq.Add(newTestItem(i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tq.snapshotItems()
+	}
+}
+
+func TestTransferQueue_DispatchesNewItemPromptly(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tq.ProcessQueue(ctx)
+
+	// Let the worker start and the loop go idle
+	time.Sleep(50 * time.Millisecond)
+
+	src := filepath.Join(srcDir, "media_0001.ts")
+	if err := os.WriteFile(src, []byte("segment"), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	start := time.Now()
+	if err := tq.Add(TransferItem{
+		ID:              "prompt",
+		SourcePath:      src,
+		DestinationPath: "event/1080p/media_0001.ts",
+		Timestamp:       time.Now(),
+		Status:          StatusPending,
+		FileSize:        7,
+	}); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+
+	deadline := time.After(500 * time.Millisecond)
+	for {
+		_, completed, _, _, _ := tq.GetStats()
+		if completed == 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("Item was not transferred within 500ms of being added")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected dispatch well under the old 1s poll interval, took %v", elapsed)
+	}
+}
+
+func TestTransferQueue_WorkerCompletionTriggersDispatch(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+
+	const items = 5
+	for i := 0; i < items; i++ {
+		src := filepath.Join(srcDir, fmt.Sprintf("media_%04d.ts", i))
+		if err := os.WriteFile(src, []byte("segment"), 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		tq.Add(TransferItem{
+			ID:              fmt.Sprintf("item_%d", i),
+			SourcePath:      src,
+			DestinationPath: filepath.Join("event", "1080p", filepath.Base(src)),
+			Timestamp:       time.Now(),
+			Status:          StatusPending,
+			FileSize:        7,
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tq.ProcessQueue(ctx)
+
+	// With one worker, each item after the first relies on the worker's
+	// completion signal; polling at 1s would take several seconds.
+	deadline := time.After(time.Second)
+	for {
+		_, completed, _, _, _ := tq.GetStats()
+		if completed == items {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("Only %d of %d items transferred within 1s", completed, items)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestTransferQueue_DispatchNeverLosesItems(t *testing.T) {
+	silenceLogs(t)
+	tq := newTestQueue(t, 8, 100000)
+	for i := range tq.workers {
+		tq.workers[i] = make(chan TransferItem, 1)
+	}
+
+	const total = 5000
+	var received sync.Map
+	var dispatched int64
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Intermittent consumers so dispatch regularly finds busy workers
+	for id, w := range tq.workers {
+		wg.Add(1)
+		go func(id int, w chan TransferItem) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				if (n+id)%7 == 0 {
+					time.Sleep(50 * time.Microsecond)
+				}
+				select {
+				case <-stop:
+					return
+				case item := <-w:
+					if _, dup := received.LoadOrStore(item.ID, true); dup {
+						t.Errorf("Item %s dispatched twice", item.ID)
+					}
+					atomic.AddInt64(&dispatched, 1)
+				}
+			}
+		}(id, w)
+	}
+
+	// Producer and concurrent persistence racing with dispatch
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total; i++ {
+			if err := tq.Add(newTestItem(i)); err != nil {
+				t.Errorf("Add() failed: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			tq.SaveState()
+		}
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt64(&dispatched) < total && time.Now().Before(deadline) {
+		tq.dispatchWork()
+		runtime.Gosched()
+	}
+
+	close(stop)
+	wg.Wait()
+
+	remaining := tq.GetQueueSize()
+	buffered := 0
+	for _, w := range tq.workers {
+		buffered += len(w)
+	}
+
+	got := int(atomic.LoadInt64(&dispatched))
+	if got+remaining+buffered != total {
+		t.Errorf("Items lost: dispatched=%d remaining=%d buffered=%d, want total %d",
+			got, remaining, buffered, total)
+	}
+	if got != total {
+		t.Errorf("Expected all %d items to be dispatched, got %d", total, got)
+	}
+}
+
+func TestTransferQueue_ResumeDrainsPersistedQueue(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 2)
+
+	// Persist a queue from a "crashed" run without processing it
+	const items = 6
+	for i := 0; i < items; i++ {
+		src := filepath.Join(srcDir, fmt.Sprintf("media_%04d.ts", i))
+		if err := os.WriteFile(src, []byte("segment"), 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		item := TransferItem{
+			ID:              fmt.Sprintf("item_%d", i),
+			SourcePath:      src,
+			DestinationPath: filepath.Join("event", "1080p", filepath.Base(src)),
+			Timestamp:       time.Now(),
+			Status:          StatusPending,
+			FileSize:        7,
+		}
+		if i%3 == 0 {
+			item.Status = StatusFailed
+		}
+		tq.Add(item)
+	}
+	if err := tq.SaveState(); err != nil {
+		t.Fatalf("SaveState() failed: %v", err)
+	}
+
+	resumed := NewTransferQueue(tq.config, tq.nasService, nil)
+	restored := resumed.Restored()
+	if restored.Pending != 4 || restored.Failed != 2 {
+		t.Errorf("Expected 4 pending and 2 failed restored, got %+v", restored)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := resumed.Drain(ctx); err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+
+	if resumed.GetQueueSize() != 0 {
+		t.Errorf("Expected empty queue after drain, got %d", resumed.GetQueueSize())
+	}
+	for i := 0; i < items; i++ {
+		dest := filepath.Join(tq.nasService.Config.Path, "event", "1080p", fmt.Sprintf("media_%04d.ts", i))
+		if !fileExists(dest) {
+			t.Errorf("Expected %s to be transferred", dest)
+		}
+	}
+
+	// The drained queue is persisted, so a further resume has nothing to do
+	again := NewTransferQueue(tq.config, tq.nasService, nil)
+	if again.GetQueueSize() != 0 {
+		t.Errorf("Expected no items after a completed resume, got %d", again.GetQueueSize())
+	}
+}
+
+func TestTransferQueue_DrainEmptyQueue(t *testing.T) {
+	tq, _ := newTestNASQueue(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tq.Drain(ctx); err != nil {
+		t.Errorf("Expected empty queue to drain immediately, got %v", err)
+	}
+}
+
+func TestTransferQueue_QuarantinesInvalidSegments(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+	tq.config.VerifySegments = true
+
+	valid := make([]byte, 4*utils.TSPacketSize)
+	for i := 0; i < 4; i++ {
+		valid[i*utils.TSPacketSize] = utils.TSSyncByte
+	}
+	files := map[string][]byte{
+		"media_0001.ts": valid,
+		"media_0002.ts": []byte("<html>403 Forbidden</html>"),
+		// Subtitle segments aren't MPEG-TS and aren't checked
+		"sub_0001.vtt": []byte("WEBVTT\n"),
+	}
+	for name, data := range files {
+		src := filepath.Join(srcDir, name)
+		if err := os.WriteFile(src, data, 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		tq.Add(TransferItem{
+			ID:              name,
+			SourcePath:      src,
+			DestinationPath: filepath.Join("event", "1080p", name),
+			Timestamp:       time.Now(),
+			Status:          StatusPending,
+			FileSize:        int64(len(data)),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tq.Drain(ctx); err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+
+	nasDir := filepath.Join(tq.nasService.Config.Path, "event", "1080p")
+	if !fileExists(filepath.Join(nasDir, "media_0001.ts")) {
+		t.Error("Expected valid segment to be transferred")
+	}
+	if fileExists(filepath.Join(nasDir, "media_0002.ts")) {
+		t.Error("Invalid segment should not be transferred to the NAS")
+	}
+	if !fileExists(filepath.Join(nasDir, "sub_0001.vtt")) {
+		t.Error("Expected subtitle segment to be transferred")
+	}
+
+	quarantined := tq.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].ID != "media_0002.ts" {
+		t.Fatalf("Expected media_0002.ts to be quarantined, got %+v", quarantined)
+	}
+	if quarantined[0].Status != StatusFailed || quarantined[0].LastError == "" {
+		t.Errorf("Expected quarantined item to be failed with a reason, got %+v", quarantined[0])
+	}
+	if !fileExists(quarantined[0].SourcePath) {
+		t.Error("Quarantined segment should be kept locally")
+	}
+
+	_, completed, failed, _, _ := tq.GetStats()
+	if completed != 2 || failed != 1 {
+		t.Errorf("Expected 2 completed and 1 failed, got %d and %d", completed, failed)
+	}
+}
+
+// addTestSegments writes count segments to srcDir and queues them
+func addTestSegments(t *testing.T, tq *TransferQueue, srcDir string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("media_%04d.ts", i)
+		src := filepath.Join(srcDir, name)
+		if err := os.WriteFile(src, []byte("segment"), 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		tq.Add(TransferItem{
+			ID:              name,
+			SourcePath:      src,
+			DestinationPath: filepath.Join("event", "1080p", name),
+			Timestamp:       time.Now(),
+			Status:          StatusPending,
+			FileSize:        7,
+		})
+	}
+}
+
+func TestTransferQueue_VerifiesInParallel(t *testing.T) {
+	const items = 3
+	tq, srcDir := newTestNASQueue(t, 1)
+	tq.verifier = newVerifyPool(items)
+
+	// Each verification waits until all are running at once, which a single
+	// worker verifying inline could never reach
+	var active, peak int32
+	allRunning := make(chan struct{})
+	tq.verify = func(item TransferItem) error {
+		current := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		if current == items {
+			close(allRunning)
+		}
+		for {
+			old := atomic.LoadInt32(&peak)
+			if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+				break
+			}
+		}
+		select {
+		case <-allRunning:
+		case <-time.After(2 * time.Second):
+		}
+		return nil
+	}
+	addTestSegments(t, tq, srcDir, items)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tq.Drain(ctx); err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&peak); got != items {
+		t.Errorf("Expected %d verifications in parallel, peak was %d", items, got)
+	}
+	if _, completed, _, _, _ := tq.GetStats(); completed != items {
+		t.Errorf("Expected %d completed after verification, got %d", items, completed)
+	}
+}
+
+func TestTransferQueue_VerificationFailureAttributedToItem(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 2)
+	tq.verifier = newVerifyPool(2)
+	tq.verify = func(item TransferItem) error {
+		if item.ID == "media_0001.ts" {
+			return fmt.Errorf("checksum mismatch")
+		}
+		return nil
+	}
+	addTestSegments(t, tq, srcDir, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tq.Drain(ctx); err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+
+	nasDir := filepath.Join(tq.nasService.Config.Path, "event", "1080p")
+	for _, name := range []string{"media_0000.ts", "media_0002.ts"} {
+		if !fileExists(filepath.Join(nasDir, name)) {
+			t.Errorf("Expected verified %s to remain on the NAS", name)
+		}
+	}
+	if fileExists(filepath.Join(nasDir, "media_0001.ts")) {
+		t.Error("Copy that failed verification should be removed from the NAS")
+	}
+	if !fileExists(filepath.Join(srcDir, "media_0001.ts")) {
+		t.Error("Source of a failed verification should be kept locally")
+	}
+
+	_, completed, failed, _, _ := tq.GetStats()
+	if completed != 2 || failed != 1 {
+		t.Errorf("Expected 2 completed and 1 failed, got %d and %d", completed, failed)
+	}
+}
+
+func TestTransferQueue_ChecksumVerification(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+	tq = NewTransferQueue(QueueConfig{
+		WorkerCount:     1,
+		PersistencePath: tq.config.PersistencePath,
+		MaxQueueSize:    10,
+		BatchSize:       10,
+		VerifyChecksum:  true,
+	}, tq.nasService, nil)
+	addTestSegments(t, tq, srcDir, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tq.Drain(ctx); err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+	if _, completed, failed, _, _ := tq.GetStats(); completed != 2 || failed != 0 {
+		t.Errorf("Expected identical copies to pass checksum verification, got %d completed, %d failed", completed, failed)
+	}
+}
+
+func TestTransferService_WaitIdle(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+	ts := &TransferService{queue: tq}
+
+	for i := 0; i < 3; i++ {
+		src := filepath.Join(srcDir, fmt.Sprintf("media_%04d.ts", i))
+		os.WriteFile(src, []byte("segment"), 0644)
+		tq.Add(TransferItem{
+			ID:              fmt.Sprintf("item_%d", i),
+			SourcePath:      src,
+			DestinationPath: filepath.Join("event", "1080p", filepath.Base(src)),
+			Timestamp:       time.Now(),
+			Status:          StatusPending,
+			FileSize:        7,
+		})
+	}
+
+	// Nothing is processing the queue, so it never becomes idle
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelWait()
+	if err := ts.WaitIdle(waitCtx); err == nil {
+		t.Fatal("Expected WaitIdle to give up while items are still queued")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tq.ProcessQueue(ctx)
+
+	idleCtx, cancelIdle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelIdle()
+	if err := ts.WaitIdle(idleCtx); err != nil {
+		t.Fatalf("WaitIdle() failed: %v", err)
+	}
+	if _, completed, _, _, _ := tq.GetStats(); completed != 3 {
+		t.Errorf("Expected all 3 items transferred before idle, got %d", completed)
+	}
+}
+
+func TestTransferQueue_PauseStopsDispatch(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tq.ProcessQueue(ctx)
+
+	if !tq.Pause() {
+		t.Fatal("Pause() should report the queue was running")
+	}
+	if tq.Pause() {
+		t.Error("Pause() on a paused queue should return false")
+	}
+	addTestSegments(t, tq, srcDir, 3)
+
+	// Give the dispatcher several chances to hand out work
+	time.Sleep(200 * time.Millisecond)
+	if _, completed, _, _, _ := tq.GetStats(); completed != 0 {
+		t.Errorf("Expected no transfers while paused, got %d", completed)
+	}
+	if size := tq.GetQueueSize(); size != 3 {
+		t.Errorf("Expected 3 items to stay queued while paused, got %d", size)
+	}
+	if tq.isIdle() {
+		t.Error("A paused queue with pending items should not be idle")
+	}
+
+	if !tq.Resume() {
+		t.Fatal("Resume() should report the queue was paused")
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		_, completed, _, _, _ := tq.GetStats()
+		if completed == 3 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("Expected 3 transfers after resume, got %d", completed)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestTransferQueue_DispatchOrder(t *testing.T) {
+	now := time.Now()
+	items := []TransferItem{
+		{ID: "large-old", FileSize: 500 << 20, Timestamp: now.Add(-3 * time.Second)},
+		{ID: "small-old", FileSize: 2 << 20, Timestamp: now.Add(-2 * time.Second)},
+		{ID: "large-new", FileSize: 800 << 20, Timestamp: now},
+		{ID: "small-new", FileSize: 2 << 20, Timestamp: now.Add(-time.Second)},
+	}
+
+	tests := []struct {
+		name          string
+		smallestFirst bool
+		want          []string
+	}{
+		{"newest first", false, []string{"large-new", "small-new", "small-old", "large-old"}},
+		{"smallest first", true, []string{"small-new", "small-old", "large-old", "large-new"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tq := newTestQueue(t, 1, 100)
+			tq.items.smallestFirst = tt.smallestFirst
+			for _, item := range items {
+				if err := tq.Add(item); err != nil {
+					t.Fatalf("Add() failed: %v", err)
+				}
+			}
+
+			worker := make(chan TransferItem, 1)
+			tq.workers[0] = worker
+			var got []string
+			for range items {
+				tq.dispatchWork()
+				got = append(got, (<-worker).ID)
+			}
+
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Expected dispatch order %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTransferQueue_SaveStateCompaction(t *testing.T) {
+	tq := newTestQueue(t, 1, 1000)
+	statuses := []TransferStatus{StatusPending, StatusFailed, StatusCompleted, StatusInProgress}
+	for i := 0; i < 200; i++ {
+		item := newTestItem(i)
+		item.Status = statuses[i%len(statuses)]
+		if err := tq.Add(item); err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+	}
+
+	if err := tq.SaveState(); err != nil {
+		t.Fatalf("SaveState() failed: %v", err)
+	}
+	plain, err := os.Stat(tq.config.PersistencePath)
+	if err != nil {
+		t.Fatalf("Failed to stat state file: %v", err)
+	}
+
+	// NewTransferQueue restores the saved state
+	restored := NewTransferQueue(tq.config, nil, nil)
+	for _, item := range restored.snapshotItems() {
+		if item.Status != StatusPending && item.Status != StatusFailed {
+			t.Errorf("Expected only pending and failed items to be persisted, got %s", item.Status)
+		}
+	}
+	if got := restored.GetQueueSize(); got != 100 {
+		t.Errorf("Expected 100 items restored, got %d", got)
+	}
+
+	tq.config.CompressState = true
+	if err := tq.SaveState(); err != nil {
+		t.Fatalf("SaveState() failed: %v", err)
+	}
+	compressed, err := os.Stat(tq.config.PersistencePath)
+	if err != nil {
+		t.Fatalf("Failed to stat state file: %v", err)
+	}
+	if compressed.Size() >= plain.Size() {
+		t.Errorf("Expected gzipped state to be smaller than %d bytes, got %d", plain.Size(), compressed.Size())
+	}
+
+	// A compressed file loads even when compression is now off
+	restored = NewTransferQueue(QueueConfig{
+		WorkerCount:     1,
+		PersistencePath: tq.config.PersistencePath,
+		MaxQueueSize:    1000,
+	}, nil, nil)
+	if got := restored.Restored(); got.Pending != 50 || got.Failed != 50 {
+		t.Errorf("Expected 50 pending and 50 failed restored, got %+v", got)
+	}
+}
+
+// blockingStore holds every Update until release is closed
+type blockingStore struct {
+	jsonStateStore
+	updating chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingStore) Update(item TransferItem) error {
+	s.updating <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestTransferQueue_AddRecordsOutsideLock(t *testing.T) {
+	tq := newTestQueue(t, 1, 100)
+	store := &blockingStore{jsonStateStore: jsonStateStore{config: &tq.config}, updating: make(chan struct{}, 1), release: make(chan struct{})}
+	tq.store = store
+
+	added := make(chan error, 1)
+	go func() { added <- tq.Add(newTestItem(0)) }()
+	<-store.updating
+
+	// A slow store write doesn't hold up status lookups or dispatch
+	done := make(chan struct{})
+	go func() {
+		tq.Status(newTestItem(1).SourcePath)
+		tq.GetQueueSize()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Queue lock held while the state store was written")
+	}
+
+	close(store.release)
+	if err := <-added; err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if got := tq.GetQueueSize(); got != 1 {
+		t.Errorf("Expected 1 item queued, got %d", got)
+	}
+}
+
+func TestTransferQueue_SaveStateKeepsFailedItems(t *testing.T) {
+	tq := newTestQueue(t, 1, 100)
+	if err := tq.Add(newTestItem(0)); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+
+	// Items 1 and 2 were dispatched, so they have left the heap, and failed
+	// for good; 2 is queued again afterwards
+	for _, i := range []int{1, 2} {
+		failed := newTestItem(i)
+		failed.Status = StatusFailed
+		failed.RetryCount = 3
+		failed.LastError = "copy failed"
+		tq.setStatus(failed)
+	}
+	if err := tq.Add(newTestItem(2)); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if err := tq.SaveState(); err != nil {
+		t.Fatalf("SaveState() failed: %v", err)
+	}
+
+	restored := NewTransferQueue(tq.config, nil, nil)
+	if got := restored.Restored(); got.Pending != 2 || got.Failed != 1 {
+		t.Errorf("Expected 2 pending and 1 failed item restored, got %+v", got)
+	}
+	if status, ok := restored.Status(newTestItem(1).SourcePath); !ok || status != StatusFailed {
+		t.Errorf("Expected the failed item restored as failed, got %v, %v", status, ok)
+	}
+	for _, item := range restored.snapshotItems() {
+		if item.SourcePath == newTestItem(1).SourcePath && (item.LastError != "copy failed" || item.RetryCount != 3) {
+			t.Errorf("Expected the failed item to keep its error and retries, got %+v", item)
+		}
+	}
+}
+
+func TestTransferQueue_CorruptStateFile(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated json", []byte(`{"items": [{"ID": "transfer_0", "SourcePath": "/data/ev`)},
+		{"bad gzip", append(append([]byte{}, gzipMagic...), "not really gzip"...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "queue_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			statePath := filepath.Join(tempDir, "queue.json")
+			if err := os.WriteFile(statePath, tt.data, 0644); err != nil {
+				t.Fatalf("Failed to write state file: %v", err)
+			}
+
+			tq := NewTransferQueue(QueueConfig{
+				WorkerCount:     1,
+				PersistencePath: statePath,
+				MaxQueueSize:    100,
+			}, nil, nil)
+			if got := tq.GetQueueSize(); got != 0 {
+				t.Errorf("Expected an empty queue, got %d items", got)
+			}
+
+			backups, _ := filepath.Glob(statePath + ".corrupt.*")
+			if len(backups) != 1 {
+				t.Fatalf("Expected one backup of the corrupt file, got %v", backups)
+			}
+			if data, _ := os.ReadFile(backups[0]); string(data) != string(tt.data) {
+				t.Errorf("Expected the backup to hold the corrupt file unchanged, got %q", data)
+			}
+
+			// Saving the fresh queue leaves the backup alone
+			if err := tq.Add(newTestItem(1)); err != nil {
+				t.Fatalf("Add() failed: %v", err)
+			}
+			if err := tq.SaveState(); err != nil {
+				t.Fatalf("SaveState() failed: %v", err)
+			}
+			if data, _ := os.ReadFile(backups[0]); string(data) != string(tt.data) {
+				t.Errorf("Expected SaveState not to touch the backup, got %q", data)
+			}
+			restored := NewTransferQueue(tq.config, nil, nil)
+			if got := restored.GetQueueSize(); got != 1 {
+				t.Errorf("Expected the new state file to load 1 item, got %d", got)
+			}
+		})
+	}
+}
+
+func TestTransferQueue_ClockSkew(t *testing.T) {
+	tq := newTestQueue(t, 1, 100)
+
+	if err := tq.Add(TransferItem{ID: "undated", SourcePath: "undated.ts"}); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if tq.items.items[0].Timestamp.IsZero() {
+		t.Error("Expected an undated item to be stamped with the current time")
+	}
+
+	recent := TransferItem{ID: "recent", SourcePath: "recent.ts", Timestamp: time.Now().Add(maxClockSkew / 2)}
+	if err := tq.Add(recent); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if tq.skewWarned {
+		t.Error("A timestamp within the skew tolerance should not be reported")
+	}
+
+	future := TransferItem{ID: "future", SourcePath: "future.ts", Timestamp: time.Now().Add(time.Hour)}
+	if err := tq.Add(future); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if !tq.skewWarned {
+		t.Error("Expected a timestamp an hour ahead to be reported as clock skew")
+	}
+}
+
+func TestTransferQueue_Status(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 2)
+	tq.verifier = newVerifyPool(2)
+
+	// media_0000 is held in verification so it can be seen in progress
+	verifying := make(chan struct{})
+	release := make(chan struct{})
+	tq.verify = func(item TransferItem) error {
+		switch item.ID {
+		case "media_0000.ts":
+			close(verifying)
+			<-release
+		case "media_0001.ts":
+			return fmt.Errorf("checksum mismatch")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tq.ProcessQueue(ctx)
+
+	tq.Pause()
+	addTestSegments(t, tq, srcDir, 3)
+	path := func(i int) string {
+		return filepath.Join(srcDir, fmt.Sprintf("media_%04d.ts", i))
+	}
+
+	if _, ok := tq.Status(filepath.Join(srcDir, "media_9999.ts")); ok {
+		t.Error("Expected an unseen path to be unknown")
+	}
+	for i := 0; i < 3; i++ {
+		if status, ok := tq.Status(path(i)); !ok || status != StatusPending {
+			t.Errorf("Expected media_%04d to be pending while paused, got %v (known: %v)", i, status, ok)
+		}
+	}
+
+	tq.Resume()
+	select {
+	case <-verifying:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for media_0000 to reach verification")
+	}
+	if status, _ := tq.Status(path(0)); status != StatusInProgress {
+		t.Errorf("Expected media_0000 to be in progress during verification, got %v", status)
+	}
+	close(release)
+
+	want := map[int]TransferStatus{0: StatusCompleted, 1: StatusFailed, 2: StatusCompleted}
+	deadline := time.After(2 * time.Second)
+	for i, expected := range want {
+		for {
+			status, _ := tq.Status(path(i))
+			if status == expected {
+				break
+			}
+			select {
+			case <-deadline:
+				t.Fatalf("Expected media_%04d to be %v, got %v", i, expected, status)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	// Lookups clean the path the same way Add does
+	if status, _ := tq.Status(srcDir + "/./media_0002.ts"); status != StatusCompleted {
+		t.Errorf("Expected an uncleaned path to resolve, got %v", status)
+	}
+}
+
+func TestTransferQueue_DiskFullPausesQueue(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+
+	var calls int32
+	tq.transfer = func(ctx context.Context, item *TransferItem) error {
+		atomic.AddInt32(&calls, 1)
+		return fmt.Errorf("Failed to copy file %s: %w", item.SourcePath,
+			&os.PathError{Op: "write", Path: item.DestinationPath, Err: syscall.ENOSPC})
+	}
+	addTestSegments(t, tq, srcDir, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tq.ProcessQueue(ctx)
+
+	deadline := time.After(2 * time.Second)
+	for !tq.Paused() {
+		select {
+		case <-deadline:
+			t.Fatal("Expected the queue to pause when the NAS is full")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// Let the worker finish requeueing
+	time.Sleep(100 * time.Millisecond)
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected a single attempt before pausing, got %d", got)
+	}
+	if _, _, failed, _, _ := tq.GetStats(); failed != 0 {
+		t.Errorf("Expected no failed items on a full NAS, got %d", failed)
+	}
+	if size := tq.GetQueueSize(); size != 3 {
+		t.Errorf("Expected all 3 items to stay queued, got %d", size)
+	}
+	for i := 0; i < 3; i++ {
+		src := filepath.Join(srcDir, fmt.Sprintf("media_%04d.ts", i))
+		if status, _ := tq.Status(src); status != StatusPending {
+			t.Errorf("Expected %s to be pending, got %v", filepath.Base(src), status)
+		}
+	}
+
+	// Once space is freed, resuming transfers everything
+	tq.transfer = func(ctx context.Context, item *TransferItem) error {
+		return TransferFile(tq.nasService, ctx, item)
+	}
+	tq.Resume()
+	deadline = time.After(2 * time.Second)
+	for {
+		_, completed, _, _, _ := tq.GetStats()
+		if completed == 3 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("Expected 3 transfers after resume, got %d", completed)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestTransferQueue_RetryBackoffUsesClock(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	tq.clock = clock
+
+	attempts := make(chan int, 3)
+	calls := 0
+	tq.transfer = func(ctx context.Context, item *TransferItem) error {
+		calls++
+		attempts <- calls
+		if calls < 3 {
+			return fmt.Errorf("transient failure %d", calls)
+		}
+		return nil
+	}
+
+	item := TransferItem{
+		ID:              "backoff",
+		SourcePath:      filepath.Join(srcDir, "media_0001.ts"),
+		DestinationPath: "event/1080p/media_0001.ts",
+		Status:          StatusPending,
+	}
+	done := make(chan struct{})
+	go func() {
+		tq.processItem(context.Background(), item)
+		close(done)
+	}()
+
+	<-attempts
+
+	// The first backoff is 1s ±20% jitter
+	clock.BlockUntil(1)
+	clock.Advance(750 * time.Millisecond)
+	select {
+	case <-attempts:
+		t.Fatal("Retried before the backoff delay passed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if got := <-attempts; got != 2 {
+		t.Errorf("Expected attempt 2, got %d", got)
+	}
+	if status, _ := tq.Status(item.SourcePath); status != StatusRetrying {
+		t.Errorf("Expected status %s while retrying, got %s", StatusRetrying, status)
+	}
+
+	// The second backoff doubles to 2s ±20%
+	clock.BlockUntil(1)
+	clock.Advance(2500 * time.Millisecond)
+	if got := <-attempts; got != 3 {
+		t.Errorf("Expected attempt 3, got %d", got)
+	}
+
+	<-done
+	if status, _ := tq.Status(item.SourcePath); status != StatusCompleted {
+		t.Errorf("Expected status %s, got %s", StatusCompleted, status)
+	}
+}
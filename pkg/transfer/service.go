@@ -2,36 +2,112 @@ package transfer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"m3u8-downloader/pkg/config"
 	"m3u8-downloader/pkg/constants"
 	nas2 "m3u8-downloader/pkg/nas"
 	"m3u8-downloader/pkg/utils"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 type TransferService struct {
-	watcher *FileWatcher
-	queue   *TransferQueue
-	nas     *nas2.NASService
-	cleanup *CleanupService
-	stats   *QueueStats
+	watcher     *FileWatcher
+	queue       *TransferQueue
+	nas         *nas2.NASService
+	cleanup     *CleanupService
+	stats       *QueueStats
+	eventName   string
+	nasEventDir string // event directory on the NAS, from NAS.PathTemplate
 }
 
 func NewTrasferService(outputDir string, eventName string) (*TransferService, error) {
 	cfg := constants.MustGetConfig()
 
+	ts, err := newQueueService(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create local output directory if it doesn't exist
+	localOutputPath := cfg.GetEventPath(eventName)
+	if err := utils.EnsureDir(localOutputPath); err != nil {
+		return nil, fmt.Errorf("failed to create local output directory: %w", err)
+	}
+
+	ts.eventName = eventName
+	ts.nasEventDir = cfg.GetNASEventDir(eventName, time.Now())
+
+	if cfg.Transfer.WatchMode == config.WatchModePoll {
+		ts.watcher = NewPollingWatcher(localOutputPath, ts.nasEventDir, ts.queue, cfg.Transfer.FileSettlingDelay, cfg.Transfer.WatchPollInterval)
+	} else {
+		watcher, err := NewFileWatcher(localOutputPath, ts.nasEventDir, ts.queue, cfg.Transfer.FileSettlingDelay)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file watcher: %w", err)
+		}
+		watcher.pollInterval = cfg.Transfer.WatchPollInterval
+		ts.watcher = watcher
+	}
+
+	return ts, nil
+}
+
+// SetCaptureStart dates the NAS event directory by start instead of the time
+// the service was created. It must be called before Start or
+// QueueExistingFiles.
+func (ts *TransferService) SetCaptureStart(start time.Time) {
+	ts.nasEventDir = constants.MustGetConfig().GetNASEventDir(ts.eventName, start)
+	if ts.watcher != nil {
+		ts.watcher.destDir = ts.nasEventDir
+	}
+}
+
+// CaptureStart returns the modification time of the oldest segment under
+// localEventPath, or false if there are none
+func CaptureStart(localEventPath string) (time.Time, bool) {
+	var oldest time.Time
+	filepath.Walk(localEventPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() && utils.IsSegmentFile(info.Name()) {
+			if oldest.IsZero() || info.ModTime().Before(oldest) {
+				oldest = info.ModTime()
+			}
+		}
+		return nil
+	})
+	return oldest, !oldest.IsZero()
+}
+
+// NewResumeService builds a transfer service that only drains the persisted
+// queue; it has no file watcher and is driven by ResumePersisted rather than
+// Start.
+func NewResumeService(outputDir string) (*TransferService, error) {
+	return newQueueService(outputDir)
+}
+
+// newQueueService wires up the NAS, cleanup, and queue shared by every mode
+func newQueueService(outputDir string) (*TransferService, error) {
+	cfg := constants.MustGetConfig()
+
 	nasConfig := nas2.NASConfig{
-		Path:       outputDir,
-		Username:   cfg.NAS.Username,
-		Password:   cfg.NAS.Password,
-		Timeout:    cfg.NAS.Timeout,
-		RetryLimit: cfg.NAS.RetryLimit,
-		VerifySize: true,
+		Path:            outputDir,
+		Username:        cfg.NAS.Username,
+		Password:        cfg.NAS.Password,
+		Timeout:         cfg.NAS.Timeout,
+		RetryLimit:      cfg.NAS.RetryLimit,
+		VerifySize:      cfg.Transfer.VerifySize,
+		MaxConnections:  cfg.NAS.MaxConnections,
+		ListingCacheTTL: cfg.NAS.ListingCacheTTL,
+		PathStyle:       cfg.NAS.PathStyle,
+		MountPoint:      cfg.NAS.MountPoint,
 	}
 	nas := nas2.NewNASService(nasConfig)
 
@@ -40,34 +116,32 @@ func NewTrasferService(outputDir string, eventName string) (*TransferService, er
 	}
 
 	cleanupConfig := CleanupConfig{
-		Enabled:         cfg.Cleanup.AfterTransfer,
-		RetentionPeriod: time.Duration(cfg.Cleanup.RetainHours) * time.Hour,
-		BatchSize:       cfg.Cleanup.BatchSize,
-		CheckInterval:   cfg.Transfer.FileSettlingDelay,
+		Enabled:               cfg.Cleanup.AfterTransfer,
+		RetentionPeriod:       time.Duration(cfg.Cleanup.RetainHours) * time.Hour,
+		BatchSize:             cfg.Cleanup.BatchSize,
+		CheckInterval:         cfg.Transfer.FileSettlingDelay,
+		RequireTransferRecord: cfg.Cleanup.RequireTransferRecord,
+		FileTimeout:           cfg.Cleanup.FileTimeout,
 	}
 	cleanup := NewCleanupService(cleanupConfig)
+	cleanup.SetNASCheck(nas.FileExists)
 
 	queueConfig := QueueConfig{
 		WorkerCount:     cfg.Transfer.WorkerCount,
 		PersistencePath: cfg.Paths.PersistenceFile,
 		MaxQueueSize:    cfg.Transfer.QueueSize,
 		BatchSize:       cfg.Transfer.BatchSize,
+		VerifySegments:  cfg.Transfer.VerifySegments,
+		VerifyChecksum:  cfg.Transfer.VerifyChecksum,
+		VerifyWorkers:   cfg.Transfer.VerifyWorkers,
+		SmallestFirst:   cfg.Transfer.QueueOrder == config.TransferOrderSmallest,
+		SaveInterval:    cfg.Transfer.StateInterval,
+		CompressState:   cfg.Transfer.CompressState,
+		StateBackend:    cfg.Transfer.StateBackend,
 	}
 	queue := NewTransferQueue(queueConfig, nas, cleanup)
 
-	// Create local output directory if it doesn't exist
-	localOutputPath := cfg.GetEventPath(eventName)
-	if err := utils.EnsureDir(localOutputPath); err != nil {
-		return nil, fmt.Errorf("failed to create local output directory: %w", err)
-	}
-
-	watcher, err := NewFileWatcher(localOutputPath, queue, cfg.Transfer.FileSettlingDelay)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create file watcher: %w", err)
-	}
-
 	return &TransferService{
-		watcher: watcher,
 		queue:   queue,
 		nas:     nas,
 		cleanup: cleanup,
@@ -114,6 +188,119 @@ func (ts *TransferService) Start(ctx context.Context) error {
 	return nil
 }
 
+// ResumePersisted transfers everything restored from the persisted queue and
+// returns once it has drained, without scanning for or watching new files.
+func (ts *TransferService) ResumePersisted(ctx context.Context) (RestoredCounts, error) {
+	restored := ts.queue.Restored()
+	log.Printf("Resuming transfer queue: %d pending, %d failed items restored", restored.Pending, restored.Failed)
+
+	statsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go ts.reportStats(statsCtx)
+
+	if err := ts.queue.Drain(ctx); err != nil {
+		return restored, err
+	}
+
+	_, completed, failed, _, bytes := ts.stats.GetStats()
+	log.Printf("Transfer queue drained - Completed: %d, Failed: %d, Bytes: %d", completed, failed, bytes)
+	return restored, nil
+}
+
+// ConfirmTransferred checks the NAS for every file queued during this run and
+// returns, sorted, the destinations that are missing or whose size differs
+// from the local file's. It must be called before Shutdown disconnects.
+func (ts *TransferService) ConfirmTransferred() ([]string, error) {
+	expected := ts.queue.Expected()
+	if len(expected) == 0 {
+		return nil, nil
+	}
+
+	present, err := ts.nas.FileExistsBatch(expected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check NAS files: %w", err)
+	}
+
+	var missing []string
+	for destPath := range expected {
+		if !present[destPath] {
+			missing = append(missing, destPath)
+		}
+	}
+	sort.Strings(missing)
+
+	log.Printf("Confirmed %d of %d queued files on the NAS", len(expected)-len(missing), len(expected))
+	return missing, nil
+}
+
+// Status reports whether the local file at sourcePath is pending, in
+// progress, completed, or failed; false means the queue has not seen it
+func (ts *TransferService) Status(sourcePath string) (TransferStatus, bool) {
+	return ts.queue.Status(sourcePath)
+}
+
+// Pause stops handing queued files to transfer workers. Transfers already
+// running finish, and new files keep being queued until Resume.
+func (ts *TransferService) Pause() {
+	if ts.queue.Pause() {
+		log.Printf("Transfers paused (%d queued)", ts.queue.GetQueueSize())
+	}
+}
+
+// Resume restarts dispatch after Pause
+func (ts *TransferService) Resume() {
+	if ts.queue.Resume() {
+		log.Printf("Transfers resumed (%d queued)", ts.queue.GetQueueSize())
+	}
+}
+
+// TogglePause pauses running transfers or resumes paused ones
+func (ts *TransferService) TogglePause() {
+	if ts.queue.Paused() {
+		ts.Resume()
+	} else {
+		ts.Pause()
+	}
+}
+
+// ErrPaused is returned by WaitIdle when transfers are paused, since the
+// queue cannot drain until they are resumed
+var ErrPaused = errors.New("transfers paused")
+
+// WaitIdle blocks until no file is settling in the watcher and the queue is
+// empty with no transfer in progress, or ctx is done. Idle must be observed
+// twice in a row so a file event in flight between the two isn't missed.
+func (ts *TransferService) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	idleChecks := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if ts.queue.Paused() {
+			return ErrPaused
+		}
+
+		settling := 0
+		if ts.watcher != nil {
+			settling = ts.watcher.PendingCount()
+		}
+		if settling == 0 && ts.queue.isIdle() {
+			idleChecks++
+			if idleChecks >= 2 {
+				return nil
+			}
+		} else {
+			idleChecks = 0
+		}
+	}
+}
+
 func (ts *TransferService) reportStats(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -138,8 +325,11 @@ func (ts *TransferService) Shutdown(ctx context.Context) error {
 	if err := ts.queue.SaveState(); err != nil {
 		return fmt.Errorf("Failed to save queue state: %w", err)
 	}
+	if err := ts.queue.Close(); err != nil {
+		log.Printf("Warning: failed to close queue state: %v", err)
+	}
 
-	if err := ts.cleanup.ForceCleanupAll(ctx); err != nil {
+	if _, err := ts.cleanup.ForceCleanupAll(ctx); err != nil {
 		return fmt.Errorf("Failed to force cleanup: %w", err)
 	}
 
@@ -153,75 +343,65 @@ func (ts *TransferService) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-// QueueExistingFiles scans a directory for .ts files and queues them for transfer
+// existingFile is a local segment found by QueueExistingFiles
+type existingFile struct {
+	path        string
+	relPath     string
+	info        os.FileInfo
+	resolution  string
+	nasDestPath string
+}
+
+// QueueExistingFiles scans a directory for .ts files and queues them for
+// transfer. Files are checked against the NAS in batches, and after each
+// batch a checkpoint is saved with the queue state so an interrupted scan
+// resumes after the last file it handled instead of starting over.
 func (ts *TransferService) QueueExistingFiles(localEventPath string) error {
-	cfg := constants.MustGetConfig()
 	log.Printf("Scanning for existing files in: %s", localEventPath)
 
-	var fileCount, alreadyTransferred, scheduledForCleanup int
+	// Files go under the event's NAS directory, or one named after the
+	// local event directory if the service wasn't built for an event
+	nasEventDir := ts.nasEventDir
+	if nasEventDir == "" {
+		nasEventDir = filepath.Base(localEventPath)
+	}
 
-	// Extract event name from path for NAS destination
-	eventName := filepath.Base(localEventPath)
+	checkpoint := ts.queue.ScanCheckpoint(localEventPath)
+	if checkpoint != "" {
+		log.Printf("Resuming scan after checkpoint: %s", checkpoint)
+	}
 
+	var candidates []existingFile
 	err := filepath.Walk(localEventPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("Error accessing path %s: %v", path, err)
 			return nil // Continue walking
 		}
 
-		// Only process .ts files
-		if !info.IsDir() && strings.HasSuffix(strings.ToLower(info.Name()), ".ts") {
-			// Extract resolution from directory path
-			resolution := ts.extractResolutionFromPath(path)
-
-			// Get relative path from event directory
-			relPath, err := filepath.Rel(localEventPath, path)
-			if err != nil {
-				log.Printf("Failed to get relative path for %s: %v", path, err)
-				return nil
-			}
-
-			// Build NAS destination path (eventName/relPath)
-			nasDestPath := filepath.Join(eventName, relPath)
-
-			// Check if file already exists on NAS with matching size
-			exists, err := ts.nas.FileExists(nasDestPath, info.Size())
-			if err != nil {
-				log.Printf("Failed to check NAS file existence for %s: %v", path, err)
-				// Continue with transfer attempt on error
-			} else if exists {
-				log.Printf("File already exists on NAS: %s (%s, %d bytes)", path, resolution, info.Size())
-				alreadyTransferred++
-
-				// Schedule for cleanup if cleanup is enabled
-				if cfg.Cleanup.AfterTransfer {
-					if err := ts.cleanup.ScheduleCleanup(path); err != nil {
-						log.Printf("Failed to schedule cleanup for already-transferred file %s: %v", path, err)
-					} else {
-						scheduledForCleanup++
-					}
-				}
-				return nil // Skip queuing this file
-			}
+		// Get relative path from event directory
+		relPath, err := filepath.Rel(localEventPath, path)
+		if err != nil {
+			log.Printf("Failed to get relative path for %s: %v", path, err)
+			return nil
+		}
 
-			// Create transfer item
-			item := TransferItem{
-				ID:              ts.generateTransferID(),
-				SourcePath:      path,
-				DestinationPath: nasDestPath,
-				Resolution:      resolution,
-				Timestamp:       info.ModTime(),
-				Status:          StatusPending,
-				FileSize:        info.Size(),
+		if checkpoint != "" && relPath != "." && compareWalkOrder(relPath, checkpoint) <= 0 {
+			// Directories holding the checkpoint still need descending into
+			if info.IsDir() && !isWithin(checkpoint, relPath) {
+				return filepath.SkipDir
 			}
+			return nil
+		}
 
-			// Add to queue
-			if err := ts.queue.Add(item); err != nil {
-				log.Printf("Failed to queue file %s: %v", path, err)
-			} else {
-				log.Printf("Queued file: %s (%s, %d bytes)", path, resolution, info.Size())
-				fileCount++
-			}
+		// Only process finished segments
+		if !info.IsDir() && isTransferable(info.Name()) {
+			candidates = append(candidates, existingFile{
+				path:        path,
+				relPath:     relPath,
+				info:        info,
+				resolution:  ts.extractResolutionFromPath(path),
+				nasDestPath: filepath.Join(nasEventDir, relPath),
+			})
 		}
 
 		return nil
@@ -231,11 +411,134 @@ func (ts *TransferService) QueueExistingFiles(localEventPath string) error {
 		return fmt.Errorf("failed to walk directory: %w", err)
 	}
 
+	batchSize := ts.queue.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(candidates)
+	}
+
+	var result scanResult
+	complete := true
+	for start := 0; start < len(candidates); start += batchSize {
+		end := start + batchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		batch := candidates[start:end]
+
+		handled := ts.queueExistingBatch(batch, &result)
+		// Only advance past files handled without a gap before them
+		if complete && handled > 0 {
+			ts.queue.SetScanCheckpoint(localEventPath, batch[handled-1].relPath)
+			if err := ts.queue.SaveState(); err != nil {
+				log.Printf("Failed to save scan checkpoint: %v", err)
+			}
+		}
+		if handled < len(batch) {
+			complete = false
+		}
+	}
+
+	if complete {
+		ts.queue.SetScanCheckpoint(localEventPath, "")
+		if err := ts.queue.SaveState(); err != nil {
+			log.Printf("Failed to clear scan checkpoint: %v", err)
+		}
+	}
+
 	log.Printf("File scan completed - Queued: %d, Already transferred: %d, Scheduled for cleanup: %d",
-		fileCount, alreadyTransferred, scheduledForCleanup)
+		result.queued, result.alreadyTransferred, result.scheduledForCleanup)
 	return nil
 }
 
+// scanResult counts what QueueExistingFiles did with the files it found
+type scanResult struct {
+	queued              int
+	alreadyTransferred  int
+	scheduledForCleanup int
+}
+
+// queueExistingBatch checks a batch against the NAS in one pass, queueing
+// files that are missing and scheduling cleanup for those already there. It
+// returns how many leading files of the batch were handled before the first
+// one that could not be queued.
+func (ts *TransferService) queueExistingBatch(batch []existingFile, result *scanResult) int {
+	cfg := constants.MustGetConfig()
+
+	query := make(map[string]int64, len(batch))
+	for _, c := range batch {
+		query[c.nasDestPath] = c.info.Size()
+	}
+	existing, err := ts.nas.FileExistsBatch(query)
+	if err != nil {
+		log.Printf("Failed to check NAS file existence: %v", err)
+		// Continue with transfer attempt on error
+		existing = map[string]bool{}
+	}
+
+	handled := len(batch)
+	for i, c := range batch {
+		if existing[c.nasDestPath] {
+			log.Printf("File already exists on NAS: %s (%s, %d bytes)", c.path, c.resolution, c.info.Size())
+			result.alreadyTransferred++
+
+			// Schedule for cleanup if cleanup is enabled
+			if cfg.Cleanup.AfterTransfer {
+				ts.cleanup.RecordTransferred(c.path, c.nasDestPath)
+				if err := ts.cleanup.ScheduleCleanup(c.path); err != nil {
+					log.Printf("Failed to schedule cleanup for already-transferred file %s: %v", c.path, err)
+				} else {
+					result.scheduledForCleanup++
+				}
+			}
+			continue // Skip queuing this file
+		}
+
+		// Create transfer item
+		item := TransferItem{
+			ID:              ts.generateTransferID(),
+			SourcePath:      c.path,
+			DestinationPath: c.nasDestPath,
+			Resolution:      c.resolution,
+			Timestamp:       c.info.ModTime(),
+			Status:          StatusPending,
+			FileSize:        c.info.Size(),
+		}
+
+		// Add to queue
+		if err := ts.queue.Add(item); err != nil {
+			log.Printf("Failed to queue file %s: %v", c.path, err)
+			if i < handled {
+				handled = i
+			}
+		} else {
+			log.Printf("Queued file: %s (%s, %d bytes)", c.path, c.resolution, c.info.Size())
+			result.queued++
+		}
+	}
+
+	return handled
+}
+
+// compareWalkOrder orders two paths relative to the same root the way
+// filepath.Walk visits them: component by component, with a directory
+// before anything inside it.
+func compareWalkOrder(a, b string) int {
+	as := strings.Split(filepath.Clean(a), string(filepath.Separator))
+	bs := strings.Split(filepath.Clean(b), string(filepath.Separator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// isWithin reports whether relPath is dir or lies inside it
+func isWithin(relPath, dir string) bool {
+	rel, err := filepath.Rel(dir, relPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func (ts *TransferService) extractResolutionFromPath(filePath string) string {
 	dir := filepath.Dir(filePath)
 	parts := strings.Split(dir, string(filepath.Separator))
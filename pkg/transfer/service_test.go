@@ -0,0 +1,366 @@
+package transfer
+
+import (
+	"container/heap"
+	"fmt"
+	"m3u8-downloader/pkg/constants"
+	"m3u8-downloader/pkg/nas"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestScanService returns a transfer service over a local-directory NAS
+// and a local event directory holding count segments per resolution
+func newTestScanService(t *testing.T, persistence string, maxQueue int, count int) (*TransferService, string) {
+	t.Helper()
+	root := filepath.Dir(persistence)
+
+	eventPath := filepath.Join(root, "local", "test-event")
+	for _, resolution := range []string{"1080p", "720p"} {
+		dir := filepath.Join(eventPath, resolution)
+		os.MkdirAll(dir, 0755)
+		for i := 1; i <= count; i++ {
+			os.WriteFile(filepath.Join(dir, fmt.Sprintf("media_%04d.ts", i)), []byte("segment"), 0644)
+		}
+	}
+
+	nasService := nas.NewNASService(nas.NASConfig{
+		Path:       filepath.Join(root, "nas"),
+		Timeout:    5 * time.Second,
+		VerifySize: true,
+	})
+	queue := NewTransferQueue(QueueConfig{
+		WorkerCount:     1,
+		PersistencePath: persistence,
+		MaxQueueSize:    maxQueue,
+		BatchSize:       2,
+	}, nasService, nil)
+
+	return &TransferService{
+		queue:   queue,
+		nas:     nasService,
+		cleanup: newTestCleanupService(10),
+		stats:   queue.stats,
+	}, eventPath
+}
+
+func queuedDestinations(tq *TransferQueue) map[string]int {
+	dests := make(map[string]int)
+	for _, item := range tq.snapshotItems() {
+		dests[item.DestinationPath]++
+	}
+	return dests
+}
+
+func TestQueueExistingFiles_ResumesFromCheckpoint(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "service_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	persistence := filepath.Join(tempDir, "queue.json")
+
+	// A full queue stops the first scan partway, like an interruption
+	ts, eventPath := newTestScanService(t, persistence, 3, 3)
+	if err := ts.QueueExistingFiles(eventPath); err != nil {
+		t.Fatalf("QueueExistingFiles() failed: %v", err)
+	}
+	checkpoint := ts.queue.ScanCheckpoint(eventPath)
+	if checkpoint != filepath.Join("1080p", "media_0003.ts") {
+		t.Fatalf("Expected checkpoint at the last file queued, got %q", checkpoint)
+	}
+
+	// Restart from the persisted state with room for everything
+	resumed, _ := newTestScanService(t, persistence, 100, 3)
+	if got := resumed.queue.ScanCheckpoint(eventPath); got != checkpoint {
+		t.Fatalf("Expected checkpoint %q to be restored, got %q", checkpoint, got)
+	}
+	restoredItems := resumed.queue.GetQueueSize()
+
+	if err := resumed.QueueExistingFiles(eventPath); err != nil {
+		t.Fatalf("QueueExistingFiles() failed: %v", err)
+	}
+
+	dests := queuedDestinations(resumed.queue)
+	if len(dests) != 6 {
+		t.Errorf("Expected all 6 segments queued after resume, got %d", len(dests))
+	}
+	for dest, n := range dests {
+		if n != 1 {
+			t.Errorf("Expected %s queued once, got %d", dest, n)
+		}
+	}
+	if added := resumed.queue.GetQueueSize() - restoredItems; added != 3 {
+		t.Errorf("Expected resume to queue only the 3 files after the checkpoint, got %d", added)
+	}
+	if got := resumed.queue.ScanCheckpoint(eventPath); got != "" {
+		t.Errorf("Expected checkpoint cleared after a complete scan, got %q", got)
+	}
+}
+
+func TestQueueExistingFiles_CheckpointSkipsHandledFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "service_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ts, eventPath := newTestScanService(t, filepath.Join(tempDir, "queue.json"), 100, 3)
+	// 1080p is walked before 720p, so only 1080p/media_0003.ts and all of
+	// 720p remain after this checkpoint
+	ts.queue.SetScanCheckpoint(eventPath, filepath.Join("1080p", "media_0002.ts"))
+
+	if err := ts.QueueExistingFiles(eventPath); err != nil {
+		t.Fatalf("QueueExistingFiles() failed: %v", err)
+	}
+
+	dests := queuedDestinations(ts.queue)
+	if len(dests) != 4 {
+		t.Errorf("Expected 4 files queued after the checkpoint, got %d: %v", len(dests), dests)
+	}
+	for _, skipped := range []string{"media_0001.ts", "media_0002.ts"} {
+		if dests[filepath.Join("test-event", "1080p", skipped)] != 0 {
+			t.Errorf("File %s before the checkpoint should not be rescanned", skipped)
+		}
+	}
+}
+
+func TestCompareWalkOrder(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{filepath.Join("1080p", "media_0001.ts"), filepath.Join("1080p", "media_0002.ts"), -1},
+		{"1080p", filepath.Join("1080p", "media_0001.ts"), -1},
+		// Walk finishes 1080p before 1080p-x even though '-' sorts before '/'
+		{filepath.Join("1080p", "media_0001.ts"), filepath.Join("1080p-x", "media_0001.ts"), -1},
+		{filepath.Join("720p", "media_0001.ts"), filepath.Join("1080p", "media_0009.ts"), 1},
+		{filepath.Join("720p", "media_0001.ts"), filepath.Join("720p", "media_0001.ts"), 0},
+	}
+
+	for _, tt := range tests {
+		got := compareWalkOrder(tt.a, tt.b)
+		if (got < 0) != (tt.want < 0) || (got > 0) != (tt.want > 0) {
+			t.Errorf("compareWalkOrder(%q, %q) = %d, want sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestQueueExistingFiles_DatedDestination(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "service_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	original := cfg.NAS.PathTemplate
+	cfg.NAS.PathTemplate = "{event}/{date}"
+	t.Cleanup(func() { cfg.NAS.PathTemplate = original })
+
+	ts, eventPath := newTestScanService(t, filepath.Join(tempDir, "queue.json"), 100, 2)
+	ts.eventName = "test-event"
+	ts.SetCaptureStart(time.Date(2024, 6, 1, 20, 0, 0, 0, time.Local))
+
+	if err := ts.QueueExistingFiles(eventPath); err != nil {
+		t.Fatalf("QueueExistingFiles() failed: %v", err)
+	}
+
+	dests := queuedDestinations(ts.queue)
+	if len(dests) != 4 {
+		t.Errorf("Expected 4 files queued, got %d: %v", len(dests), dests)
+	}
+	for _, resolution := range []string{"1080p", "720p"} {
+		dest := filepath.Join("test-event", "2024-06-01", resolution, "media_0001.ts")
+		if dests[dest] != 1 {
+			t.Errorf("Expected %s to be queued, got %v", dest, dests)
+		}
+	}
+}
+
+func TestQueueExistingFiles_SubpathDestination(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "service_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cfg := constants.MustGetConfig()
+	original := cfg.NAS.Subpath
+	cfg.NAS.Subpath = "regionals"
+	t.Cleanup(func() { cfg.NAS.Subpath = original })
+
+	ts, eventPath := newTestScanService(t, filepath.Join(tempDir, "queue.json"), 100, 1)
+	ts.eventName = "test-event"
+	ts.SetCaptureStart(time.Now())
+
+	if err := ts.QueueExistingFiles(eventPath); err != nil {
+		t.Fatalf("QueueExistingFiles() failed: %v", err)
+	}
+
+	dests := queuedDestinations(ts.queue)
+	for _, resolution := range []string{"1080p", "720p"} {
+		dest := filepath.Join("regionals", "test-event", resolution, "media_0001.ts")
+		if dests[dest] != 1 {
+			t.Errorf("Expected %s to be queued, got %v", dest, dests)
+		}
+	}
+}
+
+func TestFileWatcher_DatedDestination(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+	fw, err := NewFileWatcher(srcDir, filepath.Join("test-event", "2024-06-01"), tq, time.Second)
+	if err != nil {
+		t.Fatalf("NewFileWatcher() failed: %v", err)
+	}
+	defer fw.watcher.Close()
+
+	os.MkdirAll(filepath.Join(srcDir, "1080p"), 0755)
+	src := filepath.Join(srcDir, "1080p", "media_0001.ts")
+	os.WriteFile(src, []byte("segment"), 0644)
+	fw.processFile(src)
+
+	want := filepath.Join("test-event", "2024-06-01", "1080p", "media_0001.ts")
+	if dests := queuedDestinations(tq); dests[want] != 1 {
+		t.Errorf("Expected %s to be queued, got %v", want, dests)
+	}
+}
+
+func TestTransferQueue_BackfillAndLiveOrdering(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "service_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ts, eventPath := newTestScanService(t, filepath.Join(tempDir, "queue.json"), 100, 2)
+	now := time.Now()
+	for _, resolution := range []string{"1080p", "720p"} {
+		for i, age := range []time.Duration{4 * time.Minute, 2 * time.Minute} {
+			path := filepath.Join(eventPath, resolution, fmt.Sprintf("media_%04d.ts", i+1))
+			os.Chtimes(path, now.Add(-age), now.Add(-age))
+		}
+	}
+	if err := ts.QueueExistingFiles(eventPath); err != nil {
+		t.Fatalf("QueueExistingFiles() failed: %v", err)
+	}
+
+	// Live files arrive after the backfill but media_0003 was written before
+	// the backfilled media_0002, as after a long settling delay
+	fw, err := NewFileWatcher(eventPath, "test-event", ts.queue, time.Second)
+	if err != nil {
+		t.Fatalf("NewFileWatcher() failed: %v", err)
+	}
+	defer fw.watcher.Close()
+	for i, age := range []time.Duration{3 * time.Minute, time.Minute} {
+		path := filepath.Join(eventPath, "1080p", fmt.Sprintf("media_%04d.ts", i+3))
+		os.WriteFile(path, []byte("segment"), 0644)
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+		fw.processFile(path)
+	}
+
+	var order []string
+	for ts.queue.items.Len() > 0 {
+		item := heap.Pop(ts.queue.items).(*TransferItem)
+		order = append(order, filepath.Base(item.SourcePath))
+	}
+
+	want := []string{"media_0004.ts", "media_0002.ts", "media_0002.ts", "media_0003.ts", "media_0001.ts", "media_0001.ts"}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected newest-first order by modification time %v, got %v", want, order)
+	}
+}
+
+func TestCaptureStart(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "service_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if _, ok := CaptureStart(tempDir); ok {
+		t.Error("Expected no capture start for an event without segments")
+	}
+
+	oldest := time.Date(2024, 6, 1, 23, 59, 0, 0, time.Local)
+	files := map[string]time.Time{
+		filepath.Join("1080p", "media_0002.ts"): oldest.Add(time.Hour),
+		filepath.Join("720p", "media_0001.ts"):  oldest,
+		filepath.Join("720p", "notes.txt"):      oldest.Add(-time.Hour),
+	}
+	for name, modTime := range files {
+		path := filepath.Join(tempDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("segment"), 0644)
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	start, ok := CaptureStart(tempDir)
+	if !ok || !start.Equal(oldest) {
+		t.Errorf("Expected capture start %v from the oldest segment, got %v (found: %v)", oldest, start, ok)
+	}
+}
+
+func TestTransferService_ConfirmTransferred(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "service_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ts, eventPath := newTestScanService(t, filepath.Join(tempDir, "queue.json"), 100, 3)
+	if err := ts.QueueExistingFiles(eventPath); err != nil {
+		t.Fatalf("QueueExistingFiles() failed: %v", err)
+	}
+
+	// Copy every queued file to the NAS except one, and one short
+	expected := ts.queue.Expected()
+	if len(expected) != 6 {
+		t.Fatalf("Expected 6 queued files, got %d", len(expected))
+	}
+	lost := filepath.Join("test-event", "720p", "media_0002.ts")
+	truncated := filepath.Join("test-event", "1080p", "media_0003.ts")
+	for destPath := range expected {
+		if destPath == lost {
+			continue
+		}
+		data := []byte("segment")
+		if destPath == truncated {
+			data = data[:3]
+		}
+		nasPath := filepath.Join(tempDir, "nas", destPath)
+		os.MkdirAll(filepath.Dir(nasPath), 0755)
+		if err := os.WriteFile(nasPath, data, 0644); err != nil {
+			t.Fatalf("Failed to write NAS file: %v", err)
+		}
+	}
+
+	missing, err := ts.ConfirmTransferred()
+	if err != nil {
+		t.Fatalf("ConfirmTransferred() failed: %v", err)
+	}
+	want := []string{truncated, lost}
+	if len(missing) != len(want) {
+		t.Fatalf("Expected missing %v, got %v", want, missing)
+	}
+	for i := range want {
+		if missing[i] != want[i] {
+			t.Errorf("Expected missing %v, got %v", want, missing)
+			break
+		}
+	}
+
+	// Once the file lands, nothing is reported
+	os.WriteFile(filepath.Join(tempDir, "nas", lost), []byte("segment"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "nas", truncated), []byte("segment"), 0644)
+	missing, err = ts.ConfirmTransferred()
+	if err != nil {
+		t.Fatalf("ConfirmTransferred() failed: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("Expected every file confirmed, got missing %v", missing)
+	}
+}
@@ -0,0 +1,151 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"m3u8-downloader/pkg/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// QueueState is what a StateStore persists between runs
+type QueueState struct {
+	Items           []*TransferItem   `json:"items"`
+	Quarantined     []TransferItem    `json:"quarantined"`
+	ScanCheckpoints map[string]string `json:"scanCheckpoints"`
+	Stats           *QueueStats       `json:"stats"`
+	Timestamp       time.Time         `json:"timestamp"`
+}
+
+// StateStore persists the transfer queue. Save writes a periodic snapshot
+// and Update is called as each item changes status, so a store can keep
+// items current without rewriting the whole queue; a store that records
+// items through Update ignores Items in Save.
+type StateStore interface {
+	Save(state QueueState) error
+	// Load returns the last saved state, or nil if nothing was saved
+	Load() (*QueueState, error)
+	Update(item TransferItem) error
+	Close() error
+}
+
+// newStateStore opens the store selected by QueueConfig.StateBackend. The
+// SQLite database sits beside the JSON path with a .db extension.
+func newStateStore(qc *QueueConfig) (StateStore, error) {
+	switch qc.StateBackend {
+	case "", config.StateBackendJSON:
+		return &jsonStateStore{config: qc}, nil
+	case config.StateBackendSQLite:
+		path := strings.TrimSuffix(qc.PersistencePath, filepath.Ext(qc.PersistencePath)) + ".db"
+		return openSQLiteStateStore(path)
+	default:
+		return nil, fmt.Errorf("unknown queue state backend: %s", qc.StateBackend)
+	}
+}
+
+// jsonStateStore rewrites the whole queue to QueueConfig.PersistencePath on
+// every Save, gzipped when QueueConfig.CompressState is set. It reads the
+// queue's config on each call, so either can be changed while it runs.
+type jsonStateStore struct {
+	config *QueueConfig
+}
+
+func (s *jsonStateStore) Save(state QueueState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal queue state: %w", err)
+	}
+
+	if s.config.CompressState {
+		if data, err = gzipBytes(data); err != nil {
+			return fmt.Errorf("Failed to compress queue state: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(s.config.PersistencePath, data, 0644); err != nil {
+		return fmt.Errorf("Failed to save queue state: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonStateStore) Load() (*QueueState, error) {
+	data, err := os.ReadFile(s.config.PersistencePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to load queue state: %w", err)
+	}
+
+	state, err := decodeQueueState(data)
+	if err != nil {
+		return nil, s.backUpCorrupt(err)
+	}
+	return state, nil
+}
+
+// decodeQueueState parses a state file. Either format loads, so
+// CompressState can be toggled between runs.
+func decodeQueueState(data []byte) (*QueueState, error) {
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var state QueueState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// backUpCorrupt moves a state file that can't be parsed to
+// <path>.corrupt.<time>, so the next Save doesn't overwrite what may still be
+// recovered by hand, and lets the queue start empty. It only returns an
+// error if the file couldn't be moved.
+func (s *jsonStateStore) backUpCorrupt(parseErr error) error {
+	path := s.config.PersistencePath
+	backup := fmt.Sprintf("%s.corrupt.%s", path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(path, backup); err != nil {
+		return fmt.Errorf("Failed to load queue state: %v; and failed to back up the corrupt file: %w", parseErr, err)
+	}
+	log.Printf("WARNING: queue state file %s is corrupt (%v). It was moved to %s and the queue starts empty; items queued in the previous run are only recorded there.", path, parseErr, backup)
+	return nil
+}
+
+// Update is a no-op; items are only written by Save
+func (s *jsonStateStore) Update(item TransferItem) error {
+	return nil
+}
+
+func (s *jsonStateStore) Close() error {
+	return nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
@@ -0,0 +1,252 @@
+package transfer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"time"
+)
+
+// sqliteSchema keeps one row per source file with its latest status, so the
+// queue can be inspected with e.g.
+// SELECT source_path, last_error FROM items WHERE status = 'Failed'
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS items (
+	source_path      TEXT PRIMARY KEY,
+	id               TEXT NOT NULL,
+	destination_path TEXT NOT NULL,
+	resolution       TEXT NOT NULL,
+	timestamp        INTEGER NOT NULL,
+	retry_count      INTEGER NOT NULL,
+	status           TEXT NOT NULL,
+	file_size        INTEGER NOT NULL,
+	last_error       TEXT NOT NULL,
+	updated_at       INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS items_status ON items (status);
+CREATE TABLE IF NOT EXISTS quarantine (
+	source_path      TEXT PRIMARY KEY,
+	id               TEXT NOT NULL,
+	destination_path TEXT NOT NULL,
+	resolution       TEXT NOT NULL,
+	timestamp        INTEGER NOT NULL,
+	file_size        INTEGER NOT NULL,
+	last_error       TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS scan_checkpoints (
+	root     TEXT PRIMARY KEY,
+	rel_path TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);`
+
+// sqliteStateStore upserts each item as its status changes instead of
+// rewriting the queue, which gets slow with hundreds of thousands of items.
+// Save only writes the quarantine, scan checkpoints and stats. Timestamps are
+// stored as Unix nanoseconds.
+type sqliteStateStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStateStore(path string) (*sqliteStateStore, error) {
+	dsn := "file:" + filepath.ToSlash(path) + "?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open queue database: %w", err)
+	}
+	// One connection serializes writes instead of contending for the lock
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to create queue database %s: %w", path, err)
+	}
+	return &sqliteStateStore{db: db}, nil
+}
+
+func (s *sqliteStateStore) Update(item TransferItem) error {
+	_, err := s.db.Exec(`
+		INSERT INTO items (source_path, id, destination_path, resolution, timestamp, retry_count, status, file_size, last_error, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (source_path) DO UPDATE SET
+			id = excluded.id,
+			destination_path = excluded.destination_path,
+			resolution = excluded.resolution,
+			timestamp = excluded.timestamp,
+			retry_count = excluded.retry_count,
+			status = excluded.status,
+			file_size = excluded.file_size,
+			last_error = excluded.last_error,
+			updated_at = excluded.updated_at`,
+		filepath.Clean(item.SourcePath), item.ID, item.DestinationPath, item.Resolution, item.Timestamp.UnixNano(),
+		item.RetryCount, item.Status.String(), item.FileSize, item.LastError, time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("Failed to update queue item %s: %w", item.SourcePath, err)
+	}
+	return nil
+}
+
+func (s *sqliteStateStore) Save(state QueueState) error {
+	stats, err := json.Marshal(state.Stats)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal queue stats: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Failed to save queue state: %w", err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if _, err := tx.Exec(`DELETE FROM scan_checkpoints`); err != nil {
+		return fmt.Errorf("Failed to save queue state: %w", err)
+	}
+	for root, relPath := range state.ScanCheckpoints {
+		if _, err := tx.Exec(`INSERT INTO scan_checkpoints (root, rel_path) VALUES (?, ?)`, root, relPath); err != nil {
+			return fmt.Errorf("Failed to save queue state: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM quarantine`); err != nil {
+		return fmt.Errorf("Failed to save queue state: %w", err)
+	}
+	for _, item := range state.Quarantined {
+		if _, err := tx.Exec(`INSERT INTO quarantine (source_path, id, destination_path, resolution, timestamp, file_size, last_error) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			filepath.Clean(item.SourcePath), item.ID, item.DestinationPath, item.Resolution, item.Timestamp.UnixNano(), item.FileSize, item.LastError); err != nil {
+			return fmt.Errorf("Failed to save queue state: %w", err)
+		}
+	}
+	for key, value := range map[string]string{
+		"stats":     string(stats),
+		"timestamp": state.Timestamp.Format(time.RFC3339Nano),
+	} {
+		if _, err := tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value); err != nil {
+			return fmt.Errorf("Failed to save queue state: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to save queue state: %w", err)
+	}
+	return nil
+}
+
+// Load restores every item that hadn't finished, including ones that were
+// being transferred when the process stopped, as pending, and failed items
+// as failed. The JSON store restores the same pending and failed items, but
+// only as of the last Save. Quarantined segments come back in Quarantined
+// rather than being queued again; one quarantined after the last Save is
+// still restored as failed and validated again when retried.
+func (s *sqliteStateStore) Load() (*QueueState, error) {
+	state := &QueueState{ScanCheckpoints: make(map[string]string)}
+
+	var timestamp, stats string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = 'timestamp'`).Scan(&timestamp)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("Failed to load queue state: %w", err)
+	}
+	state.Timestamp, _ = time.Parse(time.RFC3339Nano, timestamp)
+
+	err = s.db.QueryRow(`SELECT value FROM meta WHERE key = 'stats'`).Scan(&stats)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("Failed to load queue state: %w", err)
+	}
+	if stats != "" {
+		if err := json.Unmarshal([]byte(stats), &state.Stats); err != nil {
+			return nil, fmt.Errorf("Failed to load queue stats: %w", err)
+		}
+	}
+
+	if state.Items, err = s.loadItems(); err != nil {
+		return nil, fmt.Errorf("Failed to load queue state: %w", err)
+	}
+	if state.Quarantined, err = s.loadQuarantine(); err != nil {
+		return nil, fmt.Errorf("Failed to load queue state: %w", err)
+	}
+	if err := s.loadCheckpoints(state.ScanCheckpoints); err != nil {
+		return nil, fmt.Errorf("Failed to load queue state: %w", err)
+	}
+
+	if timestamp == "" && len(state.Items) == 0 {
+		return nil, nil
+	}
+	return state, nil
+}
+
+// loadItems returns the unfinished items as pending and the failed ones as
+// failed, leaving out quarantined segments. Each query closes its rows before
+// returning, since the store has a single connection.
+func (s *sqliteStateStore) loadItems() ([]*TransferItem, error) {
+	rows, err := s.db.Query(`
+		SELECT source_path, id, destination_path, resolution, timestamp, retry_count, status, file_size, last_error
+		FROM items WHERE status IN (?, ?, ?, ?)
+		AND source_path NOT IN (SELECT source_path FROM quarantine)`,
+		StatusPending.String(), StatusInProgress.String(), StatusRetrying.String(), StatusFailed.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*TransferItem
+	for rows.Next() {
+		item := &TransferItem{Status: StatusPending}
+		var ts int64
+		var status string
+		if err := rows.Scan(&item.SourcePath, &item.ID, &item.DestinationPath, &item.Resolution, &ts, &item.RetryCount, &status, &item.FileSize, &item.LastError); err != nil {
+			return nil, err
+		}
+		if status == StatusFailed.String() {
+			item.Status = StatusFailed
+		}
+		item.Timestamp = time.Unix(0, ts)
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *sqliteStateStore) loadQuarantine() ([]TransferItem, error) {
+	rows, err := s.db.Query(`
+		SELECT source_path, id, destination_path, resolution, timestamp, file_size, last_error
+		FROM quarantine`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []TransferItem
+	for rows.Next() {
+		item := TransferItem{Status: StatusFailed}
+		var ts int64
+		if err := rows.Scan(&item.SourcePath, &item.ID, &item.DestinationPath, &item.Resolution, &ts, &item.FileSize, &item.LastError); err != nil {
+			return nil, err
+		}
+		item.Timestamp = time.Unix(0, ts)
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *sqliteStateStore) loadCheckpoints(scans map[string]string) error {
+	rows, err := s.db.Query(`SELECT root, rel_path FROM scan_checkpoints`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var root, relPath string
+		if err := rows.Scan(&root, &relPath); err != nil {
+			return err
+		}
+		scans[root] = relPath
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStateStore) Close() error {
+	return s.db.Close()
+}
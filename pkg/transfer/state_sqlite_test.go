@@ -0,0 +1,248 @@
+package transfer
+
+import (
+	"errors"
+	"m3u8-downloader/pkg/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQLiteQueue(t *testing.T, persistencePath string) *TransferQueue {
+	t.Helper()
+	tq := NewTransferQueue(QueueConfig{
+		WorkerCount:     1,
+		PersistencePath: persistencePath,
+		MaxQueueSize:    100,
+		BatchSize:       1000,
+		StateBackend:    config.StateBackendSQLite,
+	}, nil, nil)
+	if _, ok := tq.store.(*sqliteStateStore); !ok {
+		t.Fatalf("Expected a SQLite state store, got %T", tq.store)
+	}
+	return tq
+}
+
+// statusCounts queries the database the way an operator would
+func statusCounts(t *testing.T, tq *TransferQueue) map[string]int {
+	t.Helper()
+	rows, err := tq.store.(*sqliteStateStore).db.Query(`SELECT status, COUNT(*) FROM items GROUP BY status`)
+	if err != nil {
+		t.Fatalf("Failed to query items: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			t.Fatalf("Failed to scan items: %v", err)
+		}
+		counts[status] = n
+	}
+	return counts
+}
+
+func TestSQLiteStateStore_PersistsItemsAsTheyChange(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "state_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	persistencePath := filepath.Join(tempDir, "queue.json")
+
+	tq := newTestSQLiteQueue(t, persistencePath)
+	for i := 0; i < 5; i++ {
+		if err := tq.Add(newTestItem(i)); err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+	}
+	if got := statusCounts(t, tq); got["Pending"] != 5 {
+		t.Errorf("Expected 5 pending rows after Add, got %v", got)
+	}
+
+	// 0 completes, 1 fails after its retries, 2 is quarantined, 3 is
+	// mid-retry and 4 is still queued
+	tq.completeItem(newTestItem(0))
+
+	failed := newTestItem(1)
+	failed.Status = StatusFailed
+	failed.RetryCount = 3
+	failed.LastError = "copy failed"
+	tq.setStatus(failed)
+
+	tq.quarantineItem(newTestItem(2), errors.New("bad sync byte"))
+
+	retrying := newTestItem(3)
+	retrying.Status = StatusRetrying
+	tq.setStatus(retrying)
+
+	got := statusCounts(t, tq)
+	if got["Completed"] != 1 || got["Failed"] != 2 || got["Retrying"] != 1 || got["Pending"] != 1 {
+		t.Errorf("Expected 1 completed, 2 failed, 1 retrying and 1 pending row, got %v", got)
+	}
+	var lastError string
+	var retries int
+	err = tq.store.(*sqliteStateStore).db.QueryRow(`SELECT last_error, retry_count FROM items WHERE source_path = ?`, failed.SourcePath).Scan(&lastError, &retries)
+	if err != nil || lastError != "copy failed" || retries != 3 {
+		t.Errorf("Expected the failed row to keep its error and retries, got %q, %d, %v", lastError, retries, err)
+	}
+
+	// No SaveState, as after a crash: items are already in the database
+	if err := tq.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err := os.Stat(persistencePath); !os.IsNotExist(err) {
+		t.Errorf("Expected no JSON state file with the SQLite backend, stat returned %v", err)
+	}
+
+	restored := newTestSQLiteQueue(t, persistencePath)
+	defer restored.Close()
+	// The quarantine is only written by SaveState, so item 2 comes back as
+	// failed alongside item 1
+	if got := restored.Restored(); got.Pending != 2 || got.Failed != 2 {
+		t.Errorf("Expected 2 items restored as pending and 2 as failed, got %+v", got)
+	}
+	for i, want := range map[int]TransferStatus{1: StatusFailed, 2: StatusFailed, 3: StatusPending, 4: StatusPending} {
+		status, ok := restored.Status(newTestItem(i).SourcePath)
+		if !ok || status != want {
+			t.Errorf("Expected item %d restored as %s, got %v, %v", i, want, status, ok)
+		}
+	}
+	if _, ok := restored.Status(newTestItem(0).SourcePath); ok {
+		t.Error("Expected the completed item not to be queued again")
+	}
+	if got := restored.Expected()[newTestItem(4).DestinationPath]; got != newTestItem(4).FileSize {
+		t.Errorf("Expected restored items to be expected on the NAS, got size %d", got)
+	}
+}
+
+func TestSQLiteStateStore_SavesCheckpointsAndStats(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "state_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	persistencePath := filepath.Join(tempDir, "queue.json")
+
+	tq := newTestSQLiteQueue(t, persistencePath)
+	if err := tq.Add(newTestItem(0)); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	tq.stats.IncrementCompleted(2048)
+	tq.SetScanCheckpoint("/data/event", "1080p/media_0.ts")
+	if err := tq.SaveState(); err != nil {
+		t.Fatalf("SaveState() failed: %v", err)
+	}
+
+	// A later save replaces the checkpoints instead of adding to them
+	tq.SetScanCheckpoint("/data/other", "720p/media_9.ts")
+	tq.SetScanCheckpoint("/data/event", "")
+	if err := tq.SaveState(); err != nil {
+		t.Fatalf("SaveState() failed: %v", err)
+	}
+	tq.Close()
+
+	restored := newTestSQLiteQueue(t, persistencePath)
+	defer restored.Close()
+	if got := restored.ScanCheckpoint("/data/other"); got != "720p/media_9.ts" {
+		t.Errorf("Expected checkpoint '720p/media_9.ts', got %q", got)
+	}
+	if got := restored.ScanCheckpoint("/data/event"); got != "" {
+		t.Errorf("Expected the cleared checkpoint to stay cleared, got %q", got)
+	}
+	added, completed, _, _, bytes := restored.GetStats()
+	if added != 1 || completed != 1 || bytes != 2048 {
+		t.Errorf("Expected stats added=1 completed=1 bytes=2048, got added=%d completed=%d bytes=%d", added, completed, bytes)
+	}
+	if got := restored.GetQueueSize(); got != 1 {
+		t.Errorf("Expected 1 item restored, got %d", got)
+	}
+}
+
+// TestStateStores_RestoreFailedAndQuarantined runs the same queue through
+// both backends and expects the same state back
+func TestStateStores_RestoreFailedAndQuarantined(t *testing.T) {
+	for _, backend := range []string{config.StateBackendJSON, config.StateBackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "state_test_*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			qc := QueueConfig{
+				WorkerCount:     1,
+				PersistencePath: filepath.Join(tempDir, "queue.json"),
+				MaxQueueSize:    100,
+				BatchSize:       1000,
+				StateBackend:    backend,
+			}
+			tq := NewTransferQueue(qc, nil, nil)
+
+			// 0 is queued, 1 failed in an earlier run, 2 was quarantined, 3
+			// completed and 4 failed for good after being dispatched
+			if err := tq.Add(newTestItem(0)); err != nil {
+				t.Fatalf("Add() failed: %v", err)
+			}
+			failed := newTestItem(1)
+			failed.Status = StatusFailed
+			failed.LastError = "copy failed"
+			if err := tq.Add(failed); err != nil {
+				t.Fatalf("Add() failed: %v", err)
+			}
+			tq.quarantineItem(newTestItem(2), errors.New("bad sync byte"))
+			tq.completeItem(newTestItem(3))
+			dispatchedFailed := newTestItem(4)
+			dispatchedFailed.Status = StatusFailed
+			dispatchedFailed.LastError = "NAS unreachable"
+			tq.setStatus(dispatchedFailed)
+
+			if err := tq.SaveState(); err != nil {
+				t.Fatalf("SaveState() failed: %v", err)
+			}
+			tq.Close()
+
+			restored := NewTransferQueue(qc, nil, nil)
+			defer restored.Close()
+			if got := restored.Restored(); got.Pending != 1 || got.Failed != 2 {
+				t.Errorf("Expected 1 pending and 2 failed items restored, got %+v", got)
+			}
+			if got := restored.GetQueueSize(); got != 3 {
+				t.Errorf("Expected 3 items queued, got %d", got)
+			}
+			for _, item := range []TransferItem{failed, dispatchedFailed} {
+				if status, ok := restored.Status(item.SourcePath); !ok || status != StatusFailed {
+					t.Errorf("Expected %s restored as failed, got %v, %v", item.ID, status, ok)
+				}
+			}
+			quarantined := restored.Quarantined()
+			if len(quarantined) != 1 || quarantined[0].SourcePath != newTestItem(2).SourcePath || quarantined[0].LastError != "bad sync byte" {
+				t.Errorf("Expected the quarantined segment restored with its error, got %+v", quarantined)
+			}
+			if _, ok := restored.Status(newTestItem(3).SourcePath); ok {
+				t.Error("Expected the completed item not to be queued again")
+			}
+		})
+	}
+}
+
+func TestSQLiteStateStore_EmptyDatabase(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "state_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := openSQLiteStateStore(filepath.Join(tempDir, "queue.db"))
+	if err != nil {
+		t.Fatalf("openSQLiteStateStore() failed: %v", err)
+	}
+	defer store.Close()
+
+	state, err := store.Load()
+	if err != nil || state != nil {
+		t.Errorf("Expected no state from a new database, got %+v, %v", state, err)
+	}
+}
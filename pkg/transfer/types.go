@@ -1,10 +1,14 @@
 package transfer
 
 import (
+	"fmt"
 	"sync"
 	"time"
 )
 
+// TransferItem is one file waiting to be copied to the NAS. Timestamp is the
+// file's modification time, used by both the watcher and the backfill scan so
+// live and backfilled items are ordered on the same clock.
 type TransferItem struct {
 	ID              string
 	SourcePath      string
@@ -49,6 +53,19 @@ type QueueConfig struct {
 	PersistencePath string
 	MaxQueueSize    int
 	BatchSize       int
+	VerifySegments  bool          // quarantine segments failing the TS sanity check
+	VerifyChecksum  bool          // compare SHA-256 of each copy with its source
+	VerifyWorkers   int           // concurrent checksum verifications, WorkerCount when 0
+	SmallestFirst   bool          // dispatch the smallest pending file first instead of the newest
+	SaveInterval    time.Duration // how often the state is persisted, 30s when 0
+	CompressState   bool          // gzip the persisted state
+	StateBackend    string        // config.StateBackendJSON or config.StateBackendSQLite
+}
+
+// RestoredCounts reports the items restored from a persisted queue by status
+type RestoredCounts struct {
+	Pending int
+	Failed  int
 }
 
 type CleanupConfig struct {
@@ -56,6 +73,45 @@ type CleanupConfig struct {
 	RetentionPeriod time.Duration
 	BatchSize       int
 	CheckInterval   time.Duration
+	// RequireTransferRecord refuses to delete files that were not recorded
+	// as transferred via RecordTransferred, or whose recorded NAS copy is
+	// not found by the check given to SetNASCheck
+	RequireTransferRecord bool
+	// FileTimeout bounds the filesystem calls for each file; files that
+	// time out are requeued. 0 means no limit.
+	FileTimeout time.Duration
+}
+
+// CleanupResult reports the outcome of a cleanup batch
+type CleanupResult struct {
+	Cleaned    int
+	Skipped    int
+	Requeued   int // timed out or cancelled, and scheduled again
+	FreedBytes int64
+	Errors     []CleanupFileError
+}
+
+// CleanupFileError records a file that could not be removed
+type CleanupFileError struct {
+	Path string
+	Err  error
+}
+
+func (e CleanupFileError) Error() string {
+	return fmt.Sprintf("Failed to cleanup file %s: %v", e.Path, e.Err)
+}
+
+func (e CleanupFileError) Unwrap() error {
+	return e.Err
+}
+
+// Add merges another batch result into r
+func (r *CleanupResult) Add(other CleanupResult) {
+	r.Cleaned += other.Cleaned
+	r.Skipped += other.Skipped
+	r.Requeued += other.Requeued
+	r.FreedBytes += other.FreedBytes
+	r.Errors = append(r.Errors, other.Errors...)
 }
 
 type QueueStats struct {
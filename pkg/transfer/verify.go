@@ -0,0 +1,34 @@
+package transfer
+
+import "context"
+
+// verifyPool runs post-copy verification off the transfer workers, at most
+// size at a time, so a slow checksum doesn't hold up the next copy
+type verifyPool struct {
+	sem chan struct{}
+}
+
+func newVerifyPool(size int) *verifyPool {
+	if size < 1 {
+		size = 1
+	}
+	return &verifyPool{sem: make(chan struct{}, size)}
+}
+
+// Submit waits for a free slot, then runs verify in the background and hands
+// its result to done. It returns ctx's error if no slot frees up in time, in
+// which case neither function runs.
+func (p *verifyPool) Submit(ctx context.Context, verify func() error, done func(error)) error {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	go func() {
+		err := verify()
+		<-p.sem
+		done(err)
+	}()
+	return nil
+}
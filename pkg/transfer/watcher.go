@@ -2,49 +2,101 @@ package transfer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"m3u8-downloader/pkg/utils"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
+// watchPollInterval is how often directories that could not be watched are
+// scanned for new segments instead
+const watchPollInterval = 10 * time.Second
+
+// FileWatcher queues segments written under outputDir. It normally follows
+// fsnotify events; a polling watcher, or directories past the inotify watch
+// limit, are scanned every pollInterval instead.
 type FileWatcher struct {
 	outputDir    string
+	destDir      string // NAS directory files under outputDir are copied to
 	queue        *TransferQueue
-	watcher      *fsnotify.Watcher
+	watcher      *fsnotify.Watcher // nil for a polling watcher
 	settingDelay time.Duration
 	pendingFiles map[string]*time.Timer
 	mu           sync.Mutex
+
+	// Directories left unwatched by the inotify watch limit, with the
+	// modification time of each entry already seen in them
+	polled       map[string]map[string]time.Time
+	limitWarned  bool
+	pollInterval time.Duration
+
+	addWatch func(path string) error // test hook, defaults to watcher.Add
 }
 
-func NewFileWatcher(outputDir string, queue *TransferQueue, settlingDelay time.Duration) (*FileWatcher, error) {
+func NewFileWatcher(outputDir, destDir string, queue *TransferQueue, settlingDelay time.Duration) (*FileWatcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 	return &FileWatcher{
 		outputDir:    outputDir,
+		destDir:      destDir,
 		queue:        queue,
 		watcher:      watcher,
 		settingDelay: settlingDelay,
 		pendingFiles: make(map[string]*time.Timer),
+		polled:       make(map[string]map[string]time.Time),
+		pollInterval: watchPollInterval,
+		addWatch:     watcher.Add,
 	}, nil
 }
 
+// NewPollingWatcher returns a FileWatcher that scans for new segments every
+// interval instead of using fsnotify, for network filesystems that don't
+// deliver change events
+func NewPollingWatcher(outputDir, destDir string, queue *TransferQueue, settlingDelay, interval time.Duration) *FileWatcher {
+	return &FileWatcher{
+		outputDir:    outputDir,
+		destDir:      destDir,
+		queue:        queue,
+		settingDelay: settlingDelay,
+		pendingFiles: make(map[string]*time.Timer),
+		polled:       make(map[string]map[string]time.Time),
+		pollInterval: interval,
+	}
+}
+
 func (fw *FileWatcher) Start(ctx context.Context) error {
-	defer fw.watcher.Close()
+	// A polling watcher has no event channels; receiving from nil blocks
+	var events chan fsnotify.Event
+	var errs chan error
+	if fw.watcher != nil {
+		defer fw.watcher.Close()
+		events = fw.watcher.Events
+		errs = fw.watcher.Errors
+	}
 
 	if err := fw.addWatchRecursive(fw.outputDir); err != nil {
 		return fmt.Errorf("Failed to add watch paths: %w", err)
 	}
 
-	log.Printf("Starting file watcher on %s", fw.outputDir)
+	if fw.watcher == nil {
+		log.Printf("Starting polling file watcher on %s (every %v)", fw.outputDir, fw.pollInterval)
+	} else {
+		log.Printf("Starting file watcher on %s", fw.outputDir)
+	}
+
+	pollTicker := time.NewTicker(fw.pollInterval)
+	defer pollTicker.Stop()
 
 	for {
 		select {
@@ -52,13 +104,16 @@ func (fw *FileWatcher) Start(ctx context.Context) error {
 			log.Println("File watcher shutting down...")
 			return ctx.Err()
 
-		case event, ok := <-fw.watcher.Events:
+		case <-pollTicker.C:
+			fw.pollUnwatched()
+
+		case event, ok := <-events:
 			if !ok {
 				return fmt.Errorf("Watcher events channel closed")
 			}
 			fw.handleFileEvent(event)
 
-		case err, ok := <-fw.watcher.Errors:
+		case err, ok := <-errs:
 			if !ok {
 				return fmt.Errorf("Watcher errors channel closed")
 			}
@@ -75,19 +130,131 @@ func (fw *FileWatcher) addWatchRecursive(root string) error {
 		}
 
 		if info.IsDir() {
-			if err := fw.watcher.Add(path); err != nil {
-				log.Printf("Failed to watch directory %s: %v", path, err)
-			} else {
-				log.Printf("Watching directory %s", path)
-			}
+			fw.watchDir(path)
 		}
 
 		return nil
 	})
 }
 
+// watchDir adds an fsnotify watch on dir. When the inotify watch limit is
+// reached the directory is polled every pollInterval instead, so segments
+// written there are still transferred, only later.
+func (fw *FileWatcher) watchDir(dir string) {
+	if fw.watcher == nil {
+		fw.pollDir(dir)
+		return
+	}
+
+	err := fw.addWatch(dir)
+	if err == nil {
+		log.Printf("Watching directory %s", dir)
+		return
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		log.Printf("Failed to watch directory %s: %v", dir, err)
+		return
+	}
+
+	fw.mu.Lock()
+	if !fw.limitWarned {
+		fw.limitWarned = true
+		log.Printf("Inotify watch limit reached; raise it with 'sysctl fs.inotify.max_user_watches=<n>' "+
+			"(and in /etc/sysctl.conf to persist). Unwatched directories are polled every %v instead.", fw.pollInterval)
+	}
+	fw.mu.Unlock()
+	fw.pollDir(dir)
+}
+
+// pollDir adds dir to the directories scanned by pollUnwatched
+func (fw *FileWatcher) pollDir(dir string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if _, ok := fw.polled[dir]; ok {
+		return
+	}
+
+	// Like a new watch, polling only picks up files written from now on
+	seen := make(map[string]time.Time)
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				seen[entry.Name()] = info.ModTime()
+			}
+		}
+	}
+	fw.polled[dir] = seen
+	log.Printf("Polling directory %s", dir)
+}
+
+// pollUnwatched schedules segments that are new or changed since the last
+// poll in each polled directory, and watches or polls any new subdirectories
+func (fw *FileWatcher) pollUnwatched() {
+	fw.mu.Lock()
+	dirs := make([]string, 0, len(fw.polled))
+	for dir := range fw.polled {
+		dirs = append(dirs, dir)
+	}
+	fw.mu.Unlock()
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fw.mu.Lock()
+				delete(fw.polled, dir)
+				fw.mu.Unlock()
+			}
+			continue
+		}
+
+		var changed, subdirs []string
+		fw.mu.Lock()
+		seen := fw.polled[dir]
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				if _, ok := seen[entry.Name()]; !ok {
+					seen[entry.Name()] = time.Time{}
+					subdirs = append(subdirs, path)
+				}
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || !isTransferable(path) {
+				continue
+			}
+			if last, ok := seen[entry.Name()]; !ok || !info.ModTime().Equal(last) {
+				seen[entry.Name()] = info.ModTime()
+				changed = append(changed, path)
+			}
+		}
+		fw.mu.Unlock()
+
+		for _, path := range changed {
+			fw.scheduleTransfer(path)
+		}
+		for _, sub := range subdirs {
+			fw.addWatchRecursive(sub)
+			// Everything in a directory created since the last poll is new
+			filepath.Walk(sub, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && isTransferable(path) {
+					fw.scheduleTransfer(path)
+				}
+				return nil
+			})
+		}
+	}
+}
+
+// isTransferable reports whether name is a finished file to move to the NAS:
+// a media segment or a subtitle segment
+func isTransferable(name string) bool {
+	return utils.IsSegmentFile(name) || utils.IsSubtitleFile(name)
+}
+
 func (fw *FileWatcher) handleFileEvent(event fsnotify.Event) {
-	if !strings.HasSuffix(strings.ToLower(event.Name), ".ts") {
+	if !isTransferable(event.Name) {
 		return
 	}
 
@@ -102,11 +269,7 @@ func (fw *FileWatcher) handleFileEvent(event fsnotify.Event) {
 
 	if event.Op&fsnotify.Create == fsnotify.Create {
 		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
-			if err := fw.watcher.Add(event.Name); err != nil {
-				log.Printf("Failed to watch directory %s: %v", event.Name, err)
-			} else {
-				log.Printf("Watching directory %s", event.Name)
-			}
+			fw.watchDir(event.Name)
 		}
 	}
 }
@@ -129,6 +292,13 @@ func (fw *FileWatcher) scheduleTransfer(filePath string) {
 	log.Printf("Scheduled file for transfer: %s", filePath)
 }
 
+// PendingCount returns how many files are waiting out the settling delay
+func (fw *FileWatcher) PendingCount() int {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return len(fw.pendingFiles)
+}
+
 func (fw *FileWatcher) cancelPendingTransfer(filePath string) {
 	fw.mu.Lock()
 	defer fw.mu.Unlock()
@@ -158,9 +328,9 @@ func (fw *FileWatcher) processFile(filePath string) {
 	item := TransferItem{
 		ID:              generateID(),
 		SourcePath:      filePath,
-		DestinationPath: relPath,
+		DestinationPath: filepath.Join(fw.destDir, relPath),
 		Resolution:      resolution,
-		Timestamp:       time.Now(),
+		Timestamp:       info.ModTime(),
 		Status:          StatusPending,
 		FileSize:        info.Size(),
 	}
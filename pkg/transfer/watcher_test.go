@@ -0,0 +1,197 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestWatcher returns a watcher over a fresh event directory whose
+// directory watches fail with failErr for the directories in fail
+func newTestWatcher(t *testing.T, failErr error, fail ...string) (*FileWatcher, string, *[]string) {
+	t.Helper()
+	tq, srcDir := newTestNASQueue(t, 1)
+	fw, err := NewFileWatcher(srcDir, "test-event", tq, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileWatcher() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		fw.watcher.Close()
+		fw.mu.Lock()
+		for _, timer := range fw.pendingFiles {
+			timer.Stop()
+		}
+		fw.mu.Unlock()
+	})
+
+	var mu sync.Mutex
+	var attempts []string
+	fw.addWatch = func(path string) error {
+		mu.Lock()
+		attempts = append(attempts, path)
+		mu.Unlock()
+		for _, dir := range fail {
+			if path == filepath.Join(srcDir, dir) {
+				return failErr
+			}
+		}
+		return nil
+	}
+	return fw, srcDir, &attempts
+}
+
+func pendingNames(fw *FileWatcher) []string {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	names := make([]string, 0, len(fw.pendingFiles))
+	for path := range fw.pendingFiles {
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFileWatcher_WatchLimitFallsBackToPolling(t *testing.T) {
+	fw, srcDir, _ := newTestWatcher(t, fmt.Errorf("inotify_add_watch: %w", syscall.ENOSPC), "720p")
+
+	for _, resolution := range []string{"1080p", "720p"} {
+		os.MkdirAll(filepath.Join(srcDir, resolution), 0755)
+		os.WriteFile(filepath.Join(srcDir, resolution, "media_0001.ts"), []byte("segment"), 0644)
+	}
+	if err := fw.addWatchRecursive(srcDir); err != nil {
+		t.Fatalf("addWatchRecursive() failed: %v", err)
+	}
+
+	if _, ok := fw.polled[filepath.Join(srcDir, "720p")]; !ok || len(fw.polled) != 1 {
+		t.Fatalf("Expected only 720p to be polled, got %v", fw.polled)
+	}
+	if !fw.limitWarned {
+		t.Error("Expected the watch limit to be reported")
+	}
+
+	// Files present when polling starts are left alone, like a new watch
+	fw.pollUnwatched()
+	if names := pendingNames(fw); len(names) != 0 {
+		t.Errorf("Expected no transfers for existing files, got %v", names)
+	}
+
+	dir := filepath.Join(srcDir, "720p")
+	os.WriteFile(filepath.Join(dir, "media_0002.ts"), []byte("segment"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a segment"), 0644)
+	fw.pollUnwatched()
+	if names := pendingNames(fw); len(names) != 1 || names[0] != "media_0002.ts" {
+		t.Errorf("Expected media_0002.ts to be scheduled, got %v", names)
+	}
+
+	// A rewritten segment is picked up again, an unchanged one is not
+	fw.cancelPendingTransfer(filepath.Join(dir, "media_0002.ts"))
+	fw.pollUnwatched()
+	if names := pendingNames(fw); len(names) != 0 {
+		t.Errorf("Expected unchanged segment to be skipped, got %v", names)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "media_0001.ts"), later, later)
+	fw.pollUnwatched()
+	if names := pendingNames(fw); len(names) != 1 || names[0] != "media_0001.ts" {
+		t.Errorf("Expected rewritten media_0001.ts to be scheduled, got %v", names)
+	}
+}
+
+func TestFileWatcher_PolledDirectoryNewSubdirectory(t *testing.T) {
+	fw, srcDir, attempts := newTestWatcher(t, syscall.ENOSPC, "1080p")
+
+	os.MkdirAll(filepath.Join(srcDir, "1080p"), 0755)
+	if err := fw.addWatchRecursive(srcDir); err != nil {
+		t.Fatalf("addWatchRecursive() failed: %v", err)
+	}
+
+	sub := filepath.Join(srcDir, "1080p", "retry")
+	os.MkdirAll(sub, 0755)
+	fw.pollUnwatched()
+	fw.pollUnwatched()
+
+	count := 0
+	for _, path := range *attempts {
+		if path == sub {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected one watch attempt for new subdirectory, got %d in %v", count, *attempts)
+	}
+}
+
+func TestFileWatcher_OtherWatchErrorsAreNotPolled(t *testing.T) {
+	fw, srcDir, _ := newTestWatcher(t, syscall.EACCES, "1080p")
+
+	os.MkdirAll(filepath.Join(srcDir, "1080p"), 0755)
+	if err := fw.addWatchRecursive(srcDir); err != nil {
+		t.Fatalf("addWatchRecursive() failed: %v", err)
+	}
+	if len(fw.polled) != 0 || fw.limitWarned {
+		t.Errorf("Expected only the watch limit to trigger polling, got %v", fw.polled)
+	}
+}
+
+func TestPollingWatcher_DetectsNewFiles(t *testing.T) {
+	tq, srcDir := newTestNASQueue(t, 1)
+	os.MkdirAll(filepath.Join(srcDir, "1080p"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "1080p", "media_0001.ts"), []byte("segment"), 0644)
+
+	fw := NewPollingWatcher(srcDir, "test-event", tq, 10*time.Millisecond, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- fw.Start(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Wait for the initial scan before writing, so the new files are found
+	// by polling rather than as existing files
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fw.mu.Lock()
+		n := len(fw.polled)
+		fw.mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	os.WriteFile(filepath.Join(srcDir, "1080p", "media_0002.ts"), []byte("segment"), 0644)
+	os.MkdirAll(filepath.Join(srcDir, "720p"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "720p", "media_0002.ts"), []byte("segment"), 0644)
+	os.MkdirAll(filepath.Join(srcDir, "subtitles_en"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "subtitles_en", "sub_0002.vtt"), []byte("WEBVTT\n"), 0644)
+
+	want := []string{
+		filepath.Join("test-event", "1080p", "media_0002.ts"),
+		filepath.Join("test-event", "720p", "media_0002.ts"),
+		filepath.Join("test-event", "subtitles_en", "sub_0002.vtt"),
+	}
+	var dests map[string]int
+	for time.Now().Before(deadline.Add(2 * time.Second)) {
+		dests = queuedDestinations(tq)
+		if dests[want[0]] == 1 && dests[want[1]] == 1 && dests[want[2]] == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, dest := range want {
+		if dests[dest] != 1 {
+			t.Errorf("Expected %s to be queued once, got %v", dest, dests)
+		}
+	}
+	if dests[filepath.Join("test-event", "1080p", "media_0001.ts")] != 0 {
+		t.Errorf("Expected the file present at startup to be left to the startup scan, got %v", dests)
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock_AfterFiresOnAdvance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	ch := clock.After(time.Second)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatal("After fired before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case got := <-ch:
+		if !got.Equal(start.Add(time.Second)) {
+			t.Errorf("Expected fire time %v, got %v", start.Add(time.Second), got)
+		}
+	default:
+		t.Fatal("After did not fire at its deadline")
+	}
+}
+
+func TestFakeClock_TickerTicksPerPeriod(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	ticks := 0
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Minute)
+		select {
+		case <-ticker.C():
+			ticks++
+		default:
+		}
+	}
+	if ticks != 3 {
+		t.Errorf("Expected 3 ticks, got %d", ticks)
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("Stopped ticker should not tick")
+	default:
+	}
+}
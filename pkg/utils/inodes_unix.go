@@ -0,0 +1,19 @@
+//go:build unix
+
+package utils
+
+import "syscall"
+
+// FreeInodes returns how many inodes are free on the filesystem holding
+// path. ok is false for filesystems without a fixed inode table, such as
+// btrfs, which report zero total inodes.
+func FreeInodes(path string) (free uint64, ok bool, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false, err
+	}
+	if st.Files == 0 {
+		return 0, false, nil
+	}
+	return uint64(st.Ffree), true, nil
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeInodes(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "inodes_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	free, ok, err := FreeInodes(tempDir)
+	if err != nil {
+		t.Fatalf("FreeInodes() failed: %v", err)
+	}
+	if !ok {
+		t.Skip("filesystem has no fixed inode table")
+	}
+	if free == 0 {
+		t.Error("Expected free inodes on the temp filesystem")
+	}
+}
+
+func TestFreeInodes_MissingPath(t *testing.T) {
+	if _, _, err := FreeInodes(filepath.Join(os.TempDir(), "no_such_dir_for_inodes")); err == nil {
+		t.Error("Expected error for a missing path")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package utils
+
+// FreeInodes is not meaningful on Windows, where NTFS has no fixed inode
+// table, so ok is always false
+func FreeInodes(path string) (free uint64, ok bool, err error) {
+	return 0, false, nil
+}
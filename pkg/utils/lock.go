@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by AcquireLock when another process holds the lock
+var ErrLocked = errors.New("lock is held by another process")
+
+// FileLock is an advisory lock backed by a file. The operating system drops
+// it when the holding process exits, so a lock file left behind by a crash
+// never blocks the next run.
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// AcquireLock takes an exclusive lock on path without blocking, returning
+// ErrLocked if another process already holds it.
+func AcquireLock(path string) (*FileLock, error) {
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	file, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the holder for whoever finds the file
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+
+	return &FileLock{path: path, file: file}, nil
+}
+
+// Release drops the lock. The file itself is left in place; removing it
+// would let a new process lock a fresh file while another still waits on
+// the old one.
+func (l *FileLock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", l.path, err)
+	}
+	return nil
+}
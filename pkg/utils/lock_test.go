@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLock_SecondAcquisitionFails(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "lock_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "locks", "event.lock")
+
+	first, err := AcquireLock(path)
+	if err != nil {
+		t.Fatalf("AcquireLock() failed: %v", err)
+	}
+
+	second, err := AcquireLock(path)
+	if !errors.Is(err, ErrLocked) {
+		second.Release()
+		t.Fatalf("Expected ErrLocked while the lock is held, got %v", err)
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatalf("Release() failed: %v", err)
+	}
+
+	third, err := AcquireLock(path)
+	if err != nil {
+		t.Fatalf("Expected lock to be acquirable after release, got %v", err)
+	}
+	defer third.Release()
+}
+
+func TestAcquireLock_IndependentEvents(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "lock_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	a, err := AcquireLock(filepath.Join(tempDir, "event-a.lock"))
+	if err != nil {
+		t.Fatalf("AcquireLock() failed: %v", err)
+	}
+	defer a.Release()
+
+	b, err := AcquireLock(filepath.Join(tempDir, "event-b.lock"))
+	if err != nil {
+		t.Fatalf("Locks for different events should not conflict: %v", err)
+	}
+	defer b.Release()
+}
+
+func TestFileLock_ReleaseTwice(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "lock_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	lock, err := AcquireLock(filepath.Join(tempDir, "event.lock"))
+	if err != nil {
+		t.Fatalf("AcquireLock() failed: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release() failed: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("Second Release() should be a no-op, got %v", err)
+	}
+}
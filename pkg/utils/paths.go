@@ -3,10 +3,28 @@ package utils
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
 )
 
+// Filename sanitizer policies for downloaded segment names
+const (
+	NamePolicyAuto    = "auto"
+	NamePolicyWindows = "windows"
+	NamePolicyPosix   = "posix"
+	NamePolicyNone    = "none"
+)
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
 func SafeJoin(base string, elements ...string) string {
 	path := filepath.Join(append([]string{base}, elements...)...)
 	return filepath.Clean(path)
@@ -60,3 +78,144 @@ func ValidateWritablePath(path string) error {
 
 	return nil
 }
+
+func IsValidNamePolicy(policy string) bool {
+	switch policy {
+	case NamePolicyAuto, NamePolicyWindows, NamePolicyPosix, NamePolicyNone:
+		return true
+	}
+	return false
+}
+
+// SanitizeFileName makes a single path element safe for the filesystem selected
+// by policy. Invalid characters are percent-encoded (":" becomes "%3A") rather
+// than dropped, and so is "%" itself, so distinct source names stay distinct
+// and the original name can be recovered with url.PathUnescape.
+func SanitizeFileName(name string, policy string) string {
+	if policy == NamePolicyAuto {
+		if runtime.GOOS == "windows" {
+			policy = NamePolicyWindows
+		} else {
+			policy = NamePolicyPosix
+		}
+	}
+
+	var invalid string
+	switch policy {
+	case NamePolicyWindows:
+		invalid = "%<>:\"/\\|?*"
+	case NamePolicyPosix:
+		invalid = "%/"
+	default:
+		return name
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(invalid, r) {
+			fmt.Fprintf(&b, "%%%02X", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	sanitized := b.String()
+
+	if policy == NamePolicyWindows {
+		// Windows silently strips trailing dots and spaces
+		trimmed := strings.TrimRight(sanitized, ". ")
+		for _, r := range sanitized[len(trimmed):] {
+			trimmed += fmt.Sprintf("%%%02X", r)
+		}
+		sanitized = trimmed
+
+		// Encoding the first character keeps a reserved name like CON
+		// recoverable, where a prefix would collide with a real "_CON"
+		stem := strings.ToUpper(strings.SplitN(sanitized, ".", 2)[0])
+		if windowsReservedNames[stem] {
+			sanitized = fmt.Sprintf("%%%02X", sanitized[0]) + sanitized[1:]
+		}
+	}
+
+	return sanitized
+}
+
+// Separator styles for paths on the NAS, which may not match the host OS
+const (
+	PathStyleAuto    = "auto"
+	PathStyleWindows = "windows"
+	PathStylePosix   = "posix"
+)
+
+func IsValidPathStyle(style string) bool {
+	switch style {
+	case PathStyleAuto, PathStyleWindows, PathStylePosix:
+		return true
+	}
+	return false
+}
+
+// JoinStyledPath joins elements with the separator of style, accepting either
+// separator in the input. PathStyleAuto uses backslashes for UNC and
+// drive-letter roots and the host separator otherwise.
+func JoinStyledPath(style string, elements ...string) string {
+	if len(elements) == 0 {
+		return ""
+	}
+	if style == PathStyleAuto {
+		style = detectPathStyle(elements[0])
+	}
+
+	parts := make([]string, 0, len(elements))
+	for _, element := range elements {
+		if element != "" {
+			parts = append(parts, strings.ReplaceAll(element, `\`, "/"))
+		}
+	}
+	joined := strings.Join(parts, "/")
+
+	// path.Clean collapses the leading pair of a UNC root into one
+	unc := strings.HasPrefix(joined, "//")
+	joined = path.Clean(joined)
+	if unc {
+		joined = "/" + joined
+	}
+
+	if style == PathStyleWindows {
+		return strings.ReplaceAll(joined, "/", `\`)
+	}
+	return joined
+}
+
+func detectPathStyle(root string) string {
+	if strings.HasPrefix(root, `\\`) || (len(root) >= 2 && root[1] == ':') {
+		return PathStyleWindows
+	}
+	if runtime.GOOS == "windows" {
+		return PathStyleWindows
+	}
+	return PathStylePosix
+}
+
+// IsSegmentFile reports whether name is a finished media segment: a .ts file
+// that is not hidden, not an editor temp file, and not a partial download.
+func IsSegmentFile(name string) bool {
+	return isFinishedFile(name, ".ts")
+}
+
+// IsSubtitleFile reports whether name is a finished WebVTT subtitle segment,
+// by the same rules as IsSegmentFile
+func IsSubtitleFile(name string) bool {
+	return isFinishedFile(name, ".vtt")
+}
+
+func isFinishedFile(name, ext string) bool {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(base, "~") {
+		return false
+	}
+	lower := strings.ToLower(base)
+	if strings.Contains(lower, ".part") {
+		return false
+	}
+	return strings.HasSuffix(lower, ext)
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -233,3 +234,208 @@ func TestValidateWritablePath(t *testing.T) {
 		}
 	}
 }
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		policy string
+		want   string
+	}{
+		{
+			name:   "clean name unchanged",
+			input:  "media_1234.ts",
+			policy: NamePolicyWindows,
+			want:   "media_1234.ts",
+		},
+		{
+			name:   "windows colon encoded",
+			input:  "seg:1234.ts",
+			policy: NamePolicyWindows,
+			want:   "seg%3A1234.ts",
+		},
+		{
+			name:   "windows multiple invalid characters",
+			input:  `a<b>c"d|e*f.ts`,
+			policy: NamePolicyWindows,
+			want:   "a%3Cb%3Ec%22d%7Ce%2Af.ts",
+		},
+		{
+			name:   "windows trailing dot",
+			input:  "segment.ts.",
+			policy: NamePolicyWindows,
+			want:   "segment.ts%2E",
+		},
+		{
+			name:   "windows reserved name",
+			input:  "CON.ts",
+			policy: NamePolicyWindows,
+			want:   "%43ON.ts",
+		},
+		{
+			name:   "windows percent encoded",
+			input:  "a%3A.ts",
+			policy: NamePolicyWindows,
+			want:   "a%253A.ts",
+		},
+		{
+			name:   "posix percent encoded",
+			input:  "seg%20.ts",
+			policy: NamePolicyPosix,
+			want:   "seg%2520.ts",
+		},
+		{
+			name:   "posix keeps colon",
+			input:  "seg:1234.ts",
+			policy: NamePolicyPosix,
+			want:   "seg:1234.ts",
+		},
+		{
+			name:   "posix control character encoded",
+			input:  "seg\x01.ts",
+			policy: NamePolicyPosix,
+			want:   "seg%01.ts",
+		},
+		{
+			name:   "none leaves name untouched",
+			input:  "seg:1234.ts",
+			policy: NamePolicyNone,
+			want:   "seg:1234.ts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SanitizeFileName(tt.input, tt.policy)
+			if got != tt.want {
+				t.Errorf("SanitizeFileName(%q, %q) = %q, want %q", tt.input, tt.policy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileName_Unique(t *testing.T) {
+	// Names differing only by invalid characters must not collide
+	a := SanitizeFileName("seg:1.ts", NamePolicyWindows)
+	b := SanitizeFileName("seg*1.ts", NamePolicyWindows)
+	if a == b {
+		t.Errorf("Sanitized names collided: %q", a)
+	}
+
+	// Nor with a name that already looks encoded
+	for _, policy := range []string{NamePolicyWindows, NamePolicyPosix} {
+		for _, pair := range [][2]string{{"a%3A.ts", "a:.ts"}, {"a%2F.ts", "a/.ts"}, {"_CON.ts", "CON.ts"}} {
+			if x, y := SanitizeFileName(pair[0], policy), SanitizeFileName(pair[1], policy); x == y {
+				t.Errorf("%s policy: %q and %q both sanitized to %q", policy, pair[0], pair[1], x)
+			}
+		}
+	}
+}
+
+func TestSanitizeFileName_Recoverable(t *testing.T) {
+	names := []string{"seg:1.ts", "a%3A.ts", "100%.ts", "CON.ts", "nul.ts", "segment.ts. ", "a/b\\c.ts", "seg\x01.ts"}
+	for _, policy := range []string{NamePolicyWindows, NamePolicyPosix} {
+		for _, name := range names {
+			sanitized := SanitizeFileName(name, policy)
+			got, err := url.PathUnescape(sanitized)
+			if err != nil || got != name {
+				t.Errorf("%s policy: %q sanitized to %q, which unescapes to %q (%v)", policy, name, sanitized, got, err)
+			}
+		}
+	}
+}
+
+func TestSanitizeFileName_Auto(t *testing.T) {
+	got := SanitizeFileName("seg:1.ts", NamePolicyAuto)
+	if runtime.GOOS == "windows" {
+		if strings.Contains(got, ":") {
+			t.Errorf("Auto policy on windows should encode ':', got %q", got)
+		}
+	} else if got != "seg:1.ts" {
+		t.Errorf("Auto policy on %s should keep ':', got %q", runtime.GOOS, got)
+	}
+}
+
+func TestIsSegmentFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"media_0001.ts", true},
+		{"MEDIA_0001.TS", true},
+		{filepath.Join("event", "1080p", "media_0001.ts"), true},
+		{"media_0001.ts.part", false},
+		{"media_0001.part.ts", false},
+		{".media_0001.ts", false},
+		{".media_0001.ts.swp", false},
+		{"~media_0001.ts", false},
+		{".seen.json", false},
+		{"manifest.json", false},
+		{"media_0001.ts~", false},
+		{"playlist.m3u8", false},
+		{"sub_0001.vtt", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := IsSegmentFile(test.name); result != test.expected {
+				t.Errorf("IsSegmentFile(%q) = %v, expected %v", test.name, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestIsSubtitleFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"sub_0001.vtt", true},
+		{filepath.Join("event", "subtitles_en", "SUB_0001.VTT"), true},
+		{"sub_0001.vtt.part", false},
+		{".sub_0001.vtt", false},
+		{"media_0001.ts", false},
+		{"subtitles.m3u8", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := IsSubtitleFile(test.name); result != test.expected {
+				t.Errorf("IsSubtitleFile(%q) = %v, expected %v", test.name, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestJoinStyledPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		style    string
+		elements []string
+		want     string
+	}{
+		{"posix", PathStylePosix, []string{"/mnt/nas", "event", "1080p", "media_0001.ts"}, "/mnt/nas/event/1080p/media_0001.ts"},
+		{"posix from windows relative path", PathStylePosix, []string{"/mnt/nas", `event\1080p\media_0001.ts`}, "/mnt/nas/event/1080p/media_0001.ts"},
+		{"windows UNC", PathStyleWindows, []string{`\\server\share\streams`, "event/1080p/media_0001.ts"}, `\\server\share\streams\event\1080p\media_0001.ts`},
+		{"windows drive", PathStyleWindows, []string{`D:\streams`, "event", "media_0001.ts"}, `D:\streams\event\media_0001.ts`},
+		{"windows mapped from posix", PathStyleWindows, []string{"/mnt/nas/", "event//1080p"}, `\mnt\nas\event\1080p`},
+		{"auto UNC root", PathStyleAuto, []string{`\\server\share`, "event/1080p"}, `\\server\share\event\1080p`},
+		{"auto drive root", PathStyleAuto, []string{`C:/streams`, "event"}, `C:\streams\event`},
+		{"empty elements skipped", PathStylePosix, []string{"/mnt/nas", "", "event"}, "/mnt/nas/event"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JoinStyledPath(tt.style, tt.elements...); got != tt.want {
+				t.Errorf("JoinStyledPath(%q, %q) = %q, want %q", tt.style, tt.elements, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinStyledPath_AutoHostRoot(t *testing.T) {
+	got := JoinStyledPath(PathStyleAuto, "nas", "event", "media_0001.ts")
+	if want := filepath.Join("nas", "event", "media_0001.ts"); got != want {
+		t.Errorf("Auto style with a relative root should use the host separator, got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_StaysUnderRate(t *testing.T) {
+	const rate = 50
+	const waits = 26
+	limiter := NewRateLimiter(rate, 1)
+
+	// Waits from several goroutines share the one bucket
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if err := limiter.Wait(context.Background()); err != nil {
+					t.Errorf("Wait() failed: %v", err)
+				}
+			}
+		}(waits / 4)
+	}
+	wg.Wait()
+	for i := 0; i < waits%4; i++ {
+		limiter.Wait(context.Background())
+	}
+	elapsed := time.Since(start)
+
+	// The first token is free, so the rest need (waits-1)/rate seconds
+	minimum := time.Duration(float64(waits-1) / rate * float64(time.Second))
+	if elapsed < minimum {
+		t.Errorf("Expected %d waits to take at least %v at %d/s, took %v", waits, minimum, rate, elapsed)
+	}
+	if achieved := float64(waits-1) / elapsed.Seconds(); achieved > rate {
+		t.Errorf("Achieved rate %.1f/s exceeds the %d/s cap", achieved, rate)
+	}
+}
+
+func TestRateLimiter_Burst(t *testing.T) {
+	limiter := NewRateLimiter(1, 3)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() failed: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected a full bucket to allow 3 immediate waits, took %v", elapsed)
+	}
+}
+
+func TestRateLimiter_WaitRespectsContext(t *testing.T) {
+	limiter := NewRateLimiter(0.1, 1)
+	limiter.Wait(context.Background()) // take the only token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded waiting on an empty bucket, got %v", err)
+	}
+}
+
+func TestRateLimiter_Unlimited(t *testing.T) {
+	limiter := NewRateLimiter(0, 1)
+	if limiter != nil {
+		t.Fatal("Expected a zero rate to mean no limiter")
+	}
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() on nil limiter failed: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Nil limiter should not wait, took %v", elapsed)
+	}
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how Retry re-runs a failing operation.
+type RetryPolicy struct {
+	Attempts     int           // Total attempts including the first; values < 1 mean 1
+	InitialDelay time.Duration // Wait before the second attempt
+	MaxDelay     time.Duration // Upper bound on any single wait; 0 means no bound
+	Multiplier   float64       // Growth factor applied per retry; values < 1 mean constant delay
+	Jitter       float64       // Fraction of the delay randomized in either direction (0.2 = ±20%)
+	Retryable    func(error) bool
+	Clock        Clock // Source of the waits between attempts; nil means RealClock
+}
+
+// Delay returns the wait before the given retry (1 = first retry).
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := float64(p.InitialDelay)
+	if p.Multiplier > 1 {
+		for i := 1; i < retry; i++ {
+			delay *= p.Multiplier
+		}
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// Retry calls fn until it succeeds, returns a non-retryable error, runs out of
+// attempts, or ctx is cancelled. fn receives the 1-based attempt number. The
+// last error from fn is returned, or ctx.Err() if cancelled while waiting.
+func Retry(ctx context.Context, policy RetryPolicy, fn func(attempt int) error) error {
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	clock := policy.Clock
+	if clock == nil {
+		clock = RealClock{}
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-clock.After(policy.Delay(attempt - 1)):
+			}
+		}
+
+		err = fn(attempt)
+		if err == nil {
+			return nil
+		}
+		if policy.Retryable != nil && !policy.Retryable(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
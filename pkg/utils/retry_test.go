@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry_SuccessAfterN(t *testing.T) {
+	policy := RetryPolicy{Attempts: 5, InitialDelay: time.Millisecond}
+
+	calls := 0
+	err := Retry(context.Background(), policy, func(attempt int) error {
+		calls++
+		if attempt < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("Retry() returned error: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+}
+
+func TestRetry_ExhaustsAttempts(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, InitialDelay: time.Millisecond}
+	lastErr := errors.New("still failing")
+
+	calls := 0
+	err := Retry(context.Background(), policy, func(attempt int) error {
+		calls++
+		return lastErr
+	})
+
+	if !errors.Is(err, lastErr) {
+		t.Errorf("Expected last error to be returned, got: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+}
+
+func TestRetry_NonRetryableFailsImmediately(t *testing.T) {
+	permanent := errors.New("permanent")
+	policy := RetryPolicy{
+		Attempts:     5,
+		InitialDelay: time.Millisecond,
+		Retryable: func(err error) bool {
+			return !errors.Is(err, permanent)
+		},
+	}
+
+	calls := 0
+	err := Retry(context.Background(), policy, func(attempt int) error {
+		calls++
+		return permanent
+	})
+
+	if !errors.Is(err, permanent) {
+		t.Errorf("Expected permanent error, got: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call for non-retryable error, got %d", calls)
+	}
+}
+
+func TestRetry_ContextCancelledMidRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{Attempts: 5, InitialDelay: 10 * time.Second}
+
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- Retry(ctx, policy, func(attempt int) error {
+			calls++
+			return errors.New("transient")
+		})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Retry() did not return after context cancellation")
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected 1 call before cancellation, got %d", calls)
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     300 * time.Millisecond,
+		Multiplier:   2,
+	}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	for i, want := range expected {
+		if got := policy.Delay(i + 1); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, got, want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := policy.Delay(1)
+		if got < 50*time.Millisecond || got > 150*time.Millisecond {
+			t.Fatalf("Delay(1) with jitter = %v, want within [50ms, 150ms]", got)
+		}
+	}
+}
+
+func TestRetry_WaitsOnClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	policy := RetryPolicy{Attempts: 3, InitialDelay: time.Minute, Multiplier: 2, Clock: clock}
+
+	attempts := make(chan int, 3)
+	done := make(chan error, 1)
+	go func() {
+		done <- Retry(context.Background(), policy, func(attempt int) error {
+			attempts <- attempt
+			if attempt < 3 {
+				return errors.New("transient")
+			}
+			return nil
+		})
+	}()
+
+	<-attempts
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute - time.Second)
+	select {
+	case <-attempts:
+		t.Fatal("Retried before the backoff delay passed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	if got := <-attempts; got != 2 {
+		t.Errorf("Expected attempt 2, got %d", got)
+	}
+
+	// The second wait doubles
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Minute)
+	if got := <-attempts; got != 3 {
+		t.Errorf("Expected attempt 3, got %d", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Retry() returned error: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	TSPacketSize = 188
+	TSSyncByte   = 0x47
+)
+
+var ErrInvalidTS = errors.New("invalid MPEG-TS segment")
+
+// ErrNoPTS is returned by FirstPTS and LastPTS for a segment without a
+// timestamped PES packet
+var ErrNoPTS = errors.New("no PTS in MPEG-TS segment")
+
+// TSClockRate is the frequency of MPEG-TS timestamps
+const TSClockRate = 90000
+
+// ValidateTSFile is a cheap sanity check that a segment looks like MPEG-TS:
+// non-empty, a whole number of 188-byte packets, each starting with the sync
+// byte. It does not parse the stream, so it catches truncated or mangled
+// downloads (e.g. an HTML error page saved as .ts) rather than bad media.
+func ValidateTSFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size == 0 || size%TSPacketSize != 0 {
+		return fmt.Errorf("%w: size %d is not a multiple of %d", ErrInvalidTS, size, TSPacketSize)
+	}
+
+	reader := bufio.NewReader(f)
+	packet := make([]byte, TSPacketSize)
+	for offset := int64(0); offset < size; offset += TSPacketSize {
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return fmt.Errorf("failed to read packet at offset %d: %w", offset, err)
+		}
+		if packet[0] != TSSyncByte {
+			return fmt.Errorf("%w: missing sync byte at offset %d", ErrInvalidTS, offset)
+		}
+	}
+
+	return nil
+}
+
+// FirstPTS returns the presentation timestamp of the first PES packet in an
+// MPEG-TS file that carries one, which is where FFmpeg starts the stream when
+// the file comes first in a concat list
+func FirstPTS(path string) (time.Duration, error) {
+	var first time.Duration
+	found := false
+	err := scanPTS(path, func(pts time.Duration) bool {
+		first, found = pts, true
+		return false
+	})
+	if err == nil && !found {
+		err = ErrNoPTS
+	}
+	return first, err
+}
+
+// LastPTS returns the latest presentation timestamp in an MPEG-TS file, which
+// is roughly where the stream ends when the file comes last in a concat list.
+// It reads the whole file, since frames needn't be stored in display order.
+func LastPTS(path string) (time.Duration, error) {
+	var last time.Duration
+	found := false
+	err := scanPTS(path, func(pts time.Duration) bool {
+		last, found = max(last, pts), true
+		return true
+	})
+	if err == nil && !found {
+		err = ErrNoPTS
+	}
+	return last, err
+}
+
+// scanPTS calls fn with the PTS of each PES packet in an MPEG-TS file that
+// carries one, until fn returns false
+func scanPTS(path string, fn func(pts time.Duration) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	packet := make([]byte, TSPacketSize)
+	for offset := 0; ; offset += TSPacketSize {
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		if packet[0] != TSSyncByte {
+			return fmt.Errorf("%w: missing sync byte at offset %d", ErrInvalidTS, offset)
+		}
+		// Only the packet starting a PES packet has its header
+		if packet[1]&0x40 == 0 {
+			continue
+		}
+
+		payload := packet[4:]
+		switch packet[3] >> 4 & 0x03 {
+		case 1: // payload only
+		case 3: // adaptation field, then payload
+			skip := 1 + int(packet[4])
+			if skip >= len(payload) {
+				continue
+			}
+			payload = payload[skip:]
+		default:
+			continue
+		}
+
+		// PES start code, then the PTS if its flag is set
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 || payload[7]&0x80 == 0 {
+			continue
+		}
+		p := payload[9:14]
+		pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+		if !fn(time.Duration(pts) * time.Second / TSClockRate) {
+			return nil
+		}
+	}
+}
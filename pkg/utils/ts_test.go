@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTSPackets(t *testing.T, path string, packets int) []byte {
+	t.Helper()
+	data := make([]byte, packets*TSPacketSize)
+	for i := 0; i < packets; i++ {
+		data[i*TSPacketSize] = TSSyncByte
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write test segment: %v", err)
+	}
+	return data
+}
+
+func TestValidateTSFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "ts_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	valid := filepath.Join(tempDir, "valid.ts")
+	writeTSPackets(t, valid, 10)
+
+	truncated := filepath.Join(tempDir, "truncated.ts")
+	data := writeTSPackets(t, truncated, 10)
+	os.WriteFile(truncated, data[:len(data)-50], 0644)
+
+	badSync := filepath.Join(tempDir, "bad_sync.ts")
+	data = writeTSPackets(t, badSync, 10)
+	data[5*TSPacketSize] = 0x00
+	os.WriteFile(badSync, data, 0644)
+
+	empty := filepath.Join(tempDir, "empty.ts")
+	os.WriteFile(empty, nil, 0644)
+
+	tests := []struct {
+		name    string
+		path    string
+		invalid bool
+	}{
+		{"valid", valid, false},
+		{"truncated", truncated, true},
+		{"bad sync byte", badSync, true},
+		{"empty", empty, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateTSFile(test.path)
+			if test.invalid && !errors.Is(err, ErrInvalidTS) {
+				t.Errorf("Expected ErrInvalidTS, got %v", err)
+			}
+			if !test.invalid && err != nil {
+				t.Errorf("Expected valid segment, got %v", err)
+			}
+		})
+	}
+
+	if err := ValidateTSFile(filepath.Join(tempDir, "missing.ts")); err == nil || errors.Is(err, ErrInvalidTS) {
+		t.Errorf("Expected a read error for a missing file, got %v", err)
+	}
+}
+
+// pesPacket returns a TS packet starting a PES packet with the given PTS,
+// after an adaptation field when adaptation is set
+func pesPacket(pts int64, adaptation bool) []byte {
+	packet := make([]byte, TSPacketSize)
+	packet[0] = TSSyncByte
+	packet[1] = 0x41 // payload start, PID 0x100
+	packet[3] = 0x10
+	payload := packet[4:]
+	if adaptation {
+		packet[3] = 0x30
+		packet[4] = 7 // adaptation field length
+		payload = packet[12:]
+	}
+	copy(payload, []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5})
+	payload[9] = 0x21 | byte(pts>>29)&0x0e
+	payload[10] = byte(pts >> 22)
+	payload[11] = byte(pts>>14) | 0x01
+	payload[12] = byte(pts >> 7)
+	payload[13] = byte(pts<<1) | 0x01
+	return packet
+}
+
+func TestFirstPTS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "ts_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A PAT-like packet without a PES header comes first
+	table := make([]byte, TSPacketSize)
+	table[0], table[1], table[3] = TSSyncByte, 0x40, 0x10
+
+	// 10s into the stream, past the 32-bit boundary of the 33-bit PTS
+	const pts = 900000 + 1<<32
+	tests := []struct {
+		name    string
+		packets [][]byte
+		want    time.Duration
+		err     error
+	}{
+		{"payload only", [][]byte{table, pesPacket(pts, false)}, time.Duration(pts) * time.Second / TSClockRate, nil},
+		{"after adaptation field", [][]byte{pesPacket(900000, true), pesPacket(0, false)}, 10 * time.Second, nil},
+		{"no pes packet", [][]byte{table}, 0, ErrNoPTS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(tempDir, "segment.ts")
+			var data []byte
+			for _, packet := range test.packets {
+				data = append(data, packet...)
+			}
+			os.WriteFile(path, data, 0644)
+
+			got, err := FirstPTS(path)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if got != test.want {
+				t.Errorf("Expected PTS %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestLastPTS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "ts_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A B-frame stored after the frame it precedes doesn't count as the end
+	path := filepath.Join(tempDir, "segment.ts")
+	var data []byte
+	for _, pts := range []int64{900000, 1080000, 990000} {
+		data = append(data, pesPacket(pts, false)...)
+	}
+	os.WriteFile(path, data, 0644)
+
+	got, err := LastPTS(path)
+	if err != nil {
+		t.Fatalf("LastPTS() failed: %v", err)
+	}
+	if got != 12*time.Second {
+		t.Errorf("Expected PTS 12s, got %v", got)
+	}
+
+	os.WriteFile(path, make([]byte, 0), 0644)
+	if _, err := LastPTS(path); !errors.Is(err, ErrNoPTS) {
+		t.Errorf("Expected ErrNoPTS for an empty segment, got %v", err)
+	}
+}